@@ -0,0 +1,40 @@
+package main
+
+// The backends confd is built with, each registering itself with
+// backends.Register from its init.
+import (
+	_ "github.com/zyf0330/confd/backends/azureappconfig"
+	_ "github.com/zyf0330/confd/backends/azurekeyvault"
+	_ "github.com/zyf0330/confd/backends/cloudflarekv"
+	_ "github.com/zyf0330/confd/backends/consul"
+	_ "github.com/zyf0330/confd/backends/dynamodb"
+	_ "github.com/zyf0330/confd/backends/env"
+	_ "github.com/zyf0330/confd/backends/etcd"
+	_ "github.com/zyf0330/confd/backends/etcdv3"
+	_ "github.com/zyf0330/confd/backends/exec"
+	_ "github.com/zyf0330/confd/backends/file"
+	_ "github.com/zyf0330/confd/backends/firestore"
+	_ "github.com/zyf0330/confd/backends/gcs"
+	_ "github.com/zyf0330/confd/backends/git"
+	_ "github.com/zyf0330/confd/backends/grpc"
+	_ "github.com/zyf0330/confd/backends/gsm"
+	_ "github.com/zyf0330/confd/backends/http"
+	_ "github.com/zyf0330/confd/backends/imds"
+	_ "github.com/zyf0330/confd/backends/k8sconfigmap"
+	_ "github.com/zyf0330/confd/backends/k8ssecret"
+	_ "github.com/zyf0330/confd/backends/ldap"
+	_ "github.com/zyf0330/confd/backends/metadata"
+	_ "github.com/zyf0330/confd/backends/mongodb"
+	_ "github.com/zyf0330/confd/backends/mysql"
+	_ "github.com/zyf0330/confd/backends/nats"
+	_ "github.com/zyf0330/confd/backends/nomad"
+	_ "github.com/zyf0330/confd/backends/postgres"
+	_ "github.com/zyf0330/confd/backends/redis"
+	_ "github.com/zyf0330/confd/backends/s3"
+	_ "github.com/zyf0330/confd/backends/secretsdir"
+	_ "github.com/zyf0330/confd/backends/secretsmanager"
+	_ "github.com/zyf0330/confd/backends/sqlite"
+	_ "github.com/zyf0330/confd/backends/ssm"
+	_ "github.com/zyf0330/confd/backends/vault"
+	_ "github.com/zyf0330/confd/backends/zookeeper"
+)
@@ -0,0 +1,340 @@
+package azureappconfig
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+const apiVersion = "1.0"
+
+// Content type of the key-values referencing a Key Vault secret
+const keyVaultRefContentType = "application/vnd.microsoft.appconfig.keyvaultref+json"
+
+// App Configuration has no way to watch key-values, changes are detected
+// by polling their ETags.
+var pollInterval = 30 * time.Second
+
+// keyValue is a key-value as returned by the API.
+type keyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+}
+
+// secretGetter is the part of the Key Vault secrets client used to resolve
+// Key Vault references.
+type secretGetter interface {
+	GetSecret(ctx context.Context, name string, version string, options *azsecrets.GetSecretOptions) (azsecrets.GetSecretResponse, error)
+}
+
+// Client is a wrapper around the App Configuration REST API.
+type Client struct {
+	client    *http.Client
+	endpoint  string
+	label     string
+	authorize func(req *http.Request) error
+	poller    *util.Poller
+
+	// Clients of the vaults Key Vault references point to, by URL
+	newVault func(vaultURL string) (secretGetter, error)
+	mu       sync.Mutex
+	vaults   map[string]secretGetter
+}
+
+// storeURL returns the endpoint of the store named by node, which is either
+// the endpoint or the name of a store in the Azure public cloud.
+func storeURL(node string) string {
+	if !strings.Contains(node, "://") {
+		if !strings.Contains(node, ".") {
+			node += ".azconfig.io"
+		}
+		node = "https://" + node
+	}
+	return strings.TrimRight(node, "/")
+}
+
+// parseConnectionString returns the endpoint and access key of a
+// connection string, Endpoint=https://...;Id=...;Secret=...
+func parseConnectionString(s string) (endpoint, id string, secret []byte, err error) {
+	for _, field := range strings.Split(s, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "endpoint":
+			endpoint = strings.TrimRight(kv[1], "/")
+		case "id":
+			id = kv[1]
+		case "secret":
+			secret, err = base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return "", "", nil, fmt.Errorf("invalid secret in the connection string: %s", err)
+			}
+		}
+	}
+	if endpoint == "" || id == "" || secret == nil {
+		return "", "", nil, fmt.Errorf("invalid connection string, want Endpoint=...;Id=...;Secret=...")
+	}
+	return endpoint, id, secret, nil
+}
+
+// hmacAuth signs the requests with an access key of the store.
+func hmacAuth(id string, secret []byte) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		date := time.Now().UTC().Format(http.TimeFormat)
+		// Only requests without a body are sent
+		hash := sha256.Sum256(nil)
+		contentHash := base64.StdEncoding.EncodeToString(hash[:])
+		mac := hmac.New(sha256.New, secret)
+		fmt.Fprintf(mac, "%s\n%s\n%s;%s;%s", req.Method, req.URL.RequestURI(), date, req.URL.Host, contentHash)
+		req.Header.Set("x-ms-date", date)
+		req.Header.Set("x-ms-content-sha256", contentHash)
+		req.Header.Set("Authorization", fmt.Sprintf("HMAC-SHA256 Credential=%s&SignedHeaders=x-ms-date;host;x-ms-content-sha256&Signature=%s",
+			id, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		return nil
+	}
+}
+
+// tokenAuth authorizes the requests with an Azure AD token for endpoint.
+func tokenAuth(cred azcore.TokenCredential, endpoint string) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		token, err := cred.GetToken(req.Context(), policy.TokenRequestOptions{Scopes: []string{endpoint + "/.default"}})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		return nil
+	}
+}
+
+func init() {
+	backends.Register("azureappconfig", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.ConnString, config.Label)
+	})
+}
+
+// New returns a *azureappconfig.Client reading the store of the connection
+// string if one is given, or else the store named by the first node with
+// the credentials of the default Azure chain. Only the key-values with
+// label are read, those without a label if it is empty. Key Vault
+// references are resolved with the credentials of the default Azure chain.
+func New(nodes []string, connectionString, label string) (*Client, error) {
+	cred, credErr := azidentity.NewDefaultAzureCredential(nil)
+	var endpoint string
+	var authorize func(req *http.Request) error
+	if connectionString != "" {
+		var id string
+		var secret []byte
+		var err error
+		endpoint, id, secret, err = parseConnectionString(connectionString)
+		if err != nil {
+			return nil, err
+		}
+		authorize = hmacAuth(id, secret)
+	} else {
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("no App Configuration store given, set it with -node or -connection-string")
+		}
+		if credErr != nil {
+			return nil, credErr
+		}
+		endpoint = storeURL(nodes[0])
+		authorize = tokenAuth(cred, endpoint)
+	}
+
+	newVault := func(vaultURL string) (secretGetter, error) {
+		if credErr != nil {
+			return nil, credErr
+		}
+		return azsecrets.NewClient(vaultURL, cred, nil)
+	}
+	return newClient(&http.Client{}, endpoint, label, authorize, newVault), nil
+}
+
+func newClient(client *http.Client, endpoint, label string, authorize func(req *http.Request) error, newVault func(string) (secretGetter, error)) *Client {
+	return &Client{
+		client:    client,
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		label:     label,
+		authorize: authorize,
+		poller:    util.NewPoller(pollInterval),
+		newVault:  newVault,
+		vaults:    make(map[string]secretGetter),
+	}
+}
+
+// escapeFilter escapes the characters with a meaning in key filters.
+func escapeFilter(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `,`, `\,`).Replace(s)
+}
+
+// list returns the key-values whose keys start with key.
+func (c *Client) list(ctx context.Context, key string) ([]keyValue, error) {
+	params := url.Values{}
+	params.Set("key", escapeFilter(key)+"*")
+	if c.label == "" {
+		// Matches the key-values without a label
+		params.Set("label", "\x00")
+	} else {
+		params.Set("label", escapeFilter(c.label))
+	}
+	params.Set("api-version", apiVersion)
+	next := "/kv?" + params.Encode()
+
+	var kvs []keyValue
+	for next != "" {
+		var page struct {
+			Items    []keyValue `json:"items"`
+			NextLink string     `json:"@nextLink"`
+		}
+		if err := c.get(ctx, next, &page); err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, page.Items...)
+		next = page.NextLink
+	}
+	return kvs, nil
+}
+
+// get requests path and query below the endpoint and decodes the JSON
+// response into v.
+func (c *Client) get(ctx context.Context, pathAndQuery string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", c.endpoint+pathAndQuery, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.microsoft.appconfig.kvset+json, application/problem+json")
+	if err := c.authorize(req); err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected response from App Configuration (%s): %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// resolve returns the value of the Key Vault secret referenced by kv.
+func (c *Client) resolve(ctx context.Context, kv keyValue) (string, error) {
+	var ref struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal([]byte(kv.Value), &ref); err != nil {
+		return "", fmt.Errorf("invalid Key Vault reference: %s", err)
+	}
+	u, err := url.Parse(ref.URI)
+	if err != nil {
+		return "", fmt.Errorf("invalid Key Vault reference: %s", err)
+	}
+	// https://<vault>/secrets/<name>[/<version>]
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "secrets" {
+		return "", fmt.Errorf("invalid Key Vault reference: %s is not a secret", ref.URI)
+	}
+	var version string
+	if len(parts) == 3 {
+		version = parts[2]
+	}
+
+	vaultURL := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	vault, ok := c.vaults[vaultURL]
+	if !ok {
+		vault, err = c.newVault(vaultURL)
+		if err == nil {
+			c.vaults[vaultURL] = vault
+		}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := vault.GetSecret(ctx, parts[1], version, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.Value == nil {
+		return "", nil
+	}
+	return *resp.Value, nil
+}
+
+// GetValues retrieves the values of the key-values whose keys start with
+// one of keys. Key Vault references are replaced by the secrets they point
+// to, those which cannot be read are skipped.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		kvs, err := c.list(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, kv := range kvs {
+			value := kv.Value
+			if strings.HasPrefix(kv.ContentType, keyVaultRefContentType) {
+				value, err = c.resolve(ctx, kv)
+				if err != nil {
+					log.Warning("Skipping %s, cannot resolve its Key Vault reference: %s", kv.Key, err)
+					continue
+				}
+			}
+			vars[kv.Key] = value
+		}
+	}
+	return vars, nil
+}
+
+// etags returns the ETag of every key-value holding keys.
+func (c *Client) etags(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		kvs, err := c.list(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, kv := range kvs {
+			vars[kv.Key] = kv.ETag
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix polls the ETags of the key-values and returns a new index
+// once one was added, deleted or changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.etags)
+}
+
+// KeepAlive is a no-op, every request uses its own HTTP round trip.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
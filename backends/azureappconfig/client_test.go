@@ -0,0 +1,221 @@
+package azureappconfig
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/zyf0330/confd/log"
+)
+
+var testSecret = []byte("s3cr3t")
+
+type fakeKeyValue struct {
+	value       string
+	contentType string
+	etag        int
+}
+
+// fakeAppConfig emulates the App Configuration REST API, listing one
+// key-value per page and checking the HMAC signature of the requests.
+// Key-values are keyed by label and key, "\x00" being no label.
+type fakeAppConfig struct {
+	mu  sync.Mutex
+	kvs map[string]map[string]*fakeKeyValue
+}
+
+func newFakeAppConfig() *fakeAppConfig {
+	return &fakeAppConfig{kvs: make(map[string]map[string]*fakeKeyValue)}
+}
+
+func (f *fakeAppConfig) set(label, key, value, contentType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.kvs[label] == nil {
+		f.kvs[label] = make(map[string]*fakeKeyValue)
+	}
+	kv, ok := f.kvs[label][key]
+	if !ok {
+		kv = &fakeKeyValue{}
+		f.kvs[label][key] = kv
+	}
+	kv.value = value
+	kv.contentType = contentType
+	kv.etag++
+}
+
+func (f *fakeAppConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mac := hmac.New(sha256.New, testSecret)
+	fmt.Fprintf(mac, "GET\n%s\n%s;%s;%s", r.URL.RequestURI(), r.Header.Get("x-ms-date"), r.Host, r.Header.Get("x-ms-content-sha256"))
+	if !strings.HasSuffix(r.Header.Get("Authorization"), "&Signature="+base64.StdEncoding.EncodeToString(mac.Sum(nil))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	if r.URL.Path != "/kv" || q.Get("api-version") != apiVersion || !strings.HasSuffix(q.Get("key"), "*") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	prefix := strings.TrimSuffix(q.Get("key"), "*")
+	var keys []string
+	for key := range f.kvs[q.Get("label")] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("after"))
+	page := map[string]interface{}{}
+	if start < len(keys) {
+		kv := f.kvs[q.Get("label")][keys[start]]
+		page["items"] = []map[string]string{{
+			"key":          keys[start],
+			"value":        kv.value,
+			"content_type": kv.contentType,
+			"etag":         strconv.Itoa(kv.etag),
+		}}
+	}
+	if start+1 < len(keys) {
+		q.Set("after", strconv.Itoa(start+1))
+		page["@nextLink"] = "/kv?" + q.Encode()
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// fakeVault serves the secrets of one vault, by name and version.
+type fakeVault map[string]string
+
+func (v fakeVault) GetSecret(ctx context.Context, name string, version string, options *azsecrets.GetSecretOptions) (azsecrets.GetSecretResponse, error) {
+	var resp azsecrets.GetSecretResponse
+	value, ok := v[name+"/"+version]
+	if !ok {
+		return resp, errors.New("Forbidden")
+	}
+	resp.Value = to.Ptr(value)
+	return resp, nil
+}
+
+func newTestClient(t *testing.T, f *fakeAppConfig, label string) *Client {
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	newVault := func(vaultURL string) (secretGetter, error) {
+		if vaultURL != "https://my-vault.vault.azure.net" {
+			return nil, errors.New("unknown vault")
+		}
+		return fakeVault{"password/": "p@sSw0rd", "password/v1": "0ld"}, nil
+	}
+	return newClient(ts.Client(), ts.URL, label, hmacAuth("id", testSecret), newVault)
+}
+
+func TestParseConnectionString(t *testing.T) {
+	endpoint, id, secret, err := parseConnectionString("Endpoint=https://my-store.azconfig.io/;Id=abc;Secret=" + base64.StdEncoding.EncodeToString(testSecret))
+	if err != nil || endpoint != "https://my-store.azconfig.io" || id != "abc" || string(secret) != string(testSecret) {
+		t.Errorf("parseConnectionString() = %q, %q, %q, %v", endpoint, id, secret, err)
+	}
+	if _, _, _, err := parseConnectionString("Endpoint=https://my-store.azconfig.io"); err == nil {
+		t.Error("expected an error without an access key")
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	ref := keyVaultRefContentType + ";charset=utf-8"
+	f := newFakeAppConfig()
+	f.set("\x00", "/key", "foobar", "")
+	f.set("\x00", "/database/host", "127.0.0.1", "")
+	f.set("\x00", "/database/port", "3306", "")
+	f.set("\x00", "/database/password", `{"uri": "https://my-vault.vault.azure.net/secrets/password"}`, ref)
+	f.set("\x00", "/database/old", `{"uri": "https://my-vault.vault.azure.net/secrets/password/v1"}`, ref)
+	f.set("\x00", "/database/token", `{"uri": "https://my-vault.vault.azure.net/secrets/token"}`, ref)
+	f.set("\x00", "/database/other", `{"uri": "https://other.vault.azure.net/secrets/password"}`, ref)
+	f.set("production", "/database/host", "10.0.0.1", "")
+	c := newTestClient(t, f, "")
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":               "foobar",
+		"/database/host":     "127.0.0.1",
+		"/database/port":     "3306",
+		"/database/password": "p@sSw0rd",
+		"/database/old":      "0ld",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestGetValuesLabel(t *testing.T) {
+	f := newFakeAppConfig()
+	f.set("\x00", "/database/host", "127.0.0.1", "")
+	f.set("production", "/database/host", "10.0.0.1", "")
+	c := newTestClient(t, f, "production")
+
+	vars, err := c.GetValues(context.Background(), []string{"/database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars["/database/host"] != "10.0.0.1" {
+		t.Errorf("GetValues() = %v, want the production /database/host only", vars)
+	}
+}
+
+func TestWatchPrefixComparesETags(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeAppConfig()
+	f.set("\x00", "/app/key", "foo", "")
+	c := newTestClient(t, f, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("\x00", "/other/key", "ignored", "")
+		f.set("staging", "/app/key", "ignored", "")
+		time.Sleep(50 * time.Millisecond)
+		f.set("\x00", "/app/key", "bar", "")
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 2", index, err)
+	}
+}
@@ -0,0 +1,187 @@
+package azurekeyvault
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// Secret names cannot contain slashes, the slashes of the keys are
+// replaced by this separator: /myapp/db/password is stored in the secret
+// myapp--db--password.
+const separator = "--"
+
+// Key Vault has no way to watch secrets, changes are detected by polling
+// the updated timestamps of the secrets.
+var pollInterval = 30 * time.Second
+
+// secretsAPI is the part of the Key Vault secrets client used by Client.
+type secretsAPI interface {
+	NewListSecretPropertiesPager(options *azsecrets.ListSecretPropertiesOptions) *runtime.Pager[azsecrets.ListSecretPropertiesResponse]
+	GetSecret(ctx context.Context, name string, version string, options *azsecrets.GetSecretOptions) (azsecrets.GetSecretResponse, error)
+}
+
+// Client is a wrapper around the Key Vault secrets client.
+type Client struct {
+	client secretsAPI
+	poller *util.Poller
+}
+
+// vaultURL returns the URL of the vault named by node, which is either the
+// URL or the name of a vault in the Azure public cloud.
+func vaultURL(node string) string {
+	if !strings.Contains(node, "://") {
+		if !strings.Contains(node, ".") {
+			node += ".vault.azure.net"
+		}
+		node = "https://" + node
+	}
+	return node
+}
+
+// transform maps a key onto the name of the secret holding it.
+func transform(key string) string {
+	return strings.Replace(strings.Trim(key, "/"), "/", separator, -1)
+}
+
+// clean maps a secret name back onto its key.
+func clean(name string) string {
+	return "/" + strings.Replace(name, separator, "/", -1)
+}
+
+func init() {
+	backends.Register("azurekeyvault", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes)
+	})
+}
+
+// New returns a *azurekeyvault.Client reading the vault named by the first
+// node. Credentials come from the default Azure chain: a service
+// principal from the environment, workload identity, managed identity or
+// the Azure CLI.
+func New(nodes []string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no Key Vault given, set it with -node")
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := azsecrets.NewClient(vaultURL(nodes[0]), cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(client), nil
+}
+
+func newClient(client secretsAPI) *Client {
+	return &Client{client: client, poller: util.NewPoller(pollInterval)}
+}
+
+// unusable returns why the current version of a secret cannot be read,
+// or "" if it can.
+func unusable(a *azsecrets.SecretAttributes) string {
+	if a == nil {
+		return ""
+	}
+	now := time.Now()
+	switch {
+	case a.Enabled != nil && !*a.Enabled:
+		return "disabled"
+	case a.Expires != nil && a.Expires.Before(now):
+		return "expired at " + a.Expires.Format(time.RFC3339)
+	case a.NotBefore != nil && a.NotBefore.After(now):
+		return "not valid before " + a.NotBefore.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// secrets returns the properties of the secrets whose keys start with one
+// of keys.
+func (c *Client) secrets(ctx context.Context, keys []string) (map[string]*azsecrets.SecretProperties, error) {
+	secrets := make(map[string]*azsecrets.SecretProperties)
+	pager := c.client.NewListSecretPropertiesPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range page.Value {
+			if s.ID == nil {
+				continue
+			}
+			name := s.ID.Name()
+			for _, key := range keys {
+				if strings.HasPrefix(name, transform(key)) {
+					secrets[name] = s
+					break
+				}
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// GetValues retrieves the current values of the secrets whose keys start
+// with one of keys. Disabled, expired and not yet valid secrets are
+// skipped.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	secrets, err := c.secrets(ctx, keys)
+	if err != nil {
+		return vars, err
+	}
+	for name, s := range secrets {
+		if reason := unusable(s.Attributes); reason != "" {
+			log.Warning("Skipping secret %s, %s", name, reason)
+			continue
+		}
+		resp, err := c.client.GetSecret(ctx, name, "", nil)
+		if err != nil {
+			return vars, err
+		}
+		if resp.Value != nil {
+			vars[clean(name)] = *resp.Value
+		}
+	}
+	return vars, nil
+}
+
+// updated returns the updated timestamp of every secret holding keys,
+// along with why it cannot be read, if so.
+func (c *Client) updated(ctx context.Context, keys []string) (map[string]string, error) {
+	secrets, err := c.secrets(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for name, s := range secrets {
+		// Expiring changes nothing but the time, tell it apart too
+		var updated string
+		if s.Attributes != nil && s.Attributes.Updated != nil {
+			updated = strconv.FormatInt(s.Attributes.Updated.UnixNano(), 10)
+		}
+		updated += " " + unusable(s.Attributes)
+		vars[clean(name)] = updated
+	}
+	return vars, nil
+}
+
+// WatchPrefix polls the secrets and returns a new index once a secret was
+// added, deleted or updated.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.updated)
+}
+
+// KeepAlive is a no-op, every request uses its own HTTP round trip.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,152 @@
+package azurekeyvault
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeKeyVault serves the secrets of a vault, listing one per page.
+type fakeKeyVault struct {
+	mu         sync.Mutex
+	values     map[string]string
+	attributes map[string]*azsecrets.SecretAttributes
+}
+
+func newFakeKeyVault() *fakeKeyVault {
+	return &fakeKeyVault{values: make(map[string]string), attributes: make(map[string]*azsecrets.SecretAttributes)}
+}
+
+func (f *fakeKeyVault) set(name, value string, a *azsecrets.SecretAttributes) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if a == nil {
+		a = &azsecrets.SecretAttributes{Enabled: to.Ptr(true)}
+	}
+	a.Updated = to.Ptr(time.Now())
+	f.values[name] = value
+	f.attributes[name] = a
+}
+
+func (f *fakeKeyVault) NewListSecretPropertiesPager(options *azsecrets.ListSecretPropertiesOptions) *runtime.Pager[azsecrets.ListSecretPropertiesResponse] {
+	f.mu.Lock()
+	var names []string
+	for name := range f.values {
+		names = append(names, name)
+	}
+	f.mu.Unlock()
+	sort.Strings(names)
+	next := 0
+	return runtime.NewPager(runtime.PagingHandler[azsecrets.ListSecretPropertiesResponse]{
+		More: func(page azsecrets.ListSecretPropertiesResponse) bool {
+			return next < len(names)
+		},
+		Fetcher: func(ctx context.Context, page *azsecrets.ListSecretPropertiesResponse) (azsecrets.ListSecretPropertiesResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			var resp azsecrets.ListSecretPropertiesResponse
+			if next < len(names) {
+				id := azsecrets.ID("https://my-vault.vault.azure.net/secrets/" + names[next])
+				resp.Value = []*azsecrets.SecretProperties{{ID: &id, Attributes: f.attributes[names[next]]}}
+				next++
+			}
+			return resp, nil
+		},
+	})
+}
+
+func (f *fakeKeyVault) GetSecret(ctx context.Context, name string, version string, options *azsecrets.GetSecretOptions) (azsecrets.GetSecretResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp azsecrets.GetSecretResponse
+	if value, ok := f.values[name]; ok {
+		resp.Value = to.Ptr(value)
+	}
+	return resp, nil
+}
+
+func TestVaultURL(t *testing.T) {
+	tests := map[string]string{
+		"my-vault":                          "https://my-vault.vault.azure.net",
+		"my-vault.vault.azure.cn":           "https://my-vault.vault.azure.cn",
+		"https://my-vault.vault.azure.net/": "https://my-vault.vault.azure.net/",
+	}
+	for node, want := range tests {
+		if got := vaultURL(node); got != want {
+			t.Errorf("vaultURL(%q) = %q, want %q", node, got, want)
+		}
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeKeyVault()
+	f.set("key", "foobar", nil)
+	f.set("database--host", "127.0.0.1", nil)
+	f.set("database--port", "3306", nil)
+	f.set("database--user", "rob", &azsecrets.SecretAttributes{Enabled: to.Ptr(false)})
+	f.set("database--password", "p@sSw0rd", &azsecrets.SecretAttributes{Expires: to.Ptr(time.Now().Add(-time.Hour))})
+	f.set("database--token", "t0k3n", &azsecrets.SecretAttributes{NotBefore: to.Ptr(time.Now().Add(time.Hour))})
+	f.set("other--key", "other", nil)
+	c := newClient(f)
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefixComparesUpdated(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeKeyVault()
+	f.set("app--key", "foo", nil)
+	c := newClient(f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("other--key", "ignored", nil)
+		time.Sleep(50 * time.Millisecond)
+		f.set("app--key", "bar", nil)
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 2", index, err)
+	}
+}
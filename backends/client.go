@@ -1,29 +1,155 @@
 package backends
 
 import (
+	"context"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/zyf0330/confd/backends/etcdv3"
+	"github.com/zyf0330/confd/backends/gunzip"
+	"github.com/zyf0330/confd/backends/retry"
 	"github.com/zyf0330/confd/log"
 )
 
 // The StoreClient interface is implemented by objects that can retrieve
 // key/value pairs from a backend store.
 type StoreClient interface {
-	GetValues(keys []string) (map[string]string, error)
-	WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool, doneChan chan bool) (uint64, error)
+	GetValues(ctx context.Context, keys []string) (map[string]string, error)
+	WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error)
 	KeepAlive(doneChan chan bool)
 }
 
+// A SecretStore is a StoreClient whose values are secrets, they are never
+// logged.
+type SecretStore interface {
+	Secret() bool
+}
+
+// IsSecret reports whether the values of client are secrets.
+func IsSecret(client StoreClient) bool {
+	s, ok := client.(SecretStore)
+	return ok && s.Secret()
+}
+
+// A Pinger is a StoreClient which can tell whether its backend is
+// reachable, without reading any keys.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping returns an error if the backend of client cannot be reached. The
+// clients which are not Pingers are assumed to reach theirs.
+func Ping(ctx context.Context, client StoreClient) error {
+	if p, ok := client.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// A NodeSetter is a StoreClient whose nodes can change while it runs.
+// SetNodes returns an error if they cannot, e.g. as those of a client
+// wrapping another one which cannot change its nodes.
+type NodeSetter interface {
+	SetNodes(nodes []string) error
+}
+
+// Ready returns an error if the backend of client cannot serve confd yet:
+// it pings it, then reads key, which is usually missing. A backend which
+// answers with no value is ready.
+func Ready(ctx context.Context, client StoreClient, key string) error {
+	if err := Ping(ctx, client); err != nil {
+		return err
+	}
+	_, err := client.GetValues(ctx, []string{key})
+	return err
+}
+
 // New is used to create a storage client based on our configuration.
 func New(config Config) (StoreClient, error) {
 
 	if config.Backend == "" {
 		config.Backend = "etcdv3"
 	}
-	backendNodes := config.BackendNodes
+	if strings.Contains(config.Backend, ",") {
+		// Several backends sharing the other settings, the nodes
+		// included, which confd allows one of them at most to read
+		var configs []Config
+		for _, backend := range strings.Split(config.Backend, ",") {
+			c := config
+			c.Backend = strings.TrimSpace(backend)
+			configs = append(configs, c)
+		}
+		return NewMulti(configs)
+	}
+	log.Info("Backend source(s) set to " + strings.Join(config.BackendNodes, ", "))
 
-	log.Info("Backend source(s) set to " + strings.Join(backendNodes, ", "))
+	registryMu.RLock()
+	factory, ok := registry[config.Backend]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported backend %s", config.Backend)
+	}
+	client, err := factory(config)
+	if err != nil {
+		return client, err
+	}
+	if config.DecodeGzip {
+		client = gunzip.New(client)
+	}
+	retries := config.BackendRetries
+	if retries <= 0 && config.Backend == "etcdv3" {
+		// etcdv3 does not retry on its own, -backend-retries winning
+		// over -retry-max
+		retries = config.RetryMax
+	}
+	if retries <= 0 {
+		return client, nil
+	}
+	return retry.New(client, retry.Config{
+		Retries:  retries,
+		Interval: time.Duration(config.RetryInterval) * time.Millisecond,
+		MaxDelay: time.Duration(config.BackendRetryMaxDelay) * time.Millisecond,
+		Jitter:   0.5,
+	}), nil
+}
+
+// A Factory creates the StoreClient of a backend from the configuration.
+type Factory func(config Config) (StoreClient, error)
+
+var (
+	registryMu sync.RWMutex
+	// registry holds the backends by name, every backend package
+	// registering its own from its init, and this one the stack backend.
+	registry = make(map[string]Factory)
+)
 
-	return etcdv3.NewEtcdClient(backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.BasicAuth, config.Username, config.Password)
+// Register makes a backend available to New by name, usually from the init
+// function of the backend package, which confd imports for its side
+// effects. It panics if the name is already taken or factory is nil.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("backends: Register factory is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic("backends: Register called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+func init() {
+	Register("stack", func(config Config) (StoreClient, error) {
+		return NewStack(config.Stack)
+	})
+}
+
+// AWSEndpoint returns the endpoint overriding the one of an AWS service,
+// the first of the nodes if any.
+func AWSEndpoint(nodes []string) string {
+	if len(nodes) > 0 {
+		return nodes[0]
+	}
+	return ""
 }
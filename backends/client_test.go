@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zyf0330/confd/backends/retry"
+	"github.com/zyf0330/confd/util"
+)
+
+func TestNewUnsupported(t *testing.T) {
+	if _, err := New(Config{Backend: "etcd4"}); err == nil || !strings.Contains(err.Error(), "unsupported backend etcd4") {
+		t.Errorf("New() of an unknown backend = %v, want an unsupported backend error", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	client := newFakeClient(map[string]string{"/key": "value"})
+	Register("fake", func(config Config) (StoreClient, error) { return client, nil })
+	defer unregister("fake")
+
+	c, err := New(Config{Backend: "fake"})
+	if err != nil || c != client {
+		t.Errorf("New() of a registered backend = %v, %v, want its client", c, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() of a taken name did not panic")
+		}
+	}()
+	Register("fake", func(config Config) (StoreClient, error) { return client, nil })
+}
+
+func TestNewRetries(t *testing.T) {
+	client := secretClient{newFakeClient(map[string]string{"/key": "value"})}
+	Register("fake", func(config Config) (StoreClient, error) { return client, nil })
+	defer unregister("fake")
+
+	c, err := New(Config{Backend: "fake", BackendRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*retry.Client); !ok {
+		t.Fatalf("New() with retries = %T, want a *retry.Client", c)
+	}
+	if !IsSecret(c) {
+		t.Error("IsSecret() of the retrying client of a secret store = false")
+	}
+}
+
+func TestReady(t *testing.T) {
+	client := newFakeClient(map[string]string{})
+	if err := Ready(context.Background(), client, "/confd-ready"); err != nil {
+		t.Errorf("Ready() of a backend without the key = %v", err)
+	}
+	client.err = errors.New("connection refused")
+	if err := Ready(context.Background(), client, "/confd-ready"); err != client.err {
+		t.Errorf("Ready() of a failing backend = %v, want %v", err, client.err)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	config := Config{TLSMinVersion: "1.2", TLSServerName: "etcd.example.com"}
+	opts, err := config.TLSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := util.NewTLSConfigWithOptions("", "", "", opts)
+	if err != nil || c == nil {
+		t.Fatalf("NewTLSConfigWithOptions() = %v, %v", c, err)
+	}
+	if c.MinVersion != tls.VersionTLS12 || c.ServerName != "etcd.example.com" || c.InsecureSkipVerify {
+		t.Errorf("TLS config = %+v, want TLS 1.2 at least and the server name", c)
+	}
+
+	// The minimum version alone does not enable TLS
+	opts, _ = Config{TLSMinVersion: "1.3"}.TLSOptions()
+	if c, err := util.NewTLSConfigWithOptions("", "", "", opts); c != nil || err != nil {
+		t.Errorf("NewTLSConfigWithOptions() with a minimum version only = %+v, %v, want nil", c, err)
+	}
+	if _, err := (Config{TLSMinVersion: "SSLv3"}).TLSOptions(); err == nil {
+		t.Error("TLSOptions() with SSLv3 succeeded")
+	}
+}
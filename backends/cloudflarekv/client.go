@@ -0,0 +1,298 @@
+package cloudflarekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// Workers KV has no way to push changes, the values are polled.
+var pollInterval = 30 * time.Second
+
+const (
+	apiURL = "https://api.cloudflare.com/client/v4"
+	// The most keys a page of the list lists and a bulk get reads
+	listLimit = 1000
+	bulkLimit = 100
+)
+
+// namespace is a Workers KV namespace given by a node.
+type namespace struct {
+	account string
+	id      string
+}
+
+func (n namespace) String() string {
+	return n.account + "/" + n.id
+}
+
+// Client is a wrapper around the Workers KV namespaces given by the nodes,
+// the values of the later ones overriding those of the earlier ones.
+type Client struct {
+	baseURL    string
+	namespaces []namespace
+	token      string
+	client     *http.Client
+	poller     *util.Poller
+	// Retries of a rate-limited or failed request and the wait before the
+	// first one unless the response tells it
+	retryMax      int
+	retryInterval time.Duration
+}
+
+func init() {
+	backends.Register("cloudflarekv", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.AuthToken,
+			config.RetryMax, time.Duration(config.RetryInterval)*time.Millisecond)
+	})
+}
+
+// New returns a *cloudflarekv.Client reading the namespaces given by nodes
+// as account/namespace IDs, authenticating with the API token.
+func New(nodes []string, token string, retryMax int, retryInterval time.Duration) (*Client, error) {
+	if token == "" {
+		return nil, errors.New("no API token given, set it with -auth-token")
+	}
+	c, err := newClient(apiURL, nodes, token)
+	if err != nil {
+		return nil, err
+	}
+	c.retryMax, c.retryInterval = retryMax, retryInterval
+	return c, nil
+}
+
+func newClient(baseURL string, nodes []string, token string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no namespace given, set it with -node as account/namespace")
+	}
+	namespaces := make([]namespace, len(nodes))
+	for i, node := range nodes {
+		parts := strings.Split(node, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s is not an account/namespace ID pair", node)
+		}
+		namespaces[i] = namespace{parts[0], parts[1]}
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &Client{
+		baseURL:       baseURL,
+		namespaces:    namespaces,
+		token:         token,
+		client:        &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		poller:        util.NewPoller(pollInterval),
+		retryInterval: time.Second,
+	}, nil
+}
+
+// response is the envelope of the answers of the API.
+type response struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Cursor string `json:"cursor"`
+	} `json:"result_info"`
+}
+
+func (r *response) err() error {
+	messages := make([]string, len(r.Errors))
+	for i, e := range r.Errors {
+		messages[i] = fmt.Sprintf("%s (%d)", e.Message, e.Code)
+	}
+	return errors.New(strings.Join(messages, ", "))
+}
+
+// retryAfter returns the wait the Retry-After header of resp asks for, in
+// seconds or as a date, and false if it has none.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// do sends the request of method to endpoint and returns the envelope of
+// the answer. Rate-limited requests are retried once the wait given by
+// Retry-After elapsed, failed ones after a backoff, up to retryMax times.
+// The API token is only ever put in the Authorization header.
+func (c *Client) do(ctx context.Context, method, endpoint string, body interface{}) (*response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest(method, c.baseURL+endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		wait := util.Backoff(c.retryInterval, retry)
+		resp, err := c.client.Do(req)
+		if err == nil {
+			var r response
+			decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&r)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				err = fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+				if d, ok := retryAfter(resp); ok {
+					wait = d
+				}
+			case decodeErr != nil:
+				return nil, fmt.Errorf("%s %s: %s: %s", method, endpoint, resp.Status, decodeErr)
+			case resp.StatusCode != http.StatusOK || !r.Success:
+				return nil, fmt.Errorf("%s %s: %s: %s", method, endpoint, resp.Status, r.err())
+			default:
+				return &r, nil
+			}
+		}
+		if retry >= c.retryMax || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warning("Request failed, retrying in %s: %s", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// list returns the names of the keys of n starting with prefix, following
+// the cursors of the pages.
+func (c *Client) list(ctx context.Context, n namespace, prefix string) ([]string, error) {
+	var names []string
+	cursor := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(listLimit)}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		r, err := c.do(ctx, "GET", fmt.Sprintf("/accounts/%s/storage/kv/namespaces/%s/keys?%s", n.account, n.id, query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+		var keys []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(r.Result, &keys); err != nil {
+			return nil, fmt.Errorf("cannot parse the keys of %s: %s", n, err)
+		}
+		for _, key := range keys {
+			names = append(names, key.Name)
+		}
+		if r.ResultInfo.Cursor == "" || len(keys) == 0 {
+			return names, nil
+		}
+		cursor = r.ResultInfo.Cursor
+	}
+}
+
+// get reads the values of names from n, bulkLimit at a time. Keys which
+// expired or were deleted since they were listed are left out.
+func (c *Client) get(ctx context.Context, n namespace, names []string, vars map[string]string) error {
+	for start := 0; start < len(names); start += bulkLimit {
+		end := start + bulkLimit
+		if end > len(names) {
+			end = len(names)
+		}
+		body := map[string]interface{}{"keys": names[start:end], "type": "text"}
+		r, err := c.do(ctx, "POST", fmt.Sprintf("/accounts/%s/storage/kv/namespaces/%s/bulk/get", n.account, n.id), body)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Values map[string]*string `json:"values"`
+		}
+		if err := json.Unmarshal(r.Result, &result); err != nil {
+			return fmt.Errorf("cannot parse the values of %s: %s", n, err)
+		}
+		for name, value := range result.Values {
+			if value != nil {
+				vars[name] = *value
+			}
+		}
+	}
+	return nil
+}
+
+// prefixes returns keys without those starting with another one, which
+// are listed with it.
+func prefixes(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	var result []string
+	for _, key := range sorted {
+		if len(result) > 0 && strings.HasPrefix(key, result[len(result)-1]) {
+			continue
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// GetValues lists the keys of the namespaces starting with one of keys and
+// reads their values with bulk gets.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, n := range c.namespaces {
+		var names []string
+		for _, prefix := range prefixes(keys) {
+			listed, err := c.list(ctx, n, prefix)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, listed...)
+		}
+		if err := c.get(ctx, n, names, vars); err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix lists and reads the keys every pollInterval, and returns
+// waitIndex+1 once their values changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+}
+
+// KeepAlive is a no-op, every request opens or reuses a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
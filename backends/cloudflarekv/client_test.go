@@ -0,0 +1,272 @@
+package cloudflarekv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+const (
+	keysPath = "/accounts/acct/storage/kv/namespaces/ns/keys"
+	bulkPath = "/accounts/acct/storage/kv/namespaces/ns/bulk/get"
+)
+
+// fakeAPI serves the keys of the acct/ns namespace two a page to the
+// holders of its token, rate-limiting the first limited requests.
+type fakeAPI struct {
+	mu      sync.Mutex
+	values  map[string]string
+	limited int
+	// The requests answered, rate-limited ones included
+	requests int
+}
+
+func (f *fakeAPI) reply(w http.ResponseWriter, status int, result interface{}, cursor string) {
+	b, _ := json.Marshal(result)
+	r := response{Success: status == http.StatusOK, Result: b}
+	r.ResultInfo.Cursor = cursor
+	if status != http.StatusOK {
+		r.Errors = append(r.Errors, struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{10000, http.StatusText(status)})
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(r)
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		f.reply(w, http.StatusForbidden, nil, "")
+		return
+	}
+	if f.limited > 0 {
+		f.limited--
+		w.Header().Set("Retry-After", "1")
+		f.reply(w, http.StatusTooManyRequests, nil, "")
+		return
+	}
+	switch r.URL.Path {
+	case keysPath:
+		var names []string
+		for name := range f.values {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		keys := []map[string]string{}
+		cursor := ""
+		for i := start; i < len(names) && i < start+2; i++ {
+			keys = append(keys, map[string]string{"name": names[i]})
+		}
+		if start+2 < len(names) {
+			cursor = strconv.Itoa(start + 2)
+		}
+		f.reply(w, http.StatusOK, keys, cursor)
+	case bulkPath:
+		var body struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Keys) > bulkLimit {
+			f.reply(w, http.StatusBadRequest, nil, "")
+			return
+		}
+		values := make(map[string]*string)
+		for _, key := range body.Keys {
+			if value, ok := f.values[key]; ok {
+				values[key] = &value
+			} else {
+				values[key] = nil
+			}
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"values": values}, "")
+	default:
+		f.reply(w, http.StatusNotFound, nil, "")
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeAPI, token string) (*Client, func()) {
+	server := httptest.NewServer(f)
+	c, err := newClient(server.URL, []string{"acct/ns"}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.retryInterval = 10 * time.Millisecond
+	return c, server.Close
+}
+
+func TestGetValues(t *testing.T) {
+	f := &fakeAPI{values: map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/myapp/upstreams/a":   "10.0.0.1",
+		"/myapp/upstreams/b":   "10.0.0.2",
+		"/myapp/upstreams/c":   "10.0.0.3",
+		"/otherapp/key":        "filtered",
+	}}
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/upstreams", "/myapp/database", "/myapp/database/url"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/myapp/upstreams/a":   "10.0.0.1",
+		"/myapp/upstreams/b":   "10.0.0.2",
+		"/myapp/upstreams/c":   "10.0.0.3",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestGetValuesBulk(t *testing.T) {
+	f := &fakeAPI{values: make(map[string]string)}
+	for i := 0; i < 2*bulkLimit+1; i++ {
+		f.values["/myapp/"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vars, f.values) {
+		t.Errorf("GetValues() read %d keys, want %d", len(vars), len(f.values))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	log.SetLevel("error")
+	f := &fakeAPI{values: map[string]string{"/myapp/key": "foo"}, limited: 1}
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+	c.retryMax = 1
+
+	start := time.Now()
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil || vars["/myapp/key"] != "foo" {
+		t.Fatalf("GetValues() = %v, %v, want the key once retried", vars, err)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("GetValues() retried after %s, want the second of Retry-After", time.Since(start))
+	}
+
+	f.mu.Lock()
+	f.limited, f.requests = 2, 0
+	f.mu.Unlock()
+	if _, err := c.GetValues(context.Background(), []string{"/myapp"}); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("GetValues() rate-limited past retryMax = %v, want the 429", err)
+	}
+	if f.requests != 2 {
+		t.Errorf("GetValues() sent %d requests, want 2", f.requests)
+	}
+}
+
+func TestWrongToken(t *testing.T) {
+	f := &fakeAPI{values: map[string]string{}}
+	c, stop := newTestClient(t, f, "wrong-token")
+	defer stop()
+	_, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("GetValues() with a wrong token = %v, want the 403", err)
+	}
+	if strings.Contains(err.Error(), "wrong-token") {
+		t.Errorf("GetValues() error %q contains the token", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Retry-After": {tt.header}}}
+		if got, ok := retryAfter(resp); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	resp := &http.Response{Header: http.Header{"Retry-After": {date}}}
+	if got, ok := retryAfter(resp); !ok || got <= 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(%q) = %s, %v, want about a minute", date, got, ok)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New([]string{"acct/ns"}, "", 3, time.Second); err == nil {
+		t.Error("New() without a token succeeded")
+	}
+	for _, nodes := range [][]string{nil, {"acct"}, {"acct/ns/extra"}, {"/ns"}} {
+		if _, err := New(nodes, "secret", 3, time.Second); err == nil {
+			t.Errorf("New(%v) succeeded", nodes)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	f := &fakeAPI{values: map[string]string{"/myapp/key": "foo", "/other/key": "foo"}}
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+	c.poller.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.mu.Lock()
+		f.values["/other/key"] = "bar"
+		f.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		f.mu.Lock()
+		f.values["/myapp/key"] = "bar"
+		f.mu.Unlock()
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -1,23 +1,181 @@
 package backends
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
 	"github.com/zyf0330/confd/util"
 )
 
 type Config struct {
-	AuthToken    string     `toml:"auth_token"`
-	AuthType     string     `toml:"auth_type"`
-	Backend      string     `toml:"backend"`
-	BasicAuth    bool       `toml:"basic_auth"`
-	ClientCaKeys string     `toml:"client_cakeys"`
-	ClientCert   string     `toml:"client_cert"`
-	ClientKey    string     `toml:"client_key"`
-	BackendNodes util.Nodes `toml:"nodes"`
-	Password     string     `toml:"password"`
-	Scheme       string     `toml:"scheme"`
-	Table        string     `toml:"table"`
-	Username     string     `toml:"username"`
-	AppID        string     `toml:"app_id"`
-	UserID       string     `toml:"user_id"`
-	YAMLFile     util.Nodes `toml:"file"`
+	AuthToken     string     `toml:"auth_token"`
+	AuthType      string     `toml:"auth_type"`
+	Backend       string     `toml:"backend"`
+	BasicAuth     bool       `toml:"basic_auth"`
+	ClientCaKeys  string     `toml:"client_cakeys"`
+	ClientCert    string     `toml:"client_cert"`
+	ClientKey     string     `toml:"client_key"`
+	BackendNodes  util.Nodes `toml:"nodes"`
+	Password      string     `toml:"password"`
+	Scheme        string     `toml:"scheme"`
+	Table         string     `toml:"table"`
+	Username      string     `toml:"username"`
+	AppID         string     `toml:"app_id"`
+	UserID        string     `toml:"user_id"`
+	RoleID        string     `toml:"role_id"`
+	SecretID      string     `toml:"secret_id"`
+	Path          string     `toml:"path"`
+	YAMLFile      util.Nodes `toml:"file"`
+	Endpoint      string     `toml:"endpoint"`
+	Credentials   string     `toml:"credentials_file"`
+	Subscription  string     `toml:"subscription"`
+	SecretVersion string     `toml:"secret_version"`
+	ConnString    string     `toml:"connection_string"`
+	Label         string     `toml:"label"`
+	NotifyChannel string     `toml:"notify_channel"`
+	Kubeconfig    string     `toml:"kubeconfig"`
+	GitRef        string     `toml:"git_ref"`
+	GitDir        string     `toml:"git_dir"`
+	CacheDir      string     `toml:"cache_dir"`
+	IdentityFile  string     `toml:"identity_file"`
+	Namespace     string     `toml:"namespace"`
+	PathStyle     bool       `toml:"path_style"`
+	MaxObjectSize int64      `toml:"max_object_size"`
+	RetryMax      int        `toml:"retry_max"`
+	RetryInterval int        `toml:"retry_interval"`
+	// Retries of the reads failing with a transient error, of any backend,
+	// and the milliseconds to wait at most in between
+	BackendRetries       int `toml:"backend_retries"`
+	BackendRetryMaxDelay int `toml:"backend_retry_max_delay"`
+	// Seconds to connect to the backend, and a request of GetValues may
+	// take
+	DialTimeout    int `toml:"backend_dial_timeout"`
+	RequestTimeout int `toml:"backend_request_timeout"`
+	// Seconds without traffic before etcd is pinged, and to wait for the
+	// answer before the connection is deemed lost, 0 for no pings
+	KeepaliveTime    int `toml:"etcd_keepalive_time"`
+	KeepaliveTimeout int `toml:"etcd_keepalive_timeout"`
+	// Seconds between two refreshes of the nodes from the members of the
+	// etcd cluster, 0 for never
+	AutoSyncInterval int `toml:"etcd_auto_sync_interval"`
+	// The prefix in etcd of the keys confd sees, e.g. that of a tenant
+	EtcdNamespace string `toml:"etcd_namespace"`
+	// How many keys a request reads at most, the others of a prefix being
+	// read in pages, 0 for no limit
+	EtcdPageSize int `toml:"etcd_page_size"`
+	// How the requests go to the nodes: "ordered" to the first which
+	// answers, "round-robin" to all of them in turn
+	EndpointOrdering string `toml:"endpoint_ordering"`
+	// The size in bytes of the largest message from and to etcd, 0 for the
+	// limits of clientv3
+	EtcdMaxRecvMsgSize int `toml:"etcd_max_recv_msg_size"`
+	EtcdMaxSendMsgSize int `toml:"etcd_max_send_msg_size"`
+	// Accept any certificate of the backend, or expect TLSServerName in it
+	// instead of the host of the node
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	TLSServerName      string `toml:"tls_server_name"`
+	// The oldest TLS version to speak to the backend, e.g. "1.2", and the
+	// comma-separated names of the cipher suites to offer
+	TLSMinVersion   string `toml:"tls_min_version"`
+	TLSCipherSuites string `toml:"tls_cipher_suites"`
+	// Decompress the values which are gzip-compressed
+	DecodeGzip bool `toml:"decode_gzip"`
+	// Files holding the username, password and auth token, read into
+	// Username, Password and AuthToken by ReadCredentialFiles
+	UsernameFile  string `toml:"username_file"`
+	PasswordFile  string `toml:"password_file"`
+	AuthTokenFile string `toml:"auth_token_file"`
+	// The children of -backend=stack, read from the [[backends]] blocks
+	// of the config file
+	Stack []StackConfig `toml:"-"`
+}
+
+// A StackConfig is a child backend of -backend=stack. Unless it is
+// required, the failures of a child are logged and its values left out.
+type StackConfig struct {
+	Config
+	Required bool
+}
+
+// TLSOptions returns the TLS settings of config besides its certificate
+// files, for the backends building a TLS configuration with
+// util.NewTLSConfigWithOptions. It returns an error if the TLS version or a
+// cipher suite is unknown.
+func (config Config) TLSOptions() (util.TLSOptions, error) {
+	minVersion, err := util.ParseTLSVersion(config.TLSMinVersion)
+	if err != nil {
+		return util.TLSOptions{}, fmt.Errorf("tls_min_version: %s", err)
+	}
+	cipherSuites, err := util.ParseCipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return util.TLSOptions{}, fmt.Errorf("tls_cipher_suites: %s", err)
+	}
+	return util.TLSOptions{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         config.TLSServerName,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
+	}, nil
+}
+
+// ReadCredentialFiles reads the username, password and auth token of config
+// from their files, if set. It returns an error if a file cannot be read,
+// or if a value is set both inline and from a file.
+func (config *Config) ReadCredentialFiles() error {
+	for _, c := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"username", config.UsernameFile, &config.Username},
+		{"password", config.PasswordFile, &config.Password},
+		{"auth_token", config.AuthTokenFile, &config.AuthToken},
+	} {
+		if c.file == "" {
+			continue
+		}
+		if *c.value != "" {
+			return fmt.Errorf("%s and %s_file are both set, set only one", c.name, c.name)
+		}
+		value, err := readCredentialFile(c.file)
+		if err != nil {
+			return err
+		}
+		*c.value = value
+	}
+	return nil
+}
+
+// readCredentialFile returns the content of the file at path, without the
+// trailing newline.
+func readCredentialFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read the credentials file: %s", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// CredentialsReader returns a function reading the username and password
+// of config again, from their files if set, for the backends
+// authenticating again once they are rejected.
+func (config Config) CredentialsReader() func() (string, string, error) {
+	if config.UsernameFile == "" && config.PasswordFile == "" {
+		return nil
+	}
+	return func() (string, string, error) {
+		username, password := config.Username, config.Password
+		var err error
+		if config.UsernameFile != "" {
+			if username, err = readCredentialFile(config.UsernameFile); err != nil {
+				return "", "", err
+			}
+		}
+		if config.PasswordFile != "" {
+			if password, err = readCredentialFile(config.PasswordFile); err != nil {
+				return "", "", err
+			}
+		}
+		return username, password, nil
+	}
 }
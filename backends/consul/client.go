@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// Consul blocking queries are capped by the agent at 10 minutes, ask for
+// the default 5 minutes and just issue a new query when it returns.
+const blockingQueryWait = "5m"
+
+// kvPair is a single entry as returned by the Consul KV HTTP API.
+// Value is base64 encoded on the wire and is null for folders.
+type kvPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// ConsulClient provides a wrapper around the Consul KV HTTP API.
+type ConsulClient struct {
+	client    *http.Client
+	address   string
+	token     string
+	basicAuth bool
+	username  string
+	password  string
+}
+
+func init() {
+	backends.Register("consul", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Scheme,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.BasicAuth, config.Username, config.Password,
+			config.AuthToken,
+		)
+	})
+}
+
+// New returns a new ConsulClient talking to the first of the given nodes.
+func New(nodes []string, scheme, cert, key, caCert string, basicAuth bool, username string, password string, token string) (*ConsulClient, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no consul node given")
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	address := nodes[0]
+	if !strings.Contains(address, "://") {
+		address = scheme + "://" + address
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &ConsulClient{
+		client:    &http.Client{Transport: transport},
+		address:   strings.TrimRight(address, "/"),
+		token:     token,
+		basicAuth: basicAuth,
+		username:  username,
+		password:  password,
+	}, nil
+}
+
+// list returns all pairs stored under prefix together with the
+// X-Consul-Index of the response. A non-zero waitIndex turns the request
+// into a blocking query that only returns once the index moved past it.
+func (c *ConsulClient) list(ctx context.Context, prefix string, waitIndex uint64) ([]kvPair, uint64, error) {
+	params := url.Values{}
+	params.Set("recurse", "true")
+	if waitIndex > 0 {
+		params.Set("index", strconv.FormatUint(waitIndex, 10))
+		params.Set("wait", blockingQueryWait)
+	}
+	u := fmt.Sprintf("%s/v1/kv/%s?%s", c.address, strings.TrimPrefix(prefix, "/"), params.Encode())
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	if c.basicAuth {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var index uint64
+	if h := resp.Header.Get("X-Consul-Index"); h != "" {
+		index, err = strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid X-Consul-Index %q: %s", h, err)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// Nothing stored under prefix yet
+		return nil, index, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("unexpected response from consul (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var pairs []kvPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+	return pairs, index, nil
+}
+
+// Ping asks the agent for the leader of the cluster, the agent failing
+// to tell it if there is none.
+func (c *ConsulClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequest("GET", c.address+"/v1/status/leader", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	if c.basicAuth {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response from consul (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// GetValues queries Consul for keys
+func (c *ConsulClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		pairs, _, err := c.list(ctx, key, 0)
+		if err != nil {
+			return vars, err
+		}
+		for _, p := range pairs {
+			// Folders are stored as keys with a trailing slash and no value
+			if p.Value == nil && strings.HasSuffix(p.Key, "/") {
+				continue
+			}
+			vars[path.Join("/", p.Key)] = string(p.Value)
+		}
+	}
+	return vars, nil
+}
+
+type watchResponse struct {
+	waitIndex uint64
+	err       error
+}
+
+// WatchPrefix issues a blocking query on prefix and returns the new
+// X-Consul-Index once something below it changed.
+func (c *ConsulClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	respChan := make(chan watchResponse, 1)
+	go func() {
+		for {
+			_, index, err := c.list(ctx, prefix, waitIndex)
+			// A blocking query that timed out returns the same index,
+			// there is nothing to render so simply wait again.
+			if err != nil || index != waitIndex || waitIndex == 0 {
+				respChan <- watchResponse{index, err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return waitIndex, nil
+	case r := <-respChan:
+		if r.err != nil {
+			return waitIndex, r.err
+		}
+		// The index is not guaranteed to increase monotonically, e.g. after
+		// a snapshot restore. Start over so the next query returns at once.
+		if r.waitIndex < waitIndex {
+			log.Debug("Consul index for '%s' went backwards (%d < %d), resetting", prefix, r.waitIndex, waitIndex)
+			return 0, nil
+		}
+		return r.waitIndex, nil
+	}
+}
+
+// KeepAlive is a no-op, every Consul request uses its own HTTP round trip.
+func (c *ConsulClient) KeepAlive(doneChan chan bool) {
+}
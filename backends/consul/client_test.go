@@ -0,0 +1,174 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeConsul emulates the parts of the Consul KV API used by ConsulClient.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	pairs   map[string]string
+	changed chan struct{}
+	indexes []string
+	token   string
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:   1,
+		pairs:   make(map[string]string),
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeConsul) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pairs[key] = value
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	f.mu.Lock()
+	f.token = r.Header.Get("X-Consul-Token")
+	f.indexes = append(f.indexes, r.URL.Query().Get("index"))
+	changed := f.changed
+	index := f.index
+	f.mu.Unlock()
+
+	if wait := r.URL.Query().Get("index"); wait != "" {
+		waitIndex, _ := strconv.ParseUint(wait, 10, 64)
+		if waitIndex >= index {
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var pairs []kvPair
+	for k, v := range f.pairs {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, kvPair{Key: k, Value: []byte(v)})
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeConsul()
+	f.pairs["app/database/host"] = "127.0.0.1"
+	f.pairs["app/database/port"] = "3306"
+	f.pairs["app/upstream/"] = ""
+	f.pairs["other/key"] = "value"
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := New([]string{ts.URL}, "http", "", "", "", false, "", "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/app/database", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/app/database/host": "127.0.0.1",
+		"/app/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+	if f.token != "secret" {
+		t.Errorf("X-Consul-Token = %q, want %q", f.token, "secret")
+	}
+}
+
+func TestWatchPrefixResumesFromIndex(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeConsul()
+	f.pairs["app/key"] = "foo"
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := New([]string{strings.TrimPrefix(ts.URL, "http://")}, "http", "", "", "", false, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/app", []string{"/app/key"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, want 1", index)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.put("app/key", "bar")
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", []string{"/app/key"}, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 2 {
+		t.Fatalf("second WatchPrefix() = %d, want 2", index)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.indexes) < 2 || f.indexes[0] != "" || f.indexes[1] != "1" {
+		t.Errorf("blocking queries sent indexes %v, want [\"\" \"1\" ...]", f.indexes)
+	}
+}
+
+func TestWatchPrefixResetsOnIndexGoingBackwards(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeConsul()
+	f.index = 3
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := New([]string{ts.URL}, "http", "", "", "", false, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := c.WatchPrefix(context.Background(), "/app", []string{"/app"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 0 {
+		t.Errorf("WatchPrefix() = %d, want 0", index)
+	}
+}
@@ -0,0 +1,141 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// DynamoDB has no way to watch a table, changes are detected by polling.
+var pollInterval = 10 * time.Second
+
+// Every scan filters on at most this many prefixes, which keeps the
+// filter expression well below the 4 KB DynamoDB accepts.
+const maxPrefixesPerScan = 25
+
+// Client is a wrapper around the DynamoDB client. Every item of the table
+// holds one confd key in its "key" attribute and the value, a string, in
+// its "value" attribute.
+type Client struct {
+	client dynamodb.ScanAPIClient
+	table  string
+	poller *util.Poller
+}
+
+func init() {
+	backends.Register("dynamodb", func(config backends.Config) (backends.StoreClient, error) {
+		return NewDynamoDBClient(config.Table, backends.AWSEndpoint(config.BackendNodes))
+	})
+}
+
+// NewDynamoDBClient returns an *dynamodb.Client for the given table.
+// Credentials and region come from the default AWS configuration chain,
+// endpoint overrides the DynamoDB endpoint, e.g. for DynamoDB Local.
+func NewDynamoDBClient(table, endpoint string) (*Client, error) {
+	if table == "" {
+		return nil, errors.New("no DynamoDB table given, set it with -table")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early instead of on the first scan
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return newClient(client, table), nil
+}
+
+func newClient(client dynamodb.ScanAPIClient, table string) *Client {
+	return &Client{
+		client: client,
+		table:  table,
+		poller: util.NewPoller(pollInterval),
+	}
+}
+
+// GetValues scans the table for items whose key starts with one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxPrefixesPerScan {
+			n = maxPrefixesPerScan
+		}
+		if err := c.scan(ctx, keys[:n], vars); err != nil {
+			return vars, err
+		}
+		keys = keys[n:]
+	}
+	return vars, nil
+}
+
+// scan stores the items whose key starts with one of prefixes in vars.
+func (c *Client) scan(ctx context.Context, prefixes []string, vars map[string]string) error {
+	filters := make([]string, len(prefixes))
+	values := make(map[string]types.AttributeValue, len(prefixes))
+	for i, prefix := range prefixes {
+		name := fmt.Sprintf(":p%d", i)
+		filters[i] = fmt.Sprintf("begins_with(#key, %s)", name)
+		values[name] = &types.AttributeValueMemberS{Value: prefix}
+	}
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(c.table),
+		FilterExpression: aws.String(strings.Join(filters, " OR ")),
+		// key and value are reserved words in DynamoDB expressions
+		ExpressionAttributeNames:  map[string]string{"#key": "key", "#value": "value"},
+		ExpressionAttributeValues: values,
+		ProjectionExpression:      aws.String("#key, #value"),
+		ConsistentRead:            aws.Bool(true),
+	}
+
+	paginator := dynamodb.NewScanPaginator(c.client, input)
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			key, ok := item["key"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			value, ok := item["value"].(*types.AttributeValueMemberS)
+			if !ok {
+				log.Warning("Skipping key '%s'. 'value' is not of type 'S'.", key.Value)
+				continue
+			}
+			vars[key.Value] = value.Value
+		}
+	}
+	return nil
+}
+
+// WatchPrefix polls the keys and returns a new index once the values changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+}
+
+// KeepAlive is a no-op, the AWS SDK retries failed requests itself.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
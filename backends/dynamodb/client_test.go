@@ -0,0 +1,162 @@
+package dynamodb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeScan serves the items of a table one per page, keeping the ones
+// starting with one of the prefixes of the filter expression.
+type fakeScan struct {
+	items []map[string]types.AttributeValue
+	scans int
+}
+
+func (f *fakeScan) Scan(ctx context.Context, in *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if in.ExclusiveStartKey == nil {
+		f.scans++
+	}
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		last := in.ExclusiveStartKey["key"].(*types.AttributeValueMemberS).Value
+		for i, item := range f.items {
+			if item["key"].(*types.AttributeValueMemberS).Value == last {
+				start = i + 1
+			}
+		}
+	}
+	out := &dynamodb.ScanOutput{}
+	if start >= len(f.items) {
+		return out, nil
+	}
+	item := f.items[start]
+	key := item["key"].(*types.AttributeValueMemberS).Value
+	for _, v := range in.ExpressionAttributeValues {
+		if strings.HasPrefix(key, v.(*types.AttributeValueMemberS).Value) {
+			out.Items = append(out.Items, item)
+			break
+		}
+	}
+	if start < len(f.items)-1 {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"key": item["key"]}
+	}
+	return out, nil
+}
+
+func newFakeScan(pairs map[string]types.AttributeValue) *fakeScan {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f := &fakeScan{}
+	for _, k := range keys {
+		f.items = append(f.items, map[string]types.AttributeValue{
+			"key":   &types.AttributeValueMemberS{Value: k},
+			"value": pairs[k],
+		})
+	}
+	return f
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeScan(map[string]types.AttributeValue{
+		"/key":             &types.AttributeValueMemberS{Value: "foobar"},
+		"/database/host":   &types.AttributeValueMemberS{Value: "127.0.0.1"},
+		"/database/port":   &types.AttributeValueMemberS{Value: "3306"},
+		"/upstream/app1":   &types.AttributeValueMemberS{Value: "10.0.1.10:8080"},
+		"/upstream/broken": &types.AttributeValueMemberN{Value: "4711"},
+		"/other/key":       &types.AttributeValueMemberS{Value: "value"},
+	})
+	c := newClient(f, "confd")
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/upstream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+		"/upstream/app1": "10.0.1.10:8080",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+	if f.scans != 1 {
+		t.Errorf("GetValues() scanned the table %d times, want 1", f.scans)
+	}
+}
+
+func TestGetValuesManyKeys(t *testing.T) {
+	f := newFakeScan(map[string]types.AttributeValue{
+		"/key": &types.AttributeValueMemberS{Value: "foobar"},
+	})
+	c := newClient(f, "confd")
+
+	keys := make([]string, 2*maxPrefixesPerScan+1)
+	for i := range keys {
+		keys[i] = "/key"
+	}
+	vars, err := c.GetValues(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["/key"] != "foobar" {
+		t.Errorf("GetValues()[/key] = %q, want %q", vars["/key"], "foobar")
+	}
+	if f.scans != 3 {
+		t.Errorf("GetValues() scanned the table %d times, want 3", f.scans)
+	}
+}
+
+func TestNewDynamoDBClientRequiresTable(t *testing.T) {
+	if _, err := NewDynamoDBClient("", ""); err == nil {
+		t.Error("expected an error for a missing table")
+	}
+}
+
+func TestWatchPrefixPolls(t *testing.T) {
+	log.SetLevel("warn")
+	pollInterval = 10 * time.Millisecond
+	f := newFakeScan(map[string]types.AttributeValue{
+		"/app/key": &types.AttributeValueMemberS{Value: "foo"},
+	})
+	c := newClient(f, "confd")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 1 {
+		t.Fatalf("WatchPrefix() without change = %d, %v, want 1", index, err)
+	}
+
+	f.items[0]["value"] = &types.AttributeValueMemberS{Value: "bar"}
+	index, err = c.WatchPrefix(context.Background(), "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+}
@@ -0,0 +1,90 @@
+package env
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/zyf0330/confd/backends"
+)
+
+// Variables starting with this prefix are looked up without it, so
+// CONFD_FOO_BAR is /foo/bar, and take precedence over FOO_BAR.
+const prefix = "CONFD_"
+
+var replacer = strings.NewReplacer("/", "_")
+var cleanReplacer = strings.NewReplacer("_", "/")
+
+// Client provides a shell for the env client
+type Client struct{}
+
+func init() {
+	backends.Register("env", func(config backends.Config) (backends.StoreClient, error) {
+		return NewEnvClient()
+	})
+}
+
+// NewEnvClient returns a new client
+func NewEnvClient() (*Client, error) {
+	return &Client{}, nil
+}
+
+// GetValues queries the environment for keys, /myapp/database/url is
+// looked up as MYAPP_DATABASE_URL and every variable starting with it.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	envMap := make(map[string]string)
+	var prefixed []string
+	for _, e := range os.Environ() {
+		index := strings.Index(e, "=")
+		if index < 0 {
+			continue
+		}
+		if strings.HasPrefix(e, prefix) {
+			prefixed = append(prefixed, e)
+			continue
+		}
+		envMap[e[:index]] = e[index+1:]
+	}
+	for _, e := range prefixed {
+		index := strings.Index(e, "=")
+		envMap[e[len(prefix):index]] = e[index+1:]
+	}
+
+	vars := make(map[string]string)
+	for _, key := range keys {
+		k := transform(key)
+		for envKey, envValue := range envMap {
+			if strings.HasPrefix(envKey, k) {
+				vars[clean(envKey)] = envValue
+			}
+		}
+	}
+	return vars, nil
+}
+
+// transform maps a key onto the name of an environment variable.
+func transform(key string) string {
+	k := strings.TrimPrefix(key, "/")
+	return strings.ToUpper(replacer.Replace(k))
+}
+
+// clean maps the name of an environment variable back onto a key.
+func clean(key string) string {
+	newKey := "/" + key
+	return cleanReplacer.Replace(strings.ToLower(newKey))
+}
+
+// WatchPrefix returns at once on the first call so the keys are rendered,
+// later calls block until stopped, the environment of a process does not
+// change.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-ctx.Done()
+	return waitIndex, nil
+}
+
+// KeepAlive is a no-op, there is no connection to keep alive.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,57 @@
+package env
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetValues(t *testing.T) {
+	t.Setenv("MYAPP_DATABASE_URL", "db.example.com")
+	t.Setenv("MYAPP_DATABASE_USER", "rob")
+	t.Setenv("CONFD_MYAPP_DATABASE_USER", "confd")
+	t.Setenv("CONFD_MYAPP_CACHE_HOST", "127.0.0.1")
+	t.Setenv("OTHERAPP_KEY", "value")
+
+	c, err := NewEnvClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "confd",
+		"/myapp/cache/host":    "127.0.0.1",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	c, _ := NewEnvClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/", []string{"/myapp"}, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/", []string{"/myapp"}, index)
+	if err != nil || index != 1 {
+		t.Fatalf("WatchPrefix() = %d, %v, want 1", index, err)
+	}
+}
@@ -0,0 +1,290 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// etcd answers with this error code when the requested waitIndex was
+// already removed from its event history.
+const errorCodeEventIndexCleared = 401
+
+// node is a key or directory as returned by the etcd v2 keys API.
+type node struct {
+	Key           string  `json:"key"`
+	Value         string  `json:"value"`
+	Dir           bool    `json:"dir"`
+	Nodes         []*node `json:"nodes"`
+	ModifiedIndex uint64  `json:"modifiedIndex"`
+}
+
+// response is the body of a successful etcd v2 keys API request.
+type response struct {
+	Action string `json:"action"`
+	Node   *node  `json:"node"`
+}
+
+// apiError is the body of a failed etcd v2 keys API request.
+type apiError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Index     uint64 `json:"index"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d: %s (%s) [%d]", e.ErrorCode, e.Message, e.Cause, e.Index)
+}
+
+// Client is a wrapper around the etcd v2 keys API.
+type Client struct {
+	client    *http.Client
+	machines  []string
+	basicAuth bool
+	username  string
+	password  string
+}
+
+func init() {
+	backends.Register("etcd", func(config backends.Config) (backends.StoreClient, error) {
+		return NewEtcdClient(config.BackendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.BasicAuth, config.Username, config.Password)
+	})
+}
+
+// NewEtcdClient returns an *etcd.Client with a connection to named machines.
+func NewEtcdClient(machines []string, cert, key, caCert string, basicAuth bool, username string, password string) (*Client, error) {
+	if len(machines) == 0 {
+		return nil, fmt.Errorf("no etcd node given")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+		scheme = "https"
+	}
+
+	c := &Client{
+		client:    &http.Client{Transport: transport},
+		basicAuth: basicAuth,
+		username:  username,
+		password:  password,
+	}
+	for _, m := range machines {
+		if !strings.Contains(m, "://") {
+			m = scheme + "://" + m
+		}
+		c.machines = append(c.machines, strings.TrimRight(m, "/"))
+	}
+	return c, nil
+}
+
+// get requests key from the first machine that answers. It returns the
+// node, nil if the key does not exist, and the X-Etcd-Index of the
+// response.
+func (c *Client) get(ctx context.Context, key string, params url.Values) (*node, uint64, error) {
+	var err error
+	for _, machine := range c.machines {
+		var n *node
+		var index uint64
+		n, index, err = c.getFrom(ctx, machine, key, params)
+		if err == nil {
+			return n, index, nil
+		}
+		if _, ok := err.(*apiError); ok || ctx.Err() != nil {
+			// The cluster answered, asking another member does not help
+			return nil, index, err
+		}
+		log.Debug("etcd node %s failed: %s", machine, err)
+	}
+	return nil, 0, err
+}
+
+func (c *Client) getFrom(ctx context.Context, machine, key string, params url.Values) (*node, uint64, error) {
+	u := fmt.Sprintf("%s/v2/keys/%s?%s", machine, strings.TrimPrefix(key, "/"), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.basicAuth {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var index uint64
+	if h := resp.Header.Get("X-Etcd-Index"); h != "" {
+		index, err = strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid X-Etcd-Index %q: %s", h, err)
+		}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if len(body) == 0 {
+			// A watch closed by the server before anything changed
+			return nil, index, nil
+		}
+		var r response
+		if err := json.Unmarshal(body, &r); err != nil {
+			return nil, 0, fmt.Errorf("invalid response from etcd: %s", err)
+		}
+		return r.Node, index, nil
+	case http.StatusNotFound:
+		// Nothing stored under key yet
+		return nil, index, nil
+	default:
+		e := &apiError{}
+		if err := json.Unmarshal(body, e); err != nil || e.ErrorCode == 0 {
+			return nil, 0, fmt.Errorf("unexpected response from etcd (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, index, e
+	}
+}
+
+// nodeWalk recursively descends nodes, updating vars.
+func nodeWalk(n *node, vars map[string]string) {
+	if n == nil {
+		return
+	}
+	if !n.Dir {
+		vars[n.Key] = n.Value
+		return
+	}
+	for _, child := range n.Nodes {
+		nodeWalk(child, vars)
+	}
+}
+
+// Ping asks the machines in turn for their version, and returns nil once
+// one answers.
+func (c *Client) Ping(ctx context.Context) error {
+	var err error
+	for _, machine := range c.machines {
+		if err = c.pingMachine(ctx, machine); err == nil {
+			return nil
+		}
+		log.Debug("etcd node %s failed: %s", machine, err)
+	}
+	return err
+}
+
+func (c *Client) pingMachine(ctx context.Context, machine string) error {
+	req, err := http.NewRequest("GET", machine+"/version", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.basicAuth {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s/version: %s", machine, resp.Status)
+	}
+	return nil
+}
+
+// GetValues queries etcd for keys prefixed by prefix.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	params := url.Values{}
+	params.Set("recursive", "true")
+	params.Set("sorted", "true")
+	params.Set("quorum", "true")
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		n, _, err := c.get(ctx, key, params)
+		cancel()
+		if err != nil {
+			return vars, err
+		}
+		nodeWalk(n, vars)
+	}
+	return vars, nil
+}
+
+// WatchPrefix waits for a change below prefix to one of keys and returns
+// its index. The first call returns the current X-Etcd-Index, later
+// calls wait for the events after waitIndex, so nothing is missed
+// between two calls.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		_, index, err := c.get(ctx, prefix, url.Values{})
+		if err != nil {
+			return 0, err
+		}
+		// return something > 0 to trigger a key retrieval from the store
+		if index == 0 {
+			index = 1
+		}
+		return index, nil
+	}
+
+	for {
+		params := url.Values{}
+		params.Set("wait", "true")
+		params.Set("recursive", "true")
+		params.Set("waitIndex", strconv.FormatUint(waitIndex+1, 10))
+		n, _, err := c.get(ctx, prefix, params)
+		if ctx.Err() != nil {
+			// Stopped
+			return waitIndex, nil
+		}
+		if e, ok := err.(*apiError); ok && e.ErrorCode == errorCodeEventIndexCleared {
+			// The events since waitIndex are gone, render what is there
+			// now and continue from the current index.
+			log.Debug("etcd events after %d were cleared, resuming at %d", waitIndex, e.Index)
+			return e.Index, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if n == nil {
+			// The watch timed out
+			continue
+		}
+
+		// Only return if the event is for a key we care about, the
+		// prefix being watched may cover many more.
+		for _, k := range keys {
+			if strings.HasPrefix(n.Key, k) {
+				return n.ModifiedIndex, nil
+			}
+		}
+		waitIndex = n.ModifiedIndex
+	}
+}
+
+// KeepAlive is a no-op, every etcd request uses its own HTTP round trip.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,240 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+type event struct {
+	key   string
+	value string
+	index uint64
+}
+
+// fakeEtcd emulates the etcd v2 keys API. Only the events after
+// firstEvent are kept in the history.
+type fakeEtcd struct {
+	mu         sync.Mutex
+	index      uint64
+	firstEvent uint64
+	pairs      map[string]string
+	events     []event
+	changed    chan struct{}
+	auth       string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		index:   1,
+		pairs:   make(map[string]string),
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeEtcd) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	f.pairs[key] = value
+	f.events = append(f.events, event{key, value, f.index})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// tree returns the node for key with all nodes below it.
+func (f *fakeEtcd) tree(key string) map[string]interface{} {
+	if v, ok := f.pairs[key]; ok {
+		return map[string]interface{}{"key": key, "value": v}
+	}
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	children := make(map[string]bool)
+	for k := range f.pairs {
+		if strings.HasPrefix(k, prefix) {
+			rest := strings.TrimPrefix(k, prefix)
+			children[prefix+strings.SplitN(rest, "/", 2)[0]] = true
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	var names []string
+	for c := range children {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	var nodes []interface{}
+	for _, c := range names {
+		nodes = append(nodes, f.tree(c))
+	}
+	return map[string]interface{}{"key": key, "dir": true, "nodes": nodes}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	if user, pass, ok := r.BasicAuth(); ok {
+		f.auth = user + ":" + pass
+	}
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+
+	if q.Get("wait") == "true" {
+		waitIndex, _ := strconv.ParseUint(q.Get("waitIndex"), 10, 64)
+		if waitIndex <= f.firstEvent {
+			f.mu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errorCode": 401, "message": "The event in requested index is outdated and cleared",
+				"index": f.index,
+			})
+			return
+		}
+		for {
+			for _, e := range f.events {
+				if e.index >= waitIndex && strings.HasPrefix(e.key, key) {
+					f.mu.Unlock()
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"action": "set",
+						"node":   map[string]interface{}{"key": e.key, "value": e.value, "modifiedIndex": e.index},
+					})
+					return
+				}
+			}
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+		}
+	}
+
+	defer f.mu.Unlock()
+	n := f.tree(key)
+	if n == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errorCode": 100, "message": "Key not found", "cause": key, "index": f.index,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"action": "get", "node": n})
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeEtcd()
+	f.set("/key", "foobar")
+	f.set("/database/host", "127.0.0.1")
+	f.set("/database/port", "3306")
+	f.set("/nested/east/app1", "10.0.1.10:8080")
+	f.set("/other", "value")
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	// The first node is down, the client fails over to the second one
+	c, err := NewEtcdClient([]string{"127.0.0.1:1", ts.URL}, "", "", "", true, "confd", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/nested", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":              "foobar",
+		"/database/host":    "127.0.0.1",
+		"/database/port":    "3306",
+		"/nested/east/app1": "10.0.1.10:8080",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+	if f.auth != "confd:secret" {
+		t.Errorf("basic auth = %q, want %q", f.auth, "confd:secret")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeEtcd()
+	f.set("/app/key", "foo")
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewEtcdClient([]string{ts.URL}, "", "", "", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app/key"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 2 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 2", index, err)
+	}
+
+	// Changes made while nobody watches are not missed
+	f.set("/app/other", "ignored")
+	f.set("/app/key", "bar")
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 4 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 4", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("/app/key", "baz")
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 5 {
+		t.Fatalf("WatchPrefix() after later change = %d, %v, want 5", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 5 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 5", index, err)
+	}
+}
+
+func TestWatchPrefixEventIndexCleared(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeEtcd()
+	f.set("/app/key", "foo")
+	f.set("/app/key", "bar")
+	f.firstEvent = 3
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewEtcdClient([]string{ts.URL}, "", "", "", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := c.WatchPrefix(context.Background(), "/app", []string{"/app"}, 1)
+	if err != nil || index != 3 {
+		t.Fatalf("WatchPrefix() = %d, %v, want the current index 3", index, err)
+	}
+}
@@ -0,0 +1,139 @@
+package etcdv3
+
+import (
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/zyf0330/confd/log"
+	"golang.org/x/net/context"
+)
+
+// tokenAuth hands etcd the token of the user with every request, watches
+// included, and asks etcd for a new one when told, e.g. once it expired.
+// clientv3 authenticates again on an invalid token by itself, but neither
+// on an old revision of the auth rules nor for the watches.
+type tokenAuth struct {
+	// The settings to connect to etcd with to authenticate
+	cfg clientv3.Config
+	// Reads the username and password again before authenticating again,
+	// if not nil, e.g. from files rotated since
+	reload func() (string, string, error)
+
+	mu                 sync.Mutex
+	username, password string
+	token              string
+}
+
+func (a *tokenAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == "" {
+		// Auth is not enabled
+		return nil, nil
+	}
+	return map[string]string{rpctypes.TokenFieldNameGRPC: a.token}, nil
+}
+
+func (a *tokenAuth) RequireTransportSecurity() bool {
+	return false
+}
+
+// authenticate asks etcd at endpoints for a new token, on a connection of
+// its own which does not send the expired one.
+func (a *tokenAuth) authenticate(ctx context.Context, endpoints []string) error {
+	if a.cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.cfg.DialTimeout)
+		defer cancel()
+	}
+	cfg := a.cfg
+	cfg.Endpoints = endpoints
+	cfg.AutoSyncInterval = 0
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	username, password := a.user()
+	resp, err := pb.NewAuthClient(client.ActiveConnection()).Authenticate(ctx,
+		&pb.AuthenticateRequest{Name: username, Password: password})
+	if rpctypes.Error(err) == rpctypes.ErrAuthNotEnabled {
+		resp, err = &pb.AuthenticateResponse{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.token = resp.Token
+	a.mu.Unlock()
+	return nil
+}
+
+// errAuthOldRevision is the error of etcd 3.4 and later on a token older
+// than the auth rules, which the rpctypes of clientv3 3.3 lack.
+const errAuthOldRevision = "etcdserver: revision of auth store is old"
+
+// user returns the username and password to authenticate with.
+func (a *tokenAuth) user() (string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.username, a.password
+}
+
+// isAuthError reports whether err tells the token of the client is no
+// longer valid. On an invalid token, clientv3, which does not know the
+// user, fails to authenticate again with ErrAuthFailed.
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrInvalidAuthToken, rpctypes.ErrAuthFailed:
+		return true
+	}
+	return rpctypes.ErrorDesc(err) == errAuthOldRevision
+}
+
+// authenticate asks etcd for a new token, if the client authenticates, and
+// reports whether it got one.
+func (c *Client) authenticate(ctx context.Context, reason error) bool {
+	if c.auth == nil {
+		return false
+	}
+	log.Warning("The etcd auth token is no longer valid (%s), authenticating again", reason)
+	if c.auth.reload != nil {
+		username, password, err := c.auth.reload()
+		if err != nil {
+			log.Error("Cannot read the etcd credentials again: %s", err)
+		} else {
+			c.auth.mu.Lock()
+			c.auth.username, c.auth.password = username, password
+			c.auth.mu.Unlock()
+		}
+	}
+	if err := c.auth.authenticate(ctx, c.client.Endpoints()); err != nil {
+		log.Error("Cannot authenticate to etcd again: %s", err)
+		return false
+	}
+	return true
+}
+
+// ReloadCredentials makes the client read its username and password again
+// with reload whenever it authenticates again, e.g. from files rotated
+// since it started.
+func (c *Client) ReloadCredentials(reload func() (string, string, error)) {
+	if c.auth != nil {
+		c.auth.reload = reload
+	}
+}
+
+// username returns the user the client authenticates as, if any.
+func (c *Client) username() string {
+	if c.auth == nil {
+		return ""
+	}
+	username, _ := c.auth.user()
+	return username
+}
@@ -1,16 +1,23 @@
 package etcdv3
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"fmt"
 	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/zyf0330/confd/backends"
 	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 	"sync"
 )
 
@@ -56,12 +63,17 @@ func (w *Watch) update(newRevision int64) {
 	w.cond = make(chan struct{})
 }
 
-func createWatch(client *clientv3.Client, prefix string, doneChan chan bool) (*Watch, error) {
+// createWatch watches prefix until the client is closed. If the watch is
+// denied, it calls reauth to authenticate again, then stop if that fails
+// or the watch is denied again.
+func createWatch(client *clientv3.Client, prefix string, reauth func(error) bool, stop func()) (*Watch, error) {
 	w := &Watch{0, make(chan struct{}), sync.RWMutex{}}
 	go func() {
 		rch := client.Watch(context.Background(), prefix, clientv3.WithPrefix(),
 			clientv3.WithCreatedNotify())
 		log.Debug("Watch created on %s", prefix)
+		// Whether confd authenticated again since the last response
+		reauthed := false
 		for {
 			for wresp := range rch {
 				if wresp.CompactRevision > w.revision {
@@ -73,13 +85,21 @@ func createWatch(client *clientv3.Client, prefix string, doneChan chan bool) (*W
 					w.update(wresp.Header.GetRevision())
 					log.Debug("Watch to '%s' updated to %d by header revision", prefix, wresp.Header.GetRevision())
 				}
-				if err := wresp.Err(); err != nil {
-					log.Error("Watch error: %s", err.Error())
-					if err.Error() == "rpc error: code = PermissionDenied desc = etcdserver: permission denied" {
-						doneChan <- false
-						close(doneChan)
+				err := wresp.Err()
+				if err == nil {
+					reauthed = false
+					continue
+				}
+				log.Error("Watch error: %s", err.Error())
+				if rpctypes.Error(err) == rpctypes.ErrPermissionDenied || isAuthError(err) ||
+					err.Error() == "rpc error: code = PermissionDenied desc = etcdserver: permission denied" {
+					// The token may have expired since the watch started,
+					// then watch again from the last seen revision
+					if reauthed || !reauth(err) {
+						stop()
 						return
 					}
+					reauthed = true
 				}
 			}
 			log.Warning("Watch to '%s' stopped at revision %d", prefix, w.revision)
@@ -103,107 +123,318 @@ func createWatch(client *clientv3.Client, prefix string, doneChan chan bool) (*W
 
 // Client is a wrapper around the etcd client
 type Client struct {
-	client  *clientv3.Client
+	client *clientv3.Client
+	// The token of the user, nil without -basic-auth
+	auth    *tokenAuth
 	watches map[string]*Watch
 	// Protect watch
 	wm sync.Mutex
+	// How long a request of GetValues may take
+	requestTimeout time.Duration
+	// How many keys a request of GetValues reads at most, 0 for no limit
+	pageSize int64
+	// How often KeepAlive asks etcd, and how long etcd may take to answer
+	keepaliveTime, keepaliveTimeout time.Duration
+	// The nodes to use in order, nil to use them all in turn
+	ordered *orderedEndpoints
+	// The doneChan given to KeepAlive, told once the client cannot go on
+	dm       sync.Mutex
+	doneChan chan bool
+	stopOnce sync.Once
 }
 
-// NewEtcdClient returns an *etcdv3.Client with a connection to named machines.
-func NewEtcdClient(machines []string, cert, key, caCert string, basicAuth bool, username string, password string) (*Client, error) {
+func init() {
+	backends.Register("etcdv3", func(config backends.Config) (backends.StoreClient, error) {
+		tlsOptions, err := config.TLSOptions()
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewEtcdClient(config.BackendNodes, Options{
+			Cert:             config.ClientCert,
+			Key:              config.ClientKey,
+			CACert:           config.ClientCaKeys,
+			TLS:              tlsOptions,
+			BasicAuth:        config.BasicAuth,
+			Username:         config.Username,
+			Password:         config.Password,
+			DialTimeout:      time.Duration(config.DialTimeout) * time.Second,
+			RequestTimeout:   time.Duration(config.RequestTimeout) * time.Second,
+			KeepaliveTime:    time.Duration(config.KeepaliveTime) * time.Second,
+			KeepaliveTimeout: time.Duration(config.KeepaliveTimeout) * time.Second,
+			AutoSyncInterval: time.Duration(config.AutoSyncInterval) * time.Second,
+			Namespace:        config.EtcdNamespace,
+			PageSize:         config.EtcdPageSize,
+			MaxRecvMsgSize:   config.EtcdMaxRecvMsgSize,
+			MaxSendMsgSize:   config.EtcdMaxSendMsgSize,
+			Ordered:          config.EndpointOrdering == "ordered",
+		})
+		if err != nil {
+			return nil, err
+		}
+		if reload := config.CredentialsReader(); reload != nil {
+			client.ReloadCredentials(reload)
+		}
+		return client, nil
+	})
+}
+
+// Options are the settings of a Client, those left zero taking the
+// defaults of clientv3.
+type Options struct {
+	// The client certificate and key, and the CA certificates to verify
+	// etcd with, the TLS connections having the settings of TLS
+	Cert, Key, CACert string
+	TLS               util.TLSOptions
+	// Whether to authenticate as Username with Password
+	BasicAuth          bool
+	Username, Password string
+	// How long connecting may take, also when the watches reconnect
+	DialTimeout time.Duration
+	// How long a request of GetValues may take
+	RequestTimeout time.Duration
+	// After KeepaliveTime without traffic, the connection is pinged, and
+	// it is deemed lost if the answer does not come within
+	// KeepaliveTimeout, the client reconnecting
+	KeepaliveTime, KeepaliveTimeout time.Duration
+	// Every AutoSyncInterval, if not 0, the client asks etcd for its
+	// members and connects to them from then on, following the cluster as
+	// it changes
+	AutoSyncInterval time.Duration
+	// If not empty, the keys of the client are those below Namespace in
+	// etcd, e.g. /myapp/db for /tenants/team-a/myapp/db with Namespace
+	// /tenants/team-a
+	Namespace string
+	// How many keys of a prefix a request of GetValues reads, if not 0,
+	// paging through the others at the same revision
+	PageSize int
+	// The largest messages to and from etcd, in bytes, if not 0
+	MaxRecvMsgSize, MaxSendMsgSize int
+	// Whether to use the first of the machines which answers rather than
+	// all of them in turn, checking them every healthCheckInterval
+	Ordered bool
+}
+
+// NewEtcdClient returns an *etcdv3.Client with a connection to named
+// machines, with the settings of opts. A failed GetValues is not retried,
+// the backends package wraps the client to retry the transient failures.
+func NewEtcdClient(machines []string, opts Options) (*Client, error) {
 	cfg := clientv3.Config{
 		Endpoints:            machines,
-		DialTimeout:          10 * time.Second,
-		DialKeepAliveTime:    10 * time.Second,
-		DialKeepAliveTimeout: 4 * time.Second,
+		AutoSyncInterval:     opts.AutoSyncInterval,
+		MaxCallRecvMsgSize:   opts.MaxRecvMsgSize,
+		MaxCallSendMsgSize:   opts.MaxSendMsgSize,
+		DialTimeout:          opts.DialTimeout,
+		DialKeepAliveTime:    opts.KeepaliveTime,
+		DialKeepAliveTimeout: opts.KeepaliveTimeout,
 		PermitWithoutStream:  true,
 	}
 
-	if basicAuth {
-		cfg.Username = username
-		cfg.Password = password
+	// The certificates are rotated without restarting confd, the next
+	// connection or watch reconnecting presenting the new one
+	tlsOptions := opts.TLS
+	tlsOptions.ReloadClientCert = true
+	tlsConfig, err := util.NewTLSConfigWithOptions(opts.Cert, opts.Key, opts.CACert, tlsOptions)
+	if err != nil {
+		return &Client{}, err
 	}
-
-	tlsEnabled := false
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: false,
+	if tlsConfig != nil {
+		cfg.TLS = tlsConfig
 	}
 
-	if caCert != "" {
-		certBytes, err := ioutil.ReadFile(caCert)
-		if err != nil {
+	// confd authenticates, rather than clientv3, to authenticate again
+	// whenever the token is no longer valid
+	var auth *tokenAuth
+	if opts.BasicAuth {
+		auth = &tokenAuth{username: opts.Username, password: opts.Password, cfg: cfg}
+		if err := auth.authenticate(context.Background(), machines); err != nil {
 			return &Client{}, err
 		}
+		cfg.DialOptions = append(cfg.DialOptions, grpc.WithPerRPCCredentials(auth))
+	}
+
+	if opts.Ordered && len(machines) > 1 {
+		// Start with the first node, then the first which answers
+		cfg.Endpoints = machines[:1]
+	}
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return &Client{}, err
+	}
+	if ns := strings.TrimRight(opts.Namespace, "/"); ns != "" {
+		client.KV = namespace.NewKV(client.KV, ns)
+		client.Watcher = namespace.NewWatcher(client.Watcher, ns)
+		client.Lease = namespace.NewLease(client.Lease, ns)
+	}
 
-		caCertPool := x509.NewCertPool()
-		ok := caCertPool.AppendCertsFromPEM(certBytes)
+	go logConnection(client)
+	if opts.AutoSyncInterval > 0 {
+		go logEndpoints(client, opts.AutoSyncInterval)
+	}
+	c := &Client{
+		client:           client,
+		auth:             auth,
+		watches:          make(map[string]*Watch),
+		requestTimeout:   opts.RequestTimeout,
+		pageSize:         int64(opts.PageSize),
+		keepaliveTime:    opts.KeepaliveTime,
+		keepaliveTimeout: opts.KeepaliveTimeout,
+	}
+	if opts.Ordered && len(machines) > 1 {
+		c.ordered = &orderedEndpoints{nodes: machines, pinned: machines[0], check: make(chan struct{}, 1)}
+		go c.pinEndpoints()
+	}
+	return c, nil
+}
 
-		if ok {
-			tlsConfig.RootCAs = caCertPool
+// logConnection logs when the connection of client is lost, e.g. once
+// etcd does not answer the keepalive pings, and when it is back, until
+// client is closed. The watches resume from their last revision once it is.
+func logConnection(client *clientv3.Client) {
+	conn := client.ActiveConnection()
+	state := conn.GetState()
+	// Whether the connection was ready once, and has been lost since
+	connected, lost := state == connectivity.Ready, false
+	for conn.WaitForStateChange(client.Ctx(), state) {
+		state = conn.GetState()
+		switch {
+		case state == connectivity.Ready:
+			if lost {
+				log.Info("Reconnected to etcd, resuming the watches")
+			}
+			connected, lost = true, false
+		case state != connectivity.Shutdown && connected && !lost:
+			log.Warning("Connection to etcd lost (%s), reconnecting", state)
+			lost = true
 		}
-		tlsEnabled = true
 	}
+}
 
-	if cert != "" && key != "" {
-		tlsCert, err := tls.LoadX509KeyPair(cert, key)
-		if err != nil {
-			return &Client{}, err
+// logEndpoints logs the endpoints of client when they changed, checking
+// every interval until client is closed.
+func logEndpoints(client *clientv3.Client, interval time.Duration) {
+	endpoints := strings.Join(client.Endpoints(), ", ")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-client.Ctx().Done():
+			return
+		}
+		if e := strings.Join(client.Endpoints(), ", "); e != endpoints {
+			log.Info("etcd endpoints set to %s from the members of the cluster", e)
+			endpoints = e
 		}
-		tlsConfig.Certificates = []tls.Certificate{tlsCert}
-		tlsEnabled = true
 	}
+}
 
-	if tlsEnabled {
-		cfg.TLS = tlsConfig
+// Ping asks the status of the endpoints in turn, and returns nil once one
+// answers.
+func (c *Client) Ping(ctx context.Context) error {
+	var err error
+	for _, endpoint := range c.nodes() {
+		if _, err = c.client.Status(ctx, endpoint); err == nil {
+			return nil
+		}
+		log.Debug("etcd endpoint %s failed: %s", endpoint, err)
 	}
+	return err
+}
 
-	client, err := clientv3.New(cfg)
+// SetNodes makes the client connect to nodes from now on, e.g. once the
+// SRV record listing them changed.
+func (c *Client) SetNodes(nodes []string) error {
+	if c.ordered == nil {
+		c.client.SetEndpoints(nodes...)
+		return nil
+	}
+	c.ordered.mu.Lock()
+	c.ordered.nodes = nodes
+	c.ordered.mu.Unlock()
+	c.checkNow()
+	return nil
+}
+
+// GetValues queries etcd for keys prefixed by prefix, authenticating again
+// once if the token is no longer valid.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars, err := c.getValues(ctx, keys)
+	if isAuthError(err) && c.authenticate(ctx, err) {
+		vars, err = c.getValues(ctx, keys)
+	}
 	if err != nil {
-		return &Client{}, err
+		// The node in use may be down
+		c.checkNow()
 	}
+	return vars, msgSizeError(err)
+}
 
-	return &Client{client, make(map[string]*Watch), sync.Mutex{}}, nil
+// msgSizeError tells which flag raises the limit err is about, if it is
+// that of the size of a message.
+func msgSizeError(err error) error {
+	if status.Code(err) != codes.ResourceExhausted {
+		return err
+	}
+	switch msg := status.Convert(err).Message(); {
+	case strings.Contains(msg, "received message larger than max"):
+		return fmt.Errorf("%w, raise -etcd-max-recv-msg-size or lower -etcd-page-size", err)
+	case strings.Contains(msg, "trying to send message larger than max"):
+		return fmt.Errorf("%w, raise -etcd-max-send-msg-size", err)
+	}
+	return err
 }
 
-// GetValues queries etcd for keys prefixed by prefix.
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+func (c *Client) getValues(ctx context.Context, keys []string) (map[string]string, error) {
 	// Use all operations on the same revision
 	var first_rev int64 = 0
 	vars := make(map[string]string)
+	addKvs := func(originKey string, kvs []*mvccpb.KeyValue) {
+		for _, ev := range kvs {
+			k := string(ev.Key)
+			if k == originKey || strings.HasPrefix(k, originKey) {
+				vars[string(ev.Key)] = string(ev.Value)
+			}
+		}
+	}
 	// Default ETCDv3 TXN limitation. Since it is configurable from v3.3,
 	// maybe an option should be added (also set max-txn=0 can disable Txn?)
 	maxTxnOps := 128
 	getOps := make([]string, 0, maxTxnOps)
 	doTxn := func(ops []string) error {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-
 		txnOps := make([]clientv3.Op, 0, maxTxnOps)
 
 		for _, k := range ops {
 			txnOps = append(txnOps, clientv3.OpGet(k,
 				clientv3.WithPrefix(),
-				clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+				clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+				clientv3.WithLimit(c.pageSize),
 				clientv3.WithRev(first_rev)))
 		}
 
-		result, err := c.client.Txn(ctx).Then(txnOps...).Commit()
+		txnCtx, cancel := c.requestContext(ctx)
+		result, err := c.client.Txn(txnCtx).Then(txnOps...).Commit()
+		cancel()
 		if err != nil {
 			return err
 		}
+		if first_rev == 0 {
+			// Save the revison of the first request
+			first_rev = result.Header.GetRevision()
+		}
 		for i, r := range result.Responses {
 			originKey := ops[i]
-			for _, ev := range r.GetResponseRange().Kvs {
-				k := string(ev.Key)
-				if k == originKey || strings.HasPrefix(k, originKey) {
-					vars[string(ev.Key)] = string(ev.Value)
+			kvs, more := r.GetResponseRange().Kvs, r.GetResponseRange().More
+			addKvs(originKey, kvs)
+			// Read the next pages after the last key read
+			for more && len(kvs) > 0 {
+				resp, err := c.getPage(ctx, originKey, string(kvs[len(kvs)-1].Key), first_rev)
+				if err != nil {
+					return err
 				}
+				kvs, more = resp.Kvs, resp.More
+				addKvs(originKey, kvs)
 			}
 		}
-		if first_rev == 0 {
-			// Save the revison of the first request
-			first_rev = result.Header.GetRevision()
-		}
 		return nil
 	}
 	for _, key := range keys {
@@ -223,7 +454,32 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	return vars, nil
 }
 
-func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool, doneChan chan bool) (uint64, error) {
+// getPage reads the page of the keys of prefix following the key after, at
+// revision rev.
+func (c *Client) getPage(ctx context.Context, prefix, after string, rev int64) (*clientv3.GetResponse, error) {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		// Every key from the next one
+		end = "\x00"
+	}
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+	return c.client.Get(ctx, after+"\x00",
+		clientv3.WithRange(end),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithLimit(c.pageSize),
+		clientv3.WithRev(rev))
+}
+
+// requestContext returns ctx limited to the request timeout of the client.
+func (c *Client) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.requestTimeout > 0 {
+		return context.WithTimeout(ctx, c.requestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
 	var err error
 
 	// Create watch for each key
@@ -232,7 +488,9 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 	for _, k := range keys {
 		watch, ok := c.watches[k]
 		if !ok {
-			watch, err = createWatch(c.client, k, doneChan)
+			watch, err = createWatch(c.client, k, func(err error) bool {
+				return c.authenticate(context.Background(), err)
+			}, c.stop)
 			if err != nil {
 				c.wm.Unlock()
 				return 0, err
@@ -243,7 +501,7 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 	}
 	c.wm.Unlock()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	notify := make(chan int64)
@@ -264,29 +522,61 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, sto
 		case nextRevision = <-notify:
 			continue
 		case <-ctx.Done():
-			return 0, ctx.Err()
+			return waitIndex, nil
 		}
 	}
+}
 
-	return 0, err
+// stop tells the doneChan given to KeepAlive that the client cannot go on,
+// once.
+func (c *Client) stop() {
+	c.stopOnce.Do(func() {
+		c.dm.Lock()
+		doneChan := c.doneChan
+		c.dm.Unlock()
+		if doneChan == nil {
+			return
+		}
+		doneChan <- false
+		close(doneChan)
+	})
 }
 
 // 手动保活
+// KeepAlive asks etcd for the user of the client every keepaliveTime, and
+// tells doneChan the client cannot go on once etcd does not answer within
+// keepaliveTimeout. With a keepaliveTime of 0, etcd is not asked.
 func (c *Client) KeepAlive(doneChan chan bool) {
+	c.dm.Lock()
+	c.doneChan = doneChan
+	c.dm.Unlock()
+	if c.keepaliveTime <= 0 {
+		return
+	}
 	log.Info("Start KeepAlive")
-	etcdClient := c.client
-	// interval and timeout value are same as etcd client grpc options
-	for {
-		select {
-		case <-time.After(10 * time.Second):
-			ctx, _ := context.WithTimeout(context.Background(), 4*time.Second)
-
-			if _, err := etcdClient.UserGet(ctx, etcdClient.Username); err != nil {
-				log.Error("KeepAlive By UserGet error: %s", err)
-				doneChan <- false
-				close(doneChan)
-				return
-			}
+	ticker := time.NewTicker(c.keepaliveTime)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.userGet(); err != nil {
+			log.Error("KeepAlive By UserGet error: %s", err)
+			c.stop()
+			return
 		}
 	}
 }
+
+// userGet asks etcd for the user of the client within keepaliveTimeout,
+// authenticating again if the token is no longer valid.
+func (c *Client) userGet() error {
+	ctx := context.Background()
+	if c.keepaliveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.keepaliveTimeout)
+		defer cancel()
+	}
+	_, err := c.client.UserGet(ctx, c.username())
+	if isAuthError(err) && c.authenticate(ctx, err) {
+		_, err = c.client.UserGet(ctx, c.username())
+	}
+	return err
+}
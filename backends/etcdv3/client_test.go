@@ -0,0 +1,723 @@
+package etcdv3
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestGetValuesRequestTimeout(t *testing.T) {
+	// A node accepting connections but never answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c, err := NewEtcdClient([]string{l.Addr().String()}, Options{DialTimeout: 200 * time.Millisecond, RequestTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+	start := time.Now()
+	if _, err := c.GetValues(context.Background(), []string{"/key"}); err == nil {
+		t.Fatal("GetValues() from a node which never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetValues() gave up after %s, want the 200ms request timeout", elapsed)
+	}
+}
+
+func TestRegisterRetries(t *testing.T) {
+	// -retry-max is that of the only retrying client of etcdv3, unless
+	// -backend-retries is set
+	tests := []struct {
+		retryMax, backendRetries int
+		retrying                 bool
+	}{
+		{0, 0, false},
+		{3, 0, true},
+		{3, 2, true},
+	}
+	for _, tt := range tests {
+		c, err := backends.New(backends.Config{Backend: "etcdv3", BackendNodes: []string{"127.0.0.1:1"},
+			DialTimeout: 1, RetryMax: tt.retryMax, BackendRetries: tt.backendRetries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.(*retry.Client); ok != tt.retrying {
+			t.Errorf("New() of etcdv3 with -retry-max %d and -backend-retries %d = %T, want a *retry.Client: %v",
+				tt.retryMax, tt.backendRetries, c, tt.retrying)
+		}
+	}
+}
+
+func TestSetNodes(t *testing.T) {
+	c, err := NewEtcdClient([]string{"127.0.0.1:1"}, Options{DialTimeout: 200 * time.Millisecond, RequestTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+	nodes := []string{"127.0.0.1:2", "127.0.0.1:3"}
+	if err := c.SetNodes(nodes); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.client.Endpoints(); !reflect.DeepEqual(got, nodes) {
+		t.Errorf("endpoints after SetNodes() = %q, want %q", got, nodes)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	c, err := NewEtcdClient([]string{"127.0.0.1:1"}, Options{DialTimeout: 200 * time.Millisecond,
+		KeepaliveTime: 50 * time.Millisecond, KeepaliveTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+	doneChan := make(chan bool)
+	go c.KeepAlive(doneChan)
+	select {
+	case done := <-doneChan:
+		if done {
+			t.Error("KeepAlive() told true, want false")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("KeepAlive() did not tell etcd is unreachable after the keepalive time and timeout")
+	}
+}
+
+// fakeEtcd is an etcd server only serving watches, every watch seeing
+// every put, the list of members, reads of kvs in transactions, and the
+// authentication of the user "confd" once it has a password.
+type fakeEtcd struct {
+	pb.UnimplementedAuthServer
+	pb.UnimplementedClusterServer
+	pb.UnimplementedKVServer
+	pb.UnimplementedMaintenanceServer
+	server *grpc.Server
+
+	mu      sync.Mutex
+	members []string
+	kvs     map[string]string
+	// The keys of kvs in order, once read
+	sorted []string
+	// The password of confd, without which auth is not enabled, and the
+	// number of requests a token is valid for, 0 for ever
+	password      string
+	tokenRequests int
+	token         string
+	tokenUses     int
+	// The tokens issued
+	authenticated int
+	// The keys read and watched, and the revisions of the pages read after
+	// the first one
+	read     []string
+	pages    []int64
+	watched  []string
+	rev      int64
+	events   []*mvccpb.Event
+	watchers map[pb.Watch_WatchServer][]int64
+	// The watches created, resumed ones included
+	created int
+}
+
+func newFakeEtcd(t testing.TB) (*fakeEtcd, string) {
+	t.Helper()
+	return newFakeEtcdAt(t, "127.0.0.1:0")
+}
+
+// newFakeEtcdAt starts a fakeEtcd at addr, e.g. that of one stopped.
+func newFakeEtcdAt(t testing.TB, addr string) (*fakeEtcd, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeEtcd{rev: 1, watchers: make(map[pb.Watch_WatchServer][]int64)}
+	f.server = grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: time.Second, PermitWithoutStream: true}))
+	pb.RegisterWatchServer(f.server, f)
+	pb.RegisterClusterServer(f.server, f)
+	pb.RegisterKVServer(f.server, f)
+	pb.RegisterAuthServer(f.server, f)
+	pb.RegisterMaintenanceServer(f.server, f)
+	go f.server.Serve(l)
+	t.Cleanup(f.server.Stop)
+	return f, l.Addr().String()
+}
+
+func (f *fakeEtcd) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.password == "" {
+		return nil, rpctypes.ErrGRPCAuthNotEnabled
+	}
+	if req.Name != "confd" || req.Password != f.password {
+		return nil, rpctypes.ErrGRPCAuthFailed
+	}
+	f.authenticated++
+	f.token = fmt.Sprintf("token-%d", f.authenticated)
+	f.tokenUses = 0
+	return &pb.AuthenticateResponse{Header: &pb.ResponseHeader{Revision: f.rev}, Token: f.token}, nil
+}
+
+// validToken reports whether the request of ctx has a valid token, if auth
+// is enabled, counting it as one more use of the token. f.mu must be held.
+func (f *fakeEtcd) validToken(ctx context.Context) bool {
+	if f.password == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(rpctypes.TokenFieldNameGRPC)
+	if len(tokens) == 0 || tokens[0] != f.token || f.token == "" {
+		return false
+	}
+	f.tokenUses++
+	return f.tokenRequests == 0 || f.tokenUses <= f.tokenRequests
+}
+
+// expire invalidates the token, and cancels the watches, as a restart of
+// etcd does.
+func (f *fakeEtcd) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = ""
+	for stream, ids := range f.watchers {
+		for _, id := range ids {
+			stream.Send(&pb.WatchResponse{Header: &pb.ResponseHeader{Revision: f.rev}, WatchId: id, Canceled: true})
+		}
+		delete(f.watchers, stream)
+	}
+}
+
+func (f *fakeEtcd) Status(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.StatusResponse{Header: &pb.ResponseHeader{Revision: f.rev}, Version: "3.3.25"}, nil
+}
+
+func (f *fakeEtcd) MemberList(ctx context.Context, req *pb.MemberListRequest) (*pb.MemberListResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &pb.MemberListResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	for i, m := range f.members {
+		resp.Members = append(resp.Members, &pb.Member{ID: uint64(i + 1), ClientURLs: []string{m}})
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Watch(stream pb.Watch_WatchServer) error {
+	defer func() {
+		f.mu.Lock()
+		delete(f.watchers, stream)
+		f.mu.Unlock()
+	}()
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		create := req.GetCreateRequest()
+		if create == nil {
+			continue
+		}
+		f.mu.Lock()
+		f.watched = append(f.watched, string(create.Key))
+		if !f.validToken(stream.Context()) {
+			stream.Send(&pb.WatchResponse{Header: &pb.ResponseHeader{Revision: f.rev}, WatchId: -1,
+				Created: true, Canceled: true, CancelReason: rpctypes.ErrGRPCPermissionDenied.Error()})
+			f.mu.Unlock()
+			continue
+		}
+		id := int64(len(f.watchers[stream]))
+		f.watchers[stream] = append(f.watchers[stream], id)
+		f.created++
+		header := &pb.ResponseHeader{Revision: f.rev}
+		var missed []*mvccpb.Event
+		for _, e := range f.events {
+			if create.StartRevision > 0 && e.Kv.ModRevision >= create.StartRevision {
+				missed = append(missed, e)
+			}
+		}
+		stream.Send(&pb.WatchResponse{Header: header, WatchId: id, Created: true})
+		if len(missed) > 0 {
+			stream.Send(&pb.WatchResponse{Header: header, WatchId: id, Events: missed})
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.validToken(ctx) {
+		return nil, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	resp := &pb.TxnResponse{Header: &pb.ResponseHeader{Revision: f.rev}, Succeeded: true}
+	for _, op := range req.Success {
+		r := op.GetRequestRange()
+		f.read = append(f.read, string(r.Key))
+		resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: f.rangeKvs(r)}})
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Range(ctx context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.validToken(ctx) {
+		return nil, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	f.pages = append(f.pages, req.Revision)
+	return f.rangeKvs(req), nil
+}
+
+// rangeKvs reads the kvs of r in the order of their keys, up to its limit.
+// f.mu must be held.
+func (f *fakeEtcd) rangeKvs(r *pb.RangeRequest) *pb.RangeResponse {
+	if f.sorted == nil {
+		for k := range f.kvs {
+			f.sorted = append(f.sorted, k)
+		}
+		sort.Strings(f.sorted)
+	}
+	keys := f.sorted[sort.SearchStrings(f.sorted, string(r.Key)):]
+	if end := string(r.RangeEnd); end != "\x00" {
+		keys = keys[:sort.SearchStrings(keys, end)]
+	}
+	resp := &pb.RangeResponse{Header: &pb.ResponseHeader{Revision: f.rev}, Count: int64(len(keys))}
+	if r.Limit > 0 && int64(len(keys)) > r.Limit {
+		keys, resp.More = keys[:r.Limit], true
+	}
+	for _, k := range keys {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(f.kvs[k])})
+	}
+	return resp
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rev++
+	e := &mvccpb.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), CreateRevision: f.rev, ModRevision: f.rev, Version: 1}}
+	f.events = append(f.events, e)
+	for stream, ids := range f.watchers {
+		for _, id := range ids {
+			stream.Send(&pb.WatchResponse{Header: &pb.ResponseHeader{Revision: f.rev}, WatchId: id, Events: []*mvccpb.Event{e}})
+		}
+	}
+}
+
+func (f *fakeEtcd) watches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.created
+}
+
+// blackholeProxy forwards the connections to addr, until blackhole makes
+// those open drop any traffic, as a firewall dropping them silently does.
+type blackholeProxy struct {
+	mu      sync.Mutex
+	dropped []*int32
+}
+
+func newBlackholeProxy(t *testing.T, addr string) (*blackholeProxy, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &blackholeProxy{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			dropped := new(int32)
+			p.mu.Lock()
+			p.dropped = append(p.dropped, dropped)
+			p.mu.Unlock()
+			go p.pipe(conn, backend, dropped)
+			go p.pipe(backend, conn, dropped)
+		}
+	}()
+	return p, l.Addr().String()
+}
+
+func (p *blackholeProxy) pipe(dst, src net.Conn, dropped *int32) {
+	defer dst.Close()
+	defer src.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && atomic.LoadInt32(dropped) == 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *blackholeProxy) blackhole() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dropped := range p.dropped {
+		atomic.StoreInt32(dropped, 1)
+	}
+}
+
+func TestWatchPrefixSurvivesDroppedConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the keepalive pings, sent after 10s at least by gRPC")
+	}
+	f, addr := newFakeEtcd(t)
+	p, proxyAddr := newBlackholeProxy(t, addr)
+	c, err := NewEtcdClient([]string{proxyAddr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, KeepaliveTime: time.Second, KeepaliveTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	keys := []string{"/app"}
+	if index, err := c.WatchPrefix(ctx, "/app", keys, 0); err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	// The connection drops silently while a key changes
+	p.blackhole()
+	f.put("/app/key", "value")
+	start := time.Now()
+	index, err := c.WatchPrefix(ctx, "/app", keys, 1)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() across a dropped connection = %d, %v, want 2", index, err)
+	}
+	t.Logf("watch resumed after %s", time.Since(start))
+	if n := f.watches(); n < 2 {
+		t.Errorf("%d watches created, want the watch resumed on a new connection", n)
+	}
+}
+
+func TestAutoSync(t *testing.T) {
+	// The cluster moved from the node given to another one
+	old, oldAddr := newFakeEtcd(t)
+	moved, newAddr := newFakeEtcd(t)
+	old.members = []string{"http://" + newAddr}
+	moved.members = old.members
+	c, err := NewEtcdClient([]string{oldAddr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, AutoSyncInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	want := []string{"http://" + newAddr}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(c.client.Endpoints(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoints = %q, want %q", c.client.Endpoints(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The node given is gone, the client uses the member instead
+	old.server.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if index, err := c.WatchPrefix(ctx, "/app", []string{"/app"}, 0); err != nil || index != 1 {
+		t.Errorf("WatchPrefix() once the node given is gone = %d, %v, want 1", index, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.kvs = map[string]string{
+		"/tenants/team-a/myapp/db": "db-a",
+		"/tenants/team-b/myapp/db": "db-b",
+		"/myapp/db":                "db",
+	}
+	c, err := NewEtcdClient([]string{addr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, Namespace: "/tenants/team-a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"/myapp/db": "db-a"}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %q, want %q", vars, want)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.WatchPrefix(ctx, "/myapp", []string{"/myapp"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if want := []string{"/tenants/team-a/myapp"}; !reflect.DeepEqual(f.read, want) || !reflect.DeepEqual(f.watched, want) {
+		t.Errorf("keys read %q and watched %q in etcd, want %q", f.read, f.watched, want)
+	}
+}
+
+func TestAuthTokenExpiry(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.password = "secret"
+	f.tokenRequests = 2
+	f.kvs = map[string]string{"/app/key": "value"}
+
+	if _, err := NewEtcdClient([]string{addr}, Options{BasicAuth: true, Username: "confd", Password: "wrong", DialTimeout: time.Second, RequestTimeout: time.Second}); err == nil {
+		t.Error("NewEtcdClient() with a wrong password succeeded")
+	}
+	c, err := NewEtcdClient([]string{addr}, Options{BasicAuth: true, Username: "confd", Password: "secret", DialTimeout: time.Second, RequestTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	// Every other read needs a new token
+	for i := 0; i < 5; i++ {
+		vars, err := c.GetValues(context.Background(), []string{"/app"})
+		if err != nil {
+			t.Fatalf("GetValues() #%d: %v", i+1, err)
+		}
+		if want := map[string]string{"/app/key": "value"}; !reflect.DeepEqual(vars, want) {
+			t.Fatalf("GetValues() #%d = %q, want %q", i+1, vars, want)
+		}
+	}
+	f.mu.Lock()
+	authenticated := f.authenticated
+	f.tokenRequests = 0
+	f.mu.Unlock()
+	if authenticated < 3 {
+		t.Errorf("authenticated %d times, want the client to authenticate again once the token expired", authenticated)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	keys := []string{"/app"}
+	if index, err := c.WatchPrefix(ctx, "/app", keys, 0); err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	// The token expires, the watch is cancelled, and a key changes before
+	// the client watches again
+	f.expire()
+	f.put("/app/key", "changed")
+	index, err := c.WatchPrefix(ctx, "/app", keys, 1)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() across an expired token = %d, %v, want 2", index, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.authenticated <= authenticated {
+		t.Errorf("authenticated %d times, want the watch to authenticate again", f.authenticated)
+	}
+}
+
+func TestGetValuesPages(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.rev = 7
+	f.kvs = map[string]string{"/other": "other"}
+	want := make(map[string]string)
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("/app/key-%02d", i)
+		f.kvs[k] = fmt.Sprint(i)
+		want[k] = fmt.Sprint(i)
+	}
+	c, err := NewEtcdClient([]string{addr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	vars, err := c.GetValues(context.Background(), []string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %q, want %q", vars, want)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if want := []int64{7, 7}; !reflect.DeepEqual(f.pages, want) {
+		t.Errorf("pages read after the first one at revisions %v, want %v", f.pages, want)
+	}
+}
+
+// BenchmarkGetValues reads a prefix of 80000 keys at once, and in pages.
+func BenchmarkGetValues(b *testing.B) {
+	f, addr := newFakeEtcd(b)
+	f.kvs = make(map[string]string)
+	for i := 0; i < 80000; i++ {
+		f.kvs[fmt.Sprintf("/app/key-%05d", i)] = "value"
+	}
+	for _, pageSize := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("page-size-%d", pageSize), func(b *testing.B) {
+			c, err := NewEtcdClient([]string{addr}, Options{DialTimeout: time.Second, RequestTimeout: 10 * time.Second, PageSize: pageSize})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.client.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.GetValues(context.Background(), []string{"/app"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetValuesReusesToken(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.password = "secret"
+	f.kvs = map[string]string{"/app/key": "value"}
+	c, err := NewEtcdClient([]string{addr}, Options{BasicAuth: true, Username: "confd", Password: "secret", DialTimeout: time.Second, RequestTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetValues(context.Background(), []string{"/app"}); err != nil {
+			t.Fatalf("GetValues() #%d: %v", i+1, err)
+		}
+	}
+	// The first read with the expired token is rejected, the client
+	// authenticates again and reads once more
+	f.expire()
+	if _, err := c.GetValues(context.Background(), []string{"/app"}); err != nil {
+		t.Fatalf("GetValues() once the token expired: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.authenticated != 2 {
+		t.Errorf("authenticated %d times, want once at startup and once the token expired", f.authenticated)
+	}
+}
+
+func TestMaxRecvMsgSize(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.kvs = map[string]string{"/app/blob": strings.Repeat("x", 1024)}
+	c, err := NewEtcdClient([]string{addr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, MaxRecvMsgSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	_, err = c.GetValues(context.Background(), []string{"/app"})
+	if err == nil || !strings.Contains(err.Error(), "-etcd-max-recv-msg-size") {
+		t.Fatalf("GetValues() of a value over the limit = %v, want an error naming -etcd-max-recv-msg-size", err)
+	}
+	f.mu.Lock()
+	f.kvs["/app/blob"] = strings.Repeat("x", 900)
+	f.sorted = nil
+	f.mu.Unlock()
+	if _, err := c.GetValues(context.Background(), []string{"/app"}); err != nil {
+		t.Errorf("GetValues() of a value within the limit: %v", err)
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	f, addr := newFakeEtcd(t)
+	f.password = "secret"
+	f.kvs = map[string]string{"/app/key": "value"}
+	c, err := NewEtcdClient([]string{addr}, Options{BasicAuth: true, Username: "confd", Password: "secret", DialTimeout: time.Second, RequestTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+	c.ReloadCredentials(func() (string, string, error) { return "confd", "rotated", nil })
+
+	// The password is rotated, and the token expires
+	f.mu.Lock()
+	f.password = "rotated"
+	f.mu.Unlock()
+	f.expire()
+	if _, err := c.GetValues(context.Background(), []string{"/app"}); err != nil {
+		t.Fatalf("GetValues() once the password was rotated: %v", err)
+	}
+}
+
+func TestOrderedEndpoints(t *testing.T) {
+	defer func(d time.Duration) { healthCheckInterval = d }(healthCheckInterval)
+	healthCheckInterval = 100 * time.Millisecond
+	// The node of the zone of confd, and that of another one
+	local, localAddr := newFakeEtcd(t)
+	local.kvs = map[string]string{"/app/zone": "local"}
+	remote, remoteAddr := newFakeEtcd(t)
+	remote.kvs = map[string]string{"/app/zone": "remote"}
+	c, err := NewEtcdClient([]string{localAddr, remoteAddr}, Options{DialTimeout: time.Second, RequestTimeout: time.Second, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.client.Close()
+
+	// waitZone reads until the value comes from zone
+	waitZone := func(zone string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			vars, err := c.GetValues(context.Background(), []string{"/app"})
+			if err == nil && vars["/app/zone"] == zone {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("GetValues() = %q, %v, want the value of the %s node", vars, err, zone)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitZone("local")
+	for i := 0; i < 10; i++ {
+		vars, err := c.GetValues(context.Background(), []string{"/app"})
+		if err != nil || vars["/app/zone"] != "local" {
+			t.Fatalf("GetValues() #%d = %q, %v, want the value of the local node only", i+1, vars, err)
+		}
+	}
+
+	// The local node fails, then recovers
+	local.server.Stop()
+	waitZone("remote")
+	local, _ = newFakeEtcdAt(t, localAddr)
+	local.kvs = map[string]string{"/app/zone": "local"}
+	waitZone("local")
+	if got, want := c.nodes(), []string{localAddr, remoteAddr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes() = %q, want %q", got, want)
+	}
+}
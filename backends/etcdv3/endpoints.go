@@ -0,0 +1,93 @@
+package etcdv3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+	"golang.org/x/net/context"
+)
+
+// healthCheckInterval is the time between two checks of the nodes with
+// ordered endpoints.
+var healthCheckInterval = 10 * time.Second
+
+// orderedEndpoints pins a client to the first node which answers, rather
+// than spreading its requests over all of them, e.g. to read from the
+// node in the same zone while it is up.
+type orderedEndpoints struct {
+	mu sync.Mutex
+	// The nodes in order of preference, and the one in use
+	nodes  []string
+	pinned string
+	// Tells to check the nodes now, e.g. once a read failed
+	check chan struct{}
+}
+
+// checkNow makes the client check its nodes without waiting for the next
+// check, if it pins one.
+func (c *Client) checkNow() {
+	if c.ordered == nil {
+		return
+	}
+	select {
+	case c.ordered.check <- struct{}{}:
+	default:
+	}
+}
+
+// nodes returns the nodes of the client, all of them with ordered
+// endpoints.
+func (c *Client) nodes() []string {
+	if c.ordered == nil {
+		return c.client.Endpoints()
+	}
+	c.ordered.mu.Lock()
+	defer c.ordered.mu.Unlock()
+	return append([]string(nil), c.ordered.nodes...)
+}
+
+// pinEndpoints checks the nodes of the client in order every
+// healthCheckInterval, or when told, until the client is closed, and pins
+// the client to the first one answering. Once it is back, the client goes
+// back to a node it left.
+func (c *Client) pinEndpoints() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.pin()
+		select {
+		case <-ticker.C:
+		case <-c.ordered.check:
+		case <-c.client.Ctx().Done():
+			return
+		}
+	}
+}
+
+// pin pins the client to the first of its nodes which answers a status
+// request within healthCheckInterval, keeping the node in use if none
+// does.
+func (c *Client) pin() {
+	for _, node := range c.nodes() {
+		ctx, cancel := context.WithTimeout(c.client.Ctx(), healthCheckInterval)
+		_, err := c.client.Status(ctx, node)
+		cancel()
+		if err != nil {
+			log.Debug("etcd endpoint %s failed: %s", node, err)
+			continue
+		}
+		c.ordered.mu.Lock()
+		pinned := c.ordered.pinned
+		c.ordered.pinned = node
+		c.ordered.mu.Unlock()
+		if node != pinned {
+			log.Info("etcd endpoint set to %s", node)
+			c.client.SetEndpoints(node)
+		}
+		return
+	}
+	if c.client.Ctx().Err() == nil {
+		log.Error("No etcd endpoint answers, keeping %s", c.client.Endpoints())
+	}
+}
@@ -0,0 +1,179 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/util"
+)
+
+var (
+	// How often the commands are run again to tell changes
+	pollInterval = 30 * time.Second
+	// How long a command may run before it is killed
+	commandTimeout = 30 * time.Second
+	// How long the output of the commands is reused, long enough for the
+	// template resources of a cycle to share one run
+	maxAge = 5 * time.Second
+)
+
+// Client runs commands printing a JSON object, flattened into keys, e.g.
+// {"myapp": {"database": {"url": "db.example.com"}}} is the key
+// /myapp/database/url.
+type Client struct {
+	commands []string
+
+	// Held while the commands run, so that concurrent reads share one run
+	mu  sync.Mutex
+	ran time.Time
+	// The keys printed by the last run and the hash of its output
+	vars  map[string]string
+	index uint64
+}
+
+func init() {
+	backends.Register("exec", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes)
+	})
+}
+
+// New returns an *exec.Client running the command lines given by nodes
+// with the shell, the keys printed by the later ones overriding those of
+// the earlier ones.
+func New(nodes []string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no command given, set it with -node")
+	}
+	return &Client{commands: nodes}, nil
+}
+
+// run runs command with the shell and returns its output. A command
+// failing or running longer than commandTimeout is an error telling its
+// standard error.
+func run(ctx context.Context, command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Do not wait for the children of a killed command holding its output
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s did not exit within %s", command, commandTimeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 1024 {
+			msg = "..." + msg[len(msg)-1024:]
+		}
+		if msg == "" {
+			return nil, fmt.Errorf("%s: %s", command, err)
+		}
+		return nil, fmt.Errorf("%s: %s: %s", command, err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// values runs the commands, unless they ran less than maxAge ago, and
+// returns the keys they printed and the hash of their output.
+func (c *Client) values(ctx context.Context) (map[string]string, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.vars != nil && time.Since(c.ran) < maxAge {
+		return c.vars, c.index, nil
+	}
+
+	vars := make(map[string]string)
+	h := sha256.New()
+	for _, command := range c.commands {
+		out, err := run(ctx, command)
+		if err != nil {
+			return nil, 0, err
+		}
+		h.Write(out)
+		dec := json.NewDecoder(bytes.NewReader(out))
+		dec.UseNumber()
+		var content interface{}
+		if err := dec.Decode(&content); err != nil {
+			return nil, 0, fmt.Errorf("cannot parse the output of %s: %s", command, err)
+		}
+		if _, ok := content.(map[string]interface{}); !ok {
+			return nil, 0, fmt.Errorf("the output of %s is not a JSON object", command)
+		}
+		util.Flatten(content, "/", vars)
+	}
+	index := binary.BigEndian.Uint64(h.Sum(nil))
+	if index == 0 {
+		// 0 asks WatchPrefix for the current index
+		index = 1
+	}
+	c.vars, c.index, c.ran = vars, index, time.Now()
+	return vars, index, nil
+}
+
+// GetValues runs the commands and returns the keys they printed prefixed
+// by one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	all, _, err := c.values(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for k, v := range all {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix runs the commands every pollInterval, and returns the hash
+// of their output once it changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		_, index, err := c.values(ctx)
+		return index, err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(pollInterval):
+		}
+		_, index, err := c.values(ctx)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index != waitIndex {
+			return index, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, the commands run anew every time.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
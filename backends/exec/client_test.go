@@ -0,0 +1,112 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetValues(t *testing.T) {
+	c, err := New([]string{
+		`echo '{"myapp": {"database": {"url": "db.example.com", "port": 5432}, "hosts": ["a", "b"]}, "other": "x"}'`,
+		`echo '{"myapp": {"database": {"url": "override.example.com"}}}'`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "override.example.com",
+		"/myapp/database/port": "5432",
+		"/myapp/hosts/0":       "a",
+		"/myapp/hosts/1":       "b",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestGetValuesCached(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	c, _ := New([]string{`echo run >> ` + runs + `; echo '{"key": "value"}'`})
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetValues(context.Background(), []string{"/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "run"); n != 1 {
+		t.Errorf("the command ran %d times, want once", n)
+	}
+}
+
+func TestGetValuesErrors(t *testing.T) {
+	defer func(d time.Duration) { commandTimeout = d }(commandTimeout)
+	commandTimeout = 100 * time.Millisecond
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{`echo "no such table" >&2; exit 3`, "exit status 3: no such table"},
+		{`echo '["a"]'`, "not a JSON object"},
+		{`echo '{"a":'`, "cannot parse the output"},
+		{`sleep 10`, "did not exit within 100ms"},
+	}
+	for _, tt := range tests {
+		c, _ := New([]string{tt.command})
+		start := time.Now()
+		_, err := c.GetValues(context.Background(), []string{"/"})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("GetValues() of %s = %v, want an error with %q", tt.command, err, tt.want)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("GetValues() of %s took %s", tt.command, time.Since(start))
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	defer func(interval, age time.Duration) { pollInterval, maxAge = interval, age }(pollInterval, maxAge)
+	pollInterval, maxAge = 10*time.Millisecond, 0
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"key": "foo"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := New([]string{"cat " + file})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/", []string{"/key"}, 0)
+	if err != nil || index == 0 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want the hash of the output", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(file, []byte(`{"key": "bar"}`), 0644)
+	}()
+	changed, err := c.WatchPrefix(ctx, "/", []string{"/key"}, index)
+	if err != nil || changed == index {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want another index than %d", changed, err, index)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", []string{"/key"}, changed); err != nil || stopped != changed {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, changed)
+	}
+}
@@ -0,0 +1,204 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+	"gopkg.in/yaml.v2"
+)
+
+// Client provides a shell for the yaml client
+type Client struct {
+	filepath []string
+}
+
+func init() {
+	backends.Register("file", func(config backends.Config) (backends.StoreClient, error) {
+		return NewFileClient(config.YAMLFile)
+	})
+}
+
+// NewFileClient returns a client reading the given YAML or JSON files.
+// Directories are searched recursively for .yaml, .yml and .json files.
+func NewFileClient(filepath []string) (*Client, error) {
+	if len(filepath) == 0 {
+		return nil, errors.New("no file given, set it with -file")
+	}
+	return &Client{filepath: filepath}, nil
+}
+
+// isConfigFile reports whether the file at p is read from a directory.
+func isConfigFile(p string) bool {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// files returns every file to read, in the order they are merged.
+func (c *Client) files() ([]string, error) {
+	var files []string
+	for _, p := range c.filepath {
+		isDir, err := util.IsDirectory(p)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
+			files = append(files, p)
+			continue
+		}
+		found, err := util.RecursiveFilesLookup(p, "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range found {
+			if isConfigFile(f) {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// readFile flattens the content of the file at p into vars.
+func readFile(p string, vars map[string]string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	var content interface{}
+	if strings.ToLower(filepath.Ext(p)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&content)
+	} else {
+		err = yaml.Unmarshal(data, &content)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %s", p, err)
+	}
+	util.Flatten(content, "/", vars)
+	return nil
+}
+
+// GetValues reads the files, later files overriding earlier ones, and
+// returns the keys prefixed by one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for _, p := range files {
+		if err := readFile(p, vars); err != nil {
+			return nil, err
+		}
+	}
+
+VarsLoop:
+	for k := range vars {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				continue VarsLoop
+			}
+		}
+		delete(vars, k)
+	}
+	return vars, nil
+}
+
+// watch adds the directories holding the files to watcher and returns
+// whether a change of the named file requires re-reading them.
+func (c *Client) watch(watcher *fsnotify.Watcher) (func(name string) bool, error) {
+	files := make(map[string]bool)
+	var roots []string
+	for _, p := range c.filepath {
+		isDir, err := util.IsDirectory(p)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
+			// Editors often replace a file instead of writing it, watch
+			// the directory to see the new one.
+			files[filepath.Clean(p)] = true
+			if err := watcher.Add(filepath.Dir(p)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		roots = append(roots, filepath.Clean(p)+string(filepath.Separator))
+		dirs, err := util.RecursiveDirsLookup(p, "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return func(name string) bool {
+		name = filepath.Clean(name)
+		if files[name] {
+			return true
+		}
+		for _, root := range roots {
+			if strings.HasPrefix(name, root) {
+				// A new subdirectory may hold files to read as well
+				isDir, _ := util.IsDirectory(name)
+				return isDir || isConfigFile(name)
+			}
+		}
+		return false
+	}, nil
+}
+
+// WatchPrefix waits for changes of the files and returns a new index.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	// return something > 0 to trigger a key retrieval from the store
+	if waitIndex == 0 {
+		return 1, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return waitIndex, err
+	}
+	defer watcher.Close()
+
+	relevant, err := c.watch(watcher)
+	if err != nil {
+		return waitIndex, err
+	}
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op == fsnotify.Chmod || !relevant(event.Name) {
+				continue
+			}
+			log.Debug("File event: %s", event)
+			return waitIndex + 1, nil
+		case err := <-watcher.Errors:
+			return waitIndex, err
+		case <-ctx.Done():
+			return waitIndex, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, there is no connection to keep alive.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,133 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "backends1", "1.yaml"), `
+key: foobar
+database:
+  host: 127.0.0.1
+  port: 3306
+  enabled: true
+upstream:
+  - 10.0.1.10:8080
+  - 10.0.1.11:8080
+`)
+	writeFile(t, filepath.Join(dir, "backends1", "nested", "2.json"), `{"nested": {"east": {"app1": "10.0.1.10:8080", "weight": 1.5}}}`)
+	writeFile(t, filepath.Join(dir, "backends1", "README"), "not: [read")
+	writeFile(t, filepath.Join(dir, "override.yml"), "database:\n  host: 10.0.0.1\n")
+
+	c, err := NewFileClient([]string{filepath.Join(dir, "backends1"), filepath.Join(dir, "override.yml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/upstream", "/nested"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":                "foobar",
+		"/database/host":      "10.0.0.1",
+		"/database/port":      "3306",
+		"/database/enabled":   "true",
+		"/upstream/0":         "10.0.1.10:8080",
+		"/upstream/1":         "10.0.1.11:8080",
+		"/nested/east/app1":   "10.0.1.10:8080",
+		"/nested/east/weight": "1.5",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestGetValuesMalformed(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "broken.yaml")
+	writeFile(t, name, "key: [foobar\n")
+
+	c, err := NewFileClient([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetValues(context.Background(), []string{"/"})
+	if err == nil || !strings.Contains(err.Error(), name) {
+		t.Errorf("GetValues() error = %v, want one naming %s", err, name)
+	}
+}
+
+func TestNewFileClientRequiresFile(t *testing.T) {
+	if _, err := NewFileClient(nil); err == nil {
+		t.Error("expected an error without files")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "config.yaml")
+	writeFile(t, name, "key: foo\n")
+	writeFile(t, filepath.Join(dir, "conf.d", "1.yaml"), "other: foo\n")
+
+	for _, files := range [][]string{{name}, {filepath.Join(dir, "conf.d")}} {
+		c, err := NewFileClient(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 0)
+		if err != nil || index != 1 {
+			t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			// Unrelated files next to the watched ones are ignored
+			writeFile(t, filepath.Join(dir, "unrelated.txt"), "foo")
+			writeFile(t, filepath.Join(dir, "conf.d", "unrelated.txt"), "foo")
+			time.Sleep(50 * time.Millisecond)
+			writeFile(t, name, "key: bar\n")
+			writeFile(t, filepath.Join(dir, "conf.d", "1.yaml"), "other: bar\n")
+		}()
+		start := time.Now()
+		index, err = c.WatchPrefix(ctx, "/", []string{"/"}, index)
+		if err != nil || index != 2 {
+			t.Fatalf("WatchPrefix(%v) after change = %d, %v, want 2", files, index, err)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Errorf("WatchPrefix(%v) returned on an unrelated file", files)
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		index, err = c.WatchPrefix(ctx, "/", []string{"/"}, index)
+		if err != nil || index != 2 {
+			t.Fatalf("stopped WatchPrefix(%v) = %d, %v, want 2", files, index, err)
+		}
+	}
+}
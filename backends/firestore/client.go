@@ -0,0 +1,435 @@
+package firestore
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/zyf0330/confd/backends"
+	"golang.org/x/oauth2/google"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+const firestoreAddr = "firestore.googleapis.com:443"
+
+var (
+	// How long a watch waits before listening again when no collection
+	// matches the keys
+	pollInterval = 30 * time.Second
+	// The wait before listening again after a failed watch, doubled on
+	// each consecutive failure
+	retryInterval = time.Second
+)
+
+// Client reads the documents of the root collections of a Firestore
+// database, the fields of the document myapp of the collection apps being
+// the keys below /apps/myapp. Subcollections are not read.
+type Client struct {
+	client pb.FirestoreClient
+	// projects/<project>/databases/(default)
+	database string
+
+	mu sync.Mutex
+	// Consecutive failed watches, per set of keys
+	failures map[string]int
+}
+
+func init() {
+	backends.Register("firestore", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Credentials)
+	})
+}
+
+// New returns a *firestore.Client reading the default database of the
+// project named by the first node, or else the project of the
+// credentials. It authenticates with the service account key in
+// credentialsFile, or the Application Default Credentials if it is empty.
+// With FIRESTORE_EMULATOR_HOST set it connects to the emulator at that
+// address instead, without credentials.
+func New(nodes []string, credentialsFile string) (*Client, error) {
+	project := ""
+	if len(nodes) > 0 {
+		project = nodes[0]
+	}
+
+	if emulator := os.Getenv("FIRESTORE_EMULATOR_HOST"); emulator != "" {
+		if project == "" {
+			return nil, fmt.Errorf("no Google Cloud project given, set it with -node")
+		}
+		conn, err := grpc.Dial(emulator, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		return newClient(conn, project), nil
+	}
+
+	scopes := []string{"https://www.googleapis.com/auth/datastore"}
+	ctx := context.Background()
+	var creds *google.Credentials
+	if credentialsFile != "" {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read credentials from %s: %s", credentialsFile, err)
+		}
+	} else {
+		var err error
+		creds, err = google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if project == "" {
+		project = creds.ProjectID
+	}
+	if project == "" {
+		return nil, fmt.Errorf("no Google Cloud project given, set it with -node")
+	}
+	conn, err := grpc.Dial(firestoreAddr,
+		grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		grpc.WithPerRPCCredentials(oauth.TokenSource{TokenSource: creds.TokenSource}))
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, project), nil
+}
+
+func newClient(conn *grpc.ClientConn, project string) *Client {
+	return &Client{
+		client:   pb.NewFirestoreClient(conn),
+		database: "projects/" + strings.TrimPrefix(project, "projects/") + "/databases/(default)",
+		failures: make(map[string]int),
+	}
+}
+
+// outgoing routes the calls made with ctx to the database.
+func (c *Client) outgoing(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "google-cloud-resource-prefix", c.database)
+}
+
+// documents returns the resource name of the root of the documents.
+func (c *Client) documents() string {
+	return c.database + "/documents"
+}
+
+// key returns the key of the document or reference name.
+func (c *Client) key(name string) string {
+	return strings.TrimPrefix(name, c.documents())
+}
+
+// reference returns the reference value of the document id of collection.
+func (c *Client) reference(collection, id string) *pb.Value {
+	return &pb.Value{ValueType: &pb.Value_ReferenceValue{
+		ReferenceValue: c.documents() + "/" + collection + "/" + id,
+	}}
+}
+
+// nameFilter returns a filter on the name of the documents.
+func nameFilter(op pb.StructuredQuery_FieldFilter_Operator, value *pb.Value) *pb.StructuredQuery_Filter {
+	return &pb.StructuredQuery_Filter{FilterType: &pb.StructuredQuery_Filter_FieldFilter{
+		FieldFilter: &pb.StructuredQuery_FieldFilter{
+			Field: &pb.StructuredQuery_FieldReference{FieldPath: "__name__"},
+			Op:    op,
+			Value: value,
+		},
+	}}
+}
+
+// queries returns the queries of the documents holding the keys starting
+// with one of keys: those of the collections starting with a key of one
+// segment, those whose ID starts with the second segment of a key of two,
+// and the document named by a longer key.
+func (c *Client) queries(ctx context.Context, keys []string) ([]*pb.StructuredQuery, error) {
+	var queries []*pb.StructuredQuery
+	var collections []string
+	for _, key := range keys {
+		segments := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 3)
+		if len(segments) == 1 {
+			if collections == nil {
+				var err error
+				if collections, err = c.collections(ctx); err != nil {
+					return nil, err
+				}
+			}
+			for _, id := range collections {
+				if strings.HasPrefix(id, segments[0]) {
+					queries = append(queries, &pb.StructuredQuery{
+						From: []*pb.StructuredQuery_CollectionSelector{{CollectionId: id}},
+					})
+				}
+			}
+			continue
+		}
+
+		q := &pb.StructuredQuery{
+			From: []*pb.StructuredQuery_CollectionSelector{{CollectionId: segments[0]}},
+		}
+		switch {
+		case len(segments) == 2 && segments[1] == "":
+			// The whole collection
+		case len(segments) == 2:
+			// The document IDs starting with the segment
+			q.Where = &pb.StructuredQuery_Filter{FilterType: &pb.StructuredQuery_Filter_CompositeFilter{
+				CompositeFilter: &pb.StructuredQuery_CompositeFilter{
+					Op: pb.StructuredQuery_CompositeFilter_AND,
+					Filters: []*pb.StructuredQuery_Filter{
+						nameFilter(pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL, c.reference(segments[0], segments[1])),
+						nameFilter(pb.StructuredQuery_FieldFilter_LESS_THAN, c.reference(segments[0], segments[1]+"\uf8ff")),
+					},
+				},
+			}}
+		default:
+			q.Where = nameFilter(pb.StructuredQuery_FieldFilter_EQUAL, c.reference(segments[0], segments[1]))
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
+
+// collections returns the IDs of the root collections.
+func (c *Client) collections(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	req := &pb.ListCollectionIdsRequest{Parent: c.documents()}
+	for {
+		resp, err := c.client.ListCollectionIds(c.outgoing(ctx), req)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, resp.CollectionIds...)
+		if resp.NextPageToken == "" {
+			return ids, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// GetValues queries the documents holding the keys starting with one of
+// keys and returns those keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	queries, err := c.queries(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for _, q := range queries {
+		stream, err := c.client.RunQuery(c.outgoing(ctx), &pb.RunQueryRequest{
+			Parent:    c.documents(),
+			QueryType: &pb.RunQueryRequest_StructuredQuery{StructuredQuery: q},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if resp.Document == nil {
+				continue
+			}
+			doc := make(map[string]string)
+			c.flatten(&pb.Value{ValueType: &pb.Value_MapValue{
+				MapValue: &pb.MapValue{Fields: resp.Document.Fields},
+			}}, c.key(resp.Document.Name), doc)
+			for k, v := range doc {
+				for _, key := range keys {
+					if strings.HasPrefix(k, key) {
+						vars[k] = v
+						break
+					}
+				}
+			}
+		}
+	}
+	return vars, nil
+}
+
+// flatten stores the value v of key into vars. Maps and arrays become
+// directories, array elements are keyed by their index.
+func (c *Client) flatten(v *pb.Value, key string, vars map[string]string) {
+	switch v := v.ValueType.(type) {
+	case *pb.Value_MapValue:
+		for name, field := range v.MapValue.GetFields() {
+			c.flatten(field, key+"/"+name, vars)
+		}
+	case *pb.Value_ArrayValue:
+		for i, value := range v.ArrayValue.GetValues() {
+			c.flatten(value, key+"/"+strconv.Itoa(i), vars)
+		}
+	case *pb.Value_NullValue:
+	case *pb.Value_BooleanValue:
+		vars[key] = strconv.FormatBool(v.BooleanValue)
+	case *pb.Value_IntegerValue:
+		vars[key] = strconv.FormatInt(v.IntegerValue, 10)
+	case *pb.Value_DoubleValue:
+		vars[key] = strconv.FormatFloat(v.DoubleValue, 'f', -1, 64)
+	case *pb.Value_TimestampValue:
+		if t, err := ptypes.Timestamp(v.TimestampValue); err == nil {
+			vars[key] = t.Format(time.RFC3339Nano)
+		}
+	case *pb.Value_StringValue:
+		vars[key] = v.StringValue
+	case *pb.Value_BytesValue:
+		vars[key] = base64.StdEncoding.EncodeToString(v.BytesValue)
+	case *pb.Value_ReferenceValue:
+		vars[key] = c.key(v.ReferenceValue)
+	case *pb.Value_GeoPointValue:
+		vars[key] = fmt.Sprintf("%s,%s",
+			strconv.FormatFloat(v.GeoPointValue.GetLatitude(), 'f', -1, 64),
+			strconv.FormatFloat(v.GeoPointValue.GetLongitude(), 'f', -1, 64))
+	}
+}
+
+// index returns the wait index of the read time t, its nanoseconds since
+// the epoch.
+func index(t *timestamp.Timestamp) uint64 {
+	return uint64(t.GetSeconds())*uint64(time.Second) + uint64(t.GetNanos())
+}
+
+// readTime returns the read time of the wait index i.
+func readTime(i uint64) *timestamp.Timestamp {
+	return &timestamp.Timestamp{Seconds: int64(i / uint64(time.Second)), Nanos: int32(i % uint64(time.Second))}
+}
+
+// WatchPrefix listens to the documents holding keys and returns the read
+// time of the first snapshot after waitIndex in which one of them was
+// added, modified or removed. A zero waitIndex returns the read time of
+// the current snapshot. After a failed watch, e.g. as the permission to
+// read the documents was revoked, the next one waits according to
+// util.Backoff.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	id := strings.Join(keys, ",")
+	c.mu.Lock()
+	failures := c.failures[id]
+	c.mu.Unlock()
+	if failures > 0 {
+		wait := util.Backoff(retryInterval, failures-1)
+		log.Warning(fmt.Sprintf("Listening to Firestore again in %s", wait))
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(wait):
+		}
+	}
+
+	index, err := c.listen(ctx, keys, waitIndex)
+	c.mu.Lock()
+	if err != nil {
+		c.failures[id]++
+	} else {
+		delete(c.failures, id)
+	}
+	c.mu.Unlock()
+	return index, err
+}
+
+// listen implements WatchPrefix.
+func (c *Client) listen(parent context.Context, keys []string, waitIndex uint64) (uint64, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	stopped := parent.Done()
+	isStopped := func() bool {
+		return parent.Err() != nil
+	}
+
+	queries, err := c.queries(ctx, keys)
+	if isStopped() {
+		return waitIndex, nil
+	}
+	if err != nil {
+		return waitIndex, err
+	}
+	if len(queries) == 0 {
+		// Nothing to listen to until a collection is created
+		select {
+		case <-stopped:
+		case <-time.After(pollInterval):
+		}
+		return waitIndex, nil
+	}
+
+	stream, err := c.client.Listen(c.outgoing(ctx))
+	if err != nil {
+		return waitIndex, err
+	}
+	for i, q := range queries {
+		target := &pb.Target{
+			TargetId: int32(i + 1),
+			TargetType: &pb.Target_Query{Query: &pb.Target_QueryTarget{
+				Parent:    c.documents(),
+				QueryType: &pb.Target_QueryTarget_StructuredQuery{StructuredQuery: q},
+			}},
+		}
+		if waitIndex > 0 {
+			// Only the changes since then are sent
+			target.ResumeType = &pb.Target_ReadTime{ReadTime: readTime(waitIndex)}
+		}
+		err := stream.Send(&pb.ListenRequest{
+			Database:     c.database,
+			TargetChange: &pb.ListenRequest_AddTarget{AddTarget: target},
+		})
+		if err != nil {
+			if isStopped() {
+				return waitIndex, nil
+			}
+			return waitIndex, err
+		}
+	}
+
+	changed := false
+	for {
+		resp, err := stream.Recv()
+		if isStopped() {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		switch r := resp.ResponseType.(type) {
+		case *pb.ListenResponse_DocumentChange, *pb.ListenResponse_DocumentDelete, *pb.ListenResponse_DocumentRemove:
+			changed = true
+		case *pb.ListenResponse_TargetChange:
+			tc := r.TargetChange
+			switch tc.TargetChangeType {
+			case pb.TargetChange_REMOVE:
+				if tc.Cause != nil {
+					return waitIndex, fmt.Errorf("Firestore stopped listening: %s", tc.Cause.Message)
+				}
+			case pb.TargetChange_RESET:
+				// The documents are sent again
+				changed = true
+			case pb.TargetChange_NO_CHANGE:
+				// A consistent snapshot of all the targets
+				if len(tc.TargetIds) == 0 && tc.ReadTime != nil && (waitIndex == 0 || changed) {
+					return index(tc.ReadTime), nil
+				}
+			}
+		}
+	}
+}
+
+// KeepAlive is a no-op, the connection is kept by gRPC.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,385 @@
+package firestore
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zyf0330/confd/log"
+)
+
+const documents = "projects/myproject/databases/(default)/documents"
+
+// fakeFirestore serves the queries and listens of confd on its documents,
+// the read time being a counter of the writes.
+type fakeFirestore struct {
+	pb.FirestoreServer
+
+	mu   sync.Mutex
+	docs map[string]*pb.Document
+	// The times the deleted documents were deleted at
+	deleted map[string]int64
+	now     int64
+	// Closed and replaced on every write
+	changed chan struct{}
+	// Returned by the next listen if not nil
+	listenErr error
+}
+
+func newFakeFirestore() *fakeFirestore {
+	return &fakeFirestore{docs: make(map[string]*pb.Document), deleted: make(map[string]int64), changed: make(chan struct{})}
+}
+
+// set writes the document at path with fields, deleting it if nil.
+func (f *fakeFirestore) set(path string, fields map[string]*pb.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now++
+	name := documents + "/" + path
+	if fields == nil {
+		delete(f.docs, name)
+		f.deleted[name] = f.now
+	} else {
+		f.docs[name] = &pb.Document{Name: name, Fields: fields, UpdateTime: &timestamp.Timestamp{Seconds: f.now}}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func compare(op pb.StructuredQuery_FieldFilter_Operator, a, b string) bool {
+	switch op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return a == b
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return a >= b
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return a < b
+	}
+	panic("unexpected operator " + op.String())
+}
+
+func matchesFilter(filter *pb.StructuredQuery_Filter, name string) bool {
+	if filter == nil {
+		return true
+	}
+	if composite := filter.GetCompositeFilter(); composite != nil {
+		for _, f := range composite.Filters {
+			if !matchesFilter(f, name) {
+				return false
+			}
+		}
+		return true
+	}
+	field := filter.GetFieldFilter()
+	return compare(field.Op, name, field.Value.GetReferenceValue())
+}
+
+func matches(q *pb.StructuredQuery, name string) bool {
+	path := strings.Split(strings.TrimPrefix(name, documents+"/"), "/")
+	return len(path) == 2 && path[0] == q.From[0].CollectionId && matchesFilter(q.Where, name)
+}
+
+// matches returns the names of the documents matching q, sorted. f.mu is
+// held.
+func (f *fakeFirestore) matches(q *pb.StructuredQuery) []string {
+	var names []string
+	for name := range f.docs {
+		if matches(q, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeFirestore) ListCollectionIds(ctx context.Context, req *pb.ListCollectionIdsRequest) (*pb.ListCollectionIdsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[string]bool)
+	resp := &pb.ListCollectionIdsResponse{}
+	for name := range f.docs {
+		id := strings.Split(strings.TrimPrefix(name, documents+"/"), "/")[0]
+		if !seen[id] {
+			seen[id] = true
+			resp.CollectionIds = append(resp.CollectionIds, id)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	f.mu.Lock()
+	var resps []*pb.RunQueryResponse
+	for _, name := range f.matches(req.GetStructuredQuery()) {
+		resps = append(resps, &pb.RunQueryResponse{Document: f.docs[name], ReadTime: &timestamp.Timestamp{Seconds: f.now}})
+	}
+	f.mu.Unlock()
+	for _, resp := range resps {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Listen sends the changes of the documents matching the targets since
+// their read time, then those of every write.
+func (f *fakeFirestore) Listen(stream pb.Firestore_ListenServer) error {
+	f.mu.Lock()
+	err := f.listenErr
+	f.listenErr = nil
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reqs := make(chan *pb.ListenRequest)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			reqs <- req
+		}
+	}()
+
+	type target struct {
+		id    int32
+		query *pb.StructuredQuery
+		// The update times of the documents sent
+		sent map[string]int64
+	}
+	var targets []*target
+	// send sends the changes of the targets and a snapshot, f.mu is held
+	send := func(ts []*target) error {
+		for _, t := range ts {
+			names := f.matches(t.query)
+			for _, name := range names {
+				updated := f.docs[name].UpdateTime.Seconds
+				if t.sent[name] < updated {
+					t.sent[name] = updated
+					if err := stream.Send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentChange{
+						DocumentChange: &pb.DocumentChange{Document: f.docs[name], TargetIds: []int32{t.id}},
+					}}); err != nil {
+						return err
+					}
+				}
+			}
+			for name := range t.sent {
+				if f.docs[name] == nil {
+					delete(t.sent, name)
+					if err := stream.Send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentDelete{
+						DocumentDelete: &pb.DocumentDelete{Document: name, RemovedTargetIds: []int32{t.id}},
+					}}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return stream.Send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{
+			TargetChange: &pb.TargetChange{ReadTime: &timestamp.Timestamp{Seconds: f.now}},
+		}})
+	}
+
+	for {
+		f.mu.Lock()
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return nil
+			}
+			add := req.GetAddTarget()
+			t := &target{id: add.TargetId, query: add.GetQuery().GetStructuredQuery(), sent: make(map[string]int64)}
+			f.mu.Lock()
+			if readTime := add.GetReadTime(); readTime != nil {
+				// The client knows the documents of then
+				for _, name := range f.matches(t.query) {
+					if updated := f.docs[name].UpdateTime.Seconds; updated <= readTime.Seconds {
+						t.sent[name] = updated
+					}
+				}
+				for name, deleted := range f.deleted {
+					if deleted > readTime.Seconds && matches(t.query, name) {
+						t.sent[name] = 0
+					}
+				}
+			}
+			targets = append(targets, t)
+			err := stream.Send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{
+				TargetChange: &pb.TargetChange{TargetChangeType: pb.TargetChange_ADD, TargetIds: []int32{t.id}},
+			}})
+			if err == nil {
+				err = send([]*target{t})
+			}
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case <-changed:
+			f.mu.Lock()
+			err := send(targets)
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func str(s string) *pb.Value {
+	return &pb.Value{ValueType: &pb.Value_StringValue{StringValue: s}}
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeFirestore) {
+	f := newFakeFirestore()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterFirestoreServer(server, f)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newClient(conn, "myproject"), f
+}
+
+func TestGetValues(t *testing.T) {
+	c, f := newTestClient(t)
+	f.set("apps/myapp", map[string]*pb.Value{
+		"database": {ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{Fields: map[string]*pb.Value{
+			"url":  str("db.example.com"),
+			"port": {ValueType: &pb.Value_IntegerValue{IntegerValue: 5432}},
+			"replica": {ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{Fields: map[string]*pb.Value{
+				"url": str("replica.example.com"),
+			}}}},
+		}}}},
+		"upstreams": {ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: []*pb.Value{
+			str("10.0.0.1"), str("10.0.0.2"),
+		}}}},
+		"debug":   {ValueType: &pb.Value_BooleanValue{BooleanValue: true}},
+		"ratio":   {ValueType: &pb.Value_DoubleValue{DoubleValue: 0.5}},
+		"owner":   {ValueType: &pb.Value_ReferenceValue{ReferenceValue: documents + "/users/rob"}},
+		"unset":   {ValueType: &pb.Value_NullValue{}},
+		"updated": {ValueType: &pb.Value_TimestampValue{TimestampValue: &timestamp.Timestamp{Seconds: 1767225600}}},
+	})
+	f.set("apps/myapp2", map[string]*pb.Value{"name": str("myapp2")})
+	f.set("apps/otherapp", map[string]*pb.Value{"name": str("otherapp")})
+	f.set("settings/global", map[string]*pb.Value{"region": str("eu")})
+
+	vars, err := c.GetValues(context.Background(), []string{"/apps/myapp", "/sett"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/apps/myapp/database/url":         "db.example.com",
+		"/apps/myapp/database/port":        "5432",
+		"/apps/myapp/database/replica/url": "replica.example.com",
+		"/apps/myapp/upstreams/0":          "10.0.0.1",
+		"/apps/myapp/upstreams/1":          "10.0.0.2",
+		"/apps/myapp/debug":                "true",
+		"/apps/myapp/ratio":                "0.5",
+		"/apps/myapp/owner":                "/users/rob",
+		"/apps/myapp/updated":              "2026-01-01T00:00:00Z",
+		"/apps/myapp2/name":                "myapp2",
+		"/settings/global/region":          "eu",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+
+	vars, err = c.GetValues(context.Background(), []string{"/apps/myapp/database/replica", "/apps/missing/name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"/apps/myapp/database/replica/url": "replica.example.com"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	c, f := newTestClient(t)
+	f.set("apps/myapp", map[string]*pb.Value{"url": str("db.example.com")})
+	f.set("apps/otherapp", map[string]*pb.Value{"url": str("db.example.com")})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/apps/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 2*uint64(time.Second) {
+		t.Fatalf("first WatchPrefix() = %d, %v, want the read time of the second write", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("apps/otherapp", map[string]*pb.Value{"url": str("db2.example.com")})
+		time.Sleep(50 * time.Millisecond)
+		f.set("apps/myapp", map[string]*pb.Value{"url": str("db2.example.com")})
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 4*uint64(time.Second) {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want the read time of the fourth write", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	// The changes since the index are sent, even made between two watches
+	f.set("apps/myapp", nil)
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 5*uint64(time.Second) {
+		t.Fatalf("WatchPrefix() after delete = %d, %v, want the read time of the fifth write", index, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
+
+func TestWatchPrefixRetry(t *testing.T) {
+	log.SetLevel("error")
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = 100 * time.Millisecond
+	c, f := newTestClient(t)
+	f.set("apps/myapp", map[string]*pb.Value{"url": str("db.example.com")})
+	f.listenErr = status.Error(codes.PermissionDenied, "missing permission")
+	keys := []string{"/apps/myapp"}
+
+	if _, err := c.WatchPrefix(context.Background(), "/", keys, 0); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("WatchPrefix() with the permission revoked = %v, want the error", err)
+	}
+	start := time.Now()
+	index, err := c.WatchPrefix(context.Background(), "/", keys, 0)
+	if err != nil || index != uint64(time.Second) {
+		t.Fatalf("WatchPrefix() once allowed = %d, %v, want the read time of the write", index, err)
+	}
+	if time.Since(start) < retryInterval/2 {
+		t.Errorf("WatchPrefix() listened again after %s, want a backoff", time.Since(start))
+	}
+}
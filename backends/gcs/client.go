@@ -0,0 +1,374 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+const (
+	storageURL = "https://storage.googleapis.com"
+	pubsubURL  = "https://pubsub.googleapis.com"
+)
+
+// Without a Pub/Sub subscription, changes are detected by polling the
+// generations of the objects.
+var pollInterval = 10 * time.Second
+
+// Notifications kept to answer watches which fell behind
+const maxEvents = 1000
+
+// object is an object as returned by the JSON API.
+type object struct {
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	Size       string `json:"size"`
+}
+
+// event is a change notification of an object.
+type event struct {
+	index uint64
+	key   string
+}
+
+// Client is a wrapper around the Cloud Storage JSON API.
+type Client struct {
+	client     *http.Client
+	storageURL string
+	pubsubURL  string
+	bucket     string
+	// Objects larger than this many bytes are skipped
+	maxSize int64
+	poller  *util.Poller
+
+	// Subscription to the bucket's Pub/Sub notifications, if any, pulled
+	// from once the first watch starts.
+	subscription string
+	pullOnce     sync.Once
+	mu           sync.Mutex
+	index        uint64
+	events       []event
+	changed      chan struct{}
+}
+
+func init() {
+	backends.Register("gcs", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Endpoint, config.Credentials, config.Subscription, config.MaxObjectSize)
+	})
+}
+
+// New returns a *gcs.Client reading the bucket named by the first node.
+// It authenticates with the service account key in credentialsFile, or the
+// Application Default Credentials if it is empty. endpoint overrides the
+// Cloud Storage endpoint, e.g. for a fake server. If subscription is set,
+// changes are received from that Pub/Sub subscription instead of polling.
+func New(nodes []string, endpoint, credentialsFile, subscription string, maxSize int64) (*Client, error) {
+	if len(nodes) == 0 || strings.Trim(strings.TrimPrefix(nodes[0], "gs://"), "/") == "" {
+		return nil, fmt.Errorf("no Cloud Storage bucket given, set it with -node")
+	}
+	bucket := strings.Trim(strings.TrimPrefix(nodes[0], "gs://"), "/")
+
+	scopes := []string{"https://www.googleapis.com/auth/devstorage.read_only"}
+	if subscription != "" {
+		scopes = append(scopes, "https://www.googleapis.com/auth/pubsub")
+	}
+	ctx := context.Background()
+	var creds *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read credentials from %s: %s", credentialsFile, err)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if endpoint == "" {
+		endpoint = storageURL
+	}
+	return newClient(oauth2.NewClient(ctx, creds.TokenSource), endpoint, pubsubURL, bucket, subscription, maxSize), nil
+}
+
+func newClient(client *http.Client, storageURL, pubsubURL, bucket, subscription string, maxSize int64) *Client {
+	return &Client{
+		client:       client,
+		storageURL:   strings.TrimRight(storageURL, "/"),
+		pubsubURL:    strings.TrimRight(pubsubURL, "/"),
+		bucket:       bucket,
+		maxSize:      maxSize,
+		poller:       util.NewPoller(pollInterval),
+		subscription: strings.Trim(subscription, "/"),
+		index:        1,
+		changed:      make(chan struct{}),
+	}
+}
+
+// do sends a request and decodes the JSON response into v, unless v is
+// nil. A missing resource is returned as an error.
+func (c *Client) do(ctx context.Context, method, u string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected response from %s (%s): %s", req.URL.Host, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// objects returns the objects whose names start with the key.
+func (c *Client) objects(ctx context.Context, key string) ([]object, error) {
+	var objects []object
+	params := url.Values{}
+	params.Set("prefix", strings.TrimPrefix(key, "/"))
+	params.Set("fields", "items(name,generation,size),nextPageToken")
+	for {
+		var page struct {
+			Items         []object `json:"items"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", c.storageURL, url.PathEscape(c.bucket), params.Encode())
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := c.do(ctx, "GET", u, nil, &page)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Items {
+			if strings.HasSuffix(o.Name, "/") {
+				// A folder created in the console
+				continue
+			}
+			objects = append(objects, o)
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		params.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// GetValues retrieves the contents of the objects whose names, with a
+// leading slash, start with one of keys. Objects larger than the maximum
+// size are skipped.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		objects, err := c.objects(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, o := range objects {
+			if size, _ := strconv.ParseInt(o.Size, 10, 64); size > c.maxSize {
+				log.Warning("Skipping Cloud Storage object %s of %d bytes, larger than %d bytes", o.Name, size, c.maxSize)
+				continue
+			}
+			value, err := c.getObject(ctx, o)
+			if err != nil {
+				return vars, err
+			}
+			vars["/"+o.Name] = value
+		}
+	}
+	return vars, nil
+}
+
+// getObject returns the content of the listed generation of o.
+func (c *Client) getObject(ctx context.Context, o object) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media&generation=%s",
+		c.storageURL, url.PathEscape(c.bucket), url.PathEscape(o.Name), url.QueryEscape(o.Generation))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot read Cloud Storage object %s: %s", o.Name, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxSize))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// generations returns the generation of every object holding one of keys.
+func (c *Client) generations(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		objects, err := c.objects(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, o := range objects {
+			vars["/"+o.Name] = o.Generation
+		}
+	}
+	return vars, nil
+}
+
+// pull receives the notifications of the subscription for as long as
+// confd runs, keeping the latest ones for the watches.
+func (c *Client) pull() {
+	u := fmt.Sprintf("%s/v1/%s", c.pubsubURL, c.subscription)
+	for {
+		var resp struct {
+			ReceivedMessages []struct {
+				AckID   string `json:"ackId"`
+				Message struct {
+					Attributes map[string]string `json:"attributes"`
+				} `json:"message"`
+			} `json:"receivedMessages"`
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+		err := c.do(ctx, "POST", u+":pull", map[string]interface{}{"maxMessages": 100}, &resp)
+		cancel()
+		if err != nil {
+			log.Error("Cannot pull Cloud Storage notifications from %s: %s", c.subscription, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var ackIDs []string
+		c.mu.Lock()
+		for _, m := range resp.ReceivedMessages {
+			ackIDs = append(ackIDs, m.AckID)
+			if m.Message.Attributes["bucketId"] != c.bucket {
+				continue
+			}
+			c.index++
+			c.events = append(c.events, event{c.index, "/" + m.Message.Attributes["objectId"]})
+			log.Debug("Cloud Storage object %s changed (%s)", m.Message.Attributes["objectId"], m.Message.Attributes["eventType"])
+		}
+		if len(c.events) > maxEvents {
+			c.events = c.events[len(c.events)-maxEvents:]
+		}
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.mu.Unlock()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		err = c.do(ctx, "POST", u+":acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil)
+		cancel()
+		if err != nil {
+			// The messages are delivered again, which only renders again
+			log.Error("Cannot acknowledge Cloud Storage notifications on %s: %s", c.subscription, err)
+		}
+	}
+}
+
+// watchNotifications waits for a notification after waitIndex about an
+// object holding one of keys.
+func (c *Client) watchNotifications(ctx context.Context, keys []string, waitIndex uint64) (uint64, error) {
+	c.pullOnce.Do(func() { go c.pull() })
+
+	c.mu.Lock()
+	if waitIndex == 0 {
+		// return something > 0 to trigger a key retrieval from the store
+		defer c.mu.Unlock()
+		return c.index, nil
+	}
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if len(c.events) > 0 && c.events[0].index > waitIndex+1 {
+			// Notifications were dropped, render what is there now
+			defer c.mu.Unlock()
+			return c.index, nil
+		}
+		for _, e := range c.events {
+			if e.index > waitIndex && hasPrefix(e.key, keys) {
+				defer c.mu.Unlock()
+				return c.index, nil
+			}
+		}
+		waitIndex = c.index
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return waitIndex, nil
+		}
+	}
+}
+
+func hasPrefix(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchPrefix returns a new index once an object holding one of keys was
+// changed, added or deleted, as told by the Pub/Sub subscription if there
+// is one, by polling the generations of the objects otherwise.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if c.subscription != "" {
+		return c.watchNotifications(ctx, keys, waitIndex)
+	}
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.generations)
+}
+
+// KeepAlive is a no-op, every request uses its own HTTP round trip.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,199 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeGCS emulates the Cloud Storage JSON API for one bucket, listing one
+// object per page, and the Pub/Sub subscription of its notifications.
+type fakeGCS struct {
+	mu         sync.Mutex
+	objects    map[string]string
+	generation map[string]int
+	messages   []map[string]string
+	acked      int
+}
+
+func newFakeGCS(objects map[string]string) *fakeGCS {
+	f := &fakeGCS{objects: make(map[string]string), generation: make(map[string]int)}
+	for name, content := range objects {
+		f.put(name, content)
+	}
+	return f
+}
+
+func (f *fakeGCS) put(name, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[name] = content
+	f.generation[name]++
+	f.messages = append(f.messages, map[string]string{
+		"bucketId": "config", "objectId": name, "eventType": "OBJECT_FINALIZE",
+	})
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/storage/v1/b/config/o":
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		page := map[string]interface{}{}
+		if start < len(names) {
+			name := names[start]
+			page["items"] = []map[string]string{{
+				"name":       name,
+				"generation": strconv.Itoa(f.generation[name]),
+				"size":       strconv.Itoa(len(f.objects[name])),
+			}}
+		}
+		if start+1 < len(names) {
+			page["nextPageToken"] = strconv.Itoa(start + 1)
+		}
+		json.NewEncoder(w).Encode(page)
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/config/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/b/config/o/"))
+		content, ok := f.objects[name]
+		if !ok || r.URL.Query().Get("alt") != "media" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	case r.URL.Path == "/v1/projects/p/subscriptions/confd:pull":
+		var received []interface{}
+		for i, m := range f.messages[f.acked:] {
+			received = append(received, map[string]interface{}{
+				"ackId":   strconv.Itoa(f.acked + i),
+				"message": map[string]interface{}{"attributes": m},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": received})
+	case r.URL.Path == "/v1/projects/p/subscriptions/confd:acknowledge":
+		var req struct {
+			AckIDs []string `json:"ackIds"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.acked += len(req.AckIDs)
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeGCS(map[string]string{
+		"key":           "foobar",
+		"database/host": "127.0.0.1",
+		"database/port": "3306",
+		"database/":     "",
+		"big.tar":       strings.Repeat("x", 2048),
+		"other/key":     "other",
+	})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, ts.URL, "config", "", 1024)
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/big.tar", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefixPollsGenerations(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeGCS(map[string]string{"app/key": "foo"})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, ts.URL, "config", "", 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// Same content, new generation
+		f.put("app/key", "foo")
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+}
+
+func TestWatchPrefixNotifications(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeGCS(nil)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, ts.URL, "config", "projects/p/subscriptions/confd", 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.put("other/key", "ignored")
+		time.Sleep(50 * time.Millisecond)
+		f.put("app/key", "foo")
+	}()
+	start := time.Now()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index < 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want a new index", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated object")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	stopped, err := c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,314 @@
+package git
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/zyf0330/confd/backends"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// How often the head of the branch is asked to the remote
+var pollInterval = 30 * time.Second
+
+// Client is a wrapper around a git repository. Every file below the
+// directory of the checked out ref is a key, its path relative to the
+// directory, and its content the value.
+type Client struct {
+	url  string
+	ref  string
+	dir  string
+	auth transport.AuthMethod
+
+	mu     sync.Mutex
+	repo   *gogit.Repository
+	remote *gogit.Remote
+	// The commit last read and its files
+	commit string
+	files  map[string]string
+}
+
+func init() {
+	backends.Register("git", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.GitRef, config.GitDir, config.CacheDir,
+			config.Username, config.Password, config.IdentityFile)
+	})
+}
+
+// New returns a *git.Client reading the files below dir of ref, a branch
+// or tag, in the repository given by nodes, or of the default branch if
+// ref is empty. The repository is fetched into a bare repository below
+// cacheDir, only the commits read being fetched. HTTPS remotes
+// authenticate with username and password, SSH remotes with identityFile,
+// password being its passphrase, or the SSH agent.
+func New(nodes []string, ref, dir, cacheDir, username, password, identityFile string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("give the URL of the repository as the only node with -node")
+	}
+	url := nodes[0]
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(userCacheDir, "confd", "git")
+	}
+
+	var auth transport.AuthMethod
+	if identityFile != "" {
+		endpoint, err := transport.NewEndpoint(url)
+		if err != nil {
+			return nil, err
+		}
+		user := endpoint.User
+		if username != "" {
+			user = username
+		}
+		if user == "" {
+			user = "git"
+		}
+		keys, err := ssh.NewPublicKeysFromFile(user, identityFile, password)
+		if err != nil {
+			return nil, err
+		}
+		auth = keys
+	} else if username != "" || password != "" {
+		auth = &http.BasicAuth{Username: username, Password: password}
+	}
+
+	// A cache directory per repository, named by its URL
+	sum := sha1.Sum([]byte(url))
+	repoDir := filepath.Join(cacheDir, hex.EncodeToString(sum[:]))
+	repo, err := gogit.PlainOpen(repoDir)
+	if err == gogit.ErrRepositoryNotExists {
+		repo, err = gogit.PlainInit(repoDir, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the cache of %s in %s: %s", url, repoDir, err)
+	}
+	remote, err := repo.Remote(gogit.DefaultRemoteName)
+	if err == gogit.ErrRemoteNotFound {
+		remote, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+			Name: gogit.DefaultRemoteName,
+			URLs: []string{url},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		url:    url,
+		ref:    ref,
+		dir:    path.Clean("/" + filepath.ToSlash(dir)),
+		auth:   auth,
+		repo:   repo,
+		remote: remote,
+	}, nil
+}
+
+// head asks the remote for the commit ref points to, like git ls-remote,
+// and returns it with the name of the reference.
+func (c *Client) head(ctx context.Context) (plumbing.ReferenceName, plumbing.Hash, error) {
+	refs, err := c.remote.ListContext(ctx, &gogit.ListOptions{Auth: c.auth})
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("cannot list the references of %s: %s", c.url, err)
+	}
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+
+	var names []plumbing.ReferenceName
+	switch {
+	case c.ref == "":
+		names = []plumbing.ReferenceName{plumbing.HEAD}
+	case strings.HasPrefix(c.ref, "refs/"):
+		names = []plumbing.ReferenceName{plumbing.ReferenceName(c.ref)}
+	default:
+		names = []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName(c.ref),
+			plumbing.NewTagReferenceName(c.ref),
+		}
+	}
+	for _, name := range names {
+		ref, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if ref.Type() == plumbing.SymbolicReference {
+			// HEAD names the default branch
+			name = ref.Target()
+			if ref, ok = byName[name]; !ok {
+				continue
+			}
+		}
+		// An annotated tag is fetched and peeled to its commit
+		return name, ref.Hash(), nil
+	}
+	if c.ref == "" {
+		return "", plumbing.ZeroHash, fmt.Errorf("%s has no default branch", c.url)
+	}
+	return "", plumbing.ZeroHash, fmt.Errorf("%s has no branch or tag %s", c.url, c.ref)
+}
+
+// fetch fetches the commit hash of the reference name unless it is in the
+// cache already. Only the commit is fetched, not its history.
+func (c *Client) fetch(ctx context.Context, name plumbing.ReferenceName, hash plumbing.Hash) error {
+	if _, err := c.repo.Object(plumbing.AnyObject, hash); err == nil {
+		return nil
+	}
+	log.Debug("Fetching %s of %s at %s", name, c.url, hash)
+	err := c.remote.FetchContext(ctx, &gogit.FetchOptions{
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", name, name))},
+		Depth:    1,
+		Auth:     c.auth,
+		Tags:     gogit.NoTags,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("cannot fetch %s of %s: %s", name, c.url, err)
+	}
+	return nil
+}
+
+// read returns the files below the directory of the commit hash points
+// to, peeling annotated tags.
+func (c *Client) read(hash plumbing.Hash) (map[string]string, error) {
+	obj, err := c.repo.Object(plumbing.AnyObject, hash)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tag, ok := obj.(*object.Tag)
+		if !ok {
+			break
+		}
+		if obj, err = tag.Object(); err != nil {
+			return nil, err
+		}
+	}
+	commit, ok := obj.(*object.Commit)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a commit", hash)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if c.dir != "/" {
+		if tree, err = tree.Tree(strings.TrimPrefix(c.dir, "/")); err != nil {
+			return nil, fmt.Errorf("cannot read %s of %s at %s: %s", c.dir, c.url, hash, err)
+		}
+	}
+
+	files := make(map[string]string)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !f.Mode.IsFile() {
+			// Symbolic links and submodules are not followed
+			return nil
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files["/"+f.Name] = string(b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetValues reads the files of the head of the ref whose path starts with
+// one of keys, fetching it if it is new.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	name, hash, err := c.head(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.commit != hash.String() {
+		if err := c.fetch(ctx, name, hash); err != nil {
+			return nil, err
+		}
+		files, err := c.read(hash)
+		if err != nil {
+			return nil, err
+		}
+		c.commit, c.files = hash.String(), files
+	}
+
+	vars := make(map[string]string)
+	for k, v := range c.files {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// index returns the wait index of the commit hash, made of its first
+// bytes.
+func index(hash plumbing.Hash) uint64 {
+	if i := binary.BigEndian.Uint64(hash[:8]); i != 0 {
+		return i
+	}
+	return 1
+}
+
+// WatchPrefix asks the remote for the head of the ref every pollInterval,
+// and returns the index of its commit once it changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	for {
+		_, hash, err := c.head(ctx)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if i := index(hash); i != waitIndex {
+			return i, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// KeepAlive is a no-op, every request opens a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
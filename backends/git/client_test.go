@@ -0,0 +1,135 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// newRepository creates a repository to read, and returns its path and a
+// function committing files to it.
+func newRepository(t *testing.T) (string, func(files map[string]string), func()) {
+	log.SetLevel("error")
+	dir, err := ioutil.TempDir("", "confd-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "repo")
+	repo, err := gogit.PlainInit(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(files map[string]string) {
+		for name, content := range files {
+			file := filepath.Join(path, name)
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Error(err)
+			}
+			if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+				t.Error(err)
+			}
+			if _, err := worktree.Add(name); err != nil {
+				t.Error(err)
+			}
+		}
+		_, err := worktree.Commit("Update", &gogit.CommitOptions{
+			Author: &object.Signature{Name: "confd", Email: "confd@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	return path, commit, func() { os.RemoveAll(dir) }
+}
+
+func TestGetValues(t *testing.T) {
+	path, commit, cleanup := newRepository(t)
+	defer cleanup()
+	commit(map[string]string{
+		"README.md":                    "not read",
+		"config/myapp/database/url":    "db.example.com",
+		"config/myapp/database/user":   "rob",
+		"config/otherapp/database/url": "other.example.com",
+	})
+
+	c, err := New([]string{path}, "", "config", filepath.Join(filepath.Dir(path), "cache"), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+
+	c, err = New([]string{path}, "missing", "", filepath.Join(filepath.Dir(path), "cache"), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetValues(context.Background(), []string{"/"}); err == nil {
+		t.Error("GetValues() of a missing branch succeeded")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	path, commit, cleanup := newRepository(t)
+	defer cleanup()
+	commit(map[string]string{"myapp/key": "foo"})
+
+	c, err := New([]string{path}, "master", "", filepath.Join(filepath.Dir(path), "cache"), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index == 0 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want the index of the head", index, err)
+	}
+	if vars, err := c.GetValues(context.Background(), keys); err != nil || vars["/myapp/key"] != "foo" {
+		t.Errorf("GetValues() = %v, %v, want the first value", vars, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		commit(map[string]string{"myapp/key": "bar"})
+	}()
+	next, err := c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || next == index {
+		t.Fatalf("WatchPrefix() after a commit = %d, %v, want a new index", next, err)
+	}
+	if vars, err := c.GetValues(context.Background(), keys); err != nil || vars["/myapp/key"] != "bar" {
+		t.Errorf("GetValues() after a commit = %v, %v, want the new value", vars, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, next); err != nil || stopped != next {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, next)
+	}
+}
@@ -0,0 +1,113 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/grpc/kvpb"
+	"github.com/zyf0330/confd/util"
+)
+
+// tokenAuth sends a bearer token with every call.
+type tokenAuth string
+
+func (t tokenAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity allows the token over plaintext connections,
+// e.g. to a sidecar.
+func (t tokenAuth) RequireTransportSecurity() bool {
+	return false
+}
+
+// Client is a wrapper around a KV service, see kvpb/kv.proto.
+type Client struct {
+	kv kvpb.KVClient
+}
+
+func init() {
+	backends.Register("grpc", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.AuthToken)
+	})
+}
+
+// New returns a *grpc.Client of the KV service at nodes, the calls being
+// balanced between them. The connections use TLS if a client certificate
+// or CA certificate is given, and the calls carry authToken as a bearer
+// token if set.
+func New(nodes []string, cert, key, caCert, authToken string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no server given, set it with -node")
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if tlsConfig != nil {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+	}
+	if authToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenAuth(authToken)))
+	}
+
+	// The nodes are resolved once, as given
+	r, _ := manual.GenerateAndRegisterManualResolver()
+	addresses := make([]resolver.Address, 0, len(nodes))
+	for _, node := range nodes {
+		addresses = append(addresses, resolver.Address{Addr: node})
+	}
+	r.InitialState(resolver.State{Addresses: addresses})
+	opts = append(opts, grpc.WithBalancerName("round_robin"))
+
+	conn, err := grpc.Dial(r.Scheme()+":///confd", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{kv: kvpb.NewKVClient(conn)}, nil
+}
+
+// GetValues queries the service for the pairs whose keys start with one of
+// keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	resp, err := c.kv.GetValues(ctx, &kvpb.GetValuesRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	vars := resp.GetValues()
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	return vars, nil
+}
+
+// WatchPrefix returns the first revision after waitIndex the service sends
+// on the WatchPrefix stream of keys, the current one if waitIndex is 0.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.kv.WatchPrefix(ctx, &kvpb.WatchPrefixRequest{Keys: keys, Revision: waitIndex})
+	for err == nil {
+		var resp *kvpb.WatchPrefixResponse
+		resp, err = stream.Recv()
+		if err == nil && resp.GetRevision() > waitIndex {
+			return resp.GetRevision(), nil
+		}
+	}
+	if ctx.Err() != nil {
+		return waitIndex, nil
+	}
+	return waitIndex, err
+}
+
+// KeepAlive is a no-op, gRPC reconnects on its own.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
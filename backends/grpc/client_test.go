@@ -0,0 +1,165 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/zyf0330/confd/backends/grpc/kvpb"
+)
+
+// fakeKV is a KV service whose revision increases on every set.
+type fakeKV struct {
+	mu       sync.Mutex
+	revision uint64
+	values   map[string]string
+	changed  chan struct{}
+}
+
+func newFakeKV(values map[string]string) *fakeKV {
+	return &fakeKV{revision: 1, values: values, changed: make(chan struct{})}
+}
+
+func (f *fakeKV) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++
+	f.values[key] = value
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func authorized(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer token" {
+		return status.Error(codes.Unauthenticated, "no token")
+	}
+	return nil
+}
+
+func (f *fakeKV) GetValues(ctx context.Context, req *kvpb.GetValuesRequest) (*kvpb.GetValuesResponse, error) {
+	if err := authorized(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := make(map[string]string)
+	for k, v := range f.values {
+		for _, key := range req.Keys {
+			if strings.HasPrefix(k, key) {
+				values[k] = v
+			}
+		}
+	}
+	return &kvpb.GetValuesResponse{Values: values, Revision: f.revision}, nil
+}
+
+func (f *fakeKV) WatchPrefix(req *kvpb.WatchPrefixRequest, stream kvpb.KV_WatchPrefixServer) error {
+	if err := authorized(stream.Context()); err != nil {
+		return err
+	}
+	for {
+		f.mu.Lock()
+		revision, changed := f.revision, f.changed
+		f.mu.Unlock()
+		if revision > req.Revision {
+			if err := stream.Send(&kvpb.WatchPrefixResponse{Revision: revision}); err != nil {
+				return err
+			}
+			req.Revision = revision
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// serve serves kv in process and returns a client of it.
+func serve(t *testing.T, kv kvpb.KVServer) (*Client, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	kvpb.RegisterKVServer(server, kv)
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithPerRPCCredentials(tokenAuth("token")),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return lis.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{kv: kvpb.NewKVClient(conn)}, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	c, stop := serve(t, newFakeKV(map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/other":               "ignored",
+	}))
+	defer stop()
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	kv := newFakeKV(map[string]string{"/myapp/key": "foo"})
+	c, stop := serve(t, kv)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/myapp", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		kv.set("/myapp/key", "bar")
+	}()
+	index, err = c.WatchPrefix(ctx, "/myapp", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	stopped, err := c.WatchPrefix(ctx, "/myapp", keys, index)
+	if err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,6 @@
+// Package kvpb is the KV service confd reads key/value pairs from with
+// -backend=grpc. It is generated from kv.proto with protoc-gen-go v1.3.2,
+// whose gRPC code works with the gRPC version confd is built with.
+package kvpb
+
+//go:generate protoc -I ../../.. --go_out=plugins=grpc,paths=source_relative:../../.. backends/grpc/kvpb/kv.proto
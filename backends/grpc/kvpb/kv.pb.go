@@ -0,0 +1,389 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: backends/grpc/kvpb/kv.proto
+
+package kvpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type GetValuesRequest struct {
+	// Key prefixes, such as "/myapp/database"
+	Keys                 []string `protobuf:"bytes,1,rep,name=keys,proto3" json:"keys,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetValuesRequest) Reset()         { *m = GetValuesRequest{} }
+func (m *GetValuesRequest) String() string { return proto.CompactTextString(m) }
+func (*GetValuesRequest) ProtoMessage()    {}
+func (*GetValuesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_75bad11bb44b35f4, []int{0}
+}
+
+func (m *GetValuesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetValuesRequest.Unmarshal(m, b)
+}
+func (m *GetValuesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetValuesRequest.Marshal(b, m, deterministic)
+}
+func (m *GetValuesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetValuesRequest.Merge(m, src)
+}
+func (m *GetValuesRequest) XXX_Size() int {
+	return xxx_messageInfo_GetValuesRequest.Size(m)
+}
+func (m *GetValuesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetValuesRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetValuesRequest proto.InternalMessageInfo
+
+func (m *GetValuesRequest) GetKeys() []string {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+type GetValuesResponse struct {
+	Values map[string]string `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// The revision of the values
+	Revision             uint64   `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetValuesResponse) Reset()         { *m = GetValuesResponse{} }
+func (m *GetValuesResponse) String() string { return proto.CompactTextString(m) }
+func (*GetValuesResponse) ProtoMessage()    {}
+func (*GetValuesResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_75bad11bb44b35f4, []int{1}
+}
+
+func (m *GetValuesResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetValuesResponse.Unmarshal(m, b)
+}
+func (m *GetValuesResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetValuesResponse.Marshal(b, m, deterministic)
+}
+func (m *GetValuesResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetValuesResponse.Merge(m, src)
+}
+func (m *GetValuesResponse) XXX_Size() int {
+	return xxx_messageInfo_GetValuesResponse.Size(m)
+}
+func (m *GetValuesResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetValuesResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetValuesResponse proto.InternalMessageInfo
+
+func (m *GetValuesResponse) GetValues() map[string]string {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+func (m *GetValuesResponse) GetRevision() uint64 {
+	if m != nil {
+		return m.Revision
+	}
+	return 0
+}
+
+type WatchPrefixRequest struct {
+	// Key prefixes, such as "/myapp/database"
+	Keys []string `protobuf:"bytes,1,rep,name=keys,proto3" json:"keys,omitempty"`
+	// The revision the client has seen, 0 for none
+	Revision             uint64   `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchPrefixRequest) Reset()         { *m = WatchPrefixRequest{} }
+func (m *WatchPrefixRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchPrefixRequest) ProtoMessage()    {}
+func (*WatchPrefixRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_75bad11bb44b35f4, []int{2}
+}
+
+func (m *WatchPrefixRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchPrefixRequest.Unmarshal(m, b)
+}
+func (m *WatchPrefixRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchPrefixRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchPrefixRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchPrefixRequest.Merge(m, src)
+}
+func (m *WatchPrefixRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchPrefixRequest.Size(m)
+}
+func (m *WatchPrefixRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchPrefixRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchPrefixRequest proto.InternalMessageInfo
+
+func (m *WatchPrefixRequest) GetKeys() []string {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+func (m *WatchPrefixRequest) GetRevision() uint64 {
+	if m != nil {
+		return m.Revision
+	}
+	return 0
+}
+
+type WatchPrefixResponse struct {
+	Revision             uint64   `protobuf:"varint,1,opt,name=revision,proto3" json:"revision,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchPrefixResponse) Reset()         { *m = WatchPrefixResponse{} }
+func (m *WatchPrefixResponse) String() string { return proto.CompactTextString(m) }
+func (*WatchPrefixResponse) ProtoMessage()    {}
+func (*WatchPrefixResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_75bad11bb44b35f4, []int{3}
+}
+
+func (m *WatchPrefixResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchPrefixResponse.Unmarshal(m, b)
+}
+func (m *WatchPrefixResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchPrefixResponse.Marshal(b, m, deterministic)
+}
+func (m *WatchPrefixResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchPrefixResponse.Merge(m, src)
+}
+func (m *WatchPrefixResponse) XXX_Size() int {
+	return xxx_messageInfo_WatchPrefixResponse.Size(m)
+}
+func (m *WatchPrefixResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchPrefixResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchPrefixResponse proto.InternalMessageInfo
+
+func (m *WatchPrefixResponse) GetRevision() uint64 {
+	if m != nil {
+		return m.Revision
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*GetValuesRequest)(nil), "confd.kv.v1.GetValuesRequest")
+	proto.RegisterType((*GetValuesResponse)(nil), "confd.kv.v1.GetValuesResponse")
+	proto.RegisterMapType((map[string]string)(nil), "confd.kv.v1.GetValuesResponse.ValuesEntry")
+	proto.RegisterType((*WatchPrefixRequest)(nil), "confd.kv.v1.WatchPrefixRequest")
+	proto.RegisterType((*WatchPrefixResponse)(nil), "confd.kv.v1.WatchPrefixResponse")
+}
+
+func init() { proto.RegisterFile("backends/grpc/kvpb/kv.proto", fileDescriptor_75bad11bb44b35f4) }
+
+var fileDescriptor_75bad11bb44b35f4 = []byte{
+	// 287 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0xc1, 0x4e, 0x83, 0x40,
+	0x10, 0xcd, 0x52, 0x24, 0x32, 0x5c, 0xea, 0xe8, 0x81, 0x60, 0x54, 0xc2, 0xc1, 0x10, 0x0f, 0x8b,
+	0xad, 0x17, 0xf5, 0xd8, 0x68, 0x4c, 0xf4, 0x62, 0xf6, 0x50, 0x13, 0x6f, 0x40, 0xb7, 0x4a, 0xd6,
+	0x00, 0xb2, 0x74, 0x23, 0xff, 0xe3, 0xd9, 0x6f, 0x34, 0x5d, 0x9a, 0x06, 0xd2, 0x94, 0xdb, 0xbc,
+	0xc9, 0x7b, 0x2f, 0xef, 0x4d, 0x06, 0x4e, 0x93, 0x38, 0x15, 0x3c, 0x5f, 0xc8, 0xe8, 0xa3, 0x2a,
+	0xd3, 0x48, 0xa8, 0x32, 0x89, 0x84, 0xa2, 0x65, 0x55, 0xd4, 0x05, 0x3a, 0x69, 0x91, 0x2f, 0x17,
+	0x54, 0x28, 0xaa, 0x26, 0xc1, 0x25, 0x8c, 0x9f, 0x78, 0x3d, 0x8f, 0xbf, 0x56, 0x5c, 0x32, 0xfe,
+	0xbd, 0xe2, 0xb2, 0x46, 0x04, 0x53, 0xf0, 0x46, 0xba, 0xc4, 0x1f, 0x85, 0x36, 0xd3, 0x73, 0xf0,
+	0x47, 0xe0, 0xa8, 0x43, 0x94, 0x65, 0x91, 0x4b, 0x8e, 0x33, 0xb0, 0x94, 0xde, 0x68, 0xae, 0x33,
+	0xbd, 0xa2, 0x1d, 0x6f, 0xba, 0xc3, 0xa7, 0x2d, 0x7c, 0xcc, 0xeb, 0xaa, 0x61, 0x1b, 0x25, 0x7a,
+	0x70, 0x58, 0x71, 0x95, 0xc9, 0xac, 0xc8, 0x5d, 0xc3, 0x27, 0xa1, 0xc9, 0xb6, 0xd8, 0xbb, 0x03,
+	0xa7, 0x23, 0xc1, 0x31, 0x8c, 0x04, 0x6f, 0x5c, 0xe2, 0x93, 0xd0, 0x66, 0xeb, 0x11, 0x4f, 0xe0,
+	0x40, 0xdb, 0x68, 0xa5, 0xcd, 0x5a, 0x70, 0x6f, 0xdc, 0x92, 0xe0, 0x01, 0xf0, 0x2d, 0xae, 0xd3,
+	0xcf, 0xd7, 0x8a, 0x2f, 0xb3, 0x9f, 0x81, 0x6a, 0x43, 0x01, 0x82, 0x09, 0x1c, 0xf7, 0x5c, 0x36,
+	0xbd, 0xbb, 0x12, 0xd2, 0x97, 0x4c, 0x7f, 0x09, 0x18, 0x2f, 0x73, 0x7c, 0x06, 0x7b, 0xdb, 0x1f,
+	0xcf, 0xf6, 0xdd, 0x45, 0xa7, 0xf2, 0xce, 0x87, 0xcf, 0x86, 0x0c, 0x9c, 0x4e, 0x0a, 0xbc, 0xe8,
+	0xd1, 0x77, 0x5b, 0x7a, 0xfe, 0x7e, 0x42, 0xeb, 0x78, 0x4d, 0x66, 0xd6, 0xbb, 0xb9, 0x7e, 0x8b,
+	0xc4, 0xd2, 0x4f, 0x71, 0xf3, 0x3f, 0x00, 0x93, 0x9a, 0x4b, 0x9d, 0x33, 0x02, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// KVClient is the client API for KV service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type KVClient interface {
+	// GetValues returns the pairs whose keys start with one of the keys
+	// requested.
+	GetValues(ctx context.Context, in *GetValuesRequest, opts ...grpc.CallOption) (*GetValuesResponse, error)
+	// WatchPrefix streams the revisions at which the pairs whose keys start
+	// with one of the keys requested changed, after the revision requested.
+	// With revision 0 the current revision is sent at once. Revisions start
+	// at 1 and only increase.
+	WatchPrefix(ctx context.Context, in *WatchPrefixRequest, opts ...grpc.CallOption) (KV_WatchPrefixClient, error)
+}
+
+type kVClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewKVClient(cc *grpc.ClientConn) KVClient {
+	return &kVClient{cc}
+}
+
+func (c *kVClient) GetValues(ctx context.Context, in *GetValuesRequest, opts ...grpc.CallOption) (*GetValuesResponse, error) {
+	out := new(GetValuesResponse)
+	err := c.cc.Invoke(ctx, "/confd.kv.v1.KV/GetValues", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVClient) WatchPrefix(ctx context.Context, in *WatchPrefixRequest, opts ...grpc.CallOption) (KV_WatchPrefixClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_KV_serviceDesc.Streams[0], "/confd.kv.v1.KV/WatchPrefix", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVWatchPrefixClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KV_WatchPrefixClient interface {
+	Recv() (*WatchPrefixResponse, error)
+	grpc.ClientStream
+}
+
+type kVWatchPrefixClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVWatchPrefixClient) Recv() (*WatchPrefixResponse, error) {
+	m := new(WatchPrefixResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KVServer is the server API for KV service.
+type KVServer interface {
+	// GetValues returns the pairs whose keys start with one of the keys
+	// requested.
+	GetValues(context.Context, *GetValuesRequest) (*GetValuesResponse, error)
+	// WatchPrefix streams the revisions at which the pairs whose keys start
+	// with one of the keys requested changed, after the revision requested.
+	// With revision 0 the current revision is sent at once. Revisions start
+	// at 1 and only increase.
+	WatchPrefix(*WatchPrefixRequest, KV_WatchPrefixServer) error
+}
+
+// UnimplementedKVServer can be embedded to have forward compatible implementations.
+type UnimplementedKVServer struct {
+}
+
+func (*UnimplementedKVServer) GetValues(ctx context.Context, req *GetValuesRequest) (*GetValuesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetValues not implemented")
+}
+func (*UnimplementedKVServer) WatchPrefix(req *WatchPrefixRequest, srv KV_WatchPrefixServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPrefix not implemented")
+}
+
+func RegisterKVServer(s *grpc.Server, srv KVServer) {
+	s.RegisterService(&_KV_serviceDesc, srv)
+}
+
+func _KV_GetValues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetValuesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).GetValues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/confd.kv.v1.KV/GetValues",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).GetValues(ctx, req.(*GetValuesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KV_WatchPrefix_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPrefixRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVServer).WatchPrefix(m, &kVWatchPrefixServer{stream})
+}
+
+type KV_WatchPrefixServer interface {
+	Send(*WatchPrefixResponse) error
+	grpc.ServerStream
+}
+
+type kVWatchPrefixServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVWatchPrefixServer) Send(m *WatchPrefixResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _KV_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "confd.kv.v1.KV",
+	HandlerType: (*KVServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetValues",
+			Handler:    _KV_GetValues_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPrefix",
+			Handler:       _KV_WatchPrefix_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "backends/grpc/kvpb/kv.proto",
+}
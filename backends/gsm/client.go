@@ -0,0 +1,313 @@
+package gsm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+const secretManagerURL = "https://secretmanager.googleapis.com"
+
+// Secret names cannot contain slashes, the slashes of the keys are
+// replaced by this separator: /myapp/db/password is stored in the secret
+// myapp__db__password.
+const separator = "__"
+
+// Secret Manager has no way to watch secrets, changes are detected by
+// polling the creation times of the versions read.
+var pollInterval = 30 * time.Second
+
+// apiError is a failed Secret Manager API request.
+type apiError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("error from Secret Manager (%s): %s", e.Status, e.Message)
+}
+
+// version is a secret version as returned by the API.
+type version struct {
+	Name       string `json:"name"`
+	CreateTime string `json:"createTime"`
+}
+
+// Client is a wrapper around the Secret Manager API.
+type Client struct {
+	client  *http.Client
+	baseURL string
+	project string
+	// Version read of every secret, latest for the latest enabled one
+	version string
+	poller  *util.Poller
+}
+
+// transform maps a key onto the ID of the secret holding it.
+func transform(key string) string {
+	return strings.Replace(strings.Trim(key, "/"), "/", separator, -1)
+}
+
+// clean maps a secret ID back onto its key.
+func clean(id string) string {
+	return "/" + strings.Replace(id, separator, "/", -1)
+}
+
+func init() {
+	backends.Register("gsm", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Credentials, config.SecretVersion)
+	})
+}
+
+// New returns a *gsm.Client reading the secrets of the project named by
+// the first node, or else the project of the credentials. It
+// authenticates with the service account key in credentialsFile, or the
+// Application Default Credentials if it is empty. secretVersion selects
+// the version of every secret to read, a number or an alias, latest for
+// the latest enabled one.
+func New(nodes []string, credentialsFile, secretVersion string) (*Client, error) {
+	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+	ctx := context.Background()
+	var creds *google.Credentials
+	if credentialsFile != "" {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read credentials from %s: %s", credentialsFile, err)
+		}
+	} else {
+		var err error
+		creds, err = google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	project := creds.ProjectID
+	if len(nodes) > 0 {
+		project = nodes[0]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("no Google Cloud project given, set it with -node")
+	}
+	return newClient(oauth2.NewClient(ctx, creds.TokenSource), secretManagerURL, project, secretVersion), nil
+}
+
+func newClient(client *http.Client, baseURL, project, secretVersion string) *Client {
+	if secretVersion == "" {
+		secretVersion = "latest"
+	}
+	return &Client{
+		client:  client,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		project: strings.TrimPrefix(project, "projects/"),
+		version: secretVersion,
+		poller:  util.NewPoller(pollInterval),
+	}
+}
+
+// get requests path below the API and decodes the JSON response into v.
+func (c *Client) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	u := fmt.Sprintf("%s/v1/%s", c.baseURL, path)
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err := json.Unmarshal(data, &body); err != nil || body.Error.Message == "" {
+			body.Error.Message = strings.TrimSpace(string(data))
+		}
+		return &apiError{resp.StatusCode, resp.Status, body.Error.Message}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// secrets returns the IDs of the secrets whose keys start with key.
+func (c *Client) secrets(ctx context.Context, key string) ([]string, error) {
+	prefix := transform(key)
+	var ids []string
+	params := url.Values{}
+	params.Set("pageSize", "250")
+	if prefix != "" {
+		// Matches the names containing prefix, narrowed down below
+		params.Set("filter", "name:"+prefix)
+	}
+	for {
+		var page struct {
+			Secrets []struct {
+				Name string `json:"name"`
+			} `json:"secrets"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := c.get(ctx, "projects/"+c.project+"/secrets", params, &page); err != nil {
+			return nil, err
+		}
+		for _, s := range page.Secrets {
+			id := s.Name[strings.LastIndex(s.Name, "/")+1:]
+			if strings.HasPrefix(id, prefix) {
+				ids = append(ids, id)
+			}
+		}
+		if page.NextPageToken == "" {
+			return ids, nil
+		}
+		params.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// secretVersion returns the version of the secret id to read, nil if it has
+// no enabled version.
+func (c *Client) secretVersion(ctx context.Context, id string) (*version, error) {
+	secret := "projects/" + c.project + "/secrets/" + id
+	if c.version != "latest" {
+		var v version
+		if err := c.get(ctx, secret+"/versions/"+url.PathEscape(c.version), nil, &v); err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	// The latest version may be disabled, take the latest enabled one.
+	// Versions are listed newest first.
+	var page struct {
+		Versions []version `json:"versions"`
+	}
+	params := url.Values{}
+	params.Set("filter", "state:ENABLED")
+	params.Set("pageSize", "1")
+	if err := c.get(ctx, secret+"/versions", params, &page); err != nil {
+		return nil, err
+	}
+	if len(page.Versions) == 0 {
+		return nil, nil
+	}
+	return &page.Versions[0], nil
+}
+
+// skip reports whether err only concerns a single secret, which is then
+// left out rather than failing the whole render. IAM permissions are
+// often granted per secret.
+func skip(id string, err error) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		log.Warning("Skipping secret %s: %s", id, e.Message)
+		return true
+	case http.StatusNotFound:
+		// Deleted since it was listed, or without the pinned version
+		log.Debug("Skipping secret %s: %s", id, e.Message)
+		return true
+	}
+	return false
+}
+
+// versions returns the version to read of every secret holding keys.
+func (c *Client) versions(ctx context.Context, keys []string) (map[string]*version, error) {
+	versions := make(map[string]*version)
+	for _, key := range keys {
+		ids, err := c.secrets(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			v, err := c.secretVersion(ctx, id)
+			if err != nil && !skip(id, err) {
+				return nil, err
+			}
+			if v != nil {
+				versions[id] = v
+			}
+		}
+	}
+	return versions, nil
+}
+
+// GetValues retrieves the values of the secrets whose keys start with one
+// of keys, from the latest enabled or the pinned version of each.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	versions, err := c.versions(ctx, keys)
+	if err != nil {
+		return vars, err
+	}
+	for id, v := range versions {
+		var resp struct {
+			Payload struct {
+				Data string `json:"data"`
+			} `json:"payload"`
+		}
+		if err := c.get(ctx, v.Name+":access", nil, &resp); err != nil {
+			if skip(id, err) {
+				continue
+			}
+			return vars, err
+		}
+		data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+		if err != nil {
+			return vars, fmt.Errorf("invalid payload of %s: %s", v.Name, err)
+		}
+		vars[clean(id)] = string(data)
+	}
+	return vars, nil
+}
+
+// createTimes returns the creation time of the version read of every
+// secret holding keys.
+func (c *Client) createTimes(ctx context.Context, keys []string) (map[string]string, error) {
+	versions, err := c.versions(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for id, v := range versions {
+		vars[clean(id)] = v.Name + " " + v.CreateTime
+	}
+	return vars, nil
+}
+
+// WatchPrefix polls the versions of the secrets and returns a new index
+// once a secret was added, deleted or got a new version.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.createTimes)
+}
+
+// KeepAlive is a no-op, every request uses its own HTTP round trip.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
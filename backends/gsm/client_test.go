@@ -0,0 +1,217 @@
+package gsm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+type fakeVersion struct {
+	data     string
+	disabled bool
+	created  time.Time
+}
+
+// fakeGSM emulates the Secret Manager API for the project p, listing one
+// secret per page. Versions are numbered from 1 and aliases, keyed by
+// secret/alias, point to them.
+type fakeGSM struct {
+	mu        sync.Mutex
+	secrets   map[string][]fakeVersion
+	aliases   map[string]int
+	forbidden map[string]bool
+}
+
+func newFakeGSM() *fakeGSM {
+	return &fakeGSM{
+		secrets:   make(map[string][]fakeVersion),
+		aliases:   make(map[string]int),
+		forbidden: make(map[string]bool),
+	}
+}
+
+func (f *fakeGSM) add(id, data string, disabled bool) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[id] = append(f.secrets[id], fakeVersion{data, disabled, time.Now()})
+	return len(f.secrets[id])
+}
+
+func (f *fakeGSM) version(w http.ResponseWriter, id string, n int) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":       fmt.Sprintf("projects/p/secrets/%s/versions/%d", id, n),
+		"createTime": f.secrets[id][n-1].created.Format(time.RFC3339Nano),
+	})
+}
+
+func (f *fakeGSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/projects/p/secrets")
+	if path == "" {
+		filter := strings.TrimPrefix(r.URL.Query().Get("filter"), "name:")
+		var ids []string
+		for id := range f.secrets {
+			if strings.Contains(id, filter) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		page := map[string]interface{}{}
+		if start < len(ids) {
+			page["secrets"] = []map[string]string{{"name": "projects/p/secrets/" + ids[start]}}
+		}
+		if start+1 < len(ids) {
+			page["nextPageToken"] = strconv.Itoa(start + 1)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	id := parts[0]
+	versions, ok := f.secrets[id]
+	if !ok || len(parts) < 2 || parts[1] != "versions" {
+		http.Error(w, `{"error": {"message": "not found"}}`, http.StatusNotFound)
+		return
+	}
+	if f.forbidden[id] {
+		http.Error(w, `{"error": {"message": "Permission denied"}}`, http.StatusForbidden)
+		return
+	}
+	if len(parts) == 2 {
+		if r.URL.Query().Get("filter") != "state:ENABLED" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for n := len(versions); n > 0; n-- {
+			if !versions[n-1].disabled {
+				w.Write([]byte(`{"versions": [`))
+				f.version(w, id, n)
+				w.Write([]byte(`]}`))
+				return
+			}
+		}
+		w.Write([]byte("{}"))
+		return
+	}
+
+	name := strings.TrimSuffix(parts[2], ":access")
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		n = f.aliases[id+"/"+name]
+	}
+	if n < 1 || n > len(versions) {
+		http.Error(w, `{"error": {"message": "not found"}}`, http.StatusNotFound)
+		return
+	}
+	if !strings.HasSuffix(parts[2], ":access") {
+		f.version(w, id, n)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(versions[n-1].data))},
+	})
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeGSM()
+	f.add("key", "foobar", false)
+	f.add("database__host", "127.0.0.1", false)
+	f.add("database__port", "3306", false)
+	f.add("database__port", "3307", true)
+	f.add("database__user", "rob", true)
+	f.add("database__password", "p@sSw0rd", false)
+	f.forbidden["database__password"] = true
+	f.add("other__key", "other", false)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, "p", "")
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestGetValuesPinnedVersion(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeGSM()
+	f.aliases["app__key/production"] = f.add("app__key", "stable", false)
+	f.add("app__key", "canary", false)
+	f.add("app__unreleased", "new", false)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, "projects/p", "production")
+
+	vars, err := c.GetValues(context.Background(), []string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars["/app/key"] != "stable" {
+		t.Errorf("GetValues() = %v, want the production version of /app/key only", vars)
+	}
+}
+
+func TestWatchPrefixComparesCreateTimes(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeGSM()
+	f.add("app__key", "foo", false)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := newClient(ts.Client(), ts.URL, "p", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.add("other__key", "ignored", false)
+		time.Sleep(50 * time.Millisecond)
+		f.add("app__key", "bar", false)
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 2", index, err)
+	}
+}
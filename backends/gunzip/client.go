@@ -0,0 +1,100 @@
+// Package gunzip provides a StoreClient decompressing the gzip-compressed
+// values of another one, e.g. large blobs kept under the value size limit
+// of etcd.
+package gunzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// magic starts every gzip-compressed value.
+var magic = []byte{0x1f, 0x8b}
+
+// StoreClient is the backends.StoreClient interface, which the backends
+// package wraps into a *gunzip.Client.
+type StoreClient interface {
+	GetValues(ctx context.Context, keys []string) (map[string]string, error)
+	WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error)
+	KeepAlive(doneChan chan bool)
+}
+
+// Client is a StoreClient decompressing the values of another one starting
+// with the gzip magic bytes, the others being left as they are.
+type Client struct {
+	client StoreClient
+}
+
+// New returns a *gunzip.Client decompressing the values of client.
+func New(client StoreClient) *Client {
+	return &Client{client: client}
+}
+
+// GetValues reads keys from the wrapped client, decompressing the values
+// which are gzip-compressed. It returns an error naming the key of a value
+// which starts as one but cannot be decompressed.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars, err := c.client.GetValues(ctx, keys)
+	if err != nil {
+		return vars, err
+	}
+	for k, v := range vars {
+		if !bytes.HasPrefix([]byte(v), magic) {
+			continue
+		}
+		if vars[k], err = decompress(v); err != nil {
+			return nil, fmt.Errorf("cannot decompress the value of %s: %s", k, err)
+		}
+	}
+	return vars, nil
+}
+
+// decompress returns the content of the gzip-compressed value.
+func decompress(value string) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(value)))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.client.WatchPrefix(ctx, prefix, keys, waitIndex)
+}
+
+func (c *Client) KeepAlive(doneChan chan bool) {
+	c.client.KeepAlive(doneChan)
+}
+
+// Secret reports whether the values of the wrapped client are secrets.
+func (c *Client) Secret() bool {
+	s, ok := c.client.(interface{ Secret() bool })
+	return ok && s.Secret()
+}
+
+// Ping pings the wrapped client.
+func (c *Client) Ping(ctx context.Context) error {
+	if p, ok := c.client.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// SetNodes changes the nodes of the wrapped client. It returns an error if
+// the wrapped client cannot change them.
+func (c *Client) SetNodes(nodes []string) error {
+	s, ok := c.client.(interface{ SetNodes([]string) error })
+	if !ok {
+		return errors.New("the backend cannot change its nodes")
+	}
+	return s.SetNodes(nodes)
+}
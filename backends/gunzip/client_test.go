@@ -0,0 +1,92 @@
+package gunzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mapClient reads the values of a map.
+type mapClient map[string]string
+
+func (c mapClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range c {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+func (c mapClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return waitIndex, nil
+}
+
+func (c mapClient) KeepAlive(doneChan chan bool) {
+}
+
+func compress(t *testing.T, value string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGetValues(t *testing.T) {
+	blob := strings.Repeat("upstream app { server 10.0.0.1; }\n", 100)
+	c := New(mapClient{
+		"/app/blob": compress(t, blob),
+		"/app/port": "8080",
+		"/app/json": `{"a": 1}`,
+		"/app/none": "",
+	})
+	vars, err := c.GetValues(context.Background(), []string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/app/blob": blob,
+		"/app/port": "8080",
+		"/app/json": `{"a": 1}`,
+		"/app/none": "",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %q, want %q", vars, want)
+	}
+
+	// Starts as a compressed value, but is not one
+	c = New(mapClient{"/app/broken": "\x1f\x8bnot gzip"})
+	if _, err := c.GetValues(context.Background(), []string{"/app"}); err == nil || !strings.Contains(err.Error(), "/app/broken") {
+		t.Errorf("GetValues() of a broken value = %v, want an error naming its key", err)
+	}
+}
+
+// nodesClient is a mapClient recording the nodes it is given.
+type nodesClient struct {
+	mapClient
+	nodes []string
+}
+
+func (c *nodesClient) SetNodes(nodes []string) error {
+	c.nodes = nodes
+	return nil
+}
+
+func TestSetNodes(t *testing.T) {
+	nodes := []string{"etcd1:2379", "etcd2:2379"}
+	inner := &nodesClient{mapClient: mapClient{}}
+	if err := New(inner).SetNodes(nodes); err != nil || !reflect.DeepEqual(inner.nodes, nodes) {
+		t.Errorf("SetNodes() = %v, nodes of the wrapped client %q, want %q", err, inner.nodes, nodes)
+	}
+	if err := New(mapClient{}).SetNodes(nodes); err == nil {
+		t.Error("SetNodes() of a client which cannot change its nodes succeeded")
+	}
+}
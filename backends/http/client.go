@@ -0,0 +1,301 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// How often the documents are requested again to tell changes, overridden
+// in tests
+var pollInterval = 30 * time.Second
+
+// document is the last version of a node's document.
+type document struct {
+	etag string
+	vars map[string]string
+}
+
+// Client reads JSON documents from HTTP endpoints, flattening them into
+// keys.
+type Client struct {
+	urls []string
+	// client has a timeout, streamClient does not for long-polls
+	client       *http.Client
+	streamClient *http.Client
+	authorize    func(req *http.Request)
+	// Retries of a failed request and the wait before the first one
+	retryMax      int
+	retryInterval time.Duration
+
+	mu        sync.Mutex
+	documents map[string]document
+	// Closed when a long-poll receives a new document
+	changed chan struct{}
+	// Index of the values last seen, per set of keys
+	versions util.Versions
+
+	// Long-polls are started once the first watch starts
+	watchOnce sync.Once
+}
+
+func init() {
+	backends.Register("http", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.BasicAuth, config.Username, config.Password, config.AuthToken,
+			config.RetryMax, time.Duration(config.RetryInterval)*time.Millisecond)
+	})
+}
+
+// New returns an *http.Client reading the JSON documents at the URLs given
+// by nodes, the later ones overriding the values of the earlier ones. The
+// requests carry authToken as a bearer token, or the username and password
+// with basicAuth, and the client certificate if any. A failed request is
+// retried up to retryMax times, waiting retryInterval before the first
+// retry and doubling it on each one.
+func New(nodes []string, cert, key, caCert string, basicAuth bool, username, password, authToken string, retryMax int, retryInterval time.Duration) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no URL given, set it with -node")
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	authorize := func(req *http.Request) {}
+	switch {
+	case basicAuth:
+		authorize = func(req *http.Request) { req.SetBasicAuth(username, password) }
+	case authToken != "":
+		authorize = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+authToken) }
+	}
+	c := newClient(nodes, &http.Client{Transport: transport, Timeout: 30 * time.Second}, &http.Client{Transport: transport}, authorize)
+	c.retryMax, c.retryInterval = retryMax, retryInterval
+	return c, nil
+}
+
+func newClient(urls []string, client, streamClient *http.Client, authorize func(req *http.Request)) *Client {
+	return &Client{
+		urls:         urls,
+		client:       client,
+		streamClient: streamClient,
+		authorize:    authorize,
+		documents:    make(map[string]document),
+		changed:      make(chan struct{}),
+	}
+}
+
+// decode flattens the JSON document read from dec.
+func decode(dec *json.Decoder) (map[string]string, error) {
+	var content interface{}
+	if err := dec.Decode(&content); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	util.Flatten(content, "/", vars)
+	return vars, nil
+}
+
+// fetch returns the document at u, the one already read if it did not
+// change since.
+func (c *Client) fetch(ctx context.Context, u string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	c.authorize(req)
+	c.mu.Lock()
+	last, ok := c.documents[u]
+	c.mu.Unlock()
+	if ok && last.etag != "" {
+		req.Header.Set("If-None-Match", last.etag)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		return last.vars, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	vars, err := decode(dec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the document at %s: %s", u, err)
+	}
+	c.mu.Lock()
+	c.documents[u] = document{resp.Header.Get("ETag"), vars}
+	c.mu.Unlock()
+	return vars, nil
+}
+
+// GetValues requests the documents, retrying failed requests, and returns
+// their keys prefixed by one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, u := range c.urls {
+		var values map[string]string
+		err := util.Retry(ctx, c.retryMax, c.retryInterval, func() error {
+			var err error
+			values, err = c.fetch(ctx, u)
+			return err
+		})
+		if err != nil {
+			return vars, err
+		}
+		for k, v := range values {
+			for _, key := range keys {
+				if strings.HasPrefix(k, key) {
+					vars[k] = v
+					break
+				}
+			}
+		}
+	}
+	return vars, nil
+}
+
+// notify wakes up the watches.
+func (c *Client) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// longPoll receives the new versions of the document at u for as long as
+// confd runs, if the server streams them in a chunked response to a
+// request with watch=true. Otherwise the document is only polled.
+func (c *Client) longPoll(u string) {
+	watchURL, err := url.Parse(u)
+	if err != nil {
+		return
+	}
+	query := watchURL.Query()
+	query.Set("watch", "true")
+	watchURL.RawQuery = query.Encode()
+
+	interval := c.retryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	streamed := false
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest("GET", watchURL.String(), nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Accept", "application/json")
+		c.authorize(req)
+		resp, err := c.streamClient.Do(req)
+		if err == nil && (resp.StatusCode != http.StatusOK || !isChunked(resp)) {
+			resp.Body.Close()
+			if !streamed {
+				log.Debug("%s does not stream changes, polling it", u)
+				return
+			}
+			err = fmt.Errorf("GET %s: %s", watchURL, resp.Status)
+		}
+		if err != nil {
+			wait := util.Backoff(interval, retry)
+			log.Warning("Cannot long-poll %s, retrying in %s: %s", u, wait, err)
+			time.Sleep(wait)
+			continue
+		}
+
+		streamed = true
+		retry = 0
+		dec := json.NewDecoder(resp.Body)
+		dec.UseNumber()
+		for {
+			if _, err := decode(dec); err != nil {
+				log.Debug("Long-poll of %s ended: %s", u, err)
+				break
+			}
+			c.notify()
+		}
+		resp.Body.Close()
+	}
+}
+
+func isChunked(resp *http.Response) bool {
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchPrefix returns an index greater than waitIndex once the values
+// of keys changed. The documents are requested again every pollInterval,
+// with the ETag of the last version so unchanged ones are not sent again,
+// and as soon as a long-poll receives a new version.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.watchOnce.Do(func() {
+		for _, u := range c.urls {
+			go c.longPoll(u)
+		}
+	})
+	if waitIndex == 0 {
+		vars, err := c.GetValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		return c.versions.Update(keys, vars), nil
+	}
+
+	for {
+		// Values another watcher of keys already saw changed
+		if index := c.versions.Index(keys); index > waitIndex {
+			return index, nil
+		}
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		case <-time.After(pollInterval):
+		}
+
+		vars, err := c.GetValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index := c.versions.Update(keys, vars); index > waitIndex {
+			return index, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, every request opens or reuses a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
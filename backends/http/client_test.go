@@ -0,0 +1,179 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeServer serves a JSON document with its version as ETag, failing the
+// first requests if asked to, and streams the new versions to the requests
+// with watch=true if it streams.
+type fakeServer struct {
+	mu       sync.Mutex
+	document string
+	version  int
+	failures int
+	streams  bool
+	watches  []chan string
+	// Requests answered with the document
+	sent int
+}
+
+func (f *fakeServer) set(document string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.document = document
+	f.version++
+	for _, w := range f.watches {
+		w <- document
+	}
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("watch") == "true" && f.streams {
+		events := make(chan string, 10)
+		f.watches = append(f.watches, events)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-events:
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	defer f.mu.Unlock()
+	etag := fmt.Sprintf(`"%d"`, f.version)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f.sent++
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, f.document)
+}
+
+func bearer(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer token")
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	first := &fakeServer{failures: 2}
+	first.set(`{"myapp": {"database": {"url": "db.example.com", "port": 5432}, "hosts": ["a", "b"]}, "other": true}`)
+	second := &fakeServer{}
+	second.set(`{"myapp": {"database": {"url": "override.example.com"}}}`)
+	s1, s2 := httptest.NewServer(first), httptest.NewServer(second)
+	defer s1.Close()
+	defer s2.Close()
+
+	c := newClient([]string{s1.URL, s2.URL}, s1.Client(), s1.Client(), bearer)
+	c.retryMax, c.retryInterval = 3, time.Millisecond
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "override.example.com",
+		"/myapp/database/port": "5432",
+		"/myapp/hosts/0":       "a",
+		"/myapp/hosts/1":       "b",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+
+	// Unchanged documents are not sent again
+	if _, err := c.GetValues(context.Background(), []string{"/myapp"}); err != nil {
+		t.Fatal(err)
+	}
+	if first.sent != 1 || second.sent != 1 {
+		t.Errorf("documents sent %d and %d times, want once", first.sent, second.sent)
+	}
+
+	first.failures = 5
+	if _, err := c.GetValues(context.Background(), []string{"/myapp"}); err == nil {
+		t.Error("GetValues() succeeded after more failures than retries")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+
+	for _, streams := range []bool{false, true} {
+		if streams {
+			// Only the long-poll can tell the change in time
+			pollInterval = time.Hour
+		} else {
+			pollInterval = 10 * time.Millisecond
+		}
+		f := &fakeServer{streams: streams}
+		f.set(`{"myapp": {"key": "foo"}, "other": "foo"}`)
+		server := httptest.NewServer(f)
+		c := newClient([]string{server.URL}, server.Client(), server.Client(), bearer)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		keys := []string{"/myapp"}
+
+		index, err := c.WatchPrefix(ctx, "/", keys, 0)
+		if err != nil || index != 1 {
+			t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+		}
+
+		start := time.Now()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			f.set(`{"myapp": {"key": "foo"}, "other": "bar"}`)
+			time.Sleep(50 * time.Millisecond)
+			f.set(`{"myapp": {"key": "bar"}, "other": "bar"}`)
+		}()
+		index, err = c.WatchPrefix(ctx, "/", keys, index)
+		if err != nil || index != 2 {
+			t.Fatalf("WatchPrefix() after change = %d, %v, want 2 (streams: %v)", index, err, streams)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Errorf("WatchPrefix() returned on an unrelated change (streams: %v)", streams)
+		}
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+			t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+		}
+		// The long-poll connects again as soon as its connection closes, and
+		// Close waits for its handler, so no connection is accepted first
+		server.Listener.Close()
+		server.CloseClientConnections()
+		server.Close()
+	}
+}
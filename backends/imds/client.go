@@ -0,0 +1,216 @@
+package imds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+)
+
+var (
+	// How long the requests of a GetValues may take together
+	timeout = 10 * time.Second
+	// How long a session token is valid, and how long before it expires
+	// a new one is requested
+	tokenTTL     = 6 * time.Hour
+	tokenRefresh = time.Minute
+)
+
+// roots are the trees below /latest, those ending with "/" being
+// directories. The listing of /latest does not tell them apart.
+var roots = []string{"meta-data/", "dynamic/", "user-data"}
+
+// Client reads the EC2 instance metadata service with IMDSv2 session
+// tokens, its tree below /latest being the keys, e.g.
+// /meta-data/placement/availability-zone.
+type Client struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func init() {
+	backends.Register("imds", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes)
+	})
+}
+
+// New returns a *imds.Client reading the instance metadata service at the
+// URL given by nodes, e.g. http://169.254.169.254, http:// being the
+// default scheme.
+func New(nodes []string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("the imds backend needs one node, the URL of the service")
+	}
+	u := nodes[0]
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	return &Client{url: strings.TrimSuffix(u, "/"), client: &http.Client{}}, nil
+}
+
+// sessionToken returns the session token, requesting a new one if there is
+// none or it expires within tokenRefresh.
+func (c *Client) sessionToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expires) > tokenRefresh {
+		return c.token, nil
+	}
+	req, err := http.NewRequest("PUT", c.url+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(tokenTTL/time.Second)))
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot get an IMDSv2 session token: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expires = string(body), start.Add(tokenTTL)
+	return c.token, nil
+}
+
+// dropToken makes the next request get a new session token, the service
+// having refused token.
+func (c *Client) dropToken(token string) {
+	c.mu.Lock()
+	if c.token == token {
+		c.token = ""
+	}
+	c.mu.Unlock()
+}
+
+// errNotFound is returned by get for the paths the service does not have.
+var errNotFound = errors.New("not found")
+
+// get returns the body of the path below /latest. A refused session token
+// is renewed once.
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	for retry := true; ; retry = false {
+		token, err := c.sessionToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("GET", c.url+"/latest/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && retry:
+			c.dropToken(token)
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, errNotFound
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("GET /latest/%s: %s", path, resp.Status)
+		}
+		return body, err
+	}
+}
+
+// relevant reports whether the entry at path, a directory if it ends with
+// "/", holds keys starting with one of keys.
+func relevant(path string, keys []string) bool {
+	key := "/" + path
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) || strings.HasSuffix(key, "/") && strings.HasPrefix(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk reads the entries of the directory dir, "" for /latest, into vars,
+// descending only into those holding keys starting with one of keys.
+func (c *Client) walk(ctx context.Context, dir string, entries []string, keys []string, vars map[string]string) error {
+	for _, entry := range entries {
+		path := dir + entry
+		if !relevant(path, keys) {
+			continue
+		}
+		body, err := c.get(ctx, path)
+		if err == errNotFound {
+			// E.g. the user-data of an instance without any
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(path, "/") {
+			vars["/"+path] = string(body)
+			continue
+		}
+		var children []string
+		for _, line := range strings.Split(string(body), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			// The public keys are listed as <index>=<name>, their
+			// directory being <index>/
+			if i := strings.Index(line, "="); i > 0 {
+				line = line[:i] + "/"
+			}
+			children = append(children, line)
+		}
+		if err := c.walk(ctx, path, children, keys, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetValues reads the entries whose keys start with one of keys, only
+// listing the directories leading to them. The values are passed as they
+// are, the user-data being whatever the instance was given.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	vars := make(map[string]string)
+	if err := c.walk(ctx, "", roots, keys, vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// WatchPrefix returns 1 at once for the values to be read, then blocks
+// until ctx is done: the metadata of an instance hardly changes.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-ctx.Done()
+	return waitIndex, nil
+}
+
+// KeepAlive is a no-op, every request opens or reuses a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,210 @@
+package imds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIMDS serves the entries of files below /latest, listing the
+// directories, to the requests carrying a valid session token.
+type fakeIMDS struct {
+	files map[string]string
+
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	// The paths requested, and the tokens handed out
+	paths  []string
+	issued int
+}
+
+func newFakeIMDS(files map[string]string) *fakeIMDS {
+	return &fakeIMDS{files: files, tokens: make(map[string]time.Time)}
+}
+
+// revoke invalidates the session tokens handed out.
+func (f *fakeIMDS) revoke() {
+	f.mu.Lock()
+	f.tokens = make(map[string]time.Time)
+	f.mu.Unlock()
+}
+
+// requests returns the paths requested and the number of tokens handed
+// out.
+func (f *fakeIMDS) requests() ([]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.paths...), f.issued
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/latest/api/token" {
+		ttl, err := strconv.Atoi(r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+		if r.Method != "PUT" || err != nil {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		f.issued++
+		token := "token" + strconv.Itoa(f.issued)
+		f.tokens[token] = time.Now().Add(time.Duration(ttl) * time.Second)
+		w.Write([]byte(token))
+		return
+	}
+	expires, ok := f.tokens[r.Header.Get("X-aws-ec2-metadata-token")]
+	if !ok || time.Now().After(expires) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/latest/")
+	f.paths = append(f.paths, path)
+	if v, ok := f.files[path]; ok {
+		w.Write([]byte(v))
+		return
+	}
+	if !strings.HasSuffix(path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	seen := make(map[string]bool)
+	var entries []string
+	for name := range f.files {
+		if !strings.HasPrefix(name, path) {
+			continue
+		}
+		entry := strings.TrimPrefix(name, path)
+		if i := strings.Index(entry, "/"); i >= 0 {
+			entry = entry[:i+1]
+		}
+		if path == "meta-data/public-keys/" {
+			entry = strings.TrimSuffix(entry, "/") + "=my-key"
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	sort.Strings(entries)
+	w.Write([]byte(strings.Join(entries, "\n")))
+}
+
+var files = map[string]string{
+	"meta-data/instance-id":                       "i-0123456789abcdef0",
+	"meta-data/placement/availability-zone":       "eu-west-1a",
+	"meta-data/placement/region":                  "eu-west-1",
+	"meta-data/public-keys/0/openssh-key":         "ssh-ed25519 AAAA",
+	"meta-data/network/interfaces/macs/0a:1b/mac": "0a:1b",
+	"dynamic/instance-identity/document":          `{"region": "eu-west-1"}`,
+}
+
+func newTestClient(t *testing.T, f *fakeIMDS) *Client {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	c, err := New([]string{strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeIMDS(files)
+	c := newTestClient(t, f)
+
+	vars, err := c.GetValues(context.Background(), []string{"/meta-data/placement", "/meta-data/public-keys", "/user-data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/meta-data/placement/availability-zone": "eu-west-1a",
+		"/meta-data/placement/region":            "eu-west-1",
+		"/meta-data/public-keys/0/openssh-key":   "ssh-ed25519 AAAA",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %q, want %q", vars, want)
+	}
+	// Only the directories leading to the keys are listed
+	paths, _ := f.requests()
+	for _, path := range paths {
+		if strings.HasPrefix(path, "meta-data/network") || strings.HasPrefix(path, "dynamic") || path == "meta-data/instance-id" {
+			t.Errorf("GetValues() requested %s", path)
+		}
+	}
+
+	vars, err = c.GetValues(context.Background(), []string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != len(files) {
+		t.Errorf("GetValues(/) = %q, want every entry", vars)
+	}
+	if _, issued := f.requests(); issued != 1 {
+		t.Errorf("%d session tokens requested, want 1", issued)
+	}
+}
+
+func TestSessionTokenRefresh(t *testing.T) {
+	defer func(ttl, refresh time.Duration) { tokenTTL, tokenRefresh = ttl, refresh }(tokenTTL, tokenRefresh)
+	f := newFakeIMDS(files)
+	c := newTestClient(t, f)
+	keys := []string{"/meta-data/instance-id"}
+
+	// A token refused by the service is renewed
+	if _, err := c.GetValues(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	f.revoke()
+	vars, err := c.GetValues(context.Background(), keys)
+	if err != nil || vars["/meta-data/instance-id"] != files["meta-data/instance-id"] {
+		t.Fatalf("GetValues() with a revoked token = %q, %v", vars, err)
+	}
+	if _, issued := f.requests(); issued != 2 {
+		t.Errorf("%d session tokens requested, want 2", issued)
+	}
+
+	// A token about to expire is renewed beforehand
+	tokenTTL, tokenRefresh = 10*time.Second, 10*time.Second
+	f = newFakeIMDS(files)
+	c = newTestClient(t, f)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetValues(context.Background(), keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each read lists meta-data/ and gets instance-id
+	if _, issued := f.requests(); issued != 4 {
+		t.Errorf("%d session tokens requested for four requests with expiring tokens, want 4", issued)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	c, err := New([]string{"http://169.254.169.254"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 0); err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 1); err != nil || index != 1 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 1", index, err)
+	}
+}
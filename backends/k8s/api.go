@@ -0,0 +1,206 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// The API server is asked to close watches after this many seconds, they
+// are then established again
+const watchTimeout = 300
+
+// Metadata is the metadata of a resource.
+type Metadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// Status is the error returned by the API.
+type Status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("%s (%d): %s", s.Reason, s.Code, s.Message)
+}
+
+// IsNotFound reports whether err is a NotFound error of the API.
+func IsNotFound(err error) bool {
+	s, ok := err.(*Status)
+	return ok && s.Code == http.StatusNotFound
+}
+
+// request sends a GET request for the resources of namespace, or the one
+// named name, and returns the response if it succeeded. A Forbidden error
+// is fatal, naming verb: it does not get better by retrying.
+func (c *Cluster) request(ctx context.Context, verb, resource, namespace, name string, params url.Values) (*http.Response, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/%s", c.server, url.PathEscape(namespace), resource)
+	if name != "" {
+		u += "/" + url.PathEscape(name)
+	}
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s := &Status{Code: resp.StatusCode, Reason: resp.Status}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := json.Unmarshal(data, s); err != nil {
+		s.Message = strings.TrimSpace(string(data))
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		log.Fatal("Not allowed to %s %s in namespace %s, grant the %q verb on the %q resource to confd's service account: %s",
+			verb, resource, namespace, verb, resource, s.Message)
+	}
+	return nil, s
+}
+
+// get sends a request and decodes the response into v.
+func (c *Cluster) get(ctx context.Context, verb, resource, namespace, name string, params url.Values, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := c.request(ctx, verb, resource, namespace, name, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Get decodes the resource of namespace named name into v.
+func (c *Cluster) Get(ctx context.Context, resource, namespace, name string, v interface{}) error {
+	return c.get(ctx, "get", resource, namespace, name, nil, v)
+}
+
+// List decodes the list of the resources of namespace into v.
+func (c *Cluster) List(ctx context.Context, resource, namespace string, v interface{}) error {
+	return c.get(ctx, "list", resource, namespace, "", nil, v)
+}
+
+// Watch follows the changes of the resources of namespace selected by
+// fieldSelector, all of them if empty, for as long as confd runs, calling
+// changed with the name of every resource added, modified or deleted. The
+// watch is established again from the last resource version seen when it
+// closes, after listing the resources again if that version is too old:
+// changed is then called with an empty name, as changes may have been
+// missed.
+func (c *Cluster) Watch(resource, namespace, fieldSelector string, changed func(name string)) {
+	params := url.Values{}
+	if fieldSelector != "" {
+		params.Set("fieldSelector", fieldSelector)
+	}
+	var resourceVersion string
+	listed := false
+	for {
+		if resourceVersion == "" {
+			var list struct {
+				Metadata Metadata `json:"metadata"`
+			}
+			if err := c.get(context.Background(), "list", resource, namespace, "", params, &list); err != nil {
+				log.Error("Cannot list %s in namespace %s: %s", resource, namespace, err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			resourceVersion = list.Metadata.ResourceVersion
+			if listed {
+				changed("")
+			}
+			listed = true
+		}
+
+		var err error
+		resourceVersion, err = c.watchFrom(resource, namespace, params, resourceVersion, changed)
+		if err != nil {
+			log.Error("Cannot watch %s in namespace %s: %s", resource, namespace, err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// watchFrom watches the resources from resourceVersion until the watch
+// closes, and returns the last resource version seen, or "" if it is too
+// old to watch from.
+func (c *Cluster) watchFrom(resource, namespace string, params url.Values, resourceVersion string, changed func(name string)) (string, error) {
+	watchParams := url.Values{}
+	for k, v := range params {
+		watchParams[k] = v
+	}
+	watchParams.Set("watch", "1")
+	watchParams.Set("allowWatchBookmarks", "true")
+	watchParams.Set("timeoutSeconds", fmt.Sprint(watchTimeout))
+	watchParams.Set("resourceVersion", resourceVersion)
+
+	ctx, cancel := context.WithTimeout(context.Background(), (watchTimeout+30)*time.Second)
+	defer cancel()
+	resp, err := c.request(ctx, "watch", resource, namespace, "", watchParams)
+	if s, ok := err.(*Status); ok && s.Code == http.StatusGone {
+		return "", nil
+	}
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				// The API server closed the watch
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+		switch e.Type {
+		case "ADDED", "MODIFIED", "DELETED", "BOOKMARK":
+			var object struct {
+				Metadata Metadata `json:"metadata"`
+			}
+			if err := json.Unmarshal(e.Object, &object); err != nil {
+				return resourceVersion, err
+			}
+			resourceVersion = object.Metadata.ResourceVersion
+			if e.Type != "BOOKMARK" {
+				log.Debug("%s %s/%s %s", resource, namespace, object.Metadata.Name, strings.ToLower(e.Type))
+				changed(object.Metadata.Name)
+			}
+		case "ERROR":
+			var s Status
+			json.Unmarshal(e.Object, &s)
+			if s.Code == http.StatusGone {
+				return "", nil
+			}
+			return resourceVersion, &s
+		}
+	}
+}
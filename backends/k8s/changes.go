@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Changes kept to answer watches which fell behind
+const maxEvents = 1000
+
+// event is a change of the resource holding key, or of all resources if
+// key is empty.
+type event struct {
+	index uint64
+	key   string
+}
+
+// Changes records the changes of resources, to tell the watches of the
+// keys they hold.
+type Changes struct {
+	mu      sync.Mutex
+	index   uint64
+	events  []event
+	changed chan struct{}
+}
+
+// NewChanges returns a *Changes at index 1.
+func NewChanges() *Changes {
+	return &Changes{index: 1, changed: make(chan struct{})}
+}
+
+// Notify records a change of the resource holding the keys below key, of
+// all resources if key is empty.
+func (c *Changes) Notify(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.events = append(c.events, event{c.index, key})
+	if len(c.events) > maxEvents {
+		c.events = c.events[len(c.events)-maxEvents:]
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Wait implements WatchPrefix: it returns a new index once a resource
+// which may hold one of keys changed after waitIndex, or waitIndex once
+// ctx is done.
+func (c *Changes) Wait(ctx context.Context, keys []string, waitIndex uint64) uint64 {
+	c.mu.Lock()
+	if waitIndex == 0 {
+		// return something > 0 to trigger a key retrieval from the store
+		defer c.mu.Unlock()
+		return c.index
+	}
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if len(c.events) > 0 && c.events[0].index > waitIndex+1 {
+			// Changes were dropped, render what is there now
+			defer c.mu.Unlock()
+			return c.index
+		}
+		for _, e := range c.events {
+			if e.index > waitIndex && related(e.key, keys) {
+				defer c.mu.Unlock()
+				return c.index
+			}
+		}
+		waitIndex = c.index
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return waitIndex
+		}
+	}
+}
+
+// related reports whether the resource holding the keys below key may hold
+// one of keys.
+func related(key string, keys []string) bool {
+	if key == "" {
+		return true
+	}
+	for _, k := range keys {
+		if k == key || strings.HasPrefix(k, key+"/") || strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+// Package k8s holds what the Kubernetes backends share: connecting to the
+// API server, reading and watching resources, and tracking their changes.
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Where the service account of the pod is mounted, when running in a
+// cluster
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// config is how to reach and authenticate to the API server.
+type config struct {
+	server    string
+	namespace string
+	tlsConfig *tls.Config
+	authorize func(req *http.Request) error
+}
+
+// inCluster returns the config of the cluster confd runs in, with the
+// credentials of the pod's service account, or nil if it does not run in a
+// cluster.
+func inCluster() (*config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, nil
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	return &config{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		tlsConfig: &tls.Config{RootCAs: pool},
+		// The token is rotated, it is read again for every request
+		authorize: tokenFileAuth(filepath.Join(serviceAccountDir, "token")),
+	}, nil
+}
+
+func tokenFileAuth(path string) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		token, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		return nil
+	}
+}
+
+// kubeconfig is the part of a kubeconfig file used by confd.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			Username              string      `yaml:"username"`
+			Password              string      `yaml:"password"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// defaultKubeconfig returns the kubeconfig file kubectl uses.
+func defaultKubeconfig() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0]
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".kube", "config")
+}
+
+// readData returns the inline base64 data if there is some, or else the
+// content of the file at path, relative to the kubeconfig file in dir.
+func readData(data, path, dir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// loadKubeconfig returns the config of the current context of the
+// kubeconfig file at path. Credentials from exec plugins and auth
+// providers are not supported.
+func loadKubeconfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", path, err)
+	}
+	dir := filepath.Dir(path)
+
+	c := &config{namespace: "default", tlsConfig: &tls.Config{}}
+	var clusterName, userName string
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == kc.CurrentContext {
+			clusterName, userName = ctx.Context.Cluster, ctx.Context.User
+			if ctx.Context.Namespace != "" {
+				c.namespace = ctx.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("no current context in %s", path)
+	}
+
+	for _, cl := range kc.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+		c.server = strings.TrimRight(cl.Cluster.Server, "/")
+		c.tlsConfig.InsecureSkipVerify = cl.Cluster.InsecureSkipTLSVerify
+		ca, err := readData(cl.Cluster.CertificateAuthorityData, cl.Cluster.CertificateAuthority, dir)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificate authority found for cluster %s in %s", clusterName, path)
+			}
+			c.tlsConfig.RootCAs = pool
+		}
+	}
+	if c.server == "" {
+		return nil, fmt.Errorf("no server for cluster %s in %s", clusterName, path)
+	}
+
+	c.authorize = func(req *http.Request) error { return nil }
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		user := u.User
+		if user.Exec != nil || user.AuthProvider != nil {
+			return nil, fmt.Errorf("user %s in %s authenticates with a plugin, which is not supported", userName, path)
+		}
+		cert, err := readData(user.ClientCertificateData, user.ClientCertificate, dir)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readData(user.ClientKeyData, user.ClientKey, dir)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			c.tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		switch {
+		case user.Token != "":
+			token := user.Token
+			c.authorize = func(req *http.Request) error {
+				req.Header.Set("Authorization", "Bearer "+token)
+				return nil
+			}
+		case user.TokenFile != "":
+			c.authorize = tokenFileAuth(user.TokenFile)
+		case user.Username != "":
+			username, password := user.Username, user.Password
+			c.authorize = func(req *http.Request) error {
+				req.SetBasicAuth(username, password)
+				return nil
+			}
+		}
+	}
+	return c, nil
+}
+
+// httpClient returns an HTTP client for the API server of c. Watches are
+// long requests, only connecting is limited in time.
+func (c *config) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:     c.tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Cluster is a connection to the API server of a Kubernetes cluster.
+type Cluster struct {
+	// Namespace of the pod, or of the current context of the kubeconfig
+	// file
+	Namespace string
+
+	client    *http.Client
+	server    string
+	authorize func(req *http.Request) error
+}
+
+// NewCluster returns a *Cluster sending its requests to server with client,
+// authorize adding the credentials to them.
+func NewCluster(client *http.Client, server, namespace string, authorize func(req *http.Request) error) *Cluster {
+	return &Cluster{
+		Namespace: namespace,
+		client:    client,
+		server:    strings.TrimRight(server, "/"),
+		authorize: authorize,
+	}
+}
+
+// Connect returns the *Cluster confd runs in, with the credentials of the
+// pod's service account. Outside of a cluster, or if kubeconfig is set, it
+// is the cluster of the current context of the kubeconfig file, by default
+// the one kubectl uses.
+func Connect(kubeconfig string) (*Cluster, error) {
+	var c *config
+	var err error
+	if kubeconfig == "" {
+		c, err = inCluster()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c == nil {
+		if kubeconfig == "" {
+			kubeconfig = defaultKubeconfig()
+		}
+		c, err = loadKubeconfig(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("not running in a cluster and no usable kubeconfig: %s", err)
+		}
+	}
+	return NewCluster(c.httpClient(), c.server, c.namespace, c.authorize), nil
+}
@@ -0,0 +1,164 @@
+package k8sconfigmap
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/k8s"
+)
+
+// configMap is a ConfigMap as returned by the API.
+type configMap struct {
+	Metadata   k8s.Metadata      `json:"metadata"`
+	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData"`
+}
+
+// Client is a wrapper around the Kubernetes API, reading the ConfigMaps of
+// one namespace.
+type Client struct {
+	cluster *k8s.Cluster
+	// ConfigMaps read, all those of the namespace if empty
+	names []string
+
+	// ConfigMaps are watched once the first watch starts
+	watchOnce sync.Once
+	changes   *k8s.Changes
+}
+
+func init() {
+	backends.Register("k8s-configmap", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Kubeconfig)
+	})
+}
+
+// New returns a *k8sconfigmap.Client reading the ConfigMaps named by nodes,
+// or all ConfigMaps if there are none, in the namespace of the pod. Outside
+// of a cluster, or if kubeconfig is set, the cluster and namespace are
+// those of the current context of the kubeconfig file, by default the one
+// kubectl uses.
+func New(nodes []string, kubeconfig string) (*Client, error) {
+	cluster, err := k8s.Connect(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(cluster, nodes), nil
+}
+
+func newClient(cluster *k8s.Cluster, names []string) *Client {
+	return &Client{
+		cluster: cluster,
+		names:   names,
+		changes: k8s.NewChanges(),
+	}
+}
+
+// configMaps returns the ConfigMaps read.
+func (c *Client) configMaps(ctx context.Context) ([]configMap, error) {
+	if len(c.names) == 0 {
+		var list struct {
+			Items []configMap `json:"items"`
+		}
+		if err := c.cluster.List(ctx, "configmaps", c.cluster.Namespace, &list); err != nil {
+			return nil, err
+		}
+		return list.Items, nil
+	}
+
+	var configMaps []configMap
+	for _, name := range c.names {
+		var cm configMap
+		err := c.cluster.Get(ctx, "configmaps", c.cluster.Namespace, name, &cm)
+		if k8s.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		configMaps = append(configMaps, cm)
+	}
+	return configMaps, nil
+}
+
+// key returns the key of the ConfigMap named name, below which its entries
+// are.
+func (c *Client) key(name string) string {
+	return path.Join("/", c.cluster.Namespace, name)
+}
+
+// GetValues retrieves the entries of the ConfigMaps whose keys,
+// /namespace/configmap-name/key, start with one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	configMaps, err := c.configMaps(ctx)
+	if err != nil {
+		return vars, err
+	}
+	for _, cm := range configMaps {
+		for k, v := range cm.Data {
+			key := path.Join(c.key(cm.Metadata.Name), k)
+			if hasPrefix(key, keys) {
+				vars[key] = v
+			}
+		}
+		for k, v := range cm.BinaryData {
+			key := path.Join(c.key(cm.Metadata.Name), k)
+			if hasPrefix(key, keys) {
+				vars[key] = string(v)
+			}
+		}
+	}
+	return vars, nil
+}
+
+func hasPrefix(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// read reports whether the ConfigMap named name is read.
+func (c *Client) read(name string) bool {
+	if len(c.names) == 0 {
+		return true
+	}
+	for _, n := range c.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// watch follows the changes of the ConfigMaps read.
+func (c *Client) watch() {
+	var fieldSelector string
+	if len(c.names) == 1 {
+		fieldSelector = "metadata.name=" + c.names[0]
+	}
+	c.cluster.Watch("configmaps", c.cluster.Namespace, fieldSelector, func(name string) {
+		switch {
+		case name == "":
+			c.changes.Notify("")
+		case c.read(name):
+			c.changes.Notify(c.key(name))
+		}
+	})
+}
+
+// WatchPrefix returns a new index once a ConfigMap holding one of keys was
+// added, changed or deleted.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.watchOnce.Do(func() { go c.watch() })
+	return c.changes.Wait(ctx, keys, waitIndex), nil
+}
+
+// KeepAlive is a no-op, the watch is established again when it closes.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
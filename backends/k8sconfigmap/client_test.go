@@ -0,0 +1,208 @@
+package k8sconfigmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/backends/k8s"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeAPI is an API server holding ConfigMaps, streaming their changes to
+// watches.
+type fakeAPI struct {
+	mu              sync.Mutex
+	resourceVersion int
+	configMaps      map[string]map[string]*configMap
+	watches         []chan string
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{configMaps: make(map[string]map[string]*configMap)}
+}
+
+// put adds or updates a ConfigMap, notifying the watches of namespace.
+func (f *fakeAPI) put(namespace, name string, data map[string]string, binaryData map[string][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.configMaps[namespace] == nil {
+		f.configMaps[namespace] = make(map[string]*configMap)
+	}
+	eventType := "MODIFIED"
+	if f.configMaps[namespace][name] == nil {
+		eventType = "ADDED"
+	}
+	f.resourceVersion++
+	cm := &configMap{Data: data, BinaryData: binaryData}
+	cm.Metadata.Name = name
+	cm.Metadata.ResourceVersion = fmt.Sprint(f.resourceVersion)
+	f.configMaps[namespace][name] = cm
+	if namespace != "default" {
+		return
+	}
+	event, _ := json.Marshal(map[string]interface{}{"type": eventType, "object": cm})
+	for _, w := range f.watches {
+		w <- string(event)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(k8s.Status{Code: code, Reason: reason})
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "configmaps" {
+		writeStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	namespace := parts[0]
+
+	if r.URL.Query().Get("watch") == "1" {
+		events := make(chan string, 10)
+		f.mu.Lock()
+		f.watches = append(f.watches, events)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-events:
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(parts) == 3 {
+		cm := f.configMaps[namespace][parts[2]]
+		if cm == nil {
+			writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(cm)
+		return
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*configMap `json:"items"`
+	}
+	list.Metadata.ResourceVersion = fmt.Sprint(f.resourceVersion)
+	for _, cm := range f.configMaps[namespace] {
+		list.Items = append(list.Items, cm)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func bearer(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer token")
+	return nil
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	api := newFakeAPI()
+	api.put("default", "myapp", map[string]string{"key": "foobar", "database-host": "127.0.0.1"}, nil)
+	api.put("default", "other", map[string]string{"key": "other"}, nil)
+	api.put("default", "binary", nil, map[string][]byte{"cert": []byte("\x01\x02")})
+	api.put("kube-system", "myapp", map[string]string{"key": "ignored"}, nil)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	tests := []struct {
+		names []string
+		keys  []string
+		want  map[string]string
+	}{
+		{nil, []string{"/default/myapp"}, map[string]string{
+			"/default/myapp/key":           "foobar",
+			"/default/myapp/database-host": "127.0.0.1",
+		}},
+		{nil, []string{"/default/myapp/key", "/default/other", "/default/binary"}, map[string]string{
+			"/default/myapp/key":   "foobar",
+			"/default/other/key":   "other",
+			"/default/binary/cert": "\x01\x02",
+		}},
+		{[]string{"other", "missing"}, []string{"/"}, map[string]string{
+			"/default/other/key": "other",
+		}},
+	}
+	for _, tt := range tests {
+		c := newClient(k8s.NewCluster(server.Client(), server.URL, "default", bearer), tt.names)
+		vars, err := c.GetValues(context.Background(), tt.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vars) != len(tt.want) {
+			t.Errorf("GetValues(%v) = %v, want %v", tt.keys, vars, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if vars[k] != v {
+				t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+			}
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	api := newFakeAPI()
+	api.put("default", "myapp", map[string]string{"key": "foo"}, nil)
+	server := httptest.NewServer(api)
+	defer server.Close()
+	// The watch would keep the server from closing
+	defer server.CloseClientConnections()
+	c := newClient(k8s.NewCluster(server.Client(), server.URL, "default", bearer), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/default/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/default/myapp", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		// Let the watch be established
+		time.Sleep(100 * time.Millisecond)
+		api.put("default", "other", map[string]string{"key": "ignored"}, nil)
+		time.Sleep(50 * time.Millisecond)
+		api.put("default", "myapp", map[string]string{"key": "bar"}, nil)
+	}()
+	index, err = c.WatchPrefix(ctx, "/default/myapp", keys, index)
+	if err != nil || index < 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want a new index", index, err)
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated ConfigMap")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	stopped, err := c.WatchPrefix(ctx, "/default/myapp", keys, index)
+	if err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
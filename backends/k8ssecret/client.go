@@ -0,0 +1,128 @@
+package k8ssecret
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/k8s"
+)
+
+// secret is a Secret as returned by the API, its data base64-decoded.
+type secret struct {
+	Metadata k8s.Metadata      `json:"metadata"`
+	Data     map[string][]byte `json:"data"`
+}
+
+// Client is a wrapper around the Kubernetes API, reading the Secrets of
+// some namespaces.
+type Client struct {
+	cluster    *k8s.Cluster
+	namespaces []string
+
+	// Secrets are watched once the first watch starts
+	watchOnce sync.Once
+	changes   *k8s.Changes
+}
+
+func init() {
+	backends.Register("k8s-secret", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Kubeconfig)
+	})
+}
+
+// New returns a *k8ssecret.Client reading the Secrets of the namespaces
+// given by nodes, or of the namespace of the pod if there are none.
+// Outside of a cluster, or if kubeconfig is set, the cluster and default
+// namespace are those of the current context of the kubeconfig file, by
+// default the one kubectl uses.
+func New(nodes []string, kubeconfig string) (*Client, error) {
+	cluster, err := k8s.Connect(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(cluster, nodes), nil
+}
+
+func newClient(cluster *k8s.Cluster, namespaces []string) *Client {
+	if len(namespaces) == 0 {
+		namespaces = []string{cluster.Namespace}
+	}
+	return &Client{
+		cluster:    cluster,
+		namespaces: namespaces,
+		changes:    k8s.NewChanges(),
+	}
+}
+
+// GetValues retrieves the decoded values of the Secrets whose keys,
+// /namespace/secret-name/key, start with one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, namespace := range c.namespaces {
+		if !related(path.Join("/", namespace), keys) {
+			continue
+		}
+		var list struct {
+			Items []secret `json:"items"`
+		}
+		if err := c.cluster.List(ctx, "secrets", namespace, &list); err != nil {
+			return vars, err
+		}
+		for _, s := range list.Items {
+			for k, v := range s.Data {
+				key := path.Join("/", namespace, s.Metadata.Name, k)
+				if hasPrefix(key, keys) {
+					vars[key] = string(v)
+				}
+			}
+		}
+	}
+	return vars, nil
+}
+
+func hasPrefix(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// related reports whether one of keys may be below key, or key below one
+// of keys.
+func related(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(k, key+"/") || strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchPrefix returns a new index once a Secret holding one of keys was
+// added, changed or deleted.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.watchOnce.Do(func() {
+		for _, namespace := range c.namespaces {
+			namespace := namespace
+			go c.cluster.Watch("secrets", namespace, "", func(name string) {
+				// All the Secrets of namespace if name is empty
+				c.changes.Notify(path.Join("/", namespace, name))
+			})
+		}
+	})
+	return c.changes.Wait(ctx, keys, waitIndex), nil
+}
+
+// KeepAlive is a no-op, the watches are established again when they close.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
+
+// Secret reports that the values are secrets, which must not be logged.
+func (c *Client) Secret() bool {
+	return true
+}
@@ -0,0 +1,140 @@
+package k8ssecret
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/backends/k8s"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeAPI serves the Secrets of namespaces, with their data base64-encoded
+// as the API does, and streams the events sent on watch to the watches.
+type fakeAPI struct {
+	secrets map[string]map[string]map[string]string
+	watch   chan string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) != 2 || parts[1] != "secrets" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(k8s.Status{Code: http.StatusNotFound, Reason: "NotFound"})
+		return
+	}
+	if r.URL.Query().Get("watch") == "1" {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-f.watch:
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	items := []map[string]interface{}{}
+	for name, data := range f.secrets[parts[0]] {
+		encoded := make(map[string]string)
+		for k, v := range data {
+			encoded[k] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		items = append(items, map[string]interface{}{
+			"metadata": map[string]string{"name": name, "namespace": parts[0]},
+			"data":     encoded,
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metadata": map[string]string{"resourceVersion": "1"},
+		"items":    items,
+	})
+}
+
+func noAuth(req *http.Request) error {
+	return nil
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	server := httptest.NewServer(&fakeAPI{secrets: map[string]map[string]map[string]string{
+		"default":    {"myapp": {"password": "s3cr3t", "user": "rob"}},
+		"production": {"myapp": {"password": "pr0d"}},
+		"other":      {"myapp": {"password": "ignored"}},
+	}})
+	defer server.Close()
+	cluster := k8s.NewCluster(server.Client(), server.URL, "default", noAuth)
+
+	tests := []struct {
+		namespaces []string
+		keys       []string
+		want       map[string]string
+	}{
+		{nil, []string{"/default/myapp"}, map[string]string{
+			"/default/myapp/password": "s3cr3t",
+			"/default/myapp/user":     "rob",
+		}},
+		{[]string{"default", "production"}, []string{"/default/myapp/password", "/production", "/other"}, map[string]string{
+			"/default/myapp/password":    "s3cr3t",
+			"/production/myapp/password": "pr0d",
+		}},
+	}
+	for _, tt := range tests {
+		c := newClient(cluster, tt.namespaces)
+		vars, err := c.GetValues(context.Background(), tt.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vars) != len(tt.want) {
+			t.Errorf("GetValues(%v) = %v, want %v", tt.keys, vars, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if vars[k] != v {
+				t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+			}
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	api := &fakeAPI{watch: make(chan string, 10)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	// The watch would keep the server from closing
+	defer server.CloseClientConnections()
+	c := newClient(k8s.NewCluster(server.Client(), server.URL, "default", noAuth), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/default/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		api.watch <- `{"type":"ADDED","object":{"metadata":{"name":"other","resourceVersion":"2"}}}`
+		time.Sleep(50 * time.Millisecond)
+		api.watch <- `{"type":"MODIFIED","object":{"metadata":{"name":"myapp","resourceVersion":"3"}}}`
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index < 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want a new index", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated Secret")
+	}
+}
@@ -0,0 +1,337 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+var (
+	// How often the entries are searched again to tell changes
+	pollInterval = 30 * time.Second
+	// How long connecting to a server and every request may take
+	timeout = 30 * time.Second
+)
+
+const (
+	defaultFilter = "(objectClass=*)"
+	pageSize      = 500
+)
+
+// Client reads the entries below a base DN, the attributes of an entry
+// being keys below its DN relative to the base, e.g. the attribute
+// description of cn=myapp,ou=apps,dc=example,dc=com below
+// dc=example,dc=com is the key /ou=apps/cn=myapp/description.
+type Client struct {
+	// The URLs of the servers, tried in turn
+	servers  []*url.URL
+	base     *ldap.DN
+	filter   string
+	username string
+	password string
+	// The TLS configuration of ldaps servers, and that of StartTLS on
+	// ldap ones if not nil
+	tlsConfig *tls.Config
+	startTLS  bool
+	poller    *util.Poller
+
+	// search returns the entries of the subtree of base matching filter,
+	// with the given attributes, all user ones if nil. Replaced in tests.
+	search func(ctx context.Context, base, filter string, attributes []string) ([]*ldap.Entry, error)
+}
+
+func init() {
+	backends.Register("ldap", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.Username, config.Password)
+	})
+}
+
+// New returns an *ldap.Client for the servers of the LDAP URLs given by
+// nodes, e.g. ldap://ldap.example.com/dc=example,dc=com??sub?(objectClass=*).
+// The base DN and the filter of the URLs must be the same, the filter
+// defaulting to (objectClass=*). It binds as username if not empty, and
+// uses the client certificate and the CA certificates given by cert, key
+// and caCert for ldaps URLs, or with StartTLS for ldap ones.
+func New(nodes []string, cert, key, caCert, username, password string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no LDAP URL given, set it with -node")
+	}
+	c := &Client{
+		username: username,
+		password: password,
+		poller:   util.NewPoller(pollInterval),
+	}
+	c.search = c.searchServers
+	var base string
+	for i, node := range nodes {
+		u, b, filter, err := parseURL(node)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && (b != base || filter != c.filter) {
+			return nil, fmt.Errorf("%s does not have the base DN and the filter of %s", node, nodes[0])
+		}
+		base, c.filter = b, filter
+		c.servers = append(c.servers, u)
+	}
+	var err error
+	if c.base, err = ldap.ParseDN(base); err != nil {
+		return nil, fmt.Errorf("invalid base DN %q: %s", base, err)
+	}
+
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	c.tlsConfig, c.startTLS = tlsConfig, tlsConfig != nil
+	if c.tlsConfig == nil {
+		c.tlsConfig = &tls.Config{}
+	}
+	return c, nil
+}
+
+// parseURL returns the server, the base DN and the filter of the LDAP URL
+// node. Only the subtree scope is supported, and no attributes may be
+// listed as all of them are read.
+func parseURL(node string) (*url.URL, string, string, error) {
+	u, err := url.Parse(node)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, "", "", fmt.Errorf("%s is not an ldap:// or ldaps:// URL", node)
+	}
+	base := strings.TrimPrefix(u.Path, "/")
+	if base == "" {
+		return nil, "", "", fmt.Errorf("%s does not give a base DN", node)
+	}
+	// The query is attributes?scope?filter?extensions
+	query, err := url.PathUnescape(u.RawQuery)
+	if err != nil {
+		return nil, "", "", err
+	}
+	fields := strings.SplitN(query, "?", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	if fields[0] != "" {
+		return nil, "", "", fmt.Errorf("%s lists attributes, all of them are read", node)
+	}
+	if fields[1] != "" && fields[1] != "sub" {
+		return nil, "", "", fmt.Errorf("%s has the scope %s, only sub is supported", node, fields[1])
+	}
+	filter := fields[2]
+	if filter == "" {
+		filter = defaultFilter
+	}
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		return nil, "", "", fmt.Errorf("invalid filter %s: %s", filter, err)
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, base, filter, nil
+}
+
+// connect connects and binds to the first server answering.
+func (c *Client) connect() (*ldap.Conn, error) {
+	var err error
+	for _, server := range c.servers {
+		var conn *ldap.Conn
+		if conn, err = c.dial(server); err == nil {
+			return conn, nil
+		}
+		log.Error(fmt.Sprintf("cannot connect to %s: %s", server, err))
+	}
+	return nil, err
+}
+
+func (c *Client) dial(server *url.URL) (*ldap.Conn, error) {
+	dialer := ldap.DialWithDialer(&net.Dialer{Timeout: timeout})
+	conn, err := ldap.DialURL(server.String(), dialer, ldap.DialWithTLSConfig(c.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if server.Scheme == "ldap" && c.startTLS {
+		config := c.tlsConfig.Clone()
+		config.ServerName = server.Hostname()
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.username != "" {
+		if err := conn.Bind(c.username, c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) searchServers(ctx context.Context, base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	req := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, filter, attributes, nil)
+	res, err := conn.SearchWithPaging(req, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// searchBase returns the DN of the deepest entry that holds all the keys
+// starting with prefix. The last segment of prefix is left out as it may
+// be the start of an RDN or an attribute.
+func (c *Client) searchBase(prefix string) string {
+	segments := strings.Split(strings.TrimPrefix(prefix, "/"), "/")
+	segments = segments[:len(segments)-1]
+	var rdns []string
+	for _, segment := range segments {
+		if !strings.Contains(segment, "=") {
+			// An attribute, the keys are those of its entry
+			break
+		}
+		rdns = append([]string{segment}, rdns...)
+	}
+	return strings.Join(append(rdns, c.base.String()), ",")
+}
+
+// path returns the key of the entry dn, the path of its RDNs below the
+// base DN.
+func (c *Client) path(dn string) (string, error) {
+	d, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+	if !c.base.EqualFold(d) && !c.base.AncestorOfFold(d) {
+		return "", fmt.Errorf("%s is not below %s", dn, c.base)
+	}
+	var key string
+	for _, rdn := range d.RDNs[:len(d.RDNs)-len(c.base.RDNs)] {
+		key = "/" + rdn.String() + key
+	}
+	return key, nil
+}
+
+// entries returns the entries holding keys starting with one of keys.
+func (c *Client) entries(ctx context.Context, keys []string, attributes []string) ([]*ldap.Entry, error) {
+	var entries []*ldap.Entry
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		base := c.searchBase(key)
+		if seen[base] {
+			continue
+		}
+		seen[base] = true
+		found, err := c.search(ctx, base, c.filter, attributes)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+// GetValues searches the entries below the keys and returns their
+// attributes prefixed by one of keys. An attribute of several values is
+// a key per value, e.g. /ou=apps/cn=myapp/member/0.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	entries, err := c.entries(ctx, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for _, entry := range entries {
+		path, err := c.path(entry.DN)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range entry.Attributes {
+			if len(attr.Values) == 1 {
+				add(vars, keys, path+"/"+attr.Name, attr.Values[0])
+				continue
+			}
+			for i, value := range attr.Values {
+				add(vars, keys, path+"/"+attr.Name+"/"+strconv.Itoa(i), value)
+			}
+		}
+	}
+	return vars, nil
+}
+
+// add sets k to v in vars if k starts with one of keys.
+func add(vars map[string]string, keys []string, k, v string) {
+	for _, key := range keys {
+		if strings.HasPrefix(k, key) {
+			vars[k] = v
+			return
+		}
+	}
+}
+
+// timestamps returns the modifyTimestamp of the entries holding keys
+// starting with one of keys, by DN.
+func (c *Client) timestamps(ctx context.Context, keys []string) (map[string]string, error) {
+	entries, err := c.entries(ctx, keys, []string{"modifyTimestamp"})
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for _, entry := range entries {
+		path, err := c.path(entry.DN)
+		if err != nil {
+			return nil, err
+		}
+		if holds(path, keys) {
+			vars[entry.DN] = entry.GetAttributeValue("modifyTimestamp")
+		}
+	}
+	return vars, nil
+}
+
+// holds reports whether the entry of path may have keys starting with one
+// of keys: those below the entry, or the attributes of the entry below it.
+func holds(path string, keys []string) bool {
+	for _, key := range keys {
+		if strings.HasPrefix(path+"/", key) {
+			return true
+		}
+		if rest := strings.TrimPrefix(key, path+"/"); rest != key {
+			attr := strings.SplitN(rest, "/", 2)[0]
+			if !strings.Contains(attr, "=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WatchPrefix searches the entries every pollInterval, and returns once
+// an entry was added, removed or modified as told by their
+// modifyTimestamp.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.timestamps)
+}
+
+// KeepAlive is a no-op, every search connects anew.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,238 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDirectory serves the subtree searches of its entries, ignoring the
+// filter.
+type fakeDirectory struct {
+	mu      sync.Mutex
+	entries []*ldap.Entry
+	// The bases searched
+	bases []string
+}
+
+func (f *fakeDirectory) search(ctx context.Context, base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bases = append(f.bases, base)
+	b, err := ldap.ParseDN(base)
+	if err != nil {
+		return nil, err
+	}
+	var found []*ldap.Entry
+	exists := false
+	for _, entry := range f.entries {
+		dn, _ := ldap.ParseDN(entry.DN)
+		if b.EqualFold(dn) {
+			exists = true
+		}
+		if !b.EqualFold(dn) && !b.AncestorOfFold(dn) {
+			continue
+		}
+		if attributes == nil {
+			found = append(found, entry)
+			continue
+		}
+		e := &ldap.Entry{DN: entry.DN}
+		for _, name := range attributes {
+			e.Attributes = append(e.Attributes, ldap.NewEntryAttribute(name, entry.GetAttributeValues(name)))
+		}
+		found = append(found, e)
+	}
+	if !exists {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return found, nil
+}
+
+func newTestClient(t *testing.T, f *fakeDirectory) *Client {
+	c, err := New([]string{"ldap://ldap.example.com/dc=example,dc=com"}, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.search = f.search
+	return c
+}
+
+func testDirectory() *fakeDirectory {
+	return &fakeDirectory{entries: []*ldap.Entry{
+		ldap.NewEntry("dc=example,dc=com", map[string][]string{"dc": {"example"}}),
+		ldap.NewEntry("ou=apps,dc=example,dc=com", map[string][]string{"ou": {"apps"}}),
+		ldap.NewEntry("cn=myapp,ou=apps,dc=example,dc=com", map[string][]string{
+			"cn":              {"myapp"},
+			"description":     {"db.example.com"},
+			"member":          {"uid=rob", "uid=ann"},
+			"modifyTimestamp": {"20260101000000Z"},
+		}),
+		ldap.NewEntry("cn=otherapp,ou=apps,dc=example,dc=com", map[string][]string{
+			"cn":              {"otherapp"},
+			"modifyTimestamp": {"20260101000000Z"},
+		}),
+	}}
+}
+
+func TestGetValues(t *testing.T) {
+	f := testDirectory()
+	c := newTestClient(t, f)
+
+	vars, err := c.GetValues(context.Background(), []string{"/ou=apps/cn=myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/ou=apps/cn=myapp/cn":          "myapp",
+		"/ou=apps/cn=myapp/description": "db.example.com",
+		"/ou=apps/cn=myapp/member/0":    "uid=rob",
+		"/ou=apps/cn=myapp/member/1":    "uid=ann",
+	}
+	delete(vars, "/ou=apps/cn=myapp/modifyTimestamp")
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+	if !reflect.DeepEqual(f.bases, []string{"ou=apps,dc=example,dc=com"}) {
+		t.Errorf("GetValues() searched %v, want the entry of the parent", f.bases)
+	}
+
+	vars, err = c.GetValues(context.Background(), []string{"/ou=apps/cn=myapp/description", "/dc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"/ou=apps/cn=myapp/description": "db.example.com",
+		"/dc":                           "example",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+
+	vars, err = c.GetValues(context.Background(), []string{"/ou=missing/cn=myapp"})
+	if err != nil || len(vars) != 0 {
+		t.Errorf("GetValues() below a missing entry = %v, %v, want no values", vars, err)
+	}
+}
+
+func TestSearchBase(t *testing.T) {
+	c := newTestClient(t, &fakeDirectory{})
+	tests := map[string]string{
+		"":                              "dc=example,dc=com",
+		"/":                             "dc=example,dc=com",
+		"/ou=apps":                      "dc=example,dc=com",
+		"/ou=apps/":                     "ou=apps,dc=example,dc=com",
+		"/ou=apps/cn=my":                "ou=apps,dc=example,dc=com",
+		"/ou=apps/cn=myapp/description": "cn=myapp,ou=apps,dc=example,dc=com",
+		"/ou=apps/cn=myapp/member/0":    "cn=myapp,ou=apps,dc=example,dc=com",
+	}
+	for prefix, want := range tests {
+		if got := c.searchBase(prefix); got != want {
+			t.Errorf("searchBase(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestHolds(t *testing.T) {
+	tests := []struct {
+		path string
+		keys []string
+		want bool
+	}{
+		{"/ou=apps/cn=myapp", []string{"/ou=apps/cn=my"}, true},
+		{"/ou=apps/cn=myapp", []string{"/ou=apps/cn=myapp/member/0"}, true},
+		{"/ou=apps", []string{"/ou=apps/cn=myapp"}, false},
+		{"", []string{"/dc"}, true},
+		{"/ou=apps/cn=otherapp", []string{"/ou=apps/cn=myapp", "/ou=apps/cn=other"}, true},
+		{"/ou=apps/cn=otherapp", []string{"/ou=apps/cn=myapp"}, false},
+	}
+	for _, tt := range tests {
+		if got := holds(tt.path, tt.keys); got != tt.want {
+			t.Errorf("holds(%q, %v) = %v, want %v", tt.path, tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	u, base, filter, err := parseURL("ldaps://ldap.example.com:636/ou=apps,dc=example,dc=com??sub?(objectClass=groupOfNames)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "ldaps://ldap.example.com:636" || base != "ou=apps,dc=example,dc=com" || filter != "(objectClass=groupOfNames)" {
+		t.Errorf("parseURL() = %s, %q, %q", u, base, filter)
+	}
+	if _, _, filter, _ := parseURL("ldap://ldap.example.com/dc=example,dc=com"); filter != defaultFilter {
+		t.Errorf("parseURL() without a filter = %q, want %q", filter, defaultFilter)
+	}
+
+	for _, node := range []string{
+		"ldap.example.com",
+		"http://ldap.example.com/dc=example,dc=com",
+		"ldap://ldap.example.com",
+		"ldap://ldap.example.com/dc=example,dc=com?cn",
+		"ldap://ldap.example.com/dc=example,dc=com??one",
+		"ldap://ldap.example.com/dc=example,dc=com???(cn=",
+	} {
+		if _, _, _, err := parseURL(node); err == nil {
+			t.Errorf("parseURL(%q) succeeded", node)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, nodes := range [][]string{
+		nil,
+		{"ldap://a.example.com/dc=example,dc=com", "ldap://b.example.com/dc=example,dc=org"},
+		{"ldap://a.example.com/dc=example,dc=com", "ldap://b.example.com/dc=example,dc=com???(cn=x)"},
+		{"ldap://a.example.com/example"},
+	} {
+		if _, err := New(nodes, "", "", "", "", ""); err == nil {
+			t.Errorf("New(%v) succeeded", nodes)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	f := testDirectory()
+	c := newTestClient(t, f)
+	c.poller.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/ou=apps/cn=myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.mu.Lock()
+		f.entries[3] = ldap.NewEntry(f.entries[3].DN, map[string][]string{"modifyTimestamp": {"20260102000000Z"}})
+		f.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		f.mu.Lock()
+		f.entries[2] = ldap.NewEntry(f.entries[2].DN, map[string][]string{"modifyTimestamp": {"20260102000000Z"}})
+		f.mu.Unlock()
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,207 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+var (
+	// How long a long-poll of the version waits for a change, and how often
+	// a service answering at once is asked again
+	pollInterval = 30 * time.Second
+	// How long the other requests may take
+	timeout = 30 * time.Second
+)
+
+// Client reads the JSON tree of a metadata service, such as the Rancher
+// one, flattened into keys.
+type Client struct {
+	// The URLs of the services, tried in turn
+	urls   []string
+	client *http.Client
+
+	mu sync.Mutex
+	// The version last seen, per set of keys
+	versions map[string]string
+}
+
+func init() {
+	factory := func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes)
+	}
+	backends.Register("metadata", factory)
+	// The name of the backend when it only read the Rancher one
+	backends.Register("rancher", factory)
+}
+
+// New returns a *metadata.Client reading the services at the URLs given by
+// nodes, e.g. http://169.254.169.250/latest, http:// being the default
+// scheme.
+func New(nodes []string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no URL given, set it with -node")
+	}
+	c := &Client{
+		client:   &http.Client{},
+		versions: make(map[string]string),
+	}
+	for _, node := range nodes {
+		if !strings.Contains(node, "://") {
+			node = "http://" + node
+		}
+		c.urls = append(c.urls, strings.TrimSuffix(node, "/"))
+	}
+	return c, nil
+}
+
+// errNotFound is returned by get for the paths the service does not have.
+var errNotFound = errors.New("not found")
+
+// get requests path from the services in turn, and returns the body of
+// the first answer. A service that cannot be reached or fails is logged
+// and the next one tried.
+func (c *Client) get(ctx context.Context, path, accept string) ([]byte, error) {
+	var err error
+	for _, u := range c.urls {
+		var body []byte
+		body, err = c.getURL(ctx, u+path, accept)
+		if err == nil || err == errNotFound || ctx.Err() != nil {
+			return body, err
+		}
+		log.Error(fmt.Sprintf("cannot read the metadata at %s: %s", u, err))
+	}
+	return nil, err
+}
+
+func (c *Client) getURL(ctx context.Context, u, accept string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// GetValues reads the trees below keys, a missing key having no values.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	vars := make(map[string]string)
+	for _, key := range keys {
+		body, err := c.get(ctx, key, "application/json")
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var content interface{}
+		if err := dec.Decode(&content); err != nil {
+			return nil, fmt.Errorf("cannot parse the metadata at %s: %s", key, err)
+		}
+		util.Flatten(content, key, vars)
+	}
+	return vars, nil
+}
+
+// version returns the version of the metadata. With last not empty the
+// service is asked to answer once the version is no longer last, or
+// after pollInterval.
+func (c *Client) version(ctx context.Context, last string) (string, error) {
+	path, wait := "/version", timeout
+	if last != "" {
+		path += fmt.Sprintf("?wait=true&value=%s&maxWait=%d",
+			url.QueryEscape(last), int(pollInterval/time.Second))
+		wait += pollInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	body, err := c.get(ctx, path, "text/plain")
+	if err != nil {
+		return "", err
+	}
+	version := strings.TrimSpace(string(body))
+	if s, err := strconv.Unquote(version); err == nil {
+		// Answered as a JSON string
+		version = s
+	}
+	return version, nil
+}
+
+// WatchPrefix returns waitIndex+1 once the version of the metadata changed.
+// It long-polls the version with ?wait=true&value=<version>, a service
+// that answers at once with the same version being asked again every
+// pollInterval.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	id := strings.Join(keys, ",")
+
+	if waitIndex == 0 {
+		version, err := c.version(ctx, "")
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.versions[id] = version
+		c.mu.Unlock()
+		return 1, nil
+	}
+
+	for {
+		c.mu.Lock()
+		last := c.versions[id]
+		c.mu.Unlock()
+		start := time.Now()
+		version, err := c.version(ctx, last)
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		default:
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if version != last {
+			c.mu.Lock()
+			c.versions[id] = version
+			c.mu.Unlock()
+			return waitIndex + 1, nil
+		}
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(pollInterval - time.Since(start)):
+		}
+	}
+}
+
+// KeepAlive is a no-op, every request opens or reuses a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,216 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeService serves a JSON tree below /latest and its version, holding
+// the requests with ?wait=true until the version changes if wait is set.
+type fakeService struct {
+	wait bool
+
+	mu      sync.Mutex
+	tree    map[string]interface{}
+	version int
+	changed chan struct{}
+	// The requests of the version
+	versions int
+}
+
+func newFakeService(wait bool, tree map[string]interface{}) *fakeService {
+	return &fakeService{wait: wait, tree: tree, version: 1, changed: make(chan struct{})}
+}
+
+// set sets the value at the path of names and bumps the version.
+func (f *fakeService) set(value interface{}, names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node := f.tree
+	for _, name := range names[:len(names)-1] {
+		node = node[name].(map[string]interface{})
+	}
+	node[names[len(names)-1]] = value
+	f.version++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/version" {
+		f.mu.Lock()
+		f.versions++
+		version, changed := strconv.Itoa(f.version), f.changed
+		f.mu.Unlock()
+		if f.wait && r.URL.Query().Get("wait") == "true" && r.URL.Query().Get("value") == version {
+			maxWait, _ := strconv.Atoi(r.URL.Query().Get("maxWait"))
+			select {
+			case <-changed:
+			case <-time.After(time.Duration(maxWait) * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+			version = strconv.Itoa(f.version)
+			f.mu.Unlock()
+		}
+		w.Write([]byte(version + "\n"))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var node interface{} = f.tree
+	for _, name := range strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/latest"), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		m, ok := node.(map[string]interface{})
+		if !ok || m[name] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		node = m[name]
+	}
+	json.NewEncoder(w).Encode(node)
+}
+
+func testTree() map[string]interface{} {
+	return map[string]interface{}{
+		"self": map[string]interface{}{
+			"container": map[string]interface{}{
+				"name": "myapp_1",
+				"ips":  []interface{}{"10.42.0.1", "10.42.0.2"},
+			},
+			"host": map[string]interface{}{"name": "node1"},
+		},
+		"version": "ignored",
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeService(false, testTree())
+	server := httptest.NewServer(f)
+	defer server.Close()
+	c, err := New([]string{server.URL + "/latest/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := c.GetValues(context.Background(), []string{"/self/container", "/self/host/name", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/self/container/name":  "myapp_1",
+		"/self/container/ips/0": "10.42.0.1",
+		"/self/container/ips/1": "10.42.0.2",
+		"/self/host/name":       "node1",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestGetValuesFailover(t *testing.T) {
+	log.SetLevel("fatal")
+	f := newFakeService(false, testTree())
+	server := httptest.NewServer(f)
+	defer server.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	c, _ := New([]string{down.URL + "/latest", strings.TrimPrefix(server.URL, "http://") + "/latest"})
+	vars, err := c.GetValues(context.Background(), []string{"/self/host"})
+	if err != nil || vars["/self/host/name"] != "node1" {
+		t.Errorf("GetValues() = %v, %v, want the values of the second service", vars, err)
+	}
+
+	c, _ = New([]string{down.URL})
+	if _, err := c.GetValues(context.Background(), []string{"/self"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("GetValues() from a failing service = %v, want the 503", err)
+	}
+}
+
+func testWatchPrefix(t *testing.T, wait bool) *fakeService {
+	f := newFakeService(wait, testTree())
+	server := httptest.NewServer(f)
+	defer server.Close()
+	c, _ := New([]string{server.URL + "/latest"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/self"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("node2", "self", "host", "name")
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+	return f
+}
+
+func TestWatchPrefixLongPoll(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Hour
+	f := testWatchPrefix(t, true)
+	// The first version, the long-poll answered on the change and the one
+	// stopped
+	if f.versions != 3 {
+		t.Errorf("WatchPrefix() requested the version %d times, want 3", f.versions)
+	}
+}
+
+func TestWatchPrefixPoll(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 20 * time.Millisecond
+	f := testWatchPrefix(t, false)
+	if f.versions < 3 {
+		t.Errorf("WatchPrefix() requested the version %d times, want it polled", f.versions)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(nil); err == nil {
+		t.Error("New() without nodes succeeded")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, name := range []string{"metadata", "rancher"} {
+		c, err := backends.New(backends.Config{Backend: name, BackendNodes: []string{"http://127.0.0.1:1/latest"}})
+		if err != nil {
+			t.Fatalf("backends.New() of %s: %v", name, err)
+		}
+		if _, ok := c.(*Client); !ok {
+			t.Errorf("backends.New() of %s = %T, want a *metadata.Client", name, c)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Package mock provides an in-memory StoreClient for tests, whose values
+// are set by the test instead of read from a store.
+package mock
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Client is an in-memory StoreClient. Every change of a value increments
+// the index, WatchPrefix returns once a key it watches changed.
+type Client struct {
+	mu     sync.Mutex
+	values map[string]string
+	index  uint64
+	// Index of the last change of every key, deletes included
+	revisions map[string]uint64
+	// Closed when a value changes
+	changed chan struct{}
+}
+
+// New returns an empty *mock.Client.
+func New() *Client {
+	return &Client{
+		values: make(map[string]string),
+		// 0 asks WatchPrefix for the current index
+		index:     1,
+		revisions: make(map[string]uint64),
+		changed:   make(chan struct{}),
+	}
+}
+
+// update records a change of key and wakes up the watches.
+func (c *Client) update(key string) {
+	c.index++
+	c.revisions[key] = c.index
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// SetValue sets key to value.
+func (c *Client) SetValue(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	c.update(key)
+}
+
+// DeleteValue deletes key.
+func (c *Client) DeleteValue(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	c.update(key)
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetValues returns the values of the keys starting with one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vars := make(map[string]string)
+	for k, v := range c.values {
+		if hasPrefix(k, keys) {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix returns the index of the last change of keys once it is
+// after waitIndex. A zero waitIndex returns the current index at once.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	for {
+		c.mu.Lock()
+		index, changed := c.index, c.changed
+		if waitIndex > 0 {
+			index = 0
+			for k, r := range c.revisions {
+				if r > index && hasPrefix(k, keys) {
+					index = r
+				}
+			}
+		}
+		c.mu.Unlock()
+		if index > waitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		}
+	}
+}
+
+// KeepAlive is a no-op, there is nothing to connect to.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
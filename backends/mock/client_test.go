@@ -0,0 +1,62 @@
+package mock
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetValues(t *testing.T) {
+	c := New()
+	c.SetValue("/myapp/database/url", "db.example.com")
+	c.SetValue("/myapp/database/user", "rob")
+	c.SetValue("/other/key", "filtered")
+	c.DeleteValue("/myapp/database/user")
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/myapp/database/url": "db.example.com"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	c := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index == 0 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want the current index", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.SetValue("/other/key", "foo")
+		time.Sleep(50 * time.Millisecond)
+		c.SetValue("/myapp/key", "foo")
+	}()
+	next, err := c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || next <= index {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want an index after %d", next, err, index)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go c.DeleteValue("/myapp/key")
+	if index, err = c.WatchPrefix(ctx, "/", keys, next); err != nil || index <= next {
+		t.Fatalf("WatchPrefix() after delete = %d, %v, want an index after %d", index, err, next)
+	}
+
+	go func() { cancel() }()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
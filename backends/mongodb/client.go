@@ -0,0 +1,337 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// How often the collection is queried to tell changes when change streams
+// are not available, i.e. on a standalone server
+var pollInterval = 10 * time.Second
+
+// changeStream is the part of *mongo.ChangeStream the client uses.
+type changeStream interface {
+	Next(ctx context.Context) bool
+	Err() error
+	Close(ctx context.Context) error
+	ResumeToken() bson.Raw
+}
+
+// collection is the part of *mongo.Collection the client uses, faked in
+// tests.
+type collection interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	watch(ctx context.Context, resumeToken bson.Raw) (changeStream, error)
+}
+
+type mongoCollection struct {
+	*mongo.Collection
+}
+
+func (c mongoCollection) watch(ctx context.Context, resumeToken bson.Raw) (changeStream, error) {
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return c.Watch(ctx, mongo.Pipeline{}, opts)
+}
+
+// Client is a wrapper around a MongoDB collection. A document with a
+// "value" field holds the key given by its _id, any other document is
+// flattened into keys below its _id.
+type Client struct {
+	collection collection
+	poller     *util.Poller
+
+	mu sync.Mutex
+	// Closed when the change stream tells a change
+	changed chan struct{}
+	// Index of the values last seen, per set of keys
+	versions util.Versions
+
+	// The change stream is opened once the first watch starts, the
+	// collection is polled if that fails
+	streamOnce sync.Once
+	streaming  bool
+}
+
+func init() {
+	backends.Register("mongodb", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Table,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.Username, config.Password)
+	})
+}
+
+// New returns a *mongodb.Client reading collection from the database of
+// the URI given by nodes. The username and password override those of the
+// URI if set, and the connections use TLS if a client certificate or CA
+// certificate is given.
+func New(nodes []string, collection, cert, key, caCert, username, password string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("give the URI of the database as the only node with -node")
+	}
+	if collection == "" {
+		return nil, errors.New("no collection given, set it with -table")
+	}
+	cs, err := connstring.ParseAndValidate(nodes[0])
+	if err != nil {
+		return nil, err
+	}
+	if cs.Database == "" {
+		return nil, errors.New("no database in the URI, e.g. mongodb://db.example.com/config")
+	}
+	opts := options.Client().ApplyURI(nodes[0])
+	if username != "" || password != "" {
+		credential := options.Credential{}
+		if opts.Auth != nil {
+			credential = *opts.Auth
+		}
+		if username != "" {
+			credential.Username = username
+		}
+		if password != "" {
+			credential.Password = password
+			credential.PasswordSet = true
+		}
+		opts.SetAuth(credential)
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early instead of on the first query
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return newClient(mongoCollection{client.Database(cs.Database).Collection(collection)}), nil
+}
+
+func newClient(collection collection) *Client {
+	return &Client{
+		collection: collection,
+		poller:     util.NewPoller(pollInterval),
+		changed:    make(chan struct{}),
+	}
+}
+
+// filter matches the documents whose _id starts with one of keys, and
+// those whose _id is a parent of one of them, which may be flattened into
+// it.
+func filter(keys []string) bson.D {
+	var parents []string
+	conditions := bson.A{}
+	for _, key := range keys {
+		for k := key; ; k = path.Dir(k) {
+			parents = append(parents, k)
+			if k == "/" || k == "." {
+				break
+			}
+		}
+		conditions = append(conditions, bson.D{{Key: "_id", Value: bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(key)}}}})
+	}
+	conditions = append(conditions, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: parents}}}})
+	return bson.D{{Key: "$or", Value: conditions}}
+}
+
+// plain converts the values of a decoded document into those
+// util.Flatten knows.
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = plain(e.Value)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = plain(e)
+		}
+		return a
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case primitive.ObjectID:
+		return v.Hex()
+	default:
+		return v
+	}
+}
+
+// GetValues queries the collection for the documents holding keys
+// starting with one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	cursor, err := c.collection.Find(ctx, filter(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	found := make(map[string]string)
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		fields := plain(doc).(map[string]interface{})
+		id, ok := fields["_id"].(string)
+		if !ok {
+			log.Warning("Skipping document %v. '_id' is not a string.", fields["_id"])
+			continue
+		}
+		delete(fields, "_id")
+		if value, ok := fields["value"]; ok {
+			util.Flatten(value, id, found)
+		} else {
+			util.Flatten(fields, id, found)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	for k, v := range found {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// notify wakes up the watches.
+func (c *Client) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// stream opens a change stream on the collection and reads it for as long
+// as confd runs. It reports whether the stream could be opened, which
+// needs a replica set or sharded cluster.
+func (c *Client) stream() bool {
+	stream, err := c.collection.watch(context.Background(), nil)
+	if err != nil {
+		log.Warning("Cannot open a change stream, polling the collection instead: %s", err)
+		return false
+	}
+
+	go func() {
+		for retry := 0; ; retry++ {
+			for stream.Next(context.Background()) {
+				retry = 0
+				c.notify()
+			}
+			err := stream.Err()
+			resumeToken := stream.ResumeToken()
+			stream.Close(context.Background())
+
+			wait := util.Backoff(time.Second, retry)
+			log.Warning("Change stream ended, reopening it in %s: %v", wait, err)
+			time.Sleep(wait)
+			if s, err := c.collection.watch(context.Background(), resumeToken); err == nil {
+				stream = s
+			} else if s, err = c.collection.watch(context.Background(), nil); err == nil {
+				// The change may have been missed since the resume token
+				// expired
+				stream = s
+				c.notify()
+			} else {
+				log.Warning("Cannot reopen the change stream: %s", err)
+				stream = closedStream{err}
+			}
+		}
+	}()
+	return true
+}
+
+// closedStream is a change stream which could not be reopened.
+type closedStream struct {
+	err error
+}
+
+func (s closedStream) Next(ctx context.Context) bool   { return false }
+func (s closedStream) Err() error                      { return s.err }
+func (s closedStream) Close(ctx context.Context) error { return nil }
+func (s closedStream) ResumeToken() bson.Raw           { return nil }
+
+// WatchPrefix returns an index greater than waitIndex once the values
+// of keys changed. The collection is queried again whenever the change
+// stream tells a change, or every pollInterval if it cannot be opened.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.streamOnce.Do(func() {
+		c.streaming = c.stream()
+	})
+	if !c.streaming {
+		return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+	}
+	if waitIndex == 0 {
+		vars, err := c.GetValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		return c.versions.Update(keys, vars), nil
+	}
+
+	for {
+		// Taken before the query so that no change is missed between the
+		// two
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+
+		vars, err := c.GetValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index := c.versions.Update(keys, vars); index > waitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		}
+	}
+}
+
+// KeepAlive is a no-op, the driver reconnects on its own.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,159 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeCollection returns all of its documents to every query, and tells
+// their changes on a change stream if it has one.
+type fakeCollection struct {
+	mu      sync.Mutex
+	docs    []interface{}
+	streams bool
+	events  chan struct{}
+}
+
+func (f *fakeCollection) set(docs ...interface{}) {
+	f.mu.Lock()
+	f.docs = docs
+	f.mu.Unlock()
+	if f.streams {
+		f.events <- struct{}{}
+	}
+}
+
+func (f *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return mongo.NewCursorFromDocuments(f.docs, nil, nil)
+}
+
+func (f *fakeCollection) watch(ctx context.Context, resumeToken bson.Raw) (changeStream, error) {
+	if !f.streams {
+		return nil, errors.New("The $changeStream stage is only supported on replica sets")
+	}
+	return fakeStream{f.events}, nil
+}
+
+type fakeStream struct {
+	events chan struct{}
+}
+
+func (s fakeStream) Next(ctx context.Context) bool {
+	_, ok := <-s.events
+	return ok
+}
+
+func (s fakeStream) Err() error                      { return nil }
+func (s fakeStream) Close(ctx context.Context) error { return nil }
+func (s fakeStream) ResumeToken() bson.Raw           { return nil }
+
+func TestFilter(t *testing.T) {
+	got := filter([]string{"/myapp/database", "/my.app"})
+	want := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$regex", Value: "^/myapp/database"}}}},
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$regex", Value: `^/my\.app`}}}},
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: []string{"/myapp/database", "/myapp", "/", "/my.app", "/"}}}}},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filter() = %v, want %v", got, want)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newClient(&fakeCollection{docs: []interface{}{
+		bson.D{{Key: "_id", Value: "/myapp/database/url"}, {Key: "value", Value: "db.example.com"}},
+		bson.D{{Key: "_id", Value: "/myapp"}, {Key: "database", Value: bson.D{
+			{Key: "user", Value: "rob"},
+			{Key: "port", Value: int32(5432)},
+			{Key: "hosts", Value: bson.A{"a", "b"}},
+			{Key: "updated", Value: primitive.NewDateTimeFromTime(updated)},
+		}}, {Key: "other", Value: "filtered"}},
+		bson.D{{Key: "_id", Value: "/other"}, {Key: "value", Value: "filtered"}},
+		bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "value", Value: "skipped"}},
+	}})
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":     "db.example.com",
+		"/myapp/database/user":    "rob",
+		"/myapp/database/port":    "5432",
+		"/myapp/database/hosts/0": "a",
+		"/myapp/database/hosts/1": "b",
+		"/myapp/database/updated": "2024-01-02T03:04:05Z",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+
+	for _, streams := range []bool{false, true} {
+		if streams {
+			// Only the change stream can tell the change in time
+			pollInterval = time.Hour
+		} else {
+			pollInterval = 10 * time.Millisecond
+		}
+		f := &fakeCollection{streams: streams, events: make(chan struct{}, 10)}
+		f.docs = []interface{}{bson.D{{Key: "_id", Value: "/myapp/key"}, {Key: "value", Value: "foo"}}}
+		c := newClient(f)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		keys := []string{"/myapp"}
+
+		index, err := c.WatchPrefix(ctx, "/", keys, 0)
+		if err != nil || index != 1 {
+			t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+		}
+		if c.streaming != streams {
+			t.Errorf("streaming = %v, want %v", c.streaming, streams)
+		}
+
+		start := time.Now()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			f.set(
+				bson.D{{Key: "_id", Value: "/myapp/key"}, {Key: "value", Value: "foo"}},
+				bson.D{{Key: "_id", Value: "/other"}, {Key: "value", Value: "bar"}},
+			)
+			time.Sleep(50 * time.Millisecond)
+			f.set(bson.D{{Key: "_id", Value: "/myapp/key"}, {Key: "value", Value: "bar"}})
+		}()
+		index, err = c.WatchPrefix(ctx, "/", keys, index)
+		if err != nil || index != 2 {
+			t.Fatalf("WatchPrefix() after change = %d, %v, want 2 (streams: %v)", index, err, streams)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Errorf("WatchPrefix() returned on an unrelated change (streams: %v)", streams)
+		}
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+			t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+		}
+	}
+}
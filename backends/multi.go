@@ -0,0 +1,255 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// multiClient merges the key/value pairs of several StoreClients, the
+// values of the later clients overriding the earlier ones.
+type multiClient struct {
+	clients []StoreClient
+	// The names of the clients and whether they are required, all of them
+	// are if nil
+	names    []string
+	required []bool
+
+	mu sync.Mutex
+	// Last index returned by WatchPrefix
+	index uint64
+	// Indexes of the clients for every index returned by WatchPrefix
+	// which was not passed back yet
+	indexes map[uint64][]uint64
+}
+
+// NewMulti returns a StoreClient serving the key/value pairs of the
+// backends in configs, later backends overriding the values of earlier
+// ones. A single config returns the backend itself.
+func NewMulti(configs []Config) (StoreClient, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no backend given")
+	}
+	if len(configs) == 1 {
+		return New(configs[0])
+	}
+	clients := make([]StoreClient, 0, len(configs))
+	for _, config := range configs {
+		client, err := New(config)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %s", config.Backend, err)
+		}
+		clients = append(clients, client)
+	}
+	return newMultiClient(clients), nil
+}
+
+// NewStack returns a StoreClient serving the key/value pairs of the child
+// backends in configs, later children overriding the values of earlier
+// ones. A child which is not required is left out if it cannot be
+// created, and its values if they cannot be read.
+func NewStack(configs []StackConfig) (StoreClient, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no child backend given, add [[backends]] blocks to the config file")
+	}
+	var clients []StoreClient
+	var names []string
+	var required []bool
+	for i, config := range configs {
+		name := fmt.Sprintf("%d (%s)", i+1, config.Backend)
+		if config.Backend == "stack" || strings.Contains(config.Backend, ",") {
+			return nil, fmt.Errorf("backend %s: a child of the stack backend must be a single backend", name)
+		}
+		client, err := New(config.Config)
+		if err != nil {
+			if config.Required {
+				return nil, fmt.Errorf("backend %s: %s", name, err)
+			}
+			log.Error("Cannot create backend %s, leaving it out: %s", name, err)
+			continue
+		}
+		clients = append(clients, client)
+		names = append(names, name)
+		required = append(required, config.Required)
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("none of the child backends could be created")
+	}
+	c := newMultiClient(clients)
+	c.names, c.required = names, required
+	return c, nil
+}
+
+func newMultiClient(clients []StoreClient) *multiClient {
+	return &multiClient{
+		clients: clients,
+		indexes: make(map[uint64][]uint64),
+	}
+}
+
+// optional reports whether the failures of the i-th client are only
+// logged.
+func (c *multiClient) optional(i int) bool {
+	return c.required != nil && !c.required[i]
+}
+
+// GetValues queries every backend in order and merges their values. The
+// values of an optional backend which fails are left out, unless every
+// backend failed.
+func (c *multiClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	var firstErr error
+	read := false
+	for i, client := range c.clients {
+		values, err := client.GetValues(ctx, keys)
+		if err != nil && c.optional(i) {
+			log.Warning("Cannot read backend %s, leaving its values out: %s", c.names[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return vars, err
+		}
+		read = true
+		for k, v := range values {
+			vars[k] = v
+		}
+	}
+	if !read {
+		return vars, firstErr
+	}
+	return vars, nil
+}
+
+type multiWatchResponse struct {
+	client int
+	index  uint64
+	err    error
+}
+
+// WatchPrefix watches every backend and returns once one of them reports
+// a change. The returned index stands for the indexes of all backends,
+// the next call resumes each of them where it was.
+func (c *multiClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.mu.Lock()
+	indexes, ok := c.indexes[waitIndex]
+	delete(c.indexes, waitIndex)
+	c.mu.Unlock()
+	if !ok {
+		// The first call, or an index we did not hand out: start over
+		indexes = make([]uint64, len(c.clients))
+	}
+
+	// Cancelling stops the watch of every backend
+	watchCtx, stopAll := context.WithCancel(ctx)
+	defer stopAll()
+	respChan := make(chan multiWatchResponse, len(c.clients))
+	for i, client := range c.clients {
+		go func(i int, client StoreClient) {
+			index, err := client.WatchPrefix(watchCtx, prefix, keys, indexes[i])
+			respChan <- multiWatchResponse{i, index, err}
+		}(i, client)
+	}
+
+	var first *multiWatchResponse
+	// The first failure of an optional backend, the others keep watching
+	var failed *multiWatchResponse
+	cancelled := false
+	newIndexes := make([]uint64, len(indexes))
+	copy(newIndexes, indexes)
+	done := ctx.Done()
+	for range c.clients {
+		var r multiWatchResponse
+		select {
+		case r = <-respChan:
+		case <-done:
+			done = nil
+			cancelled = true
+			stopAll()
+			r = <-respChan
+		}
+		if r.err != nil && c.optional(r.client) && !cancelled {
+			log.Warning("Cannot watch backend %s, watching the others: %s", c.names[r.client], r.err)
+			if failed == nil {
+				failed = &r
+			}
+			continue
+		}
+		if first == nil && !cancelled {
+			// The first answer ends the watch of the other backends
+			first = &r
+			stopAll()
+		}
+		if r.err == nil {
+			newIndexes[r.client] = r.index
+		}
+	}
+	if first == nil || first.err != nil {
+		// Stopped or failed, the next call resumes at waitIndex again
+		c.mu.Lock()
+		c.indexes[waitIndex] = indexes
+		c.mu.Unlock()
+		if first == nil && failed != nil && !cancelled {
+			// Every backend failed
+			return waitIndex, failed.err
+		}
+		if first == nil {
+			return waitIndex, nil
+		}
+		return waitIndex, first.err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.indexes[c.index] = newIndexes
+	return c.index, nil
+}
+
+// Ping pings every backend. An optional backend which cannot be reached
+// is logged, unless none of them can be.
+func (c *multiClient) Ping(ctx context.Context) error {
+	var firstErr error
+	reached := false
+	for i, client := range c.clients {
+		err := Ping(ctx, client)
+		if err != nil && c.optional(i) {
+			log.Warning("Cannot reach backend %s: %s", c.names[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		reached = true
+	}
+	if !reached {
+		return firstErr
+	}
+	return nil
+}
+
+// KeepAlive keeps alive the connections of every backend.
+func (c *multiClient) KeepAlive(doneChan chan bool) {
+	for _, client := range c.clients {
+		go client.KeepAlive(doneChan)
+	}
+}
+
+// Secret reports whether the values of one of the backends are secrets.
+func (c *multiClient) Secret() bool {
+	for _, client := range c.clients {
+		if IsSecret(client) {
+			return true
+		}
+	}
+	return false
+}
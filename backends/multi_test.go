@@ -0,0 +1,285 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeClient is a StoreClient whose WatchPrefix returns the next index
+// once something is sent on changes.
+type fakeClient struct {
+	values  map[string]string
+	changes chan bool
+	// waitIndex of the last WatchPrefix call
+	waitIndex uint64
+	// Returned by GetValues and WatchPrefix if set
+	err error
+}
+
+func newFakeClient(values map[string]string) *fakeClient {
+	return &fakeClient{values: values, changes: make(chan bool)}
+}
+
+func (f *fakeClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.values, nil
+}
+
+func (f *fakeClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	f.waitIndex = waitIndex
+	if f.err != nil {
+		return waitIndex, f.err
+	}
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	select {
+	case <-f.changes:
+		return waitIndex + 1, nil
+	case <-ctx.Done():
+		return waitIndex, nil
+	}
+}
+
+func (f *fakeClient) KeepAlive(doneChan chan bool) {
+}
+
+func TestMultiGetValues(t *testing.T) {
+	c := newMultiClient([]StoreClient{
+		newFakeClient(map[string]string{"/key": "etcd", "/database/host": "127.0.0.1"}),
+		newFakeClient(map[string]string{"/key": "file", "/database/port": "3306"}),
+	})
+	vars, err := c.GetValues(context.Background(), []string{"/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "file",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestMultiWatchPrefix(t *testing.T) {
+	first := newFakeClient(nil)
+	second := newFakeClient(nil)
+	c := newMultiClient([]StoreClient{first, second})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 0)
+	if err != nil || index == 0 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want a new index", index, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		second.changes <- true
+	}()
+	next, err := c.WatchPrefix(ctx, "/", []string{"/"}, index)
+	if err != nil || next == index {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want a new index", next, err)
+	}
+	if first.waitIndex != 1 || second.waitIndex != 1 {
+		t.Errorf("backends watched at %d and %d, want 1", first.waitIndex, second.waitIndex)
+	}
+
+	// Each backend resumes at its own index
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.changes <- true
+	}()
+	index, err = c.WatchPrefix(ctx, "/", []string{"/"}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.waitIndex != 1 || second.waitIndex != 2 {
+		t.Errorf("backends watched at %d and %d, want 1 and 2", first.waitIndex, second.waitIndex)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	stopped, err := c.WatchPrefix(ctx, "/", []string{"/"}, index)
+	if err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+	if first.waitIndex != 2 || second.waitIndex != 2 {
+		t.Errorf("backends watched at %d and %d, want 2", first.waitIndex, second.waitIndex)
+	}
+}
+
+// secretClient is a fakeClient whose values are secrets.
+type secretClient struct {
+	*fakeClient
+}
+
+func (s secretClient) Secret() bool {
+	return true
+}
+
+func TestMultiIsSecret(t *testing.T) {
+	plain := newMultiClient([]StoreClient{newFakeClient(nil), newFakeClient(nil)})
+	if IsSecret(plain) {
+		t.Error("IsSecret() = true without a secret backend, want false")
+	}
+	secret := newMultiClient([]StoreClient{newFakeClient(nil), secretClient{newFakeClient(nil)}})
+	if !IsSecret(secret) {
+		t.Error("IsSecret() = false with a secret backend, want true")
+	}
+}
+
+// unregister removes a backend registered by a test.
+func unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, name)
+}
+
+// Fake backends registered so far, numbering the next one
+var fakeBackends int
+
+// newStackTest registers a fake backend for each client and returns the
+// configs of a stack of them.
+func newStackTest(t *testing.T, clients []*fakeClient, required []bool) []StackConfig {
+	configs := make([]StackConfig, len(clients))
+	for i, client := range clients {
+		fakeBackends++
+		name := fmt.Sprintf("fake%d", fakeBackends)
+		client := client
+		Register(name, func(config Config) (StoreClient, error) { return client, nil })
+		t.Cleanup(func() { unregister(name) })
+		configs[i] = StackConfig{Config{Backend: name}, required[i]}
+	}
+	return configs
+}
+
+func TestStackGetValues(t *testing.T) {
+	log.SetLevel("error")
+	defaults := newFakeClient(map[string]string{"/key": "file", "/database/port": "3306"})
+	etcd := newFakeClient(map[string]string{"/key": "etcd"})
+	c, err := NewStack(newStackTest(t, []*fakeClient{defaults, etcd}, []bool{true, false}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := c.GetValues(context.Background(), []string{"/"})
+	if err != nil || vars["/key"] != "etcd" || vars["/database/port"] != "3306" {
+		t.Errorf("GetValues() = %v, %v, want the values of etcd over those of the file", vars, err)
+	}
+
+	etcd.err = errors.New("etcd is down")
+	vars, err = c.GetValues(context.Background(), []string{"/"})
+	if err != nil || vars["/key"] != "file" {
+		t.Errorf("GetValues() with an optional backend down = %v, %v, want the values of the file", vars, err)
+	}
+
+	defaults.err = errors.New("no such file")
+	if _, err := c.GetValues(context.Background(), []string{"/"}); err == nil {
+		t.Error("GetValues() with a required backend down succeeded")
+	}
+
+	c, _ = NewStack(newStackTest(t, []*fakeClient{etcd}, []bool{false}))
+	if _, err := c.GetValues(context.Background(), []string{"/"}); err == nil {
+		t.Error("GetValues() with every backend down succeeded")
+	}
+}
+
+func TestStackWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	defaults := newFakeClient(nil)
+	etcd := newFakeClient(nil)
+	c, err := NewStack(newStackTest(t, []*fakeClient{defaults, etcd}, []bool{true, false}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcd.err = errors.New("etcd is down")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		defaults.changes <- true
+	}()
+	next, err := c.WatchPrefix(ctx, "/", []string{"/"}, index)
+	if err != nil || next == index {
+		t.Fatalf("WatchPrefix() with an optional backend down = %d, %v, want the change of the other", next, err)
+	}
+
+	defaults.err = errors.New("no such file")
+	if _, err := c.WatchPrefix(ctx, "/", []string{"/"}, next); err == nil {
+		t.Error("WatchPrefix() with every backend down succeeded")
+	}
+}
+
+func TestNewStack(t *testing.T) {
+	log.SetLevel("error")
+	Register("broken", func(config Config) (StoreClient, error) { return nil, errors.New("cannot connect") })
+	defer unregister("broken")
+	configs := newStackTest(t, []*fakeClient{newFakeClient(nil)}, []bool{true})
+
+	if _, err := NewStack(append(configs, StackConfig{Config{Backend: "broken"}, false})); err != nil {
+		t.Errorf("NewStack() with an optional broken backend = %v, want it left out", err)
+	}
+	if _, err := NewStack(append(configs, StackConfig{Config{Backend: "broken"}, true})); err == nil {
+		t.Error("NewStack() with a required broken backend succeeded")
+	}
+	if _, err := NewStack(append(configs, StackConfig{Config{Backend: "stack"}, true})); err == nil {
+		t.Error("NewStack() with a nested stack succeeded")
+	}
+	if _, err := NewStack(nil); err == nil {
+		t.Error("NewStack() without children succeeded")
+	}
+}
+
+// pingClient is a fakeClient which is a Pinger, failing with err.
+type pingClient struct {
+	*fakeClient
+	err error
+}
+
+func (p *pingClient) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func TestStackPing(t *testing.T) {
+	log.SetLevel("fatal")
+	required := &pingClient{fakeClient: newFakeClient(nil)}
+	optional := &pingClient{fakeClient: newFakeClient(nil)}
+	c := newMultiClient([]StoreClient{required, optional, newFakeClient(nil)})
+	c.names, c.required = []string{"1", "2", "3"}, []bool{true, false, false}
+
+	if err := Ping(context.Background(), c); err != nil {
+		t.Errorf("Ping() = %v", err)
+	}
+	optional.err = errors.New("etcd is down")
+	if err := Ping(context.Background(), c); err != nil {
+		t.Errorf("Ping() with an optional backend down = %v, want nil", err)
+	}
+	required.err = errors.New("no such file")
+	if err := Ping(context.Background(), c); err != required.err {
+		t.Errorf("Ping() with a required backend down = %v, want %v", err, required.err)
+	}
+	if err := Ping(context.Background(), newFakeClient(nil)); err != nil {
+		t.Errorf("Ping() of a client which is not a Pinger = %v, want nil", err)
+	}
+}
@@ -0,0 +1,284 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// MySQL has no way to push changes, the version of the table is polled.
+var pollInterval = 10 * time.Second
+
+// ER_BAD_FIELD_ERROR, the table has no updated_at column
+const errBadField = 1054
+
+// Client is a wrapper around a MySQL or MariaDB database. Every row of the
+// table holds one confd key in its "key" column and the value in its
+// "value" column. An "updated_at" column, set on every insert and update,
+// lets watches poll the version of the table instead of the values.
+type Client struct {
+	db     *sql.DB
+	table  string
+	poller *util.Poller
+
+	mu sync.Mutex
+	// Version of the table the values were last read at, per set of keys
+	tableVersions map[string]string
+	// Index of the values last seen, per set of keys
+	versions util.Versions
+
+	// Whether the table has an updated_at column, checked once the first
+	// watch starts
+	versionOnce sync.Once
+	versioned   bool
+}
+
+func init() {
+	backends.Register("mysql", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Table,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.Username, config.Password)
+	})
+}
+
+// New returns a *mysql.Client reading table from the database of the DSN
+// given by nodes, e.g. user:password@tcp(db.example.com:3306)/config. The
+// username, password and TLS configuration given by the certificates
+// override those of the DSN if set.
+func New(nodes []string, table, cert, key, caCert, username, password string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("give the DSN of the database as the only node with -node")
+	}
+	if table == "" {
+		return nil, errors.New("no table given, set it with -table")
+	}
+	cfg, err := config(nodes[0], cert, key, caCert, username, password)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	// A few connections are enough for the watches of the template
+	// resources, those the server closed are replaced on the next query
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	// Fail early instead of on the first query
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newClient(db, table), nil
+}
+
+func newClient(db *sql.DB, table string) *Client {
+	return &Client{
+		db:            db,
+		table:         quoteTable(table),
+		poller:        util.NewPoller(pollInterval),
+		tableVersions: make(map[string]string),
+		versioned:     true,
+	}
+}
+
+// config returns the driver configuration of dsn, with the settings given
+// by the flags.
+func config(dsn, cert, key, caCert, username, password string) (*mysql.Config, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		cfg.User = username
+	}
+	if password != "" {
+		cfg.Passwd = password
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		cfg.TLS = tlsConfig
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	return cfg, nil
+}
+
+// quoteTable quotes the table name, which may be qualified by its
+// database.
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.Replace(part, "`", "``", -1) + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// escapeLike escapes the wildcards of LIKE patterns in s with "!", which
+// unlike the default backslash does not depend on the SQL mode.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// Ping checks the connection to the database.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// GetValues queries the table for the rows whose key starts with one of
+// keys. The keys and values are read as bytes, the connection using
+// utf8mb4 unless the DSN sets another charset.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	conditions := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		conditions[i] = "`key` LIKE CONCAT(?, '%') ESCAPE '!'"
+		args[i] = escapeLike(key)
+	}
+	query := fmt.Sprintf("SELECT `key`, `value` FROM %s WHERE %s", c.table, strings.Join(conditions, " OR "))
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if value == nil {
+			log.Warning("Skipping key '%s'. 'value' is NULL.", key)
+			continue
+		}
+		// A case-insensitive collation of the column matches more keys
+		if !hasPrefix(string(key), keys) {
+			continue
+		}
+		vars[string(key)] = string(value)
+	}
+	return vars, rows.Err()
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// version returns the number of rows of the table and the last time one
+// was updated, which changes with every insert, update and delete.
+func (c *Client) version(ctx context.Context) (string, error) {
+	var count int64
+	var updated sql.NullString
+	query := fmt.Sprintf("SELECT COUNT(*), MAX(`updated_at`) FROM %s", c.table)
+	if err := c.db.QueryRowContext(ctx, query).Scan(&count, &updated); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s", count, updated.String), nil
+}
+
+// WatchPrefix returns an index greater than waitIndex once the values
+// of keys changed. The version of the table is queried every pollInterval,
+// and the values once it changed. Without an updated_at column the values
+// are polled.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.versionOnce.Do(func() {
+		_, err := c.version(ctx)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == errBadField {
+			log.Warning("%s has no updated_at column, polling its values instead", c.table)
+			c.versioned = false
+		}
+	})
+	if !c.versioned {
+		return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+	}
+	id := strings.Join(keys, ",")
+
+	if waitIndex == 0 {
+		// The version is read first so that a change meanwhile is told by
+		// the next one
+		version, err := c.version(ctx)
+		if err != nil {
+			return 0, err
+		}
+		vars, err := c.GetValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		index := c.versions.Update(keys, vars)
+		c.mu.Lock()
+		c.tableVersions[id] = version
+		c.mu.Unlock()
+		return index, nil
+	}
+
+	for {
+		// Values another watcher of keys already saw changed
+		if index := c.versions.Index(keys); index > waitIndex {
+			return index, nil
+		}
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(pollInterval):
+		}
+
+		version, err := c.version(ctx)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		c.mu.Lock()
+		last := c.tableVersions[id]
+		c.mu.Unlock()
+		if version == last {
+			continue
+		}
+		vars, err := c.GetValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		index := c.versions.Update(keys, vars)
+		c.mu.Lock()
+		c.tableVersions[id] = version
+		c.mu.Unlock()
+		if index > waitIndex {
+			return index, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, database/sql reconnects on its own.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,146 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/zyf0330/confd/log"
+)
+
+const (
+	condition    = "`key` LIKE CONCAT(?, '%') ESCAPE '!'"
+	valuesQuery  = "SELECT `key`, `value` FROM `confd` WHERE " + condition
+	versionQuery = "SELECT COUNT(*), MAX(`updated_at`) FROM `confd`"
+)
+
+func newMock(t *testing.T) (*Client, sqlmock.Sqlmock) {
+	log.SetLevel("error")
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(db, "confd"), mock
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := config("root:secret@tcp(db:3306)/config?charset=utf8mb4", "", "", "", "confd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.User != "confd" || cfg.Passwd != "secret" || cfg.Addr != "db:3306" || cfg.DBName != "config" {
+		t.Errorf("config() = %s:%s@%s/%s, want confd:secret@db:3306/config", cfg.User, cfg.Passwd, cfg.Addr, cfg.DBName)
+	}
+	if cfg.TLS != nil || cfg.Timeout != 30*time.Second {
+		t.Errorf("config() has TLS %v and timeout %s, want none and 30s", cfg.TLS, cfg.Timeout)
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	if got, want := quoteTable("config.confd"), "`config`.`confd`"; got != want {
+		t.Errorf("quoteTable() = %s, want %s", got, want)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	c, mock := newMock(t)
+	mock.ExpectQuery(valuesQuery+" OR "+condition).
+		WithArgs("/my!_app/database", "/100!%").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value"}).
+			AddRow([]byte("/my_app/database/url"), []byte("db.example.com")).
+			AddRow([]byte("/my_app/database/name"), []byte("caf\xc3\xa9 \xf0\x9f\x8d\xb5")).
+			AddRow([]byte("/my_app/database/empty"), []byte("")).
+			AddRow([]byte("/my_app/database/null"), nil).
+			// Matched by a case-insensitive collation
+			AddRow([]byte("/MY_APP/database/url"), []byte("other")))
+
+	vars, err := c.GetValues(context.Background(), []string{"/my_app/database", "/100%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/my_app/database/url":   "db.example.com",
+		"/my_app/database/name":  "café 🍵",
+		"/my_app/database/empty": "",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if got, ok := vars[k]; !ok || got != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, got, v)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func versionRows(count int, updated string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"count", "updated"}).AddRow(count, updated)
+}
+
+func valueRows(value string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"key", "value"}).AddRow("/myapp/key", value)
+}
+
+func TestWatchPrefix(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	c, mock := newMock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	// The column is checked, then the first version and values are read
+	mock.ExpectQuery(versionQuery).WillReturnRows(versionRows(2, "2024-01-01 00:00:00.000000"))
+	mock.ExpectQuery(versionQuery).WillReturnRows(versionRows(2, "2024-01-01 00:00:00.000000"))
+	mock.ExpectQuery(valuesQuery).WithArgs("/myapp").WillReturnRows(valueRows("foo"))
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	// Unchanged, then changed with unrelated values, then changed
+	mock.ExpectQuery(versionQuery).WillReturnRows(versionRows(2, "2024-01-01 00:00:00.000000"))
+	mock.ExpectQuery(versionQuery).WillReturnRows(versionRows(2, "2024-01-01 00:00:01.000000"))
+	mock.ExpectQuery(valuesQuery).WithArgs("/myapp").WillReturnRows(valueRows("foo"))
+	mock.ExpectQuery(versionQuery).WillReturnRows(versionRows(3, "2024-01-01 00:00:02.000000"))
+	mock.ExpectQuery(valuesQuery).WithArgs("/myapp").WillReturnRows(valueRows("bar"))
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
+
+func TestWatchPrefixWithoutVersion(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	c, mock := newMock(t)
+	keys := []string{"/myapp"}
+
+	mock.ExpectQuery(versionQuery).WillReturnError(&mysql.MySQLError{Number: errBadField, Message: "Unknown column 'updated_at'"})
+	mock.ExpectQuery(valuesQuery).WithArgs("/myapp").WillReturnRows(valueRows("foo"))
+	index, err := c.WatchPrefix(context.Background(), "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	if c.versioned {
+		t.Error("the version is polled without an updated_at column")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
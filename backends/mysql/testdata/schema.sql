@@ -0,0 +1,9 @@
+-- The table confd reads with -backend mysql -table confd. The binary
+-- collation keeps the keys case-sensitive, utf8mb4 stores any value, and
+-- updated_at lets the watches poll the version of the table.
+
+CREATE TABLE IF NOT EXISTS confd (
+    `key`        VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL PRIMARY KEY,
+    `value`      MEDIUMTEXT CHARACTER SET utf8mb4 NOT NULL,
+    `updated_at` TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+);
@@ -0,0 +1,304 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/zyf0330/confd/backends"
+
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// keyValue is the part of jetstream.KeyValue the client uses, faked in
+// tests.
+type keyValue interface {
+	Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error)
+	ListKeys(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyLister, error)
+	WatchAll(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error)
+}
+
+// Client is a wrapper around a NATS JetStream key-value bucket. Keys
+// starting with a slash are read as they are, the dots separating the
+// tokens of other keys are read as slashes, e.g. myapp.database.url is
+// /myapp/database/url.
+type Client struct {
+	kv keyValue
+
+	mu sync.Mutex
+	// Revision of the last update of every key, deletes included
+	revisions map[string]uint64
+	// Closed when the watcher tells a change
+	changed chan struct{}
+	// Closed once the watcher told the revisions of all keys
+	ready chan struct{}
+	// Revision last returned, per set of keys
+	indexes map[string]uint64
+	// The bucket is watched once the first watch starts
+	watchOnce sync.Once
+}
+
+func init() {
+	backends.Register("nats", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Table,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.Username, config.Password, config.AuthToken, config.Credentials)
+	})
+}
+
+// New returns a *nats.Client reading bucket from the servers given by
+// nodes. The bucket may instead be named by the bucket query parameter of
+// the nodes, e.g. nats://nats.example.com:4222?bucket=config. The
+// credentials file is either a user JWT with its seed or an nkey seed.
+func New(nodes []string, bucket, cert, key, caCert, username, password, token, credentials string) (*Client, error) {
+	servers := make([]string, len(nodes))
+	for i, node := range nodes {
+		u, err := url.Parse(node)
+		if err != nil || u.RawQuery == "" {
+			servers[i] = node
+			continue
+		}
+		if b := u.Query().Get("bucket"); b != "" && bucket == "" {
+			bucket = b
+		}
+		u.RawQuery = ""
+		servers[i] = u.String()
+	}
+	if bucket == "" {
+		return nil, errors.New("no bucket given, set it with -table or the bucket query parameter of -node")
+	}
+
+	opts := []nats.Option{
+		nats.Name("confd"),
+		nats.Timeout(30 * time.Second),
+		// Keep reconnecting, the watcher resumes once connected
+		nats.MaxReconnects(-1),
+	}
+	if username != "" || password != "" {
+		opts = append(opts, nats.UserInfo(username, password))
+	}
+	if token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+	if credentials != "" {
+		b, err := ioutil.ReadFile(credentials)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(string(b), "BEGIN NATS USER JWT") {
+			opts = append(opts, nats.UserCredentials(credentials))
+		} else {
+			opt, err := nats.NkeyOptionFromSeed(credentials)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, opt)
+		}
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	nc, err := nats.Connect(strings.Join(servers, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		nc.Close()
+		if errors.Is(err, jetstream.ErrBucketNotFound) {
+			return nil, fmt.Errorf("the key-value bucket %s does not exist", bucket)
+		}
+		return nil, err
+	}
+	return newClient(kv), nil
+}
+
+func newClient(kv keyValue) *Client {
+	return &Client{
+		kv:        kv,
+		revisions: make(map[string]uint64),
+		changed:   make(chan struct{}),
+		ready:     make(chan struct{}),
+		indexes:   make(map[string]uint64),
+	}
+}
+
+// confdKey returns the confd key of the key of the bucket.
+func confdKey(key string) string {
+	if strings.HasPrefix(key, "/") {
+		return key
+	}
+	return "/" + strings.Replace(key, ".", "/", -1)
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetValues lists the keys of the bucket and reads those starting with
+// one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	lister, err := c.kv.ListKeys(ctx)
+	if err == jetstream.ErrNoKeysFound {
+		return vars, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lister.Stop()
+
+	var matching []string
+	for key := range lister.Keys() {
+		if hasPrefix(confdKey(key), keys) {
+			matching = append(matching, key)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// The keys stop once the context is done
+		return nil, err
+	}
+	for _, key := range matching {
+		entry, err := c.kv.Get(ctx, key)
+		if err == jetstream.ErrKeyNotFound {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		vars[confdKey(key)] = string(entry.Value())
+	}
+	return vars, nil
+}
+
+// notify wakes up the watches.
+func (c *Client) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// watch watches the bucket for as long as confd runs, recording the
+// revision of every update.
+func (c *Client) watch() {
+	var readyOnce sync.Once
+	for retry := 0; ; retry++ {
+		watcher, err := c.kv.WatchAll(context.Background())
+		if err != nil {
+			wait := util.Backoff(time.Second, retry)
+			log.Error("Cannot watch the bucket, retrying in %s: %s", wait, err)
+			time.Sleep(wait)
+			continue
+		}
+		for entry := range watcher.Updates() {
+			retry = 0
+			if entry == nil {
+				// The revisions of all keys were told
+				readyOnce.Do(func() { close(c.ready) })
+				continue
+			}
+			c.mu.Lock()
+			c.revisions[confdKey(entry.Key())] = entry.Revision()
+			c.mu.Unlock()
+			c.notify()
+		}
+		watcher.Stop()
+		log.Warning("The watch of the bucket ended, watching it again")
+	}
+}
+
+// revision returns the revision of the last update of keys, 0 if none was
+// ever set.
+func (c *Client) revision(keys []string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var revision uint64
+	for key, r := range c.revisions {
+		if r > revision && hasPrefix(key, keys) {
+			revision = r
+		}
+	}
+	return revision
+}
+
+// WatchPrefix returns the revision of the last update of keys once it
+// changed, the bucket being watched for updates.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.watchOnce.Do(func() {
+		go c.watch()
+	})
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return waitIndex, nil
+	}
+	id := strings.Join(keys, ",")
+
+	if waitIndex == 0 {
+		revision := c.revision(keys)
+		c.mu.Lock()
+		c.indexes[id] = revision
+		c.mu.Unlock()
+		if revision == 0 {
+			// None of keys was set yet
+			return 1, nil
+		}
+		return revision, nil
+	}
+
+	for {
+		// Taken before the revision so that no change is missed between
+		// the two
+		c.mu.Lock()
+		changed := c.changed
+		last := c.indexes[id]
+		c.mu.Unlock()
+
+		if revision := c.revision(keys); revision != last {
+			c.mu.Lock()
+			c.indexes[id] = revision
+			c.mu.Unlock()
+			return revision, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		}
+	}
+}
+
+// KeepAlive is a no-op, the NATS client reconnects on its own.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,193 @@
+package nats
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/zyf0330/confd/log"
+)
+
+type fakeEntry struct {
+	key      string
+	value    string
+	revision uint64
+	op       jetstream.KeyValueOp
+}
+
+func (e fakeEntry) Bucket() string                  { return "config" }
+func (e fakeEntry) Key() string                     { return e.key }
+func (e fakeEntry) Value() []byte                   { return []byte(e.value) }
+func (e fakeEntry) Revision() uint64                { return e.revision }
+func (e fakeEntry) Created() time.Time              { return time.Time{} }
+func (e fakeEntry) Delta() uint64                   { return 0 }
+func (e fakeEntry) Operation() jetstream.KeyValueOp { return e.op }
+
+type fakeLister struct {
+	keys chan string
+}
+
+func (l fakeLister) Keys() <-chan string { return l.keys }
+func (l fakeLister) Stop() error         { return nil }
+
+type fakeWatcher struct {
+	updates chan jetstream.KeyValueEntry
+}
+
+func (w fakeWatcher) Updates() <-chan jetstream.KeyValueEntry { return w.updates }
+func (w fakeWatcher) Stop() error                             { return nil }
+
+// fakeBucket holds the latest entry of every key, and tells the updates to
+// its watchers.
+type fakeBucket struct {
+	mu       sync.Mutex
+	entries  map[string]fakeEntry
+	revision uint64
+	watchers []fakeWatcher
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{entries: make(map[string]fakeEntry)}
+}
+
+func (b *fakeBucket) update(key, value string, op jetstream.KeyValueOp) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.revision++
+	entry := fakeEntry{key, value, b.revision, op}
+	b.entries[key] = entry
+	for _, w := range b.watchers {
+		w.updates <- entry
+	}
+}
+
+func (b *fakeBucket) put(key, value string) { b.update(key, value, jetstream.KeyValuePut) }
+func (b *fakeBucket) delete(key string)     { b.update(key, "", jetstream.KeyValueDelete) }
+
+func (b *fakeBucket) Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entries[key]
+	if !ok || entry.op != jetstream.KeyValuePut {
+		return nil, jetstream.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+func (b *fakeBucket) ListKeys(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyLister, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make(chan string, len(b.entries))
+	for key, entry := range b.entries {
+		if entry.op == jetstream.KeyValuePut {
+			keys <- key
+		}
+	}
+	close(keys)
+	return fakeLister{keys}, nil
+}
+
+func (b *fakeBucket) WatchAll(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := fakeWatcher{make(chan jetstream.KeyValueEntry, 100)}
+	for _, entry := range b.entries {
+		w.updates <- entry
+	}
+	w.updates <- nil
+	b.watchers = append(b.watchers, w)
+	return w, nil
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	b := newFakeBucket()
+	b.put("/myapp/database/url", "db.example.com")
+	b.put("myapp.database.user", "rob")
+	b.put("/myapp/database/deleted", "gone")
+	b.delete("/myapp/database/deleted")
+	b.put("/other/key", "filtered")
+
+	vars, err := newClient(b).GetValues(context.Background(), []string{"/myapp/database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	b := newFakeBucket()
+	b.put("/myapp/key", "foo")
+	b.put("/other/key", "foo")
+	c := newClient(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want the revision 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.put("/other/key", "bar")
+		time.Sleep(50 * time.Millisecond)
+		b.put("myapp.key", "bar")
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 4 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want the revision 4", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.delete("myapp.key")
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", keys, index); err != nil || index != 5 {
+		t.Fatalf("WatchPrefix() after delete = %d, %v, want the revision 5", index, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
+
+func TestWatchPrefixWithoutKeys(t *testing.T) {
+	log.SetLevel("error")
+	b := newFakeBucket()
+	c := newClient(b)
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(context.Background(), "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.put("/myapp/key", "foo")
+	}()
+	// The first revision is 1 as well
+	if index, err = c.WatchPrefix(context.Background(), "/", keys, index); err != nil || index != 1 {
+		t.Fatalf("WatchPrefix() after the first put = %d, %v, want the revision 1", index, err)
+	}
+}
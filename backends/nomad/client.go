@@ -0,0 +1,315 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/util"
+)
+
+// How long a blocking query waits for a change before the server answers
+// anyway
+var waitTime = 5 * time.Minute
+
+// variableMetadata is a variable listed by /v1/vars.
+type variableMetadata struct {
+	Path        string
+	ModifyIndex uint64
+}
+
+// variable is a variable read from /v1/var/:path.
+type variable struct {
+	Path        string
+	ModifyIndex uint64
+	Items       map[string]string
+}
+
+// Client is a wrapper around the Variables API of Nomad. The items of a
+// variable are keys below its path, e.g. the item url of the variable
+// nomad/jobs/myapp is /nomad/jobs/myapp/url.
+type Client struct {
+	nodes     []string
+	namespace string
+	token     string
+	// client has a timeout, blockingClient does not for blocking queries
+	client         *http.Client
+	blockingClient *http.Client
+
+	mu sync.Mutex
+	// The variables read, reread once their ModifyIndex changed
+	variables map[string]variable
+	// The paths and ModifyIndex of the variables of keys last seen, per set
+	// of keys
+	states map[string]string
+}
+
+func init() {
+	backends.Register("nomad", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Scheme,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.AuthToken, config.Namespace)
+	})
+}
+
+// New returns a *nomad.Client reading the variables of namespace, the
+// default one if empty, from the Nomad agents given by nodes. The requests
+// carry token as the ACL token, and the client certificate if any.
+func New(nodes []string, scheme, cert, key, caCert, token, namespace string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no Nomad agent given, set it with -node")
+	}
+	tlsConfig, err := util.NewTLSConfig(cert, key, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && scheme == "http" {
+		scheme = "https"
+	}
+	addresses := make([]string, len(nodes))
+	for i, node := range nodes {
+		if !strings.Contains(node, "://") {
+			node = scheme + "://" + node
+		}
+		addresses[i] = strings.TrimSuffix(node, "/")
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return newClient(addresses, namespace, token,
+		&http.Client{Transport: transport, Timeout: 30 * time.Second},
+		&http.Client{Transport: transport}), nil
+}
+
+func newClient(nodes []string, namespace, token string, client, blockingClient *http.Client) *Client {
+	return &Client{
+		nodes:          nodes,
+		namespace:      namespace,
+		token:          token,
+		client:         client,
+		blockingClient: blockingClient,
+		variables:      make(map[string]variable),
+		states:         make(map[string]string),
+	}
+}
+
+// get decodes the JSON answer of the agents to a GET request of endpoint
+// into out, trying them in turn until one answers. It returns the
+// X-Nomad-Index of the answer, and os.ErrNotExist if there is nothing at
+// endpoint.
+func (c *Client) get(ctx context.Context, client *http.Client, endpoint string, query url.Values, out interface{}) (uint64, error) {
+	if c.namespace != "" {
+		query.Set("namespace", c.namespace)
+	}
+	var err error
+	for _, node := range c.nodes {
+		var req *http.Request
+		req, err = http.NewRequest("GET", node+endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req = req.WithContext(ctx)
+		if c.token != "" {
+			req.Header.Set("X-Nomad-Token", c.token)
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			// Try the next agent
+			continue
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return 0, errNotFound
+		default:
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return 0, fmt.Errorf("GET %s: %s: %s", endpoint, resp.Status, strings.TrimSpace(string(b)))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, fmt.Errorf("cannot parse the answer to GET %s: %s", endpoint, err)
+		}
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+		return index, nil
+	}
+	return 0, err
+}
+
+var errNotFound = errors.New("not found")
+
+// list lists the variables whose path starts with prefix. With an index,
+// the query blocks until the variables changed since it or waitTime
+// elapsed.
+func (c *Client) list(ctx context.Context, prefix string, index uint64) ([]variableMetadata, uint64, error) {
+	query := url.Values{"prefix": {prefix}}
+	client := c.client
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", waitTime.String())
+		client = c.blockingClient
+	}
+	var metadata []variableMetadata
+	index, err := c.get(ctx, client, "/v1/vars", query, &metadata)
+	return metadata, index, err
+}
+
+// read returns the variable of metadata, the one already read if it did
+// not change since.
+func (c *Client) read(ctx context.Context, metadata variableMetadata) (variable, error) {
+	c.mu.Lock()
+	v, ok := c.variables[metadata.Path]
+	c.mu.Unlock()
+	if ok && v.ModifyIndex == metadata.ModifyIndex {
+		return v, nil
+	}
+	if _, err := c.get(ctx, c.client, "/v1/var/"+metadata.Path, url.Values{}, &v); err != nil {
+		return variable{}, err
+	}
+	c.mu.Lock()
+	c.variables[metadata.Path] = v
+	c.mu.Unlock()
+	return v, nil
+}
+
+// listPrefix returns the prefix of the paths of the variables which may
+// hold keys, the first segment they share.
+func listPrefix(keys []string) string {
+	prefix := ""
+	for i, key := range keys {
+		segment := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 2)[0]
+		if i > 0 && segment != prefix {
+			return ""
+		}
+		prefix = segment
+	}
+	return prefix
+}
+
+// relevant returns the variables which may hold keys below one of keys.
+func relevant(metadata []variableMetadata, keys []string) []variableMetadata {
+	var vars []variableMetadata
+	for _, m := range metadata {
+		p := "/" + m.Path + "/"
+		for _, key := range keys {
+			if strings.HasPrefix(p, key) || strings.HasPrefix(key, p) {
+				vars = append(vars, m)
+				break
+			}
+		}
+	}
+	return vars
+}
+
+// GetValues lists the variables which may hold keys, and returns their
+// items below one of keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	metadata, _, err := c.list(ctx, listPrefix(keys), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range relevant(metadata, keys) {
+		v, err := c.read(ctx, m)
+		if err == errNotFound {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for item, value := range v.Items {
+			k := "/" + v.Path + "/" + item
+			for _, key := range keys {
+				if strings.HasPrefix(k, key) {
+					vars[k] = value
+					break
+				}
+			}
+		}
+	}
+	return vars, nil
+}
+
+// state returns the paths and ModifyIndex of the variables of keys, which
+// change with any of their items.
+func state(metadata []variableMetadata, keys []string) string {
+	vars := relevant(metadata, keys)
+	s := make([]string, len(vars))
+	for i, m := range vars {
+		s[i] = fmt.Sprintf("%s@%d", m.Path, m.ModifyIndex)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// WatchPrefix returns the X-Nomad-Index of the variables once those of
+// keys changed, listing them with blocking queries.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	id := strings.Join(keys, ",")
+	listPrefix := listPrefix(keys)
+
+	if waitIndex == 0 {
+		metadata, index, err := c.list(ctx, listPrefix, 0)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.states[id] = state(metadata, keys)
+		c.mu.Unlock()
+		if index == 0 {
+			index = 1
+		}
+		return index, nil
+	}
+
+	for {
+		metadata, index, err := c.list(ctx, listPrefix, waitIndex)
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		default:
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+
+		s := state(metadata, keys)
+		c.mu.Lock()
+		changed := c.states[id] != s
+		c.states[id] = s
+		c.mu.Unlock()
+		if changed {
+			return index, nil
+		}
+		if index < waitIndex {
+			// The index went backwards, e.g. the cluster was restored
+			index = 1
+		}
+		waitIndex = index
+	}
+}
+
+// KeepAlive is a no-op, every request opens or reuses a connection.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,174 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNomad serves the variables of its namespace to the holders of its
+// token, answering blocking queries once the variables changed.
+type fakeNomad struct {
+	mu        sync.Mutex
+	index     uint64
+	variables map[string]variable
+	changed   chan struct{}
+}
+
+func newFakeNomad() *fakeNomad {
+	return &fakeNomad{variables: make(map[string]variable), changed: make(chan struct{})}
+}
+
+func (f *fakeNomad) put(path string, items map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	f.variables[path] = variable{Path: path, ModifyIndex: f.index, Items: items}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Nomad-Token") != "secret" {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("namespace") != "web" {
+		http.Error(w, "wrong namespace", http.StatusBadRequest)
+		return
+	}
+	if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index > 0 {
+		f.mu.Lock()
+		current, changed := f.index, f.changed
+		f.mu.Unlock()
+		if current <= index {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			case <-time.After(waitTime):
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.index, 10))
+	switch {
+	case r.URL.Path == "/v1/vars":
+		metadata := []variableMetadata{}
+		for path, v := range f.variables {
+			if strings.HasPrefix(path, r.URL.Query().Get("prefix")) {
+				metadata = append(metadata, variableMetadata{path, v.ModifyIndex})
+			}
+		}
+		json.NewEncoder(w).Encode(metadata)
+	case strings.HasPrefix(r.URL.Path, "/v1/var/"):
+		v, ok := f.variables[strings.TrimPrefix(r.URL.Path, "/v1/var/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeNomad, token string) (*Client, func()) {
+	server := httptest.NewServer(f)
+	c, err := New([]string{server.URL}, "http", "", "", "", token, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, server.Close
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeNomad()
+	f.put("myapp/database", map[string]string{"url": "db.example.com", "user": "rob"})
+	f.put("myapp", map[string]string{"name": "myapp", "database/port": "5432"})
+	f.put("otherapp/database", map[string]string{"url": "other.example.com"})
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/myapp/database/port": "5432",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+
+	c, stop = newTestClient(t, f, "wrong")
+	defer stop()
+	if _, err := c.GetValues(context.Background(), []string{"/myapp"}); err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("GetValues() with a wrong token = %v, want the error of the agent", err)
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"/myapp/database", "/myapp/upstreams"}, "myapp"},
+		{[]string{"/myapp", "/otherapp"}, ""},
+		{[]string{"/"}, ""},
+	}
+	for _, tt := range tests {
+		if got := listPrefix(tt.keys); got != tt.want {
+			t.Errorf("listPrefix(%v) = %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	f := newFakeNomad()
+	f.put("myapp", map[string]string{"key": "foo"})
+	c, stop := newTestClient(t, f, "secret")
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.put("otherapp", map[string]string{"key": "bar"})
+		time.Sleep(50 * time.Millisecond)
+		f.put("myapp", map[string]string{"key": "bar"})
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 3 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 3", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,270 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// How often the table is queried to tell changes when the notification
+// channel cannot be listened on
+var pollInterval = 10 * time.Second
+
+// How long the first LISTEN may take before falling back to polling
+const listenTimeout = 30 * time.Second
+
+// Client is a wrapper around a PostgreSQL database. Every row of the table
+// holds one confd key in its "key" column and the value in its "value"
+// column.
+type Client struct {
+	db      *sql.DB
+	dsn     string
+	table   string
+	channel string
+	poller  *util.Poller
+
+	mu sync.Mutex
+	// Closed when a notification is received
+	changed chan struct{}
+	// Index of the values last seen, per set of keys
+	versions util.Versions
+
+	// The channel is listened on once the first watch starts, the table
+	// is polled if that fails
+	listenOnce sync.Once
+	listening  bool
+}
+
+func init() {
+	backends.Register("postgres", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Table, config.NotifyChannel,
+			config.ClientCert, config.ClientKey, config.ClientCaKeys,
+			config.Username, config.Password)
+	})
+}
+
+// New returns a *postgres.Client reading table from the database of the
+// DSN given by nodes, a URL or key=value connection string. The client
+// certificate, CA certificate, username and password are added to it if
+// set. Watches listen on channel for the notifications of a trigger on the
+// table.
+func New(nodes []string, table, channel, cert, key, caCert, username, password string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("give the DSN of the database as the only node with -node")
+	}
+	if table == "" {
+		return nil, errors.New("no table given, set it with -table")
+	}
+	dsn, err := connString(nodes[0], cert, key, caCert, username, password)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early instead of on the first query
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newClient(db, dsn, table, channel), nil
+}
+
+func newClient(db *sql.DB, dsn, table, channel string) *Client {
+	return &Client{
+		db:      db,
+		dsn:     dsn,
+		table:   quoteTable(table),
+		channel: channel,
+		poller:  util.NewPoller(pollInterval),
+		changed: make(chan struct{}),
+	}
+}
+
+// connString returns the key=value connection string of node, with the
+// settings given by the flags added, those overriding the ones of node.
+func connString(node, cert, key, caCert, username, password string) (string, error) {
+	if strings.HasPrefix(node, "postgres://") || strings.HasPrefix(node, "postgresql://") {
+		var err error
+		if node, err = pq.ParseURL(node); err != nil {
+			return "", err
+		}
+	}
+	settings := []string{node}
+	add := func(name, value string) {
+		if value != "" {
+			value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+			settings = append(settings, name+"='"+value+"'")
+		}
+	}
+	add("user", username)
+	add("password", password)
+	add("sslcert", cert)
+	add("sslkey", key)
+	add("sslrootcert", caCert)
+	if caCert != "" && !strings.Contains(node, "sslmode=") {
+		add("sslmode", "verify-full")
+	}
+	return strings.TrimSpace(strings.Join(settings, " ")), nil
+}
+
+// quoteTable quotes the table name, which may be qualified by its schema.
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// escapeLike escapes the wildcards of LIKE patterns in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Ping checks the connection to the database.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// GetValues queries the table for the rows whose key starts with one of
+// keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	conditions := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		conditions[i] = fmt.Sprintf("key LIKE $%d || '%%'", i+1)
+		args[i] = escapeLike(key)
+	}
+	query := fmt.Sprintf("SELECT key, value FROM %s WHERE %s", c.table, strings.Join(conditions, " OR "))
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if !value.Valid {
+			log.Warning("Skipping key '%s'. 'value' is NULL.", key)
+			continue
+		}
+		vars[key] = value.String
+	}
+	return vars, rows.Err()
+}
+
+// notify wakes up the watches.
+func (c *Client) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// listen starts listening on the notification channel for as long as
+// confd runs. It reports whether the LISTEN succeeded.
+func (c *Client) listen() bool {
+	listener := pq.NewListener(c.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warning("Listening on %s: %s", c.channel, err)
+		}
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Listen(c.channel)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(listenTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		listener.Close()
+		log.Warning("Cannot LISTEN on %s, polling the table instead: %s", c.channel, err)
+		return false
+	}
+
+	go func() {
+		for {
+			select {
+			// A nil notification follows a reconnection, changes may
+			// have been missed meanwhile
+			case <-listener.Notify:
+				c.notify()
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+	return true
+}
+
+// WatchPrefix returns an index greater than waitIndex once the values
+// of keys changed. The table is queried again whenever a notification is
+// received on the channel, or every pollInterval if it cannot be listened
+// on.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.listenOnce.Do(func() {
+		c.listening = c.listen()
+	})
+	if !c.listening {
+		return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+	}
+	if waitIndex == 0 {
+		vars, err := c.GetValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		return c.versions.Update(keys, vars), nil
+	}
+
+	for {
+		// Taken before the query so that no notification is missed
+		// between the two
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+
+		vars, err := c.GetValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index := c.versions.Update(keys, vars); index > waitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		}
+	}
+}
+
+// KeepAlive is a no-op, database/sql reconnects on its own.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
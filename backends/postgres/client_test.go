@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+func TestConnString(t *testing.T) {
+	tests := []struct {
+		node, cert, key, caCert, username, password string
+		want                                        string
+	}{
+		{
+			node: "host=db dbname=confd",
+			want: "host=db dbname=confd",
+		},
+		{
+			node:     "postgres://db:5433/confd?sslmode=disable",
+			username: "confd",
+			password: `it's\secret`,
+			want:     `dbname='confd' host='db' port='5433' sslmode='disable' user='confd' password='it\'s\\secret'`,
+		},
+		{
+			node:   "host=db dbname=confd",
+			cert:   "client.pem",
+			key:    "client-key.pem",
+			caCert: "ca.pem",
+			want:   "host=db dbname=confd sslcert='client.pem' sslkey='client-key.pem' sslrootcert='ca.pem' sslmode='verify-full'",
+		},
+		{
+			node:   "host=db sslmode=verify-ca",
+			caCert: "ca.pem",
+			want:   "host=db sslmode=verify-ca sslrootcert='ca.pem'",
+		},
+	}
+	for _, tt := range tests {
+		got, err := connString(tt.node, tt.cert, tt.key, tt.caCert, tt.username, tt.password)
+		if err != nil {
+			t.Errorf("connString(%q) failed: %s", tt.node, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("connString(%q) = %q, want %q", tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	if got, want := quoteTable("config.confd"), `"config"."confd"`; got != want {
+		t.Errorf("quoteTable() = %s, want %s", got, want)
+	}
+}
+
+// The tests below need a database, whose DSN is given by
+// CONFD_POSTGRES_DSN. They create the table of testdata/schema.sql.
+func testClient(t *testing.T) *Client {
+	dsn := os.Getenv("CONFD_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CONFD_POSTGRES_DSN is not set")
+	}
+	log.SetLevel("error")
+	schema, err := ioutil.ReadFile("testdata/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err = connString(dsn, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("TRUNCATE confd"); err != nil {
+		t.Fatal(err)
+	}
+	return newClient(db, dsn, "confd", "confd_updates")
+}
+
+func set(t *testing.T, c *Client, key, value string) {
+	_, err := c.db.Exec("INSERT INTO confd (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = $2", key, value)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	c := testClient(t)
+	defer c.db.Close()
+	set(t, c, "/myapp/database/url", "db.example.com")
+	set(t, c, "/myapp/database/user", "rob")
+	set(t, c, "/myapp_other", "escaped")
+	set(t, c, "/other", "ignored")
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/database", "/my%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	c := testClient(t)
+	defer c.db.Close()
+	set(t, c, "/myapp/key", "foo")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+	if !c.listening {
+		t.Fatal("not listening on confd_updates")
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		set(t, c, "/other", "bar")
+		time.Sleep(50 * time.Millisecond)
+		set(t, c, "/myapp/key", "bar")
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,22 @@
+-- The table confd reads with -backend postgres -table confd, and the
+-- trigger notifying it of the changes on the confd_updates channel.
+
+CREATE TABLE IF NOT EXISTS confd (
+    key   text PRIMARY KEY,
+    value text NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION confd_notify() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('confd_updates', OLD.key);
+    ELSE
+        PERFORM pg_notify('confd_updates', NEW.key);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS confd_notify ON confd;
+CREATE TRIGGER confd_notify AFTER INSERT OR UPDATE OR DELETE ON confd
+    FOR EACH ROW EXECUTE PROCEDURE confd_notify();
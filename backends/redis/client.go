@@ -0,0 +1,384 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// Redis keys use ':' to separate namespaces, "/app/db/host" in confd is
+// stored as "app:db:host" in Redis.
+const separator = ":"
+
+// Without keyspace notifications changes are detected by polling.
+var pollInterval = 5 * time.Second
+
+// A watch tracks the changes seen for one set of keys.
+type watch struct {
+	prefixes []string
+	// Bumped for every change below one of the prefixes
+	index uint64
+	// Closed and replaced whenever index changes
+	cond chan struct{}
+}
+
+// Client is a wrapper around the redis client
+type Client struct {
+	pool     *redis.Pool
+	machines []string
+	password string
+	// Logical database selected on every connection
+	db     int
+	poller *util.Poller
+	// Whether the server publishes keyspace notifications,
+	// only known after the first watch.
+	notify  *bool
+	watches map[string]*watch
+	// Protect notify and watches
+	wm sync.Mutex
+}
+
+func init() {
+	backends.Register("redis", func(config backends.Config) (backends.StoreClient, error) {
+		return NewRedisClient(config.BackendNodes, config.Password)
+	})
+}
+
+// NewRedisClient returns an *redis.Client with a connection to named machines.
+// It returns an error if a connection to the cluster cannot be made.
+func NewRedisClient(machines []string, password string) (*Client, error) {
+	c := &Client{
+		password: password,
+		poller:   util.NewPoller(pollInterval),
+		watches:  make(map[string]*watch),
+	}
+	for _, machine := range machines {
+		address, db, err := parseNode(machine)
+		if err != nil {
+			return nil, err
+		}
+		c.machines = append(c.machines, address)
+		c.db = db
+	}
+	c.pool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return c.dial(time.Second)
+		},
+		// Drop connections broken while idle, the pool dials a new one
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseNode splits a node of the form host:port/db, or a unix socket
+// path followed by /db, into the address and the database number.
+func parseNode(node string) (string, int, error) {
+	i := strings.LastIndex(node, "/")
+	if i < 0 {
+		return node, 0, nil
+	}
+	db, err := strconv.Atoi(node[i+1:])
+	if err != nil {
+		if strings.HasPrefix(node, "/") {
+			// A socket path without a database
+			return node, 0, nil
+		}
+		return "", 0, fmt.Errorf("invalid redis database in node %s", node)
+	}
+	return node[:i], db, nil
+}
+
+// dial connects to the first reachable machine, a zero readTimeout
+// lets reads block forever.
+func (c *Client) dial(readTimeout time.Duration) (redis.Conn, error) {
+	var err error
+	for _, address := range c.machines {
+		network := "tcp"
+		if strings.HasPrefix(address, "/") {
+			network = "unix"
+		}
+		log.Debug(fmt.Sprintf("Trying to connect to redis node %s", address))
+
+		var conn redis.Conn
+		conn, err = redis.Dial(network, address,
+			redis.DialConnectTimeout(time.Second),
+			redis.DialReadTimeout(readTimeout),
+			redis.DialWriteTimeout(time.Second),
+			redis.DialPassword(c.password),
+			redis.DialDatabase(c.db),
+		)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no redis node given")
+	}
+	return nil, err
+}
+
+// transform maps a confd key onto a Redis key.
+func transform(key string) string {
+	return strings.Replace(strings.Trim(key, "/"), "/", separator, -1)
+}
+
+// clean maps a Redis key back onto a confd key.
+func clean(key string) string {
+	return "/" + strings.Replace(key, separator, "/", -1)
+}
+
+// readKeys stores the values of the string keys, and every field of the
+// hashes as a child key of them, in vars. Types are looked up in one
+// pipeline and all string keys are fetched with a single MGET.
+func readKeys(conn redis.Conn, keys []string, vars map[string]string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if err := conn.Send("TYPE", key); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	var strs, hashes []string
+	for _, key := range keys {
+		typ, err := redis.String(conn.Receive())
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "string":
+			strs = append(strs, key)
+		case "hash":
+			hashes = append(hashes, key)
+		case "none":
+		default:
+			log.Debug("Skipping redis key %s of type %s", key, typ)
+		}
+	}
+
+	if len(strs) > 0 {
+		args := make([]interface{}, len(strs))
+		for i, key := range strs {
+			args[i] = key
+		}
+		values, err := redis.Values(conn.Do("MGET", args...))
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			// nil when removed in the meantime
+			if value != nil {
+				vars[clean(strs[i])], _ = redis.String(value, nil)
+			}
+		}
+	}
+	for _, key := range hashes {
+		fields, err := redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			vars[clean(key)+"/"+field] = value
+		}
+	}
+	return nil
+}
+
+// Ping sends a PING on a connection of the pool.
+func (c *Client) Ping(ctx context.Context) error {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
+
+// GetValues queries redis for keys prefixed by prefix.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return vars, err
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		rkey := transform(key)
+		pattern := "*"
+		if rkey != "" {
+			if err := readKeys(conn, []string{rkey}, vars); err != nil {
+				return vars, err
+			}
+			pattern = rkey + separator + "*"
+		}
+
+		cursor := 0
+		for {
+			values, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+			if err != nil {
+				return vars, err
+			}
+			var found []string
+			if _, err := redis.Scan(values, &cursor, &found); err != nil {
+				return vars, err
+			}
+			if err := readKeys(conn, found, vars); err != nil {
+				return vars, err
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// notifications reports whether the server publishes keyspace
+// notifications for generic and string/hash commands.
+func (c *Client) notifications() bool {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	config, err := redis.StringMap(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		log.Debug("Cannot read redis notify-keyspace-events: %s", err)
+		return false
+	}
+	flags := config["notify-keyspace-events"]
+	return strings.Contains(flags, "K") && strings.ContainsAny(flags, "A$h")
+}
+
+// subscribe listens for keyspace notifications of the selected database
+// and bumps the watches whose prefixes match the changed key. It
+// reconnects when the subscription breaks.
+func (c *Client) subscribe() {
+	channel := fmt.Sprintf("__keyspace@%d__:", c.db)
+	resubscribe := false
+	for {
+		// Subscriptions block on Receive, do not time out reads
+		conn, err := c.dial(0)
+		if err != nil {
+			log.Error("Redis subscription failed: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		psc := redis.PubSubConn{Conn: conn}
+		if err := psc.PSubscribe(channel + "*"); err != nil {
+			log.Error("Redis subscription failed: %s", err)
+			psc.Close()
+			time.Sleep(time.Second)
+			continue
+		}
+		if resubscribe {
+			// Something may have changed while not subscribed
+			c.bump("")
+		}
+		resubscribe = true
+
+	receive:
+		for {
+			switch n := psc.Receive().(type) {
+			case redis.Message:
+				c.bump(strings.TrimPrefix(n.Channel, channel))
+			case error:
+				log.Error("Redis subscription stopped: %s", n)
+				break receive
+			}
+		}
+		psc.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// bump notifies the watches interested in key, an empty key matches all.
+func (c *Client) bump(key string) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	for _, w := range c.watches {
+		for _, prefix := range w.prefixes {
+			if key == "" || prefix == "" || key == prefix || strings.HasPrefix(key, prefix+separator) {
+				w.index++
+				close(w.cond)
+				w.cond = make(chan struct{})
+				break
+			}
+		}
+	}
+}
+
+// WatchPrefix waits for keyspace notifications on the keys. When the
+// server does not publish them the first call returns at once and later
+// ones poll, so the keys are still rendered and kept up to date.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.wm.Lock()
+	if c.notify == nil {
+		notify := c.notifications()
+		c.notify = &notify
+		if notify {
+			go c.subscribe()
+		} else {
+			log.Warning("Redis keyspace notifications are disabled, polling every %s", pollInterval)
+		}
+	}
+	if !*c.notify {
+		c.wm.Unlock()
+		return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+	}
+
+	id := strings.Join(keys, ",")
+	w, ok := c.watches[id]
+	if !ok {
+		w = &watch{index: 1, cond: make(chan struct{})}
+		for _, k := range keys {
+			w.prefixes = append(w.prefixes, transform(k))
+		}
+		c.watches[id] = w
+	}
+	c.wm.Unlock()
+
+	for {
+		c.wm.Lock()
+		index, cond := w.index, w.cond
+		c.wm.Unlock()
+		if index > waitIndex {
+			return index, nil
+		}
+		select {
+		case <-cond:
+		case <-ctx.Done():
+			return waitIndex, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, broken connections are replaced by the pool.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,44 @@
+package redis
+
+import "testing"
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		node    string
+		address string
+		db      int
+	}{
+		{"127.0.0.1:6379", "127.0.0.1:6379", 0},
+		{"127.0.0.1:6379/4", "127.0.0.1:6379", 4},
+		{"/var/run/redis.sock", "/var/run/redis.sock", 0},
+		{"/var/run/redis.sock/1", "/var/run/redis.sock", 1},
+	}
+	for _, tt := range tests {
+		address, db, err := parseNode(tt.node)
+		if err != nil {
+			t.Errorf("parseNode(%q) unexpected error %s", tt.node, err)
+			continue
+		}
+		if address != tt.address || db != tt.db {
+			t.Errorf("parseNode(%q) = %q, %d, want %q, %d", tt.node, address, db, tt.address, tt.db)
+		}
+	}
+	if _, _, err := parseNode("127.0.0.1:6379/db"); err == nil {
+		t.Error("expected an error for a non numeric database")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	for key, want := range map[string]string{
+		"/":                "",
+		"/key":             "key",
+		"/prefix/database": "prefix:database",
+	} {
+		if got := transform(key); got != want {
+			t.Errorf("transform(%q) = %q, want %q", key, got, want)
+		}
+		if want != "" && clean(want) != key {
+			t.Errorf("clean(%q) = %q, want %q", want, clean(want), key)
+		}
+	}
+}
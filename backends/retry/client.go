@@ -0,0 +1,150 @@
+// Package retry provides a StoreClient retrying the reads of another one
+// which failed with a transient error, e.g. during an etcd leader
+// election.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StoreClient is the backends.StoreClient interface, which the backends
+// package wraps into a *retry.Client.
+type StoreClient interface {
+	GetValues(ctx context.Context, keys []string) (map[string]string, error)
+	WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error)
+	KeepAlive(doneChan chan bool)
+}
+
+// Config tells how a *retry.Client retries.
+type Config struct {
+	// Retries after the first failure
+	Retries int
+	// The wait before the first retry, doubled on each one up to MaxDelay
+	Interval time.Duration
+	MaxDelay time.Duration
+	// The part of the wait left out at random, between 0 and 1, so that
+	// clients do not retry all at once
+	Jitter float64
+}
+
+// Client is a StoreClient retrying the failed reads of another one if
+// Transient tells their error is, up to Config.Retries times.
+type Client struct {
+	client StoreClient
+	config Config
+}
+
+// New returns a *retry.Client retrying the reads of client as config
+// tells.
+func New(client StoreClient, config Config) *Client {
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = util.MaxRetryInterval
+	}
+	return &Client{client: client, config: config}
+}
+
+// Transient reports whether err may not happen again on a retry: a refused
+// or reset connection, a timeout, or an unavailable gRPC service such as an
+// etcd cluster without a leader. Authentication and permission errors, as
+// any other, are not.
+func Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do calls f until it succeeds, fails with an error which is not
+// transient, or failed Config.Retries more times. It gives up early once
+// ctx is done.
+func (c *Client) do(ctx context.Context, f func() error) error {
+	err := f()
+	for retry := 0; retry < c.config.Retries && Transient(err) && ctx.Err() == nil; retry++ {
+		wait := util.BackoffMax(c.config.Interval, c.config.MaxDelay, c.config.Jitter, retry)
+		log.Warning("Reading the backend failed (attempt %d of %d), retrying in %s: %s", retry+1, c.config.Retries+1, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		err = f()
+	}
+	return err
+}
+
+// GetValues reads keys from the wrapped client, retrying transient
+// failures.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	var vars map[string]string
+	err := c.do(ctx, func() error {
+		var err error
+		vars, err = c.client.GetValues(ctx, keys)
+		return err
+	})
+	return vars, err
+}
+
+// WatchPrefix watches keys with the wrapped client, retrying transient
+// failures.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	index := waitIndex
+	err := c.do(ctx, func() error {
+		var err error
+		index, err = c.client.WatchPrefix(ctx, prefix, keys, waitIndex)
+		return err
+	})
+	return index, err
+}
+
+func (c *Client) KeepAlive(doneChan chan bool) {
+	c.client.KeepAlive(doneChan)
+}
+
+// Secret reports whether the values of the wrapped client are secrets.
+func (c *Client) Secret() bool {
+	s, ok := c.client.(interface{ Secret() bool })
+	return ok && s.Secret()
+}
+
+// Ping pings the wrapped client, once.
+func (c *Client) Ping(ctx context.Context) error {
+	if p, ok := c.client.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// SetNodes changes the nodes of the wrapped client. It returns an error if
+// the wrapped client cannot change them.
+func (c *Client) SetNodes(nodes []string) error {
+	s, ok := c.client.(interface{ SetNodes([]string) error })
+	if !ok {
+		return errors.New("the backend cannot change its nodes")
+	}
+	return s.SetNodes(nodes)
+}
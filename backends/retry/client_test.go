@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransient(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{refused, true},
+		{fmt.Errorf("cannot read /app: %w", refused), true},
+		{context.DeadlineExceeded, true},
+		{status.Error(codes.Unavailable, "etcdserver: no leader"), true},
+		{status.Error(codes.PermissionDenied, "etcdserver: permission denied"), false},
+		{status.Error(codes.Unauthenticated, "etcdserver: invalid auth token"), false},
+		{errors.New("403 Forbidden"), false},
+	}
+	for _, tt := range tests {
+		if got := Transient(tt.err); got != tt.want {
+			t.Errorf("Transient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// failingClient fails the reads with the errors of errs in turn, then
+// succeeds.
+type failingClient struct {
+	errs  []error
+	calls int
+}
+
+func (c *failingClient) next() error {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return c.errs[c.calls-1]
+	}
+	return nil
+}
+
+func (c *failingClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := c.next(); err != nil {
+		return nil, err
+	}
+	return map[string]string{"/key": "value"}, nil
+}
+
+func (c *failingClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if err := c.next(); err != nil {
+		return waitIndex, err
+	}
+	return waitIndex + 1, nil
+}
+
+func (c *failingClient) KeepAlive(doneChan chan bool) {
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	unavailable := status.Error(codes.Unavailable, "etcdserver: leader changed")
+	denied := status.Error(codes.PermissionDenied, "etcdserver: permission denied")
+	tests := []struct {
+		name    string
+		errs    []error
+		calls   int
+		wantErr error
+	}{
+		{"transient", []error{unavailable, unavailable}, 3, nil},
+		{"too many transient", []error{unavailable, unavailable, unavailable, unavailable}, 4, unavailable},
+		{"permission", []error{denied}, 1, denied},
+	}
+	for _, tt := range tests {
+		f := &failingClient{errs: tt.errs}
+		c := New(f, Config{Retries: 3, Interval: time.Millisecond, Jitter: 0.5})
+		vars, err := c.GetValues(context.Background(), []string{"/key"})
+		if err != tt.wantErr || f.calls != tt.calls {
+			t.Errorf("GetValues() %s = %v after %d calls, want %v after %d", tt.name, err, f.calls, tt.wantErr, tt.calls)
+		}
+		if err == nil && vars["/key"] != "value" {
+			t.Errorf("GetValues() %s = %q", tt.name, vars)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("error")
+	f := &failingClient{errs: []error{context.DeadlineExceeded}}
+	c := New(f, Config{Retries: 1, Interval: time.Millisecond})
+	if index, err := c.WatchPrefix(context.Background(), "/", []string{"/key"}, 1); err != nil || index != 2 {
+		t.Errorf("WatchPrefix() after a timeout = %d, %v, want 2", index, err)
+	}
+}
+
+func TestGiveUpOnContext(t *testing.T) {
+	log.SetLevel("error")
+	f := &failingClient{errs: []error{context.DeadlineExceeded, context.DeadlineExceeded}}
+	c := New(f, Config{Retries: 5, Interval: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetValues(ctx, []string{"/key"}); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("GetValues() = %v after %s, want an error at the context deadline", err, time.Since(start))
+	}
+}
+
+// nodesClient is a failingClient recording the nodes it is given.
+type nodesClient struct {
+	failingClient
+	nodes []string
+}
+
+func (c *nodesClient) SetNodes(nodes []string) error {
+	c.nodes = nodes
+	return nil
+}
+
+func TestSetNodes(t *testing.T) {
+	nodes := []string{"etcd1:2379", "etcd2:2379"}
+	inner := &nodesClient{}
+	if err := New(inner, Config{}).SetNodes(nodes); err != nil || !reflect.DeepEqual(inner.nodes, nodes) {
+		t.Errorf("SetNodes() = %v, nodes of the wrapped client %q, want %q", err, inner.nodes, nodes)
+	}
+	if err := New(&failingClient{}, Config{}).SetNodes(nodes); err == nil {
+		t.Error("SetNodes() of a client which cannot change its nodes succeeded")
+	}
+}
@@ -0,0 +1,215 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// S3 notifications need a queue or topic to be delivered to, changes are
+// detected by polling the ETags of the objects instead.
+var pollInterval = 10 * time.Second
+
+// s3API is the part of the S3 API used by Client.
+type s3API interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// Client is a wrapper around the S3 client.
+type Client struct {
+	client s3API
+	bucket string
+	// Prefix of the objects holding the keys, "" or ending with a slash
+	root string
+	// Objects larger than this many bytes are skipped
+	maxSize int64
+	poller  *util.Poller
+}
+
+// parseNode splits a node, a bucket name or an s3://bucket/root URL, into
+// the bucket and the prefix of the objects holding the keys.
+func parseNode(node string) (string, string, error) {
+	node = strings.TrimPrefix(node, "s3://")
+	parts := strings.SplitN(node, "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("no S3 bucket given, set it with -node")
+	}
+	root := ""
+	if len(parts) == 2 {
+		if root = strings.Trim(parts[1], "/"); root != "" {
+			root += "/"
+		}
+	}
+	return parts[0], root, nil
+}
+
+func init() {
+	backends.Register("s3", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Endpoint, config.PathStyle, config.MaxObjectSize)
+	})
+}
+
+// New returns an *s3.Client reading the bucket named by the first node.
+// Credentials and region come from the default AWS configuration chain,
+// endpoint overrides the S3 endpoint, e.g. for MinIO, which usually also
+// needs pathStyle addressing.
+func New(nodes []string, endpoint string, pathStyle bool, maxSize int64) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no S3 bucket given, set it with -node")
+	}
+	bucket, root, err := parseNode(nodes[0])
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" && endpoint != "" {
+		// S3 compatible stores rarely care about the region
+		cfg.Region = "us-east-1"
+	}
+	// Fail early instead of on the first request
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	})
+	return newClient(client, bucket, root, maxSize), nil
+}
+
+func newClient(client s3API, bucket, root string, maxSize int64) *Client {
+	return &Client{
+		client:  client,
+		bucket:  bucket,
+		root:    root,
+		maxSize: maxSize,
+		poller:  util.NewPoller(pollInterval),
+	}
+}
+
+// object is an object holding a key.
+type object struct {
+	key  string
+	name string
+	etag string
+	size int64
+}
+
+// objects returns the objects holding keys prefixed by key.
+func (c *Client) objects(ctx context.Context, key string) ([]object, error) {
+	var objects []object
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(c.root + strings.TrimPrefix(key, "/")),
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			name := aws.ToString(o.Key)
+			if strings.HasSuffix(name, "/") {
+				// A folder created in the console
+				continue
+			}
+			objects = append(objects, object{
+				key:  "/" + strings.TrimPrefix(name, c.root),
+				name: name,
+				etag: aws.ToString(o.ETag),
+				size: aws.ToInt64(o.Size),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// GetValues retrieves the contents of the objects whose keys start with
+// one of keys. Objects larger than the maximum size are skipped.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		objects, err := c.objects(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, o := range objects {
+			if o.size > c.maxSize {
+				log.Warning("Skipping S3 object %s of %d bytes, larger than %d bytes", o.name, o.size, c.maxSize)
+				continue
+			}
+			value, err := c.getObject(ctx, o.name)
+			if err != nil {
+				return vars, err
+			}
+			vars[o.key] = value
+		}
+	}
+	return vars, nil
+}
+
+func (c *Client) getObject(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// The object may have grown since it was listed
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxSize))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// etags returns the ETag of every object holding one of keys.
+func (c *Client) etags(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		objects, err := c.objects(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, o := range objects {
+			vars[o.key] = o.etag
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix polls the ETags of the objects and returns a new index once
+// an object was changed, added or deleted.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.etags)
+}
+
+// KeepAlive is a no-op, the AWS SDK retries failed requests itself.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
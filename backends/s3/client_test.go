@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeS3 serves a single bucket, listing one object per page.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (f *fakeS3) put(name, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[name] = content
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, aws.ToString(in.Prefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(aws.ToString(in.ContinuationToken))
+	out := &s3.ListObjectsV2Output{}
+	if start < len(names) {
+		content := f.objects[names[start]]
+		out.Contents = []types.Object{{
+			Key:  aws.String(names[start]),
+			ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum([]byte(content)))),
+			Size: aws.Int64(int64(len(content))),
+		}}
+	}
+	if start+1 < len(names) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(strconv.Itoa(start + 1))
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(content))}, nil
+}
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		node, bucket, root string
+	}{
+		{"config", "config", ""},
+		{"s3://config", "config", ""},
+		{"s3://config/", "config", ""},
+		{"s3://config/production/", "config", "production/"},
+		{"config/production/eu", "config", "production/eu/"},
+	}
+	for _, tt := range tests {
+		bucket, root, err := parseNode(tt.node)
+		if err != nil || bucket != tt.bucket || root != tt.root {
+			t.Errorf("parseNode(%q) = %q, %q, %v, want %q, %q", tt.node, bucket, root, err, tt.bucket, tt.root)
+		}
+	}
+	if _, _, err := parseNode("s3://"); err == nil {
+		t.Error("expected an error without a bucket")
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("error")
+	f := &fakeS3{objects: map[string]string{
+		"production/key":           "foobar",
+		"production/database/host": "127.0.0.1",
+		"production/database/port": "3306",
+		"production/database/":     "",
+		"production/big.tar":       strings.Repeat("x", 2048),
+		"staging/key":              "other",
+	}}
+	c := newClient(f, "config", "production/", 1024)
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/big.tar", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefixComparesETags(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := &fakeS3{objects: map[string]string{"app/key": "foo"}}
+	c := newClient(f, "config", "", 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.put("other/key", "ignored")
+		time.Sleep(50 * time.Millisecond)
+		f.put("app/key", "bar")
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 2", index, err)
+	}
+}
@@ -0,0 +1,191 @@
+package secretsdir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+)
+
+// dataLink is the symlink to the current version of a Kubernetes volume,
+// such as a projected Secret. The kubelet writes a new version into a
+// hidden directory and atomically renames a new dataLink over the old one;
+// the visible files are symlinks through it.
+const dataLink = "..data"
+
+// Client reads the files of directories, such as the secrets Docker and
+// Swarm mount in /run/secrets.
+type Client struct {
+	dirs []string
+}
+
+func init() {
+	backends.Register("secrets-dir", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes)
+	})
+}
+
+// New returns a *secretsdir.Client reading the files below the directories
+// given by nodes, those of the later ones overriding those of the earlier
+// ones.
+func New(nodes []string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no secrets directory given, set it with -node")
+	}
+	for _, dir := range nodes {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return &Client{dirs: nodes}, nil
+}
+
+// hidden reports whether the entry name is left out, the versions and
+// links the kubelet keeps next to the files all starting with "..".
+func hidden(name string) bool {
+	return strings.HasPrefix(name, "..")
+}
+
+// walk calls fn with every file below dir, following symlinks, and its key,
+// its path relative to dir. It calls dirFn with every directory, dir
+// included. A directory already visited through another symlink is
+// skipped.
+func walk(dir string, fn func(key, name string) error, dirFn func(name string) error) error {
+	visited := make(map[string]bool)
+	var walkDir func(key, name string) error
+	walkDir = func(key, name string) error {
+		real, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return err
+		}
+		if visited[real] {
+			return nil
+		}
+		visited[real] = true
+		if err := dirFn(name); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if hidden(entry.Name()) {
+				continue
+			}
+			p := filepath.Join(name, entry.Name())
+			// Stat follows the symlinks ReadDir does not
+			fi, err := os.Stat(p)
+			if os.IsNotExist(err) {
+				// A dangling symlink, e.g. while the kubelet updates
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				err = walkDir(path.Join(key, entry.Name()), p)
+			} else {
+				err = fn(path.Join(key, entry.Name()), p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walkDir("/", dir)
+}
+
+// GetValues returns the contents of the files whose keys, their paths
+// relative to the directories, start with one of keys. The contents are
+// passed as they are, binary ones included.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, dir := range c.dirs {
+		err := walk(dir, func(key, name string) error {
+			if !hasPrefix(key, keys) {
+				return nil
+			}
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			vars[key] = string(data)
+			return nil
+		}, func(string) error { return nil })
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+func hasPrefix(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchPrefix waits for changes of the files and returns a new index.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	// return something > 0 to trigger a key retrieval from the store
+	if waitIndex == 0 {
+		return 1, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return waitIndex, err
+	}
+	defer watcher.Close()
+
+	for _, dir := range c.dirs {
+		err := walk(dir, func(string, string) error { return nil }, watcher.Add)
+		if err != nil {
+			return waitIndex, err
+		}
+	}
+	for {
+		select {
+		case event := <-watcher.Events:
+			// A new version of a Kubernetes volume is only visible once
+			// dataLink is renamed over, its other hidden entries are
+			// ignored.
+			name := filepath.Base(event.Name)
+			if event.Op == fsnotify.Chmod || hidden(name) && name != dataLink {
+				continue
+			}
+			log.Debug("Secrets directory event: %s", event)
+			return waitIndex + 1, nil
+		case err := <-watcher.Errors:
+			return waitIndex, err
+		case <-ctx.Done():
+			return waitIndex, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, there is no connection to keep alive.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
+
+// Secret reports that the values are secrets, which must not be logged.
+func (c *Client) Secret() bool {
+	return true
+}
@@ -0,0 +1,156 @@
+package secretsdir
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// project lays out files in dir like the kubelet does for a projected
+// volume: in a hidden version directory, made current by renaming ..data
+// over, the visible entries being symlinks through ..data.
+func project(t *testing.T, dir, version string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, version, name), content)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, dataLink)); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		top := strings.SplitN(name, "/", 2)[0]
+		if _, err := os.Lstat(filepath.Join(dir, top)); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dataLink, top), filepath.Join(dir, top)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	docker := t.TempDir()
+	writeFile(t, filepath.Join(docker, "db_password"), "secret\n")
+	writeFile(t, filepath.Join(docker, "tls", "key.der"), "\x00\x01\xff\xfe")
+	writeFile(t, filepath.Join(docker, "token"), "overridden")
+	k8s := t.TempDir()
+	project(t, k8s, "..2024_01_01_00_00_00.1", map[string]string{
+		"token":       "abc",
+		"app/api-key": "xyz",
+	})
+
+	c, err := New([]string{docker, k8s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/db_password", "/tls", "/token", "/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/db_password": "secret\n",
+		"/tls/key.der": "\x00\x01\xff\xfe",
+		"/token":       "abc",
+		"/app/api-key": "xyz",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %q, want %q", vars, want)
+	}
+
+	vars, err = c.GetValues(context.Background(), []string{"/tls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 {
+		t.Errorf("GetValues(/tls) = %q, want only /tls/key.der", vars)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "file"), "")
+	for _, nodes := range [][]string{nil, {filepath.Join(dir, "missing")}, {filepath.Join(dir, "file")}} {
+		if _, err := New(nodes); err == nil {
+			t.Errorf("New(%q) succeeded", nodes)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "db_password"), "secret")
+	writeFile(t, filepath.Join(dir, "nested", "token"), "abc")
+	k8s := filepath.Join(dir, "k8s")
+	project(t, k8s, "..1", map[string]string{"token": "abc"})
+
+	c, err := New([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	index, err := c.WatchPrefix(ctx, "/", []string{"/"}, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	changes := []func(){
+		func() { writeFile(t, filepath.Join(dir, "db_password"), "rotated") },
+		func() { writeFile(t, filepath.Join(dir, "nested", "token"), "def") },
+		func() {
+			// Only the rename of ..data makes the new version visible
+			writeFile(t, filepath.Join(k8s, "..2", "token"), "def")
+			time.Sleep(100 * time.Millisecond)
+			os.Symlink("..2", filepath.Join(k8s, "..data_tmp"))
+			os.Rename(filepath.Join(k8s, "..data_tmp"), filepath.Join(k8s, dataLink))
+		},
+	}
+	for i, change := range changes {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			change()
+		}()
+		start := time.Now()
+		index, err = c.WatchPrefix(ctx, "/", []string{"/"}, index)
+		if err != nil || index != uint64(i+2) {
+			t.Fatalf("WatchPrefix() after change %d = %d, %v, want %d", i, index, err, i+2)
+		}
+		if i == 2 && time.Since(start) < 150*time.Millisecond {
+			t.Error("WatchPrefix() returned before ..data was renamed")
+		}
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/k8s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["/k8s/token"] != "def" {
+		t.Errorf("GetValues() after the update = %q, want the new token", vars)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if index, err = c.WatchPrefix(ctx, "/", []string{"/"}, index); err != nil || index != 4 {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want 4", index, err)
+	}
+}
@@ -0,0 +1,285 @@
+package secretsmanager
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+)
+
+// Secrets Manager has no way to watch secrets, changes are detected by
+// polling their last changed dates.
+var pollInterval = 30 * time.Second
+
+// Accounts with many secrets are throttled when listing them, the
+// requests are retried with backoff this many times.
+const maxAttempts = 10
+
+// secretsAPI is the part of the Secrets Manager API used by Client.
+type secretsAPI interface {
+	secretsmanager.ListSecretsAPIClient
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+}
+
+// Client is a wrapper around the Secrets Manager client.
+type Client struct {
+	client secretsAPI
+}
+
+// secret is a secret holding a key, or keys below it.
+type secret struct {
+	name        string
+	lastChanged time.Time
+}
+
+func init() {
+	backends.Register("secretsmanager", func(config backends.Config) (backends.StoreClient, error) {
+		return New(backends.AWSEndpoint(config.BackendNodes))
+	})
+}
+
+// New returns a *secretsmanager.Client. Credentials and region come from
+// the default AWS configuration chain, endpoint overrides the Secrets
+// Manager endpoint, e.g. for localstack.
+func New(endpoint string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = maxAttempts
+			// Retry throttled requests for as long as it takes
+			o.RateLimiter = ratelimit.None
+		})
+	}))
+	if err != nil {
+		return nil, err
+	}
+	// Fail early instead of on the first request
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, err
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return &Client{client}, nil
+}
+
+// GetValues retrieves the values of the secrets named key or below key.
+// Binary secrets are base64 encoded. The fields of secrets holding a
+// JSON object are also available as keys below the secret name.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		secrets, err := c.secrets(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+		for _, s := range secrets {
+			if err := c.getSecretValue(ctx, s.name, vars); err != nil {
+				return vars, err
+			}
+		}
+	}
+	// A secret holding key may have brought more than asked for
+	for k := range vars {
+		if !hasPrefix(k, keys) {
+			delete(vars, k)
+		}
+	}
+	return vars, nil
+}
+
+// secrets returns the secrets named key or below key. If there are none,
+// it returns the secret holding key in its JSON object, if any.
+func (c *Client) secrets(ctx context.Context, key string) ([]secret, error) {
+	secrets, err := c.listSecrets(ctx, key)
+	if err != nil || len(secrets) > 0 {
+		return secrets, err
+	}
+	for name := path.Dir(key); name != "/" && name != "."; name = path.Dir(name) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		resp, err := c.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+			SecretId: aws.String(name),
+		})
+		cancel()
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []secret{{name, lastChanged(resp.LastChangedDate, resp.CreatedDate)}}, nil
+	}
+	return nil, nil
+}
+
+// listSecrets returns the secrets named key or below key.
+func (c *Client) listSecrets(ctx context.Context, key string) ([]secret, error) {
+	var secrets []secret
+	input := &secretsmanager.ListSecretsInput{MaxResults: aws.Int32(100)}
+	if key != "/" {
+		// The name filter matches any name starting with key
+		input.Filters = []types.Filter{{
+			Key:    types.FilterNameStringTypeName,
+			Values: []string{key},
+		}}
+	}
+	paginator := secretsmanager.NewListSecretsPaginator(c.client, input)
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range page.SecretList {
+			name := aws.ToString(s.Name)
+			if !hasPrefix(name, []string{key}) {
+				continue
+			}
+			secrets = append(secrets, secret{name, lastChanged(s.LastChangedDate, s.CreatedDate)})
+		}
+	}
+	return secrets, nil
+}
+
+// getSecretValue stores the value of the secret name in vars.
+func (c *Client) getSecretValue(ctx context.Context, name string, vars map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := c.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		// Deleted since it was listed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.SecretString == nil {
+		vars[name] = base64.StdEncoding.EncodeToString(resp.SecretBinary)
+		return nil
+	}
+	value := aws.ToString(resp.SecretString)
+	vars[name] = value
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		// Not a JSON object
+		return nil
+	}
+	for field, v := range fields {
+		if s, ok := v.(string); ok {
+			vars[name+"/"+field] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Warning("Skipping field %s of secret %s: %s", field, name, err)
+			continue
+		}
+		vars[name+"/"+field] = string(b)
+	}
+	return nil
+}
+
+// lastChanged returns the time a secret was last changed, its creation
+// if it was never changed.
+func lastChanged(changed, created *time.Time) time.Time {
+	if changed != nil {
+		return *changed
+	}
+	return aws.ToTime(created)
+}
+
+// hasPrefix reports whether name is one of keys or below one of them.
+func hasPrefix(name string, keys []string) bool {
+	for _, key := range keys {
+		key = strings.TrimSuffix(key, "/")
+		if key == "" || name == key || strings.HasPrefix(name, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// lastChangedIndex returns when the last of the secrets holding keys
+// changed, as a Unix time in nanoseconds.
+func (c *Client) lastChangedIndex(ctx context.Context, keys []string) (uint64, error) {
+	var index uint64
+	for _, key := range keys {
+		secrets, err := c.secrets(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		for _, s := range secrets {
+			if t := uint64(s.lastChanged.UnixNano()); t > index {
+				index = t
+			}
+		}
+	}
+	return index, nil
+}
+
+// WatchPrefix polls the secrets holding keys and returns when the last of
+// them changed once that differs from waitIndex. Deleting a secret other
+// than the last changed one goes unnoticed until the next change.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	if waitIndex == 0 {
+		index, err := c.lastChangedIndex(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		// return something > 0 to trigger a key retrieval from the store
+		if index == 0 {
+			index = 1
+		}
+		return index, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(pollInterval):
+		}
+
+		index, err := c.lastChangedIndex(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index == 0 {
+			index = 1
+		}
+		if index != waitIndex {
+			return index, nil
+		}
+	}
+}
+
+// KeepAlive is a no-op, the AWS SDK retries failed requests itself.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,171 @@
+package secretsmanager
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+type fakeSecret struct {
+	value       *string
+	binary      []byte
+	lastChanged time.Time
+}
+
+// fakeSecrets lists the secrets one per page.
+type fakeSecrets struct {
+	mu      sync.Mutex
+	secrets map[string]fakeSecret
+	now     time.Time
+}
+
+func newFakeSecrets() *fakeSecrets {
+	return &fakeSecrets{
+		secrets: make(map[string]fakeSecret),
+		now:     time.Unix(1500000000, 0),
+	}
+}
+
+func (f *fakeSecrets) put(name string, s fakeSecret) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(time.Second)
+	s.lastChanged = f.now
+	f.secrets[name] = s
+}
+
+func (f *fakeSecrets) ListSecrets(ctx context.Context, in *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.secrets {
+		match := true
+		for _, filter := range in.Filters {
+			if filter.Key == types.FilterNameStringTypeName && !strings.HasPrefix(name, filter.Values[0]) {
+				match = false
+			}
+		}
+		if match {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(aws.ToString(in.NextToken))
+	out := &secretsmanager.ListSecretsOutput{}
+	if start < len(names) {
+		lastChanged := f.secrets[names[start]].lastChanged
+		out.SecretList = []types.SecretListEntry{{Name: aws.String(names[start]), LastChangedDate: &lastChanged}}
+	}
+	if start+1 < len(names) {
+		out.NextToken = aws.String(strconv.Itoa(start + 1))
+	}
+	return out, nil
+}
+
+func (f *fakeSecrets) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.secrets[aws.ToString(in.SecretId)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{}
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: in.SecretId, SecretString: s.value, SecretBinary: s.binary}, nil
+}
+
+func (f *fakeSecrets) DescribeSecret(ctx context.Context, in *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.secrets[aws.ToString(in.SecretId)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{}
+	}
+	return &secretsmanager.DescribeSecretOutput{Name: in.SecretId, LastChangedDate: &s.lastChanged}, nil
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeSecrets()
+	f.put("/key", fakeSecret{value: aws.String("foobar")})
+	f.put("/myapp/db", fakeSecret{value: aws.String(`{"user": "rob", "password": "p@sSw0rd", "port": 3306}`)})
+	f.put("/myapp/cert", fakeSecret{binary: []byte{0xca, 0xfe}})
+	f.put("/myapp2/key", fakeSecret{value: aws.String("other")})
+	c := &Client{f}
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/myapp/", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":               "foobar",
+		"/myapp/db":          `{"user": "rob", "password": "p@sSw0rd", "port": 3306}`,
+		"/myapp/db/user":     "rob",
+		"/myapp/db/password": "p@sSw0rd",
+		"/myapp/db/port":     "3306",
+		"/myapp/cert":        "yv4=",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestGetValuesField(t *testing.T) {
+	f := newFakeSecrets()
+	f.put("/myapp/db", fakeSecret{value: aws.String(`{"user": "rob", "password": "p@sSw0rd"}`)})
+	c := &Client{f}
+
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/db/password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars["/myapp/db/password"] != "p@sSw0rd" {
+		t.Errorf("GetValues() = %v, want only the password", vars)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeSecrets()
+	f.put("/myapp/db", fakeSecret{value: aws.String("foo")})
+	c := &Client{f}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/myapp", keys, 0)
+	if want := uint64(time.Unix(1500000001, 0).UnixNano()); err != nil || index != want {
+		t.Fatalf("first WatchPrefix() = %d, %v, want %d", index, err, want)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.put("/other", fakeSecret{value: aws.String("ignored")})
+		time.Sleep(50 * time.Millisecond)
+		f.put("/myapp/db", fakeSecret{value: aws.String("bar")})
+	}()
+	index, err = c.WatchPrefix(ctx, "/myapp", keys, index)
+	if want := uint64(time.Unix(1500000003, 0).UnixNano()); err != nil || index != want {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want %d", index, err, want)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	stopped, err := c.WatchPrefix(ctx, "/myapp", keys, index)
+	if err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
@@ -0,0 +1,283 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// The table read when -table is not set
+const defaultTable = "kv"
+
+// Client is a wrapper around a SQLite database file. Every row of the table
+// holds one confd key in its "key" column and the value in its "value"
+// column. The file is opened read-only.
+type Client struct {
+	path  string
+	table string
+
+	mu sync.Mutex
+	db *sql.DB
+	// Closed when the file may have changed
+	changed chan struct{}
+	// Index of the values last seen, per set of keys
+	versions util.Versions
+	// Whether the directory of the file is watched
+	watching bool
+	// The file and data version last seen, to tell changes
+	info    os.FileInfo
+	version int64
+}
+
+func init() {
+	backends.Register("sqlite", func(config backends.Config) (backends.StoreClient, error) {
+		return New(config.BackendNodes, config.Table)
+	})
+}
+
+// New returns a *sqlite.Client reading table from the database file given
+// by nodes.
+func New(nodes []string, table string) (*Client, error) {
+	if len(nodes) != 1 {
+		return nil, errors.New("give the path of the database file as the only node with -node")
+	}
+	if table == "" {
+		table = defaultTable
+	}
+	c := &Client{
+		path:    nodes[0],
+		table:   table,
+		changed: make(chan struct{}),
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open opens the database file read-only, replacing the database opened
+// before, and checks that it has the table.
+func (c *Client) open() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	// Escape what the driver would take for the query string of the URI
+	name := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(c.path)
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	// PRAGMA data_version only tells the changes made by other connections
+	// since the same connection last read it
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	var found int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", c.table).Scan(&found)
+	if err == nil && found == 0 {
+		err = fmt.Errorf("%s has no table %s", c.path, c.table)
+	}
+	var version int64
+	if err == nil {
+		err = db.QueryRow("PRAGMA data_version").Scan(&version)
+	}
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	old := c.db
+	c.db, c.info, c.version = db, info, version
+	c.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (c *Client) database() *sql.DB {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db
+}
+
+// GetValues queries the table for the rows whose key starts with one of
+// keys.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	if len(keys) == 0 {
+		return vars, nil
+	}
+	// Unlike LIKE, substr compares the keys case-sensitively
+	conditions := make([]string, len(keys))
+	args := make([]interface{}, 2*len(keys))
+	for i, key := range keys {
+		conditions[i] = `substr("key", 1, length(?)) = ?`
+		args[2*i], args[2*i+1] = key, key
+	}
+	query := fmt.Sprintf(`SELECT "key", "value" FROM %s WHERE %s`, quoteTable(c.table), strings.Join(conditions, " OR "))
+	rows, err := c.database().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if !value.Valid {
+			log.Warning("Skipping key '%s'. 'value' is NULL.", key)
+			continue
+		}
+		vars[key] = value.String
+	}
+	return vars, rows.Err()
+}
+
+// quoteTable quotes the table name, which may be qualified by its schema.
+func quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.Replace(part, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// notify wakes up the watches.
+func (c *Client) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// check tells the watches if the file was replaced or modified, or another
+// connection wrote the database, which may not change the file until the
+// write-ahead log is checkpointed.
+func (c *Client) check() {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		// Being replaced, the next event tells the new file
+		log.Debug("Cannot stat %s: %s", c.path, err)
+		return
+	}
+	c.mu.Lock()
+	replaced := !os.SameFile(info, c.info)
+	c.mu.Unlock()
+	if replaced {
+		if err := c.open(); err != nil {
+			log.Error("Cannot reopen %s: %s", c.path, err)
+			return
+		}
+		c.notify()
+		return
+	}
+
+	var version int64
+	if err := c.database().QueryRow("PRAGMA data_version").Scan(&version); err != nil {
+		log.Error("Cannot read the data version of %s: %s", c.path, err)
+		return
+	}
+	c.mu.Lock()
+	modified := !info.ModTime().Equal(c.info.ModTime()) || info.Size() != c.info.Size() || version != c.version
+	c.info, c.version = info, version
+	c.mu.Unlock()
+	if modified {
+		c.notify()
+	}
+}
+
+// watch watches the directory of the file for as long as confd runs, to
+// see it replaced and its journal or write-ahead log written.
+func (c *Client) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(c.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	base := filepath.Base(c.path)
+	go func() {
+		for {
+			select {
+			case event := <-watcher.Events:
+				if event.Op == fsnotify.Chmod || !strings.HasPrefix(filepath.Base(event.Name), base) {
+					continue
+				}
+				log.Debug("File event: %s", event)
+				c.check()
+			case err := <-watcher.Errors:
+				log.Warning("Watching %s: %s", c.path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// WatchPrefix returns an index greater than waitIndex once the values
+// of keys changed. The table is queried again whenever the file or its
+// data version changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.mu.Lock()
+	if !c.watching {
+		if err := c.watch(); err != nil {
+			c.mu.Unlock()
+			return waitIndex, err
+		}
+		c.watching = true
+	}
+	c.mu.Unlock()
+	if waitIndex == 0 {
+		vars, err := c.GetValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		return c.versions.Update(keys, vars), nil
+	}
+
+	for {
+		// Taken before the query so that no change is missed between the
+		// two
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+
+		vars, err := c.GetValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index := c.versions.Update(keys, vars); index > waitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-changed:
+		}
+	}
+}
+
+// KeepAlive is a no-op, there is no connection to keep alive.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
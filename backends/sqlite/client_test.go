@@ -0,0 +1,186 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// newDatabase creates a database file with the kv table, and returns its
+// path and a connection writing it.
+func newDatabase(t *testing.T) (string, *sql.DB, func()) {
+	log.SetLevel("error")
+	dir, err := ioutil.TempDir("", "confd-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, `CREATE TABLE kv (key TEXT PRIMARY KEY, value TEXT)`)
+	return path, db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// exec runs query with db, failing the test on errors. It may be called
+// by the goroutines of the test.
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	path, db, cleanup := newDatabase(t)
+	defer cleanup()
+	exec(t, db, `INSERT INTO kv VALUES
+		('/myapp/database/url', 'db.example.com'),
+		('/myapp/database/empty', ''),
+		('/myapp/database/null', NULL),
+		('/MYAPP/database/url', 'other'),
+		('/my%app', 'other')`)
+
+	c, err := New([]string{path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/myapp/database", "/my%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/myapp/database/url":   "db.example.com",
+		"/myapp/database/empty": "",
+		"/my%app":               "other",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("GetValues() = %v, want %v", vars, want)
+	}
+
+	if _, err := c.database().Exec(`DELETE FROM kv`); err == nil {
+		t.Error("the database is writable")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	path, _, cleanup := newDatabase(t)
+	defer cleanup()
+
+	if _, err := New([]string{path}, "config"); err == nil || !strings.Contains(err.Error(), "no table config") {
+		t.Errorf("New() with a missing table = %v, want an error naming it", err)
+	}
+	missing := filepath.Join(filepath.Dir(path), "missing.db")
+	if _, err := New([]string{missing}, ""); err == nil {
+		t.Error("New() with a missing file succeeded")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Error("New() created the missing file")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	path, db, cleanup := newDatabase(t)
+	defer cleanup()
+	exec(t, db, `INSERT INTO kv VALUES ('/myapp/key', 'foo')`)
+	c, err := New([]string{path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	index, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		exec(t, db, `INSERT INTO kv VALUES ('/other', 'bar')`)
+		time.Sleep(50 * time.Millisecond)
+		exec(t, db, `UPDATE kv SET value = 'bar' WHERE key = '/myapp/key'`)
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WatchPrefix() returned on an unrelated change")
+	}
+
+	// The file is replaced by a new one
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		replacement, err := sql.Open("sqlite3", path+".new")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer replacement.Close()
+		exec(t, replacement, `CREATE TABLE kv (key TEXT PRIMARY KEY, value TEXT)`)
+		exec(t, replacement, `INSERT INTO kv VALUES ('/myapp/key', 'baz')`)
+		if err := os.Rename(path+".new", path); err != nil {
+			t.Error(err)
+		}
+	}()
+	index, err = c.WatchPrefix(ctx, "/", keys, index)
+	if err != nil || index != 3 {
+		t.Fatalf("WatchPrefix() after replacing the file = %d, %v, want 3", index, err)
+	}
+	if vars, err := c.GetValues(context.Background(), keys); err != nil || vars["/myapp/key"] != "baz" {
+		t.Errorf("GetValues() after replacing the file = %v, %v, want the new value", vars, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if stopped, err := c.WatchPrefix(ctx, "/", keys, index); err != nil || stopped != index {
+		t.Fatalf("stopped WatchPrefix() = %d, %v, want %d", stopped, err, index)
+	}
+}
+
+func TestWatchPrefixSameKeys(t *testing.T) {
+	path, db, cleanup := newDatabase(t)
+	defer cleanup()
+	exec(t, db, `INSERT INTO kv VALUES ('/myapp/key', 'foo')`)
+	c, err := New([]string{path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys := []string{"/myapp"}
+
+	// Two template resources watching the same keys
+	first, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.WatchPrefix(ctx, "/", keys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec(t, db, `UPDATE kv SET value = 'bar' WHERE key = '/myapp/key'`)
+	if index, err := c.WatchPrefix(ctx, "/", keys, first); err != nil || index <= first {
+		t.Fatalf("first WatchPrefix() after change = %d, %v, want more than %d", index, err, first)
+	}
+	if index, err := c.WatchPrefix(ctx, "/", keys, second); err != nil || index <= second {
+		t.Fatalf("second WatchPrefix() after change = %d, %v, want more than %d", index, err, second)
+	}
+}
@@ -0,0 +1,151 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/util"
+)
+
+// Parameter Store has no way to watch parameters, changes are detected
+// by polling their versions.
+var pollInterval = 10 * time.Second
+
+// ssmAPI is the part of the SSM API used by Client.
+type ssmAPI interface {
+	ssm.GetParametersByPathAPIClient
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// Client is a wrapper around the SSM Parameter Store client.
+type Client struct {
+	client ssmAPI
+	poller *util.Poller
+}
+
+func init() {
+	backends.Register("ssm", func(config backends.Config) (backends.StoreClient, error) {
+		return New(backends.AWSEndpoint(config.BackendNodes))
+	})
+}
+
+// New returns an *ssm.Client. Credentials and region come from the
+// default AWS configuration chain, endpoint overrides the SSM endpoint,
+// e.g. for localstack.
+func New(endpoint string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early instead of on the first request
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, err
+	}
+	client := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return newClient(client), nil
+}
+
+func newClient(client ssmAPI) *Client {
+	return &Client{
+		client: client,
+		poller: util.NewPoller(pollInterval),
+	}
+}
+
+// GetValues retrieves the values of the parameters below keys, or of the
+// parameter named key if there are none. SecureString parameters are
+// decrypted.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return c.parameters(ctx, keys, true, func(p types.Parameter) string {
+		return aws.ToString(p.Value)
+	})
+}
+
+// versions returns the version of every parameter below keys.
+func (c *Client) versions(ctx context.Context, keys []string) (map[string]string, error) {
+	return c.parameters(ctx, keys, false, func(p types.Parameter) string {
+		return strconv.FormatInt(p.Version, 10)
+	})
+}
+
+// parameters maps the names of the parameters below keys, or of the
+// parameter named key if there are none, to the result of field.
+func (c *Client) parameters(ctx context.Context, keys []string, decrypt bool, field func(types.Parameter) string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		params, err := c.getParametersByPath(ctx, key, decrypt)
+		if err != nil {
+			return vars, err
+		}
+		if len(params) == 0 {
+			params, err = c.getParameter(ctx, key, decrypt)
+			if err != nil {
+				return vars, err
+			}
+		}
+		for _, p := range params {
+			vars[aws.ToString(p.Name)] = field(p)
+		}
+	}
+	return vars, nil
+}
+
+func (c *Client) getParametersByPath(ctx context.Context, path string, decrypt bool) ([]types.Parameter, error) {
+	var params []types.Parameter
+	paginator := ssm.NewGetParametersByPathPaginator(c.client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(decrypt),
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, page.Parameters...)
+	}
+	return params, nil
+}
+
+func (c *Client) getParameter(ctx context.Context, name string, decrypt bool) ([]types.Parameter, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := c.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(decrypt),
+	})
+	var notFound *types.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []types.Parameter{*resp.Parameter}, nil
+}
+
+// WatchPrefix polls the versions of the parameters and returns a new
+// index once a parameter was changed, added or deleted.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.versions)
+}
+
+// KeepAlive is a no-op, the AWS SDK retries failed requests itself.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,141 @@
+package ssm
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// fakeSSM serves parameters one per page. SecureString values are only
+// readable with decryption.
+type fakeSSM struct {
+	mu     sync.Mutex
+	params map[string]types.Parameter
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{params: make(map[string]types.Parameter)}
+}
+
+func (f *fakeSSM) put(name, value string, typ types.ParameterType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.params[name] = types.Parameter{
+		Name:    aws.String(name),
+		Value:   aws.String(value),
+		Type:    typ,
+		Version: f.params[name].Version + 1,
+	}
+}
+
+func (f *fakeSSM) visible(p types.Parameter, decrypt bool) types.Parameter {
+	if p.Type == types.ParameterTypeSecureString && !decrypt {
+		p.Value = aws.String("encrypted")
+	}
+	return p
+}
+
+func (f *fakeSSM) GetParametersByPath(ctx context.Context, in *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := strings.TrimSuffix(aws.ToString(in.Path), "/") + "/"
+	var names []string
+	for name := range f.params {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(aws.ToString(in.NextToken))
+	out := &ssm.GetParametersByPathOutput{}
+	if start < len(names) {
+		out.Parameters = []types.Parameter{f.visible(f.params[names[start]], aws.ToBool(in.WithDecryption))}
+	}
+	if start+1 < len(names) {
+		out.NextToken = aws.String(strconv.Itoa(start + 1))
+	}
+	return out, nil
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.params[aws.ToString(in.Name)]
+	if !ok {
+		return nil, &types.ParameterNotFound{}
+	}
+	p = f.visible(p, aws.ToBool(in.WithDecryption))
+	return &ssm.GetParameterOutput{Parameter: &p}, nil
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeSSM()
+	f.put("/key", "foobar", types.ParameterTypeString)
+	f.put("/database/host", "127.0.0.1", types.ParameterTypeString)
+	f.put("/database/password", "p@sSw0rd", types.ParameterTypeSecureString)
+	f.put("/database/port", "3306", types.ParameterTypeString)
+	f.put("/other/key", "value", types.ParameterTypeString)
+	c := newClient(f)
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":               "foobar",
+		"/database/host":     "127.0.0.1",
+		"/database/password": "p@sSw0rd",
+		"/database/port":     "3306",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWatchPrefixComparesVersions(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	f := newFakeSSM()
+	f.put("/app/key", "foo", types.ParameterTypeString)
+	c := newClient(f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// The same value stored again is a new version
+		f.put("/app/key", "foo", types.ParameterTypeString)
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() without change = %d, %v, want 2", index, err)
+	}
+}
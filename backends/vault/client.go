@@ -0,0 +1,423 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// Vault has no way to watch a path, changes are detected by polling.
+var pollInterval = 10 * time.Second
+
+// Client is a wrapper around the Vault HTTP API.
+type Client struct {
+	client  *http.Client
+	address string
+	token   string
+	poller  *util.Poller
+	// KV engine version of every mount seen so far, by mount path
+	mounts map[string]int
+	mm     sync.Mutex
+}
+
+// secret is the part of a Vault response confd cares about.
+type secret struct {
+	Data map[string]interface{} `json:"data"`
+	Auth *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// getParameter returns the named parameter, it panics when it is not set
+func getParameter(key string, parameters map[string]string) string {
+	value := parameters[key]
+	if value == "" {
+		// panic if a configuration is missing
+		panic(fmt.Sprintf("%s is missing from configuration", key))
+	}
+	return value
+}
+
+// panicToError converts a panic to an error
+func panicToError(err *error) {
+	if r := recover(); r != nil {
+		switch t := r.(type) {
+		case string:
+			*err = errors.New(t)
+		case error:
+			*err = t
+		default: // panic again if we don't know how to handle
+			panic(r)
+		}
+	}
+}
+
+// authenticate with the remote client
+func (c *Client) authenticate(authType string, params map[string]string) (err error) {
+	defer panicToError(&err)
+
+	var s *secret
+	switch authType {
+	case "token":
+		c.token = getParameter("token", params)
+		return nil
+	case "app-id":
+		s, err = c.write(context.Background(), "auth/app-id/login", map[string]interface{}{
+			"app_id":  getParameter("app-id", params),
+			"user_id": getParameter("user-id", params),
+		})
+	case "app-role":
+		s, err = c.write(context.Background(), fmt.Sprintf("auth/%s/login", getMountPath(params, "approle")), map[string]interface{}{
+			"role_id":   getParameter("role-id", params),
+			"secret_id": getParameter("secret-id", params),
+		})
+	case "userpass":
+		username, password := getParameter("username", params), getParameter("password", params)
+		s, err = c.write(context.Background(), fmt.Sprintf("auth/%s/login/%s", getMountPath(params, "userpass"), username), map[string]interface{}{
+			"password": password,
+		})
+	case "cert":
+		s, err = c.write(context.Background(), fmt.Sprintf("auth/%s/login", getMountPath(params, "cert")), map[string]interface{}{})
+	default:
+		return fmt.Errorf("unsupported vault auth type: %s", authType)
+	}
+
+	if err != nil {
+		return err
+	}
+	if s == nil || s.Auth == nil || s.Auth.ClientToken == "" {
+		return errors.New("vault login did not return a client token")
+	}
+
+	log.Debug("client authenticated with auth backend: %s", authType)
+	// the default place for a token is in the X-Vault-Token header
+	c.token = s.Auth.ClientToken
+	return nil
+}
+
+func getMountPath(params map[string]string, defaultPath string) string {
+	if p := strings.Trim(params["path"], "/"); p != "" {
+		return p
+	}
+	return defaultPath
+}
+
+func init() {
+	backends.Register("vault", func(config backends.Config) (backends.StoreClient, error) {
+		vaultConfig := map[string]string{
+			"app-id":    config.AppID,
+			"user-id":   config.UserID,
+			"role-id":   config.RoleID,
+			"secret-id": config.SecretID,
+			"username":  config.Username,
+			"password":  config.Password,
+			"token":     config.AuthToken,
+			"cert":      config.ClientCert,
+			"key":       config.ClientKey,
+			"caCert":    config.ClientCaKeys,
+			"path":      config.Path,
+		}
+		address := config.BackendNodes[0]
+		if !strings.Contains(address, "://") {
+			address = config.Scheme + "://" + address
+		}
+		return NewVaultClient(address, config.AuthType, vaultConfig)
+	})
+}
+
+// NewVaultClient returns an *vault.Client with a connection to named machines.
+// It returns an error if authentication fails.
+func NewVaultClient(address, authType string, params map[string]string) (*Client, error) {
+	if authType == "" {
+		return nil, errors.New("you have to set the auth type when using the vault backend")
+	}
+	log.Info("Vault authType: %s", authType)
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	tlsConfig, err := util.NewTLSConfig(params["cert"], params["key"], params["caCert"])
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	c := &Client{
+		client:  &http.Client{Transport: transport, Timeout: 60 * time.Second},
+		address: strings.TrimRight(address, "/"),
+		poller:  util.NewPoller(pollInterval),
+		mounts:  make(map[string]int),
+	}
+	if err := c.authenticate(authType, params); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// do sends a request to the Vault API and decodes the response.
+// A missing path yields a nil secret and no error.
+func (c *Client) do(ctx context.Context, method, p string, body interface{}) (*secret, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.address+"/v1/"+strings.TrimPrefix(p, "/"), &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var s secret
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid response from vault (%s): %s", resp.Status, err)
+		}
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &responseError{
+			status: resp.StatusCode,
+			msg:    fmt.Sprintf("error from vault (%s) on %s: %s", resp.Status, p, strings.Join(s.Errors, ", ")),
+		}
+	}
+	return &s, nil
+}
+
+// responseError is the error of a request Vault answered with a failure.
+type responseError struct {
+	status int
+	msg    string
+}
+
+func (e *responseError) Error() string {
+	return e.msg
+}
+
+// Ping asks the health of the server, a sealed or uninitialized one
+// failing.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "GET", "sys/health?standbyok=true", nil)
+	return err
+}
+
+func (c *Client) read(ctx context.Context, p string) (*secret, error) {
+	return c.do(ctx, "GET", p, nil)
+}
+
+func (c *Client) list(ctx context.Context, p string) (*secret, error) {
+	return c.do(ctx, "LIST", p, nil)
+}
+
+func (c *Client) write(ctx context.Context, p string, data map[string]interface{}) (*secret, error) {
+	return c.do(ctx, "PUT", p, data)
+}
+
+// kvMount returns the mount the given key lives on and the version of
+// the KV secrets engine behind it. Version 1 is assumed when Vault tells
+// the mount cannot be looked up, e.g. because the token lacks the
+// permission, for the key and those below it, which are not looked up
+// again. Any other failure, e.g. a sealed Vault, is returned so that the
+// next read looks the mount up again.
+func (c *Client) kvMount(ctx context.Context, key string) (string, int, error) {
+	key = strings.Trim(key, "/")
+
+	c.mm.Lock()
+	defer c.mm.Unlock()
+	for mount, version := range c.mounts {
+		if key+"/" == mount || strings.HasPrefix(key, mount) {
+			return mount, version, nil
+		}
+	}
+
+	resp, err := c.read(ctx, "sys/internal/ui/mounts/"+key)
+	if err != nil {
+		if rerr, ok := err.(*responseError); !ok || rerr.status != http.StatusBadRequest && rerr.status != http.StatusForbidden {
+			return "", 0, err
+		}
+	}
+	var mount string
+	if resp != nil && resp.Data != nil {
+		mount, _ = resp.Data["path"].(string)
+	}
+	if mount == "" {
+		log.Debug("Cannot look up the Vault mount of %s, assuming KV version 1", key)
+		c.mounts[key+"/"] = 1
+		return "", 1, nil
+	}
+	version := 1
+	if options, ok := resp.Data["options"].(map[string]interface{}); ok {
+		if v, _ := options["version"].(string); v == "2" {
+			version = 2
+		}
+	}
+	log.Debug("Vault mount %s uses KV version %d", mount, version)
+	c.mounts[mount] = version
+	return mount, version, nil
+}
+
+// apiPath maps a confd key onto the API path to query. On a KV version 2
+// mount secrets are read below <mount>/data/ and listed below
+// <mount>/metadata/, op selects which of them is wanted.
+func (c *Client) apiPath(ctx context.Context, key, op string) (string, bool, error) {
+	mount, version, err := c.kvMount(ctx, key)
+	if err != nil || version != 2 {
+		return key, false, err
+	}
+	rest := strings.TrimPrefix(strings.Trim(key, "/"), strings.TrimSuffix(mount, "/"))
+	return path.Join(mount, op, rest), true, nil
+}
+
+// readSecret returns the fields of the secret stored at key.
+func (c *Client) readSecret(ctx context.Context, key string) (map[string]interface{}, error) {
+	p, v2, err := c.apiPath(ctx, key, "data")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.read(ctx, p)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if !v2 {
+		return resp.Data, nil
+	}
+	// Version 2 wraps the fields next to the secret's metadata, a deleted
+	// secret has no data at all.
+	data, _ := resp.Data["data"].(map[string]interface{})
+	return data, nil
+}
+
+// GetValues queries vault for keys prefixed by prefix.
+func (c *Client) GetValues(ctx context.Context, paths []string) (map[string]string, error) {
+	branches := make(map[string]bool)
+	for _, p := range paths {
+		if err := c.walkTree(ctx, p, branches); err != nil {
+			return nil, err
+		}
+	}
+	vars := make(map[string]string)
+	for key := range branches {
+		data, err := c.readSecret(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+
+		// if the key has only one string value
+		// treat it as a string and not a map of values
+		if val, ok := isKV(data); ok {
+			vars[key] = val
+		} else {
+			// every field becomes a sub-key to allow usage of gets & getvs
+			flatten(key, data, vars)
+		}
+	}
+	return vars, nil
+}
+
+// isKV checks if a given map has only one key of type string
+// if so, returns the value of that key
+func isKV(data map[string]interface{}) (string, bool) {
+	if len(data) == 1 {
+		if value, ok := data["value"]; ok {
+			if text, ok := value.(string); ok {
+				return text, true
+			}
+		}
+	}
+	return "", false
+}
+
+// recursively walks on all the values of a specific key and set them in the variables map
+func flatten(key string, value interface{}, vars map[string]string) {
+	switch value := value.(type) {
+	case string:
+		vars[key] = value
+	case bool, float64:
+		vars[key] = fmt.Sprint(value)
+	case map[string]interface{}:
+		for innerKey, innerValue := range value {
+			flatten(path.Join(key, innerKey), innerValue, vars)
+		}
+	default: // we don't know how to handle non string or maps of strings
+		log.Warning("type of '%s' is not supported (%T)", key, value)
+	}
+}
+
+// recursively walk the branches in the Vault, adding to branches map
+func (c *Client) walkTree(ctx context.Context, key string, branches map[string]bool) error {
+	// strip trailing slash as long as it's not the only character
+	if last := len(key) - 1; last > 0 && key[last] == '/' {
+		key = key[:last]
+	}
+	if branches[key] {
+		// already processed this branch
+		return nil
+	}
+	branches[key] = true
+
+	listPath, _, err := c.apiPath(ctx, key, "metadata")
+	if err != nil {
+		return err
+	}
+	resp, err := c.list(ctx, listPath)
+	if err != nil {
+		return err
+	}
+	if resp == nil || resp.Data == nil {
+		return nil
+	}
+
+	keyList, ok := resp.Data["keys"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, innerKey := range keyList {
+		if s, ok := innerKey.(string); ok {
+			if err := c.walkTree(ctx, path.Join(key, s), branches); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WatchPrefix polls the keys and returns a new index once the values changed.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	return c.poller.WatchPrefix(ctx, keys, waitIndex, c.GetValues)
+}
+
+// KeepAlive is a no-op, Vault tokens are not renewed by confd.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
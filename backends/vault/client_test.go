@@ -0,0 +1,338 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeVault emulates a Vault server. Secrets below kv2/ live on a KV
+// version 2 mount, everything else behaves like KV version 1.
+type fakeVault struct {
+	mu      sync.Mutex
+	token   string
+	secrets map[string]map[string]interface{}
+	logins  map[string]map[string]interface{}
+	// How many times a mount was looked up
+	mountLookups int
+	// How many more mount lookups fail as on a sealed Vault
+	mountFailures int
+}
+
+func newFakeVault(token string) *fakeVault {
+	return &fakeVault{
+		token:   token,
+		secrets: make(map[string]map[string]interface{}),
+		logins:  make(map[string]map[string]interface{}),
+	}
+}
+
+func (f *fakeVault) set(p string, data map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[p] = data
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	if strings.HasPrefix(p, "auth/") {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.logins[p] = body
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": f.token},
+		})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	if strings.HasPrefix(p, "sys/internal/ui/mounts/") {
+		f.mountLookups++
+		if f.mountFailures > 0 {
+			f.mountFailures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"Vault is sealed"}})
+			return
+		}
+		if !strings.HasPrefix(strings.TrimPrefix(p, "sys/internal/ui/mounts/"), "kv2") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"path":    "kv2/",
+				"type":    "kv",
+				"options": map[string]interface{}{"version": "2"},
+			},
+		})
+		return
+	}
+
+	v2 := false
+	if strings.HasPrefix(p, "kv2/") {
+		// Only the data/ and metadata/ endpoints exist on a v2 mount
+		switch {
+		case r.Method == "GET" && strings.HasPrefix(p, "kv2/data/"):
+			p = "kv2/" + strings.TrimPrefix(p, "kv2/data/")
+		case r.Method == "LIST" && strings.HasPrefix(p, "kv2/metadata"):
+			p = strings.TrimSuffix("kv2/"+strings.TrimPrefix(strings.TrimPrefix(p, "kv2/metadata"), "/"), "/")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		v2 = true
+	}
+
+	switch r.Method {
+	case "LIST":
+		keys := make(map[string]bool)
+		for k := range f.secrets {
+			if !strings.HasPrefix(k, p+"/") {
+				continue
+			}
+			rest := strings.TrimPrefix(k, p+"/")
+			if i := strings.Index(rest, "/"); i >= 0 {
+				rest = rest[:i+1]
+			}
+			keys[rest] = true
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var list []string
+		for k := range keys {
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"keys": list},
+		})
+	case "GET":
+		data, ok := f.secrets[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v2 {
+			data = map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]interface{}{"version": 1},
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeVault("root")
+	f.set("key", map[string]interface{}{"value": "foobar"})
+	f.set("database/host", map[string]interface{}{"value": "127.0.0.1"})
+	f.set("database/port", map[string]interface{}{"value": "3306"})
+	f.set("upstream", map[string]interface{}{"app1": "10.0.1.10:8080", "app2": "10.0.1.11:8080"})
+	f.set("nested/east/app1", map[string]interface{}{"value": "10.0.1.10:8080"})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewVaultClient(ts.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database", "/upstream", "/nested"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":              "foobar",
+		"/database/host":    "127.0.0.1",
+		"/database/port":    "3306",
+		"/upstream/app1":    "10.0.1.10:8080",
+		"/upstream/app2":    "10.0.1.11:8080",
+		"/nested/east/app1": "10.0.1.10:8080",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestGetValuesMountLookupFails(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeVault("root")
+	f.set("database/host", map[string]interface{}{"value": "127.0.0.1"})
+	f.set("database/port", map[string]interface{}{"value": "3306"})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewVaultClient(ts.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		vars, err := c.GetValues(context.Background(), []string{"/database"})
+		if err != nil || vars["/database/port"] != "3306" {
+			t.Fatalf("GetValues() = %v, %v, want the KV version 1 secrets", vars, err)
+		}
+	}
+	// Neither the secrets below the key nor the next reads look it up again
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mountLookups != 1 {
+		t.Errorf("mount looked up %d times, want once", f.mountLookups)
+	}
+}
+
+func TestGetValuesMountLookupUnavailable(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeVault("root")
+	f.set("kv2/app/key", map[string]interface{}{"value": "foobar"})
+	f.mountFailures = 1
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewVaultClient(ts.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars, err := c.GetValues(context.Background(), []string{"/kv2/app"}); err == nil {
+		t.Fatalf("GetValues() with a sealed Vault = %v, want an error", vars)
+	}
+	// The failure is not taken for a KV version 1 mount
+	vars, err := c.GetValues(context.Background(), []string{"/kv2/app"})
+	if err != nil || vars["/kv2/app/key"] != "foobar" {
+		t.Errorf("GetValues() once unsealed = %v, %v, want the KV version 2 secrets", vars, err)
+	}
+}
+
+func TestGetValuesKVv2(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeVault("root")
+	f.set("kv2/app/database", map[string]interface{}{"host": "127.0.0.1", "port": float64(3306)})
+	f.set("kv2/app/key", map[string]interface{}{"value": "foobar"})
+	f.set("kv1/app/key", map[string]interface{}{"value": "v1"})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewVaultClient(ts.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := c.GetValues(context.Background(), []string{"/kv2/app", "/kv1/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/kv2/app/database/host": "127.0.0.1",
+		"/kv2/app/database/port": "3306",
+		"/kv2/app/key":           "foobar",
+		"/kv1/app/key":           "v1",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		authType string
+		params   map[string]string
+		path     string
+		field    string
+		value    string
+	}{
+		{"app-role", map[string]string{"role-id": "role", "secret-id": "secret"}, "auth/approle/login", "role_id", "role"},
+		{"app-role", map[string]string{"role-id": "role", "secret-id": "secret", "path": "test"}, "auth/test/login", "secret_id", "secret"},
+		{"app-id", map[string]string{"app-id": "app", "user-id": "user"}, "auth/app-id/login", "user_id", "user"},
+		{"userpass", map[string]string{"username": "confd", "password": "pass"}, "auth/userpass/login/confd", "password", "pass"},
+	}
+	for _, tt := range tests {
+		f := newFakeVault("issued")
+		ts := httptest.NewServer(f)
+		c, err := NewVaultClient(ts.URL, tt.authType, tt.params)
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.authType, err)
+			continue
+		}
+		if c.token != "issued" {
+			t.Errorf("%s: token = %q, want %q", tt.authType, c.token, "issued")
+		}
+		if got := f.logins[tt.path][tt.field]; got != tt.value {
+			t.Errorf("%s: login %s %s = %v, want %s", tt.authType, tt.path, tt.field, got, tt.value)
+		}
+	}
+
+	if _, err := NewVaultClient("http://127.0.0.1:0", "app-role", map[string]string{"role-id": "role"}); err == nil {
+		t.Error("expected an error for a missing secret-id")
+	}
+	if _, err := NewVaultClient("http://127.0.0.1:0", "github", map[string]string{}); err == nil {
+		t.Error("expected an error for an unsupported auth type")
+	}
+}
+
+func TestWatchPrefixPolls(t *testing.T) {
+	log.SetLevel("warn")
+	pollInterval = 10 * time.Millisecond
+	f := newFakeVault("root")
+	f.set("app/key", map[string]interface{}{"value": "foo"})
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	c, err := NewVaultClient(ts.URL, "token", map[string]string{"token": "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys := []string{"/app"}
+
+	index, err := c.WatchPrefix(ctx, "/app", keys, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.set("app/key", map[string]interface{}{"value": "bar"})
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	index, err = c.WatchPrefix(ctx, "/app", keys, index)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() without change = %d, %v, want 2", index, err)
+	}
+}
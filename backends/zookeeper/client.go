@@ -0,0 +1,194 @@
+package zookeeper
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/log"
+)
+
+// zkLogger sends the messages of the ZooKeeper library to the debug log.
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, v ...interface{}) {
+	log.Debug(format, v...)
+}
+
+// conn is the part of *zk.Conn used by Client.
+type conn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+}
+
+// Client provides a wrapper around the zookeeper client
+type Client struct {
+	client conn
+}
+
+func init() {
+	backends.Register("zookeeper", func(config backends.Config) (backends.StoreClient, error) {
+		return NewZookeeperClient(config.BackendNodes)
+	})
+}
+
+// NewZookeeperClient returns an *zookeeper.Client with a connection to named machines.
+// The connection, and the session if it expires, is re-established by the
+// ZooKeeper library in the background.
+func NewZookeeperClient(machines []string) (*Client, error) {
+	c, _, err := zk.Connect(machines, 10*time.Second, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c}, nil
+}
+
+// znodePath maps a confd key onto a znode path. Like a key prefix given
+// to the etcd backends a trailing slash makes no difference, "/app/" and
+// "/app" both select the znode /app and everything below it.
+func znodePath(key string) string {
+	return path.Clean("/" + strings.Replace(key, "/*", "", -1))
+}
+
+// nodeWalk stores the data of prefix and every znode below it in vars.
+// Empty znodes are directories and do not hold a value.
+func (c *Client) nodeWalk(prefix string, vars map[string]string) error {
+	data, stat, err := c.client.Get(prefix)
+	if err == zk.ErrNoNode {
+		// Removed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		vars[prefix] = string(data)
+	}
+	if stat.NumChildren == 0 {
+		return nil
+	}
+
+	children, _, err := c.client.Children(prefix)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := c.nodeWalk(path.Join(prefix, child), vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetValues queries zookeeper for keys prefixed by prefix.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		// The ZooKeeper client cannot cancel requests, stop in between
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
+		if err := c.nodeWalk(znodePath(key), vars); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+// watch sets a data watch on key and, if it has children, a child watch.
+// A missing key is watched for its creation. The first event of any of
+// them is sent on events.
+func (c *Client) watch(key string, events chan<- zk.Event) error {
+	exists, stat, dataCh, err := c.client.ExistsW(key)
+	if err != nil {
+		return err
+	}
+	go forward(dataCh, events)
+	if !exists || stat.NumChildren == 0 {
+		return nil
+	}
+
+	_, _, childCh, err := c.client.ChildrenW(key)
+	if err == zk.ErrNoNode {
+		// Removed in the meantime, the data watch fires
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	go forward(childCh, events)
+	return nil
+}
+
+// forward passes the single event of a ZooKeeper watch on. ZooKeeper
+// watches cannot be removed, so the event is dropped when nobody waits.
+func forward(ch <-chan zk.Event, events chan<- zk.Event) {
+	e := <-ch
+	select {
+	case events <- e:
+	default:
+	}
+}
+
+// WatchPrefix sets watches on the keys and every znode below them and
+// returns a new index when one of them fires. Watches lost because the
+// session expired also return, the caller then re-reads the keys and
+// sets new watches.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	// return something > 0 to trigger a key retrieval from the store
+	if waitIndex == 0 {
+		return 1, nil
+	}
+
+	// Buffered so the first event is kept while the watches are set up
+	events := make(chan zk.Event, 1)
+	for _, key := range keys {
+		if err := c.watchTree(znodePath(key), events); err != nil {
+			return waitIndex, err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return waitIndex, nil
+	case e := <-events:
+		if e.Type == zk.EventNotWatching {
+			log.Warning("ZooKeeper watch on %s lost: %s", e.Path, e.Err)
+		} else {
+			log.Debug("ZooKeeper %s on %s", e.Type, e.Path)
+		}
+		return waitIndex + 1, nil
+	}
+}
+
+// watchTree watches key and the znodes below it.
+func (c *Client) watchTree(key string, events chan<- zk.Event) error {
+	if err := c.watch(key, events); err != nil {
+		return err
+	}
+	children, _, err := c.client.Children(key)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := c.watchTree(path.Join(key, child), events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeepAlive is a no-op, the ZooKeeper library keeps the session alive.
+func (c *Client) KeepAlive(doneChan chan bool) {
+}
@@ -0,0 +1,219 @@
+package zookeeper
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/zyf0330/confd/log"
+)
+
+// fakeConn is an in-memory znode tree with one-shot watches.
+type fakeConn struct {
+	mu       sync.Mutex
+	nodes    map[string]string
+	watchers map[string][]chan zk.Event
+}
+
+func newFakeConn(nodes map[string]string) *fakeConn {
+	f := &fakeConn{
+		nodes:    map[string]string{"/": ""},
+		watchers: make(map[string][]chan zk.Event),
+	}
+	for p, data := range nodes {
+		f.set(p, data)
+	}
+	return f
+}
+
+// set creates or updates a znode and its parents and fires the watches.
+func (f *fakeConn) set(p, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := f.nodes[dir]; !ok {
+			f.nodes[dir] = ""
+			f.fire(path.Dir(dir), zk.EventNodeChildrenChanged)
+		}
+	}
+	f.nodes[p] = data
+	f.fire(p, zk.EventNodeDataChanged)
+	f.fire(path.Dir(p), zk.EventNodeChildrenChanged)
+}
+
+func (f *fakeConn) fire(p string, t zk.EventType) {
+	for _, ch := range f.watchers[p] {
+		ch <- zk.Event{Type: t, Path: p}
+	}
+	delete(f.watchers, p)
+}
+
+func (f *fakeConn) children(p string) []string {
+	var children []string
+	for n := range f.nodes {
+		if n != "/" && path.Dir(n) == p {
+			children = append(children, path.Base(n))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (f *fakeConn) watch(p string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	f.watchers[p] = append(f.watchers[p], ch)
+	return ch
+}
+
+func (f *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(data), &zk.Stat{NumChildren: int32(len(f.children(p)))}, nil
+}
+
+func (f *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	children := f.children(p)
+	return children, &zk.Stat{NumChildren: int32(len(children))}, nil
+}
+
+func (f *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.nodes[p]
+	return ok, &zk.Stat{NumChildren: int32(len(f.children(p)))}, f.watch(p), nil
+}
+
+func (f *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.nodes[p]; !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	children := f.children(p)
+	return children, &zk.Stat{NumChildren: int32(len(children))}, f.watch(p), nil
+}
+
+func TestGetValues(t *testing.T) {
+	log.SetLevel("warn")
+	c := &Client{newFakeConn(map[string]string{
+		"/key":                "foobar",
+		"/database/host":      "127.0.0.1",
+		"/database/port":      "3306",
+		"/upstream/app1":      "10.0.1.10:8080",
+		"/upstream/app2":      "10.0.1.11:8080",
+		"/upstream/empty/dir": "",
+	})}
+
+	vars, err := c.GetValues(context.Background(), []string{"/key", "/database/", "/upstream/*", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/key":           "foobar",
+		"/database/host": "127.0.0.1",
+		"/database/port": "3306",
+		"/upstream/app1": "10.0.1.10:8080",
+		"/upstream/app2": "10.0.1.11:8080",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("GetValues() = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("GetValues()[%s] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestZnodePath(t *testing.T) {
+	for key, want := range map[string]string{
+		"":            "/",
+		"/":           "/",
+		"/app":        "/app",
+		"/app/":       "/app",
+		"app//db/":    "/app/db",
+		"/upstream/*": "/upstream",
+	} {
+		if got := znodePath(key); got != want {
+			t.Errorf("znodePath(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	log.SetLevel("warn")
+	f := newFakeConn(map[string]string{"/app/db/host": "127.0.0.1"})
+	c := &Client{f}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index, err := c.WatchPrefix(ctx, "/app", []string{"/app"}, 0)
+	if err != nil || index != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", index, err)
+	}
+
+	for _, change := range []struct{ key, value string }{
+		{"/app/db/host", "10.0.0.1"},
+		{"/app/db/port", "3306"},
+		{"/app/cache/host", "127.0.0.1"},
+	} {
+		go func(key, value string) {
+			time.Sleep(20 * time.Millisecond)
+			f.set(key, value)
+		}(change.key, change.value)
+		next, err := c.WatchPrefix(ctx, "/app", []string{"/app/"}, index)
+		if err != nil || next != index+1 {
+			t.Fatalf("WatchPrefix() after setting %s = %d, %v, want %d", change.key, next, err, index+1)
+		}
+		index = next
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.set("/other/key", "value")
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	next, err := c.WatchPrefix(ctx, "/app", []string{"/app"}, index)
+	if err != nil || next != index {
+		t.Fatalf("WatchPrefix() after an unrelated change = %d, %v, want %d", next, err, index)
+	}
+}
+
+func TestWatchPrefixSessionExpired(t *testing.T) {
+	log.SetLevel("error")
+	f := newFakeConn(map[string]string{"/app/key": "value"})
+	c := &Client{f}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for p, chans := range f.watchers {
+			if strings.HasPrefix(p, "/app") {
+				for _, ch := range chans {
+					ch <- zk.Event{Type: zk.EventNotWatching, Path: p, Err: zk.ErrSessionExpired}
+				}
+				delete(f.watchers, p)
+			}
+		}
+	}()
+	index, err := c.WatchPrefix(context.Background(), "/app", []string{"/app"}, 1)
+	if err != nil || index != 2 {
+		t.Fatalf("WatchPrefix() after a lost session = %d, %v, want 2", index, err)
+	}
+}
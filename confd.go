@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path"
 	"runtime"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/zyf0330/confd/backends"
 	"github.com/zyf0330/confd/log"
 	"github.com/zyf0330/confd/resource/template"
+	"github.com/zyf0330/confd/util"
 )
 
 func main() {
 	flag.Parse()
+	// The configuration before the config file and the environment are
+	// read, to read them again on SIGHUP
+	flags := config
 	if config.PrintVersion {
 		fmt.Printf("confd %s (Git SHA: %s, Go Version: %s)\n", Version, GitSHA, runtime.Version())
 		os.Exit(0)
@@ -30,23 +39,42 @@ func main() {
 	if err := initConfig(); err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := setLogging(config); err != nil {
+		log.Fatal(err.Error())
+	}
 
 	log.Info("Starting confd")
+	if config.SRVRecord != "" {
+		log.Info("SRV record set to " + config.SRVRecord)
+	}
+	log.Info("Backend set to " + config.Backend)
+	if config.InsecureSkipVerify {
+		log.Warning("The certificate of the backend is not verified (insecure_skip_verify): anyone between confd and the backend can read and change the keys")
+	}
 
-	storeClient, err := backends.New(config.BackendsConfig)
+	storeClient, err := connect(time.Duration(config.WaitForBackend) * time.Second)
 	if err != nil {
-		log.Fatal("Backend create fail: %s", err.Error())
+		if config.OneTime {
+			log.Error(err.Error())
+			os.Exit(exitCode(err))
+		}
+		log.Fatal(err.Error())
 	}
 
 	config.TemplateConfig.StoreClient = storeClient
+	if !config.OneTime {
+		serve()
+	}
 	if config.OneTime {
 		if err := template.Process(config.TemplateConfig); err != nil {
-			log.Fatal(err.Error())
+			log.Error(err.Error())
+			os.Exit(exitCode(err))
 		}
 		os.Exit(0)
 	}
 
-	stopChan := make(chan bool)
+	// Cancelled on SIGINT and SIGTERM, stopping the processor
+	ctx, cancel := context.WithCancel(context.Background())
 	doneChan := make(chan bool)
 	errChan := make(chan error, 10)
 
@@ -55,21 +83,35 @@ func main() {
 	var processor template.Processor
 	switch {
 	case config.Watch:
-		processor = template.WatchProcessor(config.TemplateConfig, stopChan, doneChan, errChan)
+		processor = template.WatchProcessor(ctx, config.TemplateConfig, doneChan, errChan)
 	default:
-		processor = template.IntervalProcessor(config.TemplateConfig, stopChan, doneChan, errChan, config.Interval)
+		processor = template.IntervalProcessor(ctx, config.TemplateConfig, doneChan, errChan, config.Interval)
 	}
 
 	go processor.Process()
+	if config.SRVRecord != "" && config.SRVRefresh > 0 {
+		go refreshNodes(ctx, storeClient, time.Duration(config.SRVRefresh)*time.Second, util.LookupSRV)
+	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
 		case err := <-errChan:
 			log.Error(err.Error())
 		case s := <-signalChan:
+			if s == syscall.SIGHUP {
+				reload(flags, processor)
+				continue
+			}
 			log.Info(fmt.Sprintf("Captured %v. Exiting...", s))
+			cancel()
+			// Let a run in progress finish
+			select {
+			case <-doneChan:
+			case <-time.After(shutdownTimeout):
+				log.Warning(fmt.Sprintf("The processor did not stop within %s", shutdownTimeout))
+			}
 			os.Exit(0)
 		case normal := <-doneChan:
 			log.Info(fmt.Sprintf("Exiting caused by doneChan, normal: %v", normal))
@@ -81,3 +123,210 @@ func main() {
 		}
 	}
 }
+
+var (
+	// How long a check of the backend may take
+	pingTimeout = 5 * time.Second
+	// How long to wait before the first retry of a failed check
+	connectRetryInterval = time.Second
+	// How long the processor may take to stop on SIGINT and SIGTERM
+	shutdownTimeout = 10 * time.Second
+)
+
+// readinessKey is read below the prefix by connect to tell whether the
+// backend serves keys, once it answers pings.
+const readinessKey = "confd-ready"
+
+// connect creates the backend client and checks that it reaches its
+// backend. Until wait elapsed, the failures are retried, waiting according
+// to util.Backoff in between, e.g. while the backend starts next to confd,
+// and the backend must also answer a read of readinessKey. The last
+// failure is returned as a *template.BackendError.
+func connect(wait time.Duration) (backends.StoreClient, error) {
+	deadline := time.Now().Add(wait)
+	key := path.Join("/", config.Prefix, readinessKey)
+	var storeClient backends.StoreClient
+	for retry := 0; ; retry++ {
+		var err error
+		if storeClient == nil {
+			storeClient, err = backends.New(config.BackendsConfig)
+			if err != nil {
+				storeClient = nil
+				err = fmt.Errorf("Backend create fail: %s", err)
+			}
+		}
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+			if wait > 0 {
+				err = backends.Ready(ctx, storeClient, key)
+			} else {
+				err = backends.Ping(ctx, storeClient)
+			}
+			cancel()
+			if err == nil {
+				return storeClient, nil
+			}
+			err = fmt.Errorf("cannot reach backend at %s: %s", backendNodes(), err)
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			if wait > 0 {
+				err = fmt.Errorf("backend not ready after waiting %s: %s", wait, err)
+			}
+			return nil, &template.BackendError{Err: err}
+		}
+		delay := util.Backoff(connectRetryInterval, retry)
+		if delay > left {
+			delay = left
+		}
+		log.Warning(fmt.Sprintf("%s, retrying in %s", err, delay))
+		time.Sleep(delay)
+	}
+}
+
+// refreshNodes resolves config.SRVRecord with lookup every interval until
+// ctx is done, and hands the nodes to client when they changed. A failed
+// or empty resolution keeps the nodes. It stops once client cannot change
+// its nodes.
+func refreshNodes(ctx context.Context, client backends.StoreClient, interval time.Duration, lookup func(string) ([]string, error)) {
+	setter, ok := client.(backends.NodeSetter)
+	if !ok {
+		log.Warning("The %s backend cannot change its nodes, the SRV record is not resolved again", config.Backend)
+		return
+	}
+	nodes := sortedNodes(config.BackendNodes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		srvNodes, err := lookup(config.SRVRecord)
+		if err == nil && len(srvNodes) == 0 {
+			err = fmt.Errorf("no nodes")
+		}
+		if err == nil {
+			srvNodes, err = normalizeNodes(config.Backend, srvNodes)
+		}
+		if err != nil {
+			log.Error("Cannot resolve %s again, keeping the nodes: %s", config.SRVRecord, err)
+			continue
+		}
+		if sorted := sortedNodes(srvNodes); sorted != nodes {
+			if err := setter.SetNodes(srvNodes); err != nil {
+				log.Warning("Cannot change the nodes of the %s backend, the SRV record is not resolved again: %s", config.Backend, err)
+				return
+			}
+			log.Info("Backend nodes set to %s from %s", strings.Join(srvNodes, ", "), config.SRVRecord)
+			nodes = sorted
+		}
+	}
+}
+
+// sortedNodes returns nodes sorted and joined, to compare node sets.
+func sortedNodes(nodes []string) string {
+	sorted := append([]string(nil), nodes...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// backendNodes returns the nodes of the backend, or its name if it has
+// none, for the error messages.
+func backendNodes() string {
+	if len(config.BackendNodes) == 0 {
+		return config.Backend
+	}
+	return strings.Join(config.BackendNodes, ", ")
+}
+
+// Exit codes of the onetime mode
+const (
+	exitFailure      = 1
+	exitCheckFailure = 2
+	exitBackendError = 3
+)
+
+// exitCode returns the exit code of the onetime mode failing with err.
+func exitCode(err error) int {
+	switch err.(type) {
+	case *template.BackendError:
+		return exitBackendError
+	case *template.CheckError:
+		return exitCheckFailure
+	default:
+		return exitFailure
+	}
+}
+
+// reload reads the config file and the environment again, on top of the
+// flags, and applies the log settings and the interval to the running
+// confd. The other settings only apply once confd is restarted.
+func reload(flags Config, processor template.Processor) {
+	log.Info("Captured SIGHUP. Reloading " + flags.ConfigFile)
+	running := config
+	config = flags
+	err := initConfig()
+	reloaded := config
+	config = running
+	if err != nil {
+		log.Error("Cannot reload %s: %s", flags.ConfigFile, err)
+		return
+	}
+
+	if err := setLogging(reloaded); err != nil {
+		log.Error("Cannot reload the log settings: %s", err)
+	}
+	config.LogLevel = reloaded.LogLevel
+	config.LogFormat = reloaded.LogFormat
+	config.LogFile = reloaded.LogFile
+	config.LogMaxSize = reloaded.LogMaxSize
+	config.LogMaxFiles = reloaded.LogMaxFiles
+	if p, ok := processor.(template.IntervalSetter); ok && config.Interval != reloaded.Interval {
+		if err := p.SetInterval(reloaded.Interval); err != nil {
+			log.Error("Cannot reload the interval: %s", err)
+			return
+		}
+		config.Interval = reloaded.Interval
+		log.Info(fmt.Sprintf("Interval set to %ds", config.Interval))
+	}
+}
+
+// serve starts the health and metrics servers asked for, on one server if
+// they share their address. Both serve the same Prometheus metrics.
+func serve() {
+	for addr, m := range serveMuxes() {
+		addr, m := addr, m
+		log.Info("start HTTP server at " + addr)
+		go func() {
+			log.Error(fmt.Sprintf("%s", http.ListenAndServe(addr, m)))
+		}()
+	}
+}
+
+// serveMuxes returns the handlers of the health and metrics servers by
+// address, none if neither is asked for, and makes the processor record
+// its health.
+func serveMuxes() map[string]*http.ServeMux {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if config.Listen == "" && config.MetricsListen == "" {
+		return muxes
+	}
+	health := template.NewHealth()
+	config.TemplateConfig.Health = health
+	if config.Listen != "" {
+		mux(config.Listen).HandleFunc("/healthz", health.ServeHealthz)
+		mux(config.Listen).Handle("/metrics", template.MetricsHandler())
+	}
+	if config.MetricsListen != "" && config.MetricsListen != config.Listen {
+		mux(config.MetricsListen).Handle("/metrics", template.MetricsHandler())
+	}
+	return muxes
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/mock"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/resource/template"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("template: myapp.tmpl: map has no entry for key"), 1},
+		{&template.CheckError{Err: errors.New("exit status 1")}, 2},
+		{&template.BackendError{Err: errors.New("connection refused")}, 3},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(c Config, d time.Duration) { config, connectRetryInterval = c, d }(config, connectRetryInterval)
+	connectRetryInterval = 10 * time.Millisecond
+
+	// An etcd answering from the third request on, holding no keys
+	var requests, reads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/keys/myapp/confd-ready" {
+			atomic.AddInt32(&reads, 1)
+			http.Error(w, `{"errorCode":100,"message":"Key not found"}`, http.StatusNotFound)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"etcdserver":"2.3.8","etcdcluster":"2.3.0"}`))
+	}))
+	defer server.Close()
+	config.Backend = "etcd"
+	config.BackendNodes = []string{server.URL}
+	config.Prefix = "/myapp"
+
+	_, err := connect(0)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach backend at "+server.URL) {
+		t.Fatalf("connect(0) to a starting backend = %v, want it cannot reach it", err)
+	}
+	if code := exitCode(err); code != exitBackendError {
+		t.Errorf("exit code of connect(0) to a starting backend = %d, want %d", code, exitBackendError)
+	}
+	if _, err := connect(5 * time.Second); err != nil {
+		t.Fatalf("connect(5s) = %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("backend pinged %d times, want 3", n)
+	}
+	if n := atomic.LoadInt32(&reads); n != 1 {
+		t.Errorf("readiness key read %d times, want 1", n)
+	}
+
+	server.Close()
+	start := time.Now()
+	_, err = connect(200 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "backend not ready after waiting 200ms") {
+		t.Fatalf("connect(200ms) to a stopped backend = %v, want it is not ready", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connect(200ms) gave up after %s", elapsed)
+	}
+}
+
+// nodesClient records the nodes it is given.
+type nodesClient struct {
+	backends.StoreClient
+	nodes chan []string
+}
+
+func (c nodesClient) SetNodes(nodes []string) error {
+	c.nodes <- nodes
+	return nil
+}
+
+func TestRefreshNodes(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(c Config) { config = c }(config)
+	config.SRVRecord = "_etcd-client._tcp.example.com"
+	config.BackendNodes = []string{"etcd1:2379", "etcd2:2379"}
+
+	// A resolver listing the nodes in another order, failing, then
+	// listing a new node
+	answers := []struct {
+		nodes []string
+		err   error
+	}{
+		{[]string{"etcd2:2379", "etcd1:2379"}, nil},
+		{nil, errors.New("no such host")},
+		{nil, nil},
+		{[]string{"etcd1:2379", "etcd3:2379"}, nil},
+	}
+	var lookups int32
+	lookup := func(record string) ([]string, error) {
+		i := int(atomic.AddInt32(&lookups, 1)) - 1
+		if i >= len(answers) {
+			i = len(answers) - 1
+		}
+		return answers[i].nodes, answers[i].err
+	}
+	client := nodesClient{nodes: make(chan []string, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		refreshNodes(ctx, client, 10*time.Millisecond, lookup)
+		close(done)
+	}()
+
+	select {
+	case nodes := <-client.nodes:
+		if want := []string{"etcd1:2379", "etcd3:2379"}; !reflect.DeepEqual(nodes, want) {
+			t.Errorf("nodes set to %q, want %q", nodes, want)
+		}
+		if n := atomic.LoadInt32(&lookups); n != 4 {
+			t.Errorf("nodes set after %d lookups, want 4", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the nodes were not set")
+	}
+	// The same nodes are not set again
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case nodes := <-client.nodes:
+		t.Errorf("nodes set again to %q", nodes)
+	default:
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshNodes() did not stop once cancelled")
+	}
+}
+
+// fixedNodesClient cannot change its nodes, as a wrapper of such a client.
+type fixedNodesClient struct {
+	backends.StoreClient
+}
+
+func (c fixedNodesClient) SetNodes(nodes []string) error {
+	return errors.New("the backend cannot change its nodes")
+}
+
+func TestRefreshNodesUnsupported(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(c Config) { config = c }(config)
+	config.SRVRecord = "_etcd-client._tcp.example.com"
+	config.BackendNodes = []string{"etcd1:2379"}
+	lookup := func(record string) ([]string, error) {
+		return []string{"etcd2:2379"}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		refreshNodes(context.Background(), fixedNodesClient{}, 10*time.Millisecond, lookup)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshNodes() did not stop once the nodes could not be changed")
+	}
+}
+
+// intervalProcessor records the intervals it is given.
+type intervalProcessor struct {
+	intervals []int
+}
+
+func (p *intervalProcessor) Process() {}
+
+func (p *intervalProcessor) SetInterval(interval int) error {
+	p.intervals = append(p.intervals, interval)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(c Config) { config = c }(config)
+	defer log.SetFormat("text")
+	file := filepath.Join(t.TempDir(), "confd.toml")
+	flags := config
+	flags.ConfigFile = file
+	config.LogLevel = "fatal"
+	config.LogFormat = "text"
+	config.Interval = 600
+	p := &intervalProcessor{}
+
+	// Invalid log settings leave the running settings as they are,
+	// instead of exiting
+	for _, bad := range []string{
+		"log-level = \"bogus\"\ninterval = 30\n",
+		"log-format = \"xml\"\ninterval = 30\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reload(flags, p)
+		if config.LogLevel != "fatal" || config.LogFormat != "text" || config.Interval != 600 || len(p.intervals) != 0 {
+			t.Errorf("reload() of %q: log level %q, format %q, interval %d, intervals set %v, want them unchanged",
+				bad, config.LogLevel, config.LogFormat, config.Interval, p.intervals)
+		}
+		if logrus.GetLevel() != logrus.FatalLevel {
+			t.Errorf("reload() of %q set the log level to %s", bad, logrus.GetLevel())
+		}
+		if _, ok := logrus.StandardLogger().Formatter.(*log.ConfdFormatter); !ok {
+			t.Errorf("reload() of %q changed the log format", bad)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("log-level = \"error\"\nlog-format = \"json\"\ninterval = 30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reload(flags, p)
+	level := logrus.GetLevel()
+	_, json := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter)
+	log.SetLevel("fatal")
+	if config.LogLevel != "error" || config.LogFormat != "json" || config.Interval != 30 || !reflect.DeepEqual(p.intervals, []int{30}) {
+		t.Errorf("reload(): log level %q, format %q, interval %d, intervals set %v, want error, json, 30 and [30]",
+			config.LogLevel, config.LogFormat, config.Interval, p.intervals)
+	}
+	if level != logrus.ErrorLevel || !json {
+		t.Errorf("reload() applied the log level %s, the json format: %v, want error and json", level, json)
+	}
+}
+
+func TestServe(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(c Config) { config = c }(config)
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	files := map[string]string{
+		"myapp.tmpl": `{{getv "/myapp/url"}}`,
+		"conf.d/myapp.toml": `[template]
+src = "myapp.tmpl"
+dest = "` + filepath.Join(dir, "myapp.conf") + `"
+keys = ["/myapp"]
+`,
+	}
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := mock.New()
+	config.TemplateConfig = template.Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store}
+	config.Listen, config.MetricsListen = "127.0.0.1:8080", "127.0.0.1:9090"
+
+	muxes := serveMuxes()
+	if len(muxes) != 2 {
+		t.Fatalf("serveMuxes() = %v, want the servers of -listen and -metrics-listen", muxes)
+	}
+	server := httptest.NewServer(muxes[config.Listen])
+	defer server.Close()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if status, _ := get("/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before the first cycle = %d, want 503", status)
+	}
+	store.SetValue("/myapp/url", "db.example.com")
+	if err := template.Process(config.TemplateConfig); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get("/healthz"); status != http.StatusOK {
+		t.Errorf("/healthz after a successful cycle = %d %q, want 200", status, body)
+	}
+	store.DeleteValue("/myapp/url")
+	if err := template.Process(config.TemplateConfig); err == nil {
+		t.Fatal("Process() without the key succeeded")
+	}
+	if status, body := get("/healthz"); status != http.StatusServiceUnavailable || !strings.Contains(body, "myapp.toml") {
+		t.Errorf("/healthz after a failed cycle = %d %q, want 503 naming myapp.toml", status, body)
+	}
+
+	// -listen serves the metrics too, those -metrics-listen serves
+	if status, body := get("/metrics"); status != http.StatusOK || !strings.Contains(body, "confd_template_failures_total") {
+		t.Errorf("/metrics on -listen = %d, want 200 with the confd metrics", status)
+	}
+	metrics := httptest.NewServer(muxes[config.MetricsListen])
+	defer metrics.Close()
+	resp, err := http.Get(metrics.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/healthz on -metrics-listen = %d, want 404", resp.StatusCode)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	"github.com/zyf0330/confd/backends"
 	"github.com/zyf0330/confd/log"
 	"github.com/zyf0330/confd/resource/template"
+	"github.com/zyf0330/confd/util"
 )
 
 type TemplateConfig = template.Config
@@ -24,51 +26,118 @@ type BackendsConfig = backends.Config
 type Config struct {
 	TemplateConfig
 	BackendsConfig
-	Interval      int    `toml:"interval"`
-	SecretKeyring string `toml:"secret_keyring"`
-	SRVDomain     string `toml:"srv_domain"`
-	SRVRecord     string `toml:"srv_record"`
-	LogLevel      string `toml:"log-level"`
-	Watch         bool   `toml:"watch"`
-	PrintVersion  bool
-	ConfigFile    string
-	OneTime       bool
-	PProf         bool
+	Interval       int    `toml:"interval"`
+	SecretKeyring  string `toml:"secret_keyring"`
+	SRVDomain      string `toml:"srv_domain"`
+	SRVRecord      string `toml:"srv_record"`
+	SRVRefresh     int    `toml:"srv_refresh"`
+	NodesFile      string `toml:"nodes_file"`
+	LogLevel       string `toml:"log-level"`
+	LogFormat      string `toml:"log-format"`
+	LogFile        string `toml:"log-file"`
+	LogMaxSize     int    `toml:"log-max-size"`
+	LogMaxFiles    int    `toml:"log-max-files"`
+	Listen         string `toml:"listen"`
+	MetricsListen  string `toml:"metrics_listen"`
+	Watch          bool   `toml:"watch"`
+	WaitForBackend int    `toml:"wait_for_backend"`
+	PrintVersion   bool
+	ConfigFile     string
+	OneTime        bool
+	PProf          bool
 }
 
 var config Config
 
 func init() {
 	flag.StringVar(&config.AuthToken, "auth-token", "", "Auth bearer token to use")
-	flag.StringVar(&config.Backend, "backend", "etcdv3", "backend to use")
-	flag.BoolVar(&config.BasicAuth, "basic-auth", false, "Use Basic Auth to authenticate (only used with -backend=consul and -backend=etcd)")
+	flag.StringVar(&config.AuthTokenFile, "auth-token-file", "", "file holding the auth token, instead of -auth-token")
+	flag.StringVar(&config.Backend, "backend", "etcdv3", "backend to use, several separated by commas are merged with the later ones winning, only one of them reading -node, stack for the [[backends]] blocks of the config file")
+	flag.IntVar(&config.BackendTimeout, "backend-timeout", 30, "seconds a template resource may wait for the backend each cycle, 0 for no limit")
+	flag.BoolVar(&config.BasicAuth, "basic-auth", false, "Use Basic Auth to authenticate (only used with -backend=consul, -backend=etcd and -backend=http)")
+	flag.StringVar(&config.CacheDir, "cache-dir", "", "the directory to fetch the repository into, in the user's cache directory if empty (only used with -backend=git)")
+	flag.IntVar(&config.CheckCmdTimeout, "check-cmd-timeout", 0, "seconds the check command of a template resource may run before it is killed and the check fails, 0 for no limit")
 	flag.StringVar(&config.ClientCaKeys, "client-ca-keys", "", "client ca keys")
 	flag.StringVar(&config.ClientCert, "client-cert", "", "the client cert")
 	flag.StringVar(&config.ClientKey, "client-key", "", "the client key")
+	flag.StringVar(&config.ConnString, "connection-string", "", "the connection string of the App Configuration store, instead of the node and Azure AD credentials (only used with -backend=azureappconfig)")
+	flag.StringVar(&config.Credentials, "credentials-file", "", "the service account key file, instead of the Application Default Credentials (only used with -backend=gcs, -backend=gsm and -backend=firestore), or the NATS credentials or nkey seed file (only used with -backend=nats)")
+	flag.StringVar(&config.EndpointOrdering, "endpoint-ordering", "round-robin", "ordered to send the requests to the first of the nodes which answers, checking them every 10s to go back to a preferred one, round-robin to send them to all the nodes in turn (only used with -backend=etcdv3)")
+	flag.StringVar(&config.Endpoint, "endpoint", "", "the endpoint of the storage service, e.g. of MinIO (only used with -backend=s3 and -backend=gcs)")
 	flag.StringVar(&config.ConfDir, "confdir", "/etc/confd", "confd conf directory")
 	flag.StringVar(&config.ConfigFile, "config-file", "/etc/confd/confd.toml", "the confd config file")
-	flag.Var(&config.YAMLFile, "file", "the YAML file to watch for changes (only used with -backend=file)")
+	flag.Var(&config.YAMLFile, "file", "the YAML or JSON file, or directory of them, to watch for changes (only used with -backend=file)")
+	flag.StringVar(&config.GitDir, "git-dir", "", "the directory of the repository holding the files to read, the root if empty (only used with -backend=git)")
+	flag.StringVar(&config.GitRef, "git-ref", "", "the branch or tag to read, the default branch if empty (only used with -backend=git)")
+	flag.StringVar(&config.IdentityFile, "identity-file", "", "the SSH private key to authenticate with, -password being its passphrase (only used with -backend=git)")
 	flag.IntVar(&config.Interval, "interval", 600, "backend polling interval")
+	flag.BoolVar(&config.DecodeGzip, "decode-gzip", false, "decompress the values of the backend starting with the gzip magic bytes, leaving the others as they are")
 	flag.BoolVar(&config.KeepStageFile, "keep-stage-file", false, "keep staged files")
 	flag.StringVar(&config.LogLevel, "log-level", "", "level which confd should log messages")
+	flag.IntVar(&config.LogMaxFiles, "log-max-files", 5, "number of rotated log files to keep (only used with -log-file)")
+	flag.IntVar(&config.LogMaxSize, "log-max-size", 100, "megabytes the log file may grow to before it is rotated, 0 to never rotate it (only used with -log-file)")
+	flag.BoolVar(&config.InsecureSkipVerify, "insecure-skip-verify", false, "accept any TLS certificate of the backend, for tests only (only used with -backend=etcdv3)")
+	flag.StringVar(&config.Kubeconfig, "kubeconfig", "", "the kubeconfig file to use instead of the in-cluster configuration (only used with -backend=k8s-configmap and -backend=k8s-secret)")
+	flag.StringVar(&config.Label, "label", "", "the label of the key-values to read, those without a label if empty (only used with -backend=azureappconfig)")
+	flag.StringVar(&config.Listen, "listen", "", "address to serve /healthz and the Prometheus metrics at /metrics on, e.g. :8080")
+	flag.StringVar(&config.LogFile, "log-file", "", "file to write the log messages to instead of stderr")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "format of the log messages (text or json)")
+	flag.BoolVar(&config.PathStyle, "path-style", false, "address buckets in the path instead of the host name, e.g. for MinIO (only used with -backend=s3)")
 	flag.BoolVar(&config.PProf, "pprof", false, "enable pprof debug")
 	flag.Var(&config.BackendNodes, "node", "list of backend nodes")
+	flag.StringVar(&config.NodesFile, "nodes-file", "", "file listing the backend nodes, one per line, unless -node is given")
+	flag.StringVar(&config.MetricsListen, "metrics-listen", "", "address to serve the Prometheus metrics on at /metrics, e.g. :9100")
+	flag.Int64Var(&config.MaxObjectSize, "max-object-size", 1048576, "the largest object in bytes to read, larger ones are skipped (only used with -backend=s3 and -backend=gcs)")
+	flag.StringVar(&config.Namespace, "namespace", "", "the namespace of the variables, the default one if empty (only used with -backend=nomad)")
 	flag.BoolVar(&config.Noop, "noop", false, "only show pending changes")
+	flag.StringVar(&config.NotifyChannel, "notify-channel", "confd_updates", "the channel to LISTEN on for the changes of the table (only used with -backend=postgres)")
+	flag.BoolVar(&config.Diff, "diff", false, "like -noop, and print a unified diff of the pending changes to stdout")
 	flag.BoolVar(&config.OneTime, "onetime", false, "run once and exit")
 	flag.StringVar(&config.Prefix, "prefix", "", "key path prefix")
 	flag.BoolVar(&config.PrintVersion, "version", false, "print version and exit")
 	flag.StringVar(&config.Scheme, "scheme", "http", "the backend URI scheme for nodes retrieved from DNS SRV records (http or https)")
+	flag.StringVar(&config.SecretVersion, "secret-version", "latest", "the version number or alias of the secrets to read, latest for the latest enabled one (only used with -backend=gsm)")
 	flag.StringVar(&config.SecretKeyring, "secret-keyring", "", "path to armored PGP secret keyring (for use with crypt functions)")
 	flag.StringVar(&config.SRVDomain, "srv-domain", "", "the name of the resource record")
 	flag.StringVar(&config.SRVRecord, "srv-record", "", "the SRV record to search for backends nodes. Example: _etcd-client._tcp.example.com")
+	flag.IntVar(&config.SRVRefresh, "srv-refresh", 0, "seconds between two resolutions of the SRV record, the backend following the nodes it lists, 0 to resolve it once (only used with -backend=etcdv3)")
+	flag.StringVar(&config.Subscription, "subscription", "", "the Pub/Sub subscription to the bucket's notifications, projects/<project>/subscriptions/<name>, instead of polling (only used with -backend=gcs)")
 	flag.BoolVar(&config.SyncOnly, "sync-only", false, "sync without check_cmd and reload_cmd")
+	flag.StringVar(&config.TLSCipherSuites, "tls-cipher-suites", "", "the comma-separated cipher suites to offer the backend up to TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, those of Go if empty (only used with -backend=etcdv3)")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "the oldest TLS version to speak to the backend, 1.0, 1.1, 1.2 or 1.3 (only used with -backend=etcdv3)")
+	flag.StringVar(&config.TLSServerName, "tls-server-name", "", "the name the TLS certificate of the backend must hold, instead of the host of the node, e.g. behind a load balancer (only used with -backend=etcdv3)")
 	flag.StringVar(&config.AuthType, "auth-type", "", "Vault auth backend type to use (only used with -backend=vault)")
 	flag.StringVar(&config.AppID, "app-id", "", "Vault app-id to use with the app-id backend (only used with -backend=vault and auth-type=app-id)")
 	flag.StringVar(&config.UserID, "user-id", "", "Vault user-id to use with the app-id backend (only used with -backend=value and auth-type=app-id)")
-	flag.StringVar(&config.Table, "table", "", "the name of the DynamoDB table (only used with -backend=dynamodb)")
-	flag.StringVar(&config.Username, "username", "", "the username to authenticate as (only used with vault and etcd backends)")
-	flag.StringVar(&config.Password, "password", "", "the password to authenticate with (only used with vault and etcd backends)")
+	flag.StringVar(&config.RoleID, "role-id", "", "Vault role-id to use with the AppRole backend (only used with -backend=vault and auth-type=app-role)")
+	flag.StringVar(&config.SecretID, "secret-id", "", "Vault secret-id to use with the AppRole backend (only used with -backend=vault and auth-type=app-role)")
+	flag.StringVar(&config.Path, "path", "", "Vault mount path of the auth method (only used with -backend=vault)")
+	flag.StringVar(&config.Table, "table", "", "the name of the table, collection or bucket (only used with -backend=dynamodb, -backend=postgres, -backend=mysql, -backend=mongodb, -backend=sqlite and -backend=nats)")
+	flag.StringVar(&config.Username, "username", "", "the username to authenticate as (only used with vault, etcd, http, postgres, mysql, mongodb, git, nats and ldap backends)")
+	flag.StringVar(&config.Password, "password", "", "the password to authenticate with (only used with vault, redis, etcd, http, postgres, mysql, mongodb, git, nats and ldap backends)")
+	flag.StringVar(&config.PasswordFile, "password-file", "", "file holding the password, instead of -password, read again when etcd asks confd to authenticate again")
+	flag.StringVar(&config.UsernameFile, "username-file", "", "file holding the username, instead of -username, read again when etcd asks confd to authenticate again")
 	flag.BoolVar(&config.Watch, "watch", false, "enable watch support")
+	flag.IntVar(&config.WatchDebounce, "watch-debounce", 0, "milliseconds to wait in watch mode after a change of the keys of a template resource for more before processing it, each one restarting the wait")
+	flag.IntVar(&config.Workers, "workers", 1, "how many template resources of the same priority to process at once, outside of watch mode")
+	flag.IntVar(&config.WaitForBackend, "wait-for-backend", 0, "seconds to retry reaching the backend at startup before giving up, e.g. while it starts next to confd")
+	flag.StringVar(&config.OnchangeCmd, "onchange-cmd", "", "command to run once after the template resources processed together changed files, listed in $CONFD_CHANGED_FILES")
+	flag.IntVar(&config.ReloadRetries, "reload-retries", 0, "how many times to run a failed reload_cmd again")
+	flag.IntVar(&config.ReloadRetryInterval, "reload-retry-interval", 1000, "milliseconds to wait before the first retry of a failed reload_cmd, doubled on each retry")
+	flag.IntVar(&config.DialTimeout, "backend-dial-timeout", 10, "seconds to connect to the backend, also when a watch reconnects (only used with -backend=etcdv3)")
+	flag.IntVar(&config.AutoSyncInterval, "etcd-auto-sync-interval", 0, "seconds between two refreshes of the nodes from the members of the etcd cluster, to follow it as members are added and replaced, 0 to only use the nodes given (only used with -backend=etcdv3)")
+	flag.IntVar(&config.EtcdMaxRecvMsgSize, "etcd-max-recv-msg-size", 0, "bytes of the largest response confd accepts from etcd, e.g. with large values, 0 for the default of the etcd client (only used with -backend=etcdv3)")
+	flag.IntVar(&config.EtcdMaxSendMsgSize, "etcd-max-send-msg-size", 0, "bytes of the largest request confd sends to etcd, 0 for the default of the etcd client, 2MiB (only used with -backend=etcdv3)")
+	flag.IntVar(&config.EtcdPageSize, "etcd-page-size", 1000, "how many keys a request reads at most, those of a larger prefix being read in pages of a consistent snapshot, 0 for no limit (only used with -backend=etcdv3)")
+	flag.IntVar(&config.EtcdPageSize, "get-page-size", 1000, "the same as -etcd-page-size")
+	flag.StringVar(&config.EtcdNamespace, "etcd-namespace", "", "the prefix in etcd of every key confd reads and watches, which the templates and -prefix leave out, e.g. /tenants/team-a (only used with -backend=etcdv3)")
+	flag.IntVar(&config.KeepaliveTime, "etcd-keepalive-time", 10, "seconds without traffic before etcd is pinged, to notice a connection dropped silently, e.g. by a firewall, 0 to never ping it (only used with -backend=etcdv3)")
+	flag.IntVar(&config.KeepaliveTimeout, "etcd-keepalive-timeout", 4, "seconds to wait for the answer to a ping before reconnecting to etcd (only used with -backend=etcdv3)")
+	flag.IntVar(&config.RequestTimeout, "backend-request-timeout", 3, "seconds a request for the keys may take, the watches being exempt (only used with -backend=etcdv3)")
+	flag.IntVar(&config.BackendRetries, "backend-retries", 0, "how many times to retry the backend reads failing with a transient error, e.g. a refused connection or an etcd leader election, waiting -retry-interval before the first retry, doubled on each one, instead of -retry-max with -backend=etcdv3")
+	flag.IntVar(&config.BackendRetryMaxDelay, "backend-retry-max-delay", 30000, "milliseconds to wait at most between two retries of a backend read (only used with -backend-retries)")
+	flag.IntVar(&config.RetryMax, "retry-max", 3, "how many times to retry failed backend reads (only used with -backend=etcdv3, -backend=http and -backend=cloudflarekv, -backend-retries winning over it with -backend=etcdv3)")
+	flag.IntVar(&config.RetryInterval, "retry-interval", 500, "milliseconds to wait before the first retry of a failed backend read, doubled on each retry, unless a rate-limited one tells how long (only used with -backend=etcdv3, -backend=http and -backend=cloudflarekv)")
 }
 
 // initConfig initializes the confd configuration by first setting defaults,
@@ -91,68 +160,350 @@ func initConfig() error {
 		if err != nil {
 			return err
 		}
+		if err := decodeStack(string(configBytes)); err != nil {
+			return err
+		}
 	}
 
 	// Update config from environment variables.
 	processEnv()
 
+	if err := config.ReadCredentialFiles(); err != nil {
+		return err
+	}
+
 	if config.SecretKeyring != "" {
-		kr, err := os.Open(config.SecretKeyring)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-		defer kr.Close()
-		config.PGPPrivateKey, err = ioutil.ReadAll(kr)
+		keyring, err := ioutil.ReadFile(config.SecretKeyring)
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
 		}
+		config.PGPPrivateKey = keyring
 	}
 
+	// Checked here, applied by setLogging once the whole config is valid
 	if config.LogLevel != "" {
-		log.SetLevel(config.LogLevel)
+		if err := log.CheckLevel(config.LogLevel); err != nil {
+			return err
+		}
+	}
+	if config.LogFormat != "" {
+		if err := log.CheckFormat(config.LogFormat); err != nil {
+			return err
+		}
 	}
 
+	if err := checkSharedNodes(config.Backend); err != nil {
+		return err
+	}
 	if config.SRVDomain != "" && config.SRVRecord == "" {
 		config.SRVRecord = fmt.Sprintf("_%s._tcp.%s.", config.Backend, config.SRVDomain)
 	}
 
 	// Update BackendNodes from SRV records.
 	if config.SRVRecord != "" {
-		log.Info("SRV record set to " + config.SRVRecord)
-		srvNodes, err := getBackendNodesFromSRV(config.SRVRecord)
+		srvNodes, err := util.LookupSRV(config.SRVRecord)
 		if err != nil {
 			return errors.New("Cannot get nodes from SRV records " + err.Error())
 		}
 
 		config.BackendNodes = srvNodes
 	}
+	if len(config.BackendNodes) == 0 && config.NodesFile != "" {
+		nodes, err := readNodesFile(config.NodesFile)
+		if err != nil {
+			return err
+		}
+		config.BackendNodes = nodes
+	}
 	if len(config.BackendNodes) == 0 {
-		config.BackendNodes = []string{"127.0.0.1:2379"}
+		// With several backends, use the default nodes of the one
+		// connecting to a server
+		for _, backend := range strings.Split(config.Backend, ",") {
+			config.BackendNodes = defaultNodes(strings.TrimSpace(backend))
+			if len(config.BackendNodes) > 0 {
+				break
+			}
+		}
+	}
+	nodes, err := normalizeNodes(config.Backend, config.BackendNodes)
+	if err != nil {
+		return err
+	}
+	config.BackendNodes = nodes
+	if _, err := config.TLSOptions(); err != nil {
+		return err
+	}
+	switch config.EndpointOrdering {
+	case "round-robin", "":
+	case "ordered":
+		if config.AutoSyncInterval > 0 {
+			return errors.New("endpoint_ordering ordered cannot follow the members of the cluster, leave etcd_auto_sync_interval out")
+		}
+	default:
+		return fmt.Errorf("unknown endpoint_ordering %q, want ordered or round-robin", config.EndpointOrdering)
 	}
-	// Initialize the storage client
-	log.Info("Backend set to " + config.Backend)
 
 	config.ConfigDir = filepath.Join(config.ConfDir, "conf.d")
 	config.TemplateDir = filepath.Join(config.ConfDir, "templates")
 	return nil
 }
 
-func getBackendNodesFromSRV(record string) ([]string, error) {
-	nodes := make([]string, 0)
+// setLogging applies the log settings of c, the level going back to info
+// if it has none.
+func setLogging(c Config) error {
+	if c.LogLevel != "" {
+		log.SetLevel(c.LogLevel)
+	} else {
+		log.SetLevel("info")
+	}
+	if c.LogFormat != "" {
+		log.SetFormat(c.LogFormat)
+	}
+	if c.LogFile != "" {
+		return log.SetFile(c.LogFile, c.LogMaxSize, c.LogMaxFiles)
+	}
+	return nil
+}
+
+// stackBackend is a [[backends]] block of the config file, a child of
+// -backend=stack.
+type stackBackend struct {
+	BackendsConfig
+	Type     string `toml:"type"`
+	Required bool   `toml:"required"`
+}
+
+// decodeStack reads the [[backends]] blocks of the config file into
+// config.Stack. A child has the settings of the top level but the nodes,
+// overridden by those of its block.
+func decodeStack(data string) error {
+	var file struct {
+		Backends []toml.Primitive `toml:"backends"`
+	}
+	md, err := toml.Decode(data, &file)
+	if err != nil {
+		return err
+	}
+	config.Stack = nil
+	for i, p := range file.Backends {
+		child := stackBackend{BackendsConfig: config.BackendsConfig}
+		child.BackendNodes = nil
+		child.Stack = nil
+		if err := md.PrimitiveDecode(p, &child); err != nil {
+			return fmt.Errorf("[[backends]] block %d: %s", i+1, err)
+		}
+		if child.Type == "" {
+			return fmt.Errorf("[[backends]] block %d has no type", i+1)
+		}
+		child.Backend = child.Type
+		if len(child.BackendNodes) == 0 {
+			child.BackendNodes = defaultNodes(child.Type)
+		}
+		if child.BackendNodes, err = normalizeNodes(child.Type, child.BackendNodes); err != nil {
+			return fmt.Errorf("[[backends]] block %d: %s", i+1, err)
+		}
+		if err := child.ReadCredentialFiles(); err != nil {
+			return fmt.Errorf("[[backends]] block %d: %s", i+1, err)
+		}
+		config.Stack = append(config.Stack, backends.StackConfig{Config: child.BackendsConfig, Required: child.Required})
+	}
+	return nil
+}
 
-	// Ignore the CNAME as we don't need it.
-	_, addrs, err := net.LookupSRV("", "", record)
+// readNodesFile returns the nodes listed in the file at path, one per line.
+// Blank lines and those starting with # are skipped, as what follows a #
+// on the others.
+func readNodesFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nodes, err
+		return nil, fmt.Errorf("Cannot read the nodes file: %s", err)
+	}
+	var nodes []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			nodes = append(nodes, line)
+		}
 	}
-	for _, srv := range addrs {
-		host := strings.TrimRight(srv.Target, ".")
-		port := strconv.FormatUint(uint64(srv.Port), 10)
-		nodes = append(nodes, net.JoinHostPort(host, port))
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in %s", path)
 	}
 	return nodes, nil
 }
 
+// checkSharedNodes returns an error if more than one of the comma-separated
+// backends reads nodes, which they would share: e.g. vault would connect to
+// the nodes of etcdv3. Only env and file read none.
+func checkSharedNodes(backend string) error {
+	var withNodes []string
+	for _, name := range strings.Split(backend, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "env", "file":
+		default:
+			withNodes = append(withNodes, name)
+		}
+	}
+	if len(withNodes) > 1 {
+		return fmt.Errorf("the backends %s cannot share the nodes, use backend = \"stack\" to give each its own", strings.Join(withNodes, ", "))
+	}
+	return nil
+}
+
+// nodePorts are the ports of the backends whose nodes are host:port
+// addresses, or URLs of them, used for the nodes without one.
+var nodePorts = map[string]string{
+	"etcd":      "2379",
+	"etcdv3":    "2379",
+	"consul":    "8500",
+	"vault":     "8200",
+	"zookeeper": "2181",
+}
+
+// normalizeNodes returns the nodes of backend with the default port of the
+// backend added to those without one. The scheme of a node must be http or
+// https, and is removed for zookeeper which takes none. It returns an error
+// for a node which is not an address. The nodes of the other backends are
+// returned as they are.
+func normalizeNodes(backend string, nodes []string) ([]string, error) {
+	port, ok := nodePorts[backend]
+	if !ok {
+		return nodes, nil
+	}
+	normalized := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		n, err := normalizeNode(node, port, backend != "zookeeper")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s node %q: %s", backend, node, err)
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+func normalizeNode(node, defaultPort string, keepScheme bool) (string, error) {
+	scheme, address := "", strings.TrimSpace(node)
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return "", fmt.Errorf("the scheme must be http or https")
+		}
+		if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return "", fmt.Errorf("a node has no path")
+		}
+		scheme, address = u.Scheme, u.Host
+	}
+	if address == "" {
+		return "", fmt.Errorf("no host")
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// No port, or an IPv6 address without brackets
+		host, port = strings.Trim(address, "[]"), defaultPort
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", fmt.Errorf("want host:port")
+		}
+	}
+	if host == "" || strings.IndexFunc(host, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(".-_:%", r))
+	}) >= 0 {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	address = net.JoinHostPort(host, port)
+	if scheme != "" && keepScheme {
+		return scheme + "://" + address, nil
+	}
+	return address, nil
+}
+
+// defaultNodes returns the nodes used by backend when none are given.
+func defaultNodes(backend string) []string {
+	switch backend {
+	case "consul":
+		return []string{"127.0.0.1:8500"}
+	case "vault":
+		return []string{"http://127.0.0.1:8200"}
+	case "redis":
+		return []string{"127.0.0.1:6379"}
+	case "zookeeper":
+		return []string{"127.0.0.1:2181"}
+	case "metadata", "rancher":
+		// The link-local address of the Rancher metadata service
+		return []string{"http://169.254.169.250/latest"}
+	case "imds":
+		// The link-local address of the EC2 instance metadata service
+		return []string{"http://169.254.169.254"}
+	case "dynamodb", "ssm", "secretsmanager":
+		// Use the endpoint of the AWS region
+		return nil
+	case "s3", "gcs":
+		// The node is the bucket, it has no default
+		return nil
+	case "gsm", "firestore":
+		// The node is the project, taken from the credentials by default
+		return nil
+	case "azurekeyvault":
+		// The node is the vault, it has no default
+		return nil
+	case "azureappconfig":
+		// The node is the store, or it is in the connection string
+		return nil
+	case "k8s-configmap":
+		// The nodes are the ConfigMaps, all of the namespace by default
+		return nil
+	case "k8s-secret":
+		// The nodes are the namespaces, that of the pod by default
+		return nil
+	case "http":
+		// The nodes are the URLs of the documents, there is no default
+		return nil
+	case "grpc":
+		// The nodes are the servers of the KV service, there is no default
+		return nil
+	case "postgres", "mysql", "mongodb":
+		// The node is the DSN or URI of the database, there is no default
+		return nil
+	case "nomad":
+		return []string{"http://127.0.0.1:4646"}
+	case "nats":
+		return []string{"nats://127.0.0.1:4222"}
+	case "cloudflarekv":
+		// The nodes are the account and namespace IDs, there is no default
+		return nil
+	case "exec":
+		// The nodes are the commands, there is no default
+		return nil
+	case "ldap":
+		// The nodes are the URLs of the servers with the base DN, there is
+		// no default
+		return nil
+	case "stack":
+		// The children have their own nodes
+		return nil
+	case "git":
+		// The node is the URL of the repository, there is no default
+		return nil
+	case "sqlite":
+		// The node is the path of the database file, there is no default
+		return nil
+	case "secrets-dir":
+		// Where Docker and Swarm mount the secrets of a container
+		return []string{"/run/secrets"}
+	case "env", "file":
+		// Reads the environment or files, there is nothing to connect to
+		return nil
+	default:
+		return []string{"127.0.0.1:2379"}
+	}
+}
+
 func processEnv() {
 	cakeys := os.Getenv("CONFD_CLIENT_CAKEYS")
 	if len(cakeys) > 0 && config.ClientCaKeys == "" {
@@ -168,4 +519,24 @@ func processEnv() {
 	if len(key) > 0 && config.ClientKey == "" {
 		config.ClientKey = key
 	}
+
+	connectionString := os.Getenv("CONFD_CONNECTION_STRING")
+	if len(connectionString) > 0 && config.ConnString == "" {
+		config.ConnString = connectionString
+	}
+
+	usernameFile := os.Getenv("CONFD_USERNAME_FILE")
+	if len(usernameFile) > 0 && config.UsernameFile == "" {
+		config.UsernameFile = usernameFile
+	}
+
+	passwordFile := os.Getenv("CONFD_PASSWORD_FILE")
+	if len(passwordFile) > 0 && config.PasswordFile == "" {
+		config.PasswordFile = passwordFile
+	}
+
+	authTokenFile := os.Getenv("CONFD_AUTH_TOKEN_FILE")
+	if len(authTokenFile) > 0 && config.AuthTokenFile == "" {
+		config.AuthTokenFile = authTokenFile
+	}
 }
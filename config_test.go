@@ -1,7 +1,13 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/zyf0330/confd/log"
@@ -11,18 +17,37 @@ func TestInitConfigDefaultConfig(t *testing.T) {
 	log.SetLevel("warn")
 	want := Config{
 		BackendsConfig: BackendsConfig{
-			Backend:      "etcdv3",
-			BackendNodes: []string{"127.0.0.1:2379"},
-			Scheme:       "http",
+			Backend:              "etcdv3",
+			BackendNodes:         []string{"127.0.0.1:2379"},
+			BackendRetryMaxDelay: 30000,
+			DialTimeout:          10,
+			RequestTimeout:       3,
+			EtcdPageSize:         1000,
+			EndpointOrdering:     "round-robin",
+			KeepaliveTime:        10,
+			KeepaliveTimeout:     4,
+			Scheme:               "http",
+			MaxObjectSize:        1048576,
+			RetryMax:             3,
+			RetryInterval:        500,
+			SecretVersion:        "latest",
+			TLSMinVersion:        "1.2",
+			NotifyChannel:        "confd_updates",
 		},
 		TemplateConfig: TemplateConfig{
-			ConfDir:     "/etc/confd",
-			ConfigDir:   "/etc/confd/conf.d",
-			TemplateDir: "/etc/confd/templates",
-			Noop:        false,
+			BackendTimeout:      30,
+			ConfDir:             "/etc/confd",
+			ConfigDir:           "/etc/confd/conf.d",
+			ReloadRetryInterval: 1000,
+			TemplateDir:         "/etc/confd/templates",
+			Workers:             1,
+			Noop:                false,
 		},
-		ConfigFile: "/etc/confd/confd.toml",
-		Interval:   600,
+		ConfigFile:  "/etc/confd/confd.toml",
+		Interval:    600,
+		LogFormat:   "text",
+		LogMaxSize:  100,
+		LogMaxFiles: 5,
 	}
 	if err := initConfig(); err != nil {
 		t.Errorf(err.Error())
@@ -31,3 +56,245 @@ func TestInitConfigDefaultConfig(t *testing.T) {
 		t.Errorf("initConfig() = %v, want %v", config, want)
 	}
 }
+
+func TestInitConfigStack(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	file := filepath.Join(t.TempDir(), "confd.toml")
+	content := `backend = "stack"
+scheme = "https"
+nodes = ["unused:1234"]
+
+[[backends]]
+type = "file"
+file = ["/etc/confd/defaults.yaml"]
+
+[[backends]]
+type = "etcdv3"
+nodes = ["etcd.example.com:2379"]
+username = "confd"
+required = true
+
+[[backends]]
+type = "consul"
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.ConfigFile = file
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Stack) != 3 {
+		t.Fatalf("initConfig() read %d backends, want 3", len(config.Stack))
+	}
+	defaults, etcd, consul := config.Stack[0], config.Stack[1], config.Stack[2]
+	if defaults.Backend != "file" || len(defaults.YAMLFile) != 1 || defaults.Required {
+		t.Errorf("first backend = %+v, want the optional file backend", defaults)
+	}
+	if etcd.Backend != "etcdv3" || !reflect.DeepEqual([]string(etcd.BackendNodes), []string{"etcd.example.com:2379"}) ||
+		etcd.Username != "confd" || !etcd.Required {
+		t.Errorf("second backend = %+v, want the required etcdv3 backend", etcd)
+	}
+	if !reflect.DeepEqual([]string(consul.BackendNodes), []string{"127.0.0.1:8500"}) || consul.Scheme != "https" || consul.Username != "" {
+		t.Errorf("third backend = %+v, want the default nodes of consul and the scheme of the top level", consul)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("[[backends]]\nnodes = [\"x\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initConfig(); err == nil {
+		t.Error("initConfig() with a backend without type succeeded")
+	}
+}
+
+func TestInitConfigTLSVersion(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	file := filepath.Join(t.TempDir(), "confd.toml")
+	if err := ioutil.WriteFile(file, []byte(`tls_min_version = "1.5"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.ConfigFile = file
+	if err := initConfig(); err == nil || !strings.Contains(err.Error(), `tls_min_version: unknown TLS version "1.5"`) {
+		t.Errorf("initConfig() with an unknown TLS version = %v", err)
+	}
+}
+
+func TestInitConfigEndpointOrdering(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	config.ConfigFile = filepath.Join(t.TempDir(), "confd.toml")
+	tests := []struct {
+		ordering         string
+		autoSyncInterval int
+		wantErr          string
+	}{
+		{"ordered", 0, ""},
+		{"round-robin", 60, ""},
+		{"ordered", 60, "etcd_auto_sync_interval"},
+		{"nearest", 0, `unknown endpoint_ordering "nearest"`},
+	}
+	for _, tt := range tests {
+		config.EndpointOrdering = tt.ordering
+		config.AutoSyncInterval = tt.autoSyncInterval
+		err := initConfig()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("initConfig() with endpoint_ordering %s and etcd_auto_sync_interval %d = %v, want %q", tt.ordering, tt.autoSyncInterval, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInitConfigInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		name    string
+		set     func()
+		wantErr string
+	}{
+		{"log level", func() { config.LogLevel = "bogus" }, `not a valid level: "bogus"`},
+		{"log format", func() { config.LogFormat = "xml" }, `not a valid format: "xml"`},
+		{"secret keyring", func() { config.SecretKeyring = filepath.Join(t.TempDir(), "missing.asc") }, "missing.asc"},
+		{"backend list", func() { config.Backend = "etcdv3, vault" }, "the backends etcdv3, vault cannot share the nodes"},
+	}
+	for _, tt := range tests {
+		func(c Config) {
+			defer func() { config = c }()
+			config.ConfigFile = filepath.Join(t.TempDir(), "confd.toml")
+			tt.set()
+			if err := initConfig(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("initConfig() with an invalid %s = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		}(config)
+	}
+}
+
+func TestInitConfigBackendList(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	config.ConfigFile = filepath.Join(t.TempDir(), "confd.toml")
+	config.Backend = "file,etcdv3,env"
+	config.BackendNodes = nil
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	// The nodes of the only backend reading some
+	if want := []string{"127.0.0.1:2379"}; !reflect.DeepEqual([]string(config.BackendNodes), want) {
+		t.Errorf("nodes of %s = %v, want %v", config.Backend, config.BackendNodes, want)
+	}
+}
+
+func TestPageSizeFlags(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	for _, name := range []string{"etcd-page-size", "get-page-size"} {
+		config.EtcdPageSize = 1000
+		if err := flag.CommandLine.Parse([]string{"-" + name, "50"}); err != nil {
+			t.Fatal(err)
+		}
+		if config.EtcdPageSize != 50 {
+			t.Errorf("-%s 50 set the page size to %d, want 50", name, config.EtcdPageSize)
+		}
+	}
+}
+
+func TestInitConfigNodesFile(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	file := filepath.Join(t.TempDir(), "nodes")
+	content := `# The etcd cluster
+10.0.0.1:2379
+
+  10.0.0.2:2379  # second member
+https://etcd.example.com:2379
+	# 10.0.0.3:2379
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.ConfigFile = filepath.Join(t.TempDir(), "confd.toml")
+	config.BackendNodes = nil
+	config.NodesFile = file
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:2379", "10.0.0.2:2379", "https://etcd.example.com:2379"}
+	if !reflect.DeepEqual([]string(config.BackendNodes), want) {
+		t.Errorf("nodes read from the nodes file = %q, want %q", config.BackendNodes, want)
+	}
+
+	// -node wins
+	config.BackendNodes = []string{"127.0.0.1:2379"}
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:2379"}; !reflect.DeepEqual([]string(config.BackendNodes), want) {
+		t.Errorf("nodes given with -node and a nodes file = %q, want %q", config.BackendNodes, want)
+	}
+
+	config.BackendNodes = nil
+	if err := ioutil.WriteFile(file, []byte("# none yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initConfig(); err == nil {
+		t.Error("initConfig() with an empty nodes file succeeded")
+	}
+}
+
+func TestInitConfigCredentialFiles(t *testing.T) {
+	log.SetLevel("warn")
+	defer func(c Config) { config = c }(config)
+	dir := t.TempDir()
+	for name, content := range map[string]string{"username": "confd\n", "password": "s3cret\n", "token": "t0ken"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.ConfigFile = filepath.Join(dir, "confd.toml")
+	config.UsernameFile = filepath.Join(dir, "username")
+	config.AuthTokenFile = filepath.Join(dir, "token")
+	os.Setenv("CONFD_PASSWORD_FILE", filepath.Join(dir, "password"))
+	defer os.Unsetenv("CONFD_PASSWORD_FILE")
+	if err := initConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "confd" || config.Password != "s3cret" || config.AuthToken != "t0ken" {
+		t.Errorf("credentials read from their files = %q, %q, %q, want %q, %q, %q", config.Username, config.Password, config.AuthToken, "confd", "s3cret", "t0ken")
+	}
+
+	// The password is set twice
+	config.Username, config.AuthToken = "", ""
+	config.Password = "inline"
+	if err := initConfig(); err == nil || !strings.Contains(err.Error(), "password_file") {
+		t.Errorf("initConfig() with password and password_file = %v, want an error naming both", err)
+	}
+}
+
+func TestNormalizeNodes(t *testing.T) {
+	tests := []struct {
+		backend string
+		nodes   []string
+		want    []string
+	}{
+		{"etcdv3", []string{"localhost", "http://host", "host:1234", " https://10.0.0.1:2380/ ", "::1", "[::1]:2380"},
+			[]string{"localhost:2379", "http://host:2379", "host:1234", "https://10.0.0.1:2380", "[::1]:2379", "[::1]:2380"}},
+		{"consul", []string{"localhost"}, []string{"localhost:8500"}},
+		{"zookeeper", []string{"http://zk1", "zk2:2182"}, []string{"zk1:2181", "zk2:2182"}},
+		// The nodes of the other backends are not addresses
+		{"file", []string{"/etc/confd/values.yaml"}, []string{"/etc/confd/values.yaml"}},
+		{"s3", []string{"my-bucket"}, []string{"my-bucket"}},
+	}
+	for _, tt := range tests {
+		got, err := normalizeNodes(tt.backend, tt.nodes)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeNodes(%s, %q) = %q, %v, want %q", tt.backend, tt.nodes, got, err, tt.want)
+		}
+	}
+
+	for _, node := range []string{"", "ftp://host", "http://", "host:port", "host:99999", "my host", "http://host:2379/v3", "host:2379:1", "etcd1,etcd2"} {
+		_, err := normalizeNodes("etcdv3", []string{node})
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("invalid etcdv3 node %q", node)) {
+			t.Errorf("normalizeNodes(etcdv3, %q) = %v, want an invalid node error", node, err)
+		}
+	}
+}
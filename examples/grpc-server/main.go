@@ -0,0 +1,164 @@
+// Command grpc-server is a reference implementation of the KV service
+// confd reads with -backend=grpc. It serves the content of a YAML or JSON
+// file, flattened into keys like with -backend=file, and reads it again
+// when it changes:
+//
+//	go run ./examples/grpc-server -listen :9000 -file config.yaml
+//	confd -watch -backend grpc -node 127.0.0.1:9000
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v2"
+
+	"github.com/zyf0330/confd/backends/grpc/kvpb"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+// server serves the pairs of the last version of the file.
+type server struct {
+	mu       sync.Mutex
+	revision uint64
+	values   map[string]string
+	// The revision of every key, to tell which keys changed
+	revisions map[string]uint64
+	// Closed when the file changed
+	changed chan struct{}
+}
+
+// set makes vars the new version of the pairs.
+func (s *server) set(vars map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revision++
+	for k, v := range vars {
+		if old, ok := s.values[k]; !ok || old != v {
+			s.revisions[k] = s.revision
+		}
+	}
+	for k := range s.values {
+		if _, ok := vars[k]; !ok {
+			// Deleted keys keep their revision to tell the change
+			s.revisions[k] = s.revision
+		}
+	}
+	s.values = vars
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func hasPrefix(key string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) GetValues(ctx context.Context, req *kvpb.GetValuesRequest) (*kvpb.GetValuesResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]string)
+	for k, v := range s.values {
+		if hasPrefix(k, req.Keys) {
+			values[k] = v
+		}
+	}
+	return &kvpb.GetValuesResponse{Values: values, Revision: s.revision}, nil
+}
+
+// lastChange returns the last revision at which a key starting with one of
+// keys changed.
+func (s *server) lastChange(keys []string) uint64 {
+	var last uint64
+	for k, r := range s.revisions {
+		if r > last && hasPrefix(k, keys) {
+			last = r
+		}
+	}
+	return last
+}
+
+func (s *server) WatchPrefix(req *kvpb.WatchPrefixRequest, stream kvpb.KV_WatchPrefixServer) error {
+	for {
+		s.mu.Lock()
+		revision, last, changed := s.revision, s.lastChange(req.Keys), s.changed
+		s.mu.Unlock()
+		if req.Revision == 0 || last > req.Revision {
+			if err := stream.Send(&kvpb.WatchPrefixResponse{Revision: revision}); err != nil {
+				return err
+			}
+			req.Revision = revision
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func read(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var content interface{}
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	util.Flatten(content, "/", vars)
+	return vars, nil
+}
+
+func main() {
+	listen := flag.String("listen", ":9000", "address to serve the KV service on")
+	file := flag.String("file", "config.yaml", "the YAML or JSON file to serve")
+	flag.Parse()
+
+	vars, err := read(*file)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	s := &server{revisions: make(map[string]uint64), changed: make(chan struct{})}
+	s.set(vars)
+
+	go func() {
+		info, _ := os.Stat(*file)
+		for range time.Tick(time.Second) {
+			newInfo, err := os.Stat(*file)
+			if err != nil || (info != nil && newInfo.ModTime().Equal(info.ModTime())) {
+				continue
+			}
+			info = newInfo
+			vars, err := read(*file)
+			if err != nil {
+				log.Error("Cannot read %s: %s", *file, err)
+				continue
+			}
+			log.Info("Serving the new version of " + *file)
+			s.set(vars)
+		}
+	}()
+
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	grpcServer := grpc.NewServer()
+	kvpb.RegisterKVServer(grpcServer, s)
+	log.Info("Serving " + *file + " on " + *listen)
+	log.Fatal(grpcServer.Serve(lis).Error())
+}
@@ -1,7 +1,6 @@
 #!/bin/bash
 
 export HOSTNAME="localhost"
-export DYNAMODB_LOCAL="1"
 export AWS_ACCESS_KEY_ID="foo"
 export AWS_SECRET_ACCESS_KEY="bar"
 export AWS_REGION="eu-west-1"
@@ -59,15 +58,15 @@ aws dynamodb put-item --table-name confd --region eu-west-1 \
     --endpoint-url http://localhost:8000
 
 # Run confd, expect it to work
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd --node http://localhost:8000
 if [ $? -ne 0 ]
 then
         exit 1
 fi
 
-# Run confd with --watch, expecting it to fail
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd --watch
-if [ $? -eq 0 ]
+# Run confd with --watch, changes are polled
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd --node http://localhost:8000 --watch
+if [ $? -ne 0 ]
 then
         exit 1
 fi
@@ -76,7 +75,7 @@ fi
 unset AWS_ACCESS_KEY_ID
 unset AWS_SECRET_ACCESS_KEY
 
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend dynamodb --table confd --node http://localhost:8000
 if [ $? -eq 0 ]
 then
         exit 1
@@ -0,0 +1,30 @@
+#!/bin/bash
+
+export HOSTNAME="localhost"
+
+rm -rf /tmp/confd-git /tmp/confd-git-cache
+mkdir -p /tmp/confd-git
+cd /tmp/confd-git
+git init -q
+for key in key:foobar \
+    database/host:127.0.0.1 \
+    database/password:p@sSw0rd \
+    database/port:3306 \
+    database/username:confd \
+    upstream/app1:10.0.1.10:8080 \
+    upstream/app2:10.0.1.11:8080; do
+    for prefix in "" prefix/; do
+        mkdir -p "config/$prefix$(dirname ${key%%:*})"
+        printf "%s" "${key#*:}" > "config/$prefix${key%%:*}"
+    done
+done
+git add config
+git -c user.name=confd -c user.email=confd@example.com commit -q -m "Configure"
+cd - > /dev/null
+
+# Run confd
+confd --onetime --log-level debug --confdir ./integration/confdir --backend git --node /tmp/confd-git --git-dir config --cache-dir /tmp/confd-git-cache
+if [ $? -ne 0 ]
+then
+        exit 1
+fi
@@ -0,0 +1,22 @@
+#!/bin/bash
+
+export HOSTNAME="localhost"
+
+mongo confd --quiet --eval '
+db.confd.drop();
+db.confd.insertMany([
+    {_id: "/key", value: "foobar"},
+    {_id: "/database", host: "127.0.0.1", password: "p@sSw0rd", port: "3306", username: "confd"},
+    {_id: "/upstream/app1", value: "10.0.1.10:8080"},
+    {_id: "/upstream/app2", value: "10.0.1.11:8080"},
+    {_id: "/prefix", database: {host: "127.0.0.1", password: "p@sSw0rd", port: "3306", username: "confd"}},
+    {_id: "/prefix/upstream/app1", value: "10.0.1.10:8080"},
+    {_id: "/prefix/upstream/app2", value: "10.0.1.11:8080"}
+]);'
+
+# Run confd
+confd --onetime --log-level debug --confdir ./integration/confdir --backend mongodb --node "mongodb://127.0.0.1:27017/confd" --table confd
+if [ $? -ne 0 ]
+then
+        exit 1
+fi
@@ -0,0 +1,30 @@
+#!/bin/bash
+
+export HOSTNAME="localhost"
+
+mysql -h 127.0.0.1 -u root -e "CREATE DATABASE IF NOT EXISTS confd"
+mysql -h 127.0.0.1 -u root confd < ./backends/mysql/testdata/schema.sql
+
+mysql -h 127.0.0.1 -u root confd <<SQL
+REPLACE INTO confd (\`key\`, \`value\`) VALUES
+    ('/key', 'foobar'),
+    ('/database/host', '127.0.0.1'),
+    ('/database/password', 'p@sSw0rd'),
+    ('/database/port', '3306'),
+    ('/database/username', 'confd'),
+    ('/upstream/app1', '10.0.1.10:8080'),
+    ('/upstream/app2', '10.0.1.11:8080'),
+    ('/prefix/database/host', '127.0.0.1'),
+    ('/prefix/database/password', 'p@sSw0rd'),
+    ('/prefix/database/port', '3306'),
+    ('/prefix/database/username', 'confd'),
+    ('/prefix/upstream/app1', '10.0.1.10:8080'),
+    ('/prefix/upstream/app2', '10.0.1.11:8080');
+SQL
+
+# Run confd
+confd --onetime --log-level debug --confdir ./integration/confdir --backend mysql --node "root@tcp(127.0.0.1:3306)/confd" --table confd
+if [ $? -ne 0 ]
+then
+        exit 1
+fi
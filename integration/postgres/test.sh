@@ -0,0 +1,35 @@
+#!/bin/bash
+
+export HOSTNAME="localhost"
+export DSN="postgres://postgres@127.0.0.1/confd?sslmode=disable"
+
+createdb -h 127.0.0.1 -U postgres confd
+psql "$DSN" -f ./backends/postgres/testdata/schema.sql
+
+psql "$DSN" <<SQL
+INSERT INTO confd (key, value) VALUES
+    ('/key', 'foobar'),
+    ('/database/host', '127.0.0.1'),
+    ('/database/password', 'p@sSw0rd'),
+    ('/database/port', '3306'),
+    ('/database/username', 'confd'),
+    ('/upstream/app1', '10.0.1.10:8080'),
+    ('/upstream/app2', '10.0.1.11:8080'),
+    ('/prefix/database/host', '127.0.0.1'),
+    ('/prefix/database/password', 'p@sSw0rd'),
+    ('/prefix/database/port', '3306'),
+    ('/prefix/database/username', 'confd'),
+    ('/prefix/upstream/app1', '10.0.1.10:8080'),
+    ('/prefix/upstream/app2', '10.0.1.11:8080')
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value;
+SQL
+
+# Run confd
+confd --onetime --log-level debug --confdir ./integration/confdir --backend postgres --node "$DSN" --table confd
+if [ $? -ne 0 ]
+then
+        exit 1
+fi
+
+# The Go tests of the backend, listening on confd_updates
+CONFD_POSTGRES_DSN="$DSN" go test ./backends/postgres
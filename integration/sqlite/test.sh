@@ -0,0 +1,29 @@
+#!/bin/bash
+
+export HOSTNAME="localhost"
+
+rm -f /tmp/confd.db
+sqlite3 /tmp/confd.db <<SQL
+CREATE TABLE kv (key TEXT PRIMARY KEY, value TEXT);
+INSERT INTO kv (key, value) VALUES
+    ('/key', 'foobar'),
+    ('/database/host', '127.0.0.1'),
+    ('/database/password', 'p@sSw0rd'),
+    ('/database/port', '3306'),
+    ('/database/username', 'confd'),
+    ('/upstream/app1', '10.0.1.10:8080'),
+    ('/upstream/app2', '10.0.1.11:8080'),
+    ('/prefix/database/host', '127.0.0.1'),
+    ('/prefix/database/password', 'p@sSw0rd'),
+    ('/prefix/database/port', '3306'),
+    ('/prefix/database/username', 'confd'),
+    ('/prefix/upstream/app1', '10.0.1.10:8080'),
+    ('/prefix/upstream/app2', '10.0.1.11:8080');
+SQL
+
+# Run confd
+confd --onetime --log-level debug --confdir ./integration/confdir --backend sqlite --node /tmp/confd.db
+if [ $? -ne 0 ]
+then
+        exit 1
+fi
@@ -1,7 +1,6 @@
 #!/bin/bash
 
 export HOSTNAME="localhost"
-export SSM_LOCAL="1"
 export AWS_ACCESS_KEY_ID="foo"
 export AWS_SECRET_ACCESS_KEY="bar"
 export AWS_DEFAULT_REGION="us-east-1"
@@ -23,14 +22,14 @@ aws ssm put-parameter --name "/prefix/upstream/app1" --type "String" --value "10
 aws ssm put-parameter --name "/prefix/upstream/app2" --type "String" --value "10.0.1.11:8080" --endpoint-url $SSM_ENDPOINT_URL
 
 # Run confd, expect it to work
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --table confd
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --node $SSM_ENDPOINT_URL
 if [ $? -ne 0 ]
 then
         exit 1
 fi
 
 # Run confd with --watch, expecting it to fail
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --table confd --watch
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --node $SSM_ENDPOINT_URL --watch
 if [ $? -eq 0 ]
 then
         exit 1
@@ -40,7 +39,7 @@ fi
 unset AWS_ACCESS_KEY_ID
 unset AWS_SECRET_ACCESS_KEY
 
-confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --table confd
+confd --onetime --log-level debug --confdir ./integration/confdir --interval 5 --backend ssm --node $SSM_ENDPOINT_URL
 if [ $? -eq 0 ]
 then
         exit 1
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+var zkdata = [][]string{
+	{"/key", "foobar"},
+	{"/database/host", "127.0.0.1"},
+	{"/database/password", "p@sSw0rd"},
+	{"/database/port", "3306"},
+	{"/database/username", "confd"},
+	{"/upstream/app1", "10.0.1.10:8080"},
+	{"/upstream/app2", "10.0.1.11:8080"},
+	{"/prefix/database/host", "127.0.0.1"},
+	{"/prefix/database/password", "p@sSw0rd"},
+	{"/prefix/database/port", "3306"},
+	{"/prefix/database/username", "confd"},
+	{"/prefix/upstream/app1", "10.0.1.10:8080"},
+	{"/prefix/upstream/app2", "10.0.1.11:8080"},
+}
+
+// create stores value at key, creating the empty parent znodes first.
+func create(c *zk.Conn, key, value string) error {
+	if dir := path.Dir(key); dir != "/" {
+		if err := create(c, dir, ""); err != nil {
+			return err
+		}
+	}
+	_, err := c.Create(key, []byte(value), 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		if value == "" {
+			return nil
+		}
+		_, err = c.Set(key, []byte(value), -1)
+	}
+	return err
+}
+
+func main() {
+	zkNode := os.Getenv("ZOOKEEPER_NODE")
+	if zkNode == "" {
+		zkNode = "127.0.0.1:2181"
+	}
+	c, _, err := zk.Connect(strings.Split(zkNode, ","), time.Second)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer c.Close()
+	for _, kv := range zkdata {
+		if err := create(c, kv[0], kv[1]); err != nil {
+			fmt.Println(kv[0], err)
+			os.Exit(1)
+		}
+	}
+}
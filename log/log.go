@@ -1,15 +1,20 @@
 /*
-Package log provides support for logging to stdout and stderr.
+Package log provides support for logging to stderr, or to a rotated file.
 
 Log entries will be logged in the following format:
 
-    timestamp hostname tag[pid]: SEVERITY Message
+    timestamp hostname tag[pid]: SEVERITY key=value Message
+
+where the key=value fields are those of the Logger, if any, or, with the json format, as one object per line:
+
+    {"key":"value","level":"info","msg":"Message","time":"timestamp"}
 */
 package log
 
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,7 +27,16 @@ type ConfdFormatter struct {
 func (c *ConfdFormatter) Format(entry *log.Entry) ([]byte, error) {
 	timestamp := time.Now().Format(time.RFC3339)
 	hostname, _ := os.Hostname()
-	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s\n", timestamp, hostname, tag, os.Getpid(), strings.ToUpper(entry.Level.String()), entry.Message)), nil
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var fields string
+	for _, k := range keys {
+		fields += fmt.Sprintf("%s=%v ", k, entry.Data[k])
+	}
+	return []byte(fmt.Sprintf("%s %s %s[%d]: %s %s%s\n", timestamp, hostname, tag, os.Getpid(), strings.ToUpper(entry.Level.String()), fields, entry.Message)), nil
 }
 
 // tag represents the application name generating the log message. The tag
@@ -39,15 +53,62 @@ func SetTag(t string) {
 	tag = t
 }
 
+// SetFormat sets the format of the log entries. Valid formats are text and json.
+func SetFormat(format string) {
+	switch format {
+	case "text":
+		log.SetFormatter(&ConfdFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339})
+	default:
+		Fatal(CheckFormat(format).Error())
+	}
+}
+
+// CheckFormat returns an error if format is not valid for SetFormat.
+func CheckFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf(`not a valid format: "%s"`, format)
+	}
+	return nil
+}
+
+// The file set by SetFile, closed when another one is set
+var logFile *RotatingFile
+
+// SetFile makes the log entries go to path instead of stderr, rotating it
+// once it grows larger than maxSize megabytes and keeping maxFiles old
+// files.
+func SetFile(path string, maxSize, maxFiles int) error {
+	f, err := OpenRotatingFile(path, int64(maxSize)*1024*1024, maxFiles)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
 // SetLevel sets the log level. Valid levels are panic, fatal, error, warn, info and debug.
 func SetLevel(level string) {
-	lvl, err := log.ParseLevel(level)
-	if err != nil {
-		Fatal(fmt.Sprintf(`not a valid level: "%s"`, level))
+	if err := CheckLevel(level); err != nil {
+		Fatal(err.Error())
 	}
+	lvl, _ := log.ParseLevel(level)
 	log.SetLevel(lvl)
 }
 
+// CheckLevel returns an error if level is not valid for SetLevel.
+func CheckLevel(level string) error {
+	if _, err := log.ParseLevel(level); err != nil {
+		return fmt.Errorf(`not a valid level: "%s"`, level)
+	}
+	return nil
+}
+
 // Debug logs a message with severity DEBUG.
 func Debug(format string, v ...interface{}) {
 	log.Debug(fmt.Sprintf(format, v...))
@@ -72,3 +133,52 @@ func Info(format string, v ...interface{}) {
 func Warning(format string, v ...interface{}) {
 	log.Warning(fmt.Sprintf(format, v...))
 }
+
+// Logger logs messages tagged with fields, e.g. the template resource they
+// are about. A nil Logger logs them untagged.
+type Logger struct {
+	entry *log.Entry
+}
+
+// WithField returns a Logger tagging every message with key=value.
+func WithField(key string, value interface{}) *Logger {
+	return &Logger{log.WithField(key, value)}
+}
+
+// WithField returns a Logger tagging every message with the fields of l
+// and key=value.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return &Logger{l.get().WithField(key, value)}
+}
+
+func (l *Logger) get() *log.Entry {
+	if l == nil {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return l.entry
+}
+
+// Debug logs a message with severity DEBUG.
+func (l *Logger) Debug(format string, v ...interface{}) {
+	l.get().Debug(fmt.Sprintf(format, v...))
+}
+
+// Error logs a message with severity ERROR.
+func (l *Logger) Error(format string, v ...interface{}) {
+	l.get().Error(fmt.Sprintf(format, v...))
+}
+
+// Fatal logs a message with severity ERROR followed by a call to os.Exit().
+func (l *Logger) Fatal(format string, v ...interface{}) {
+	l.get().Fatal(fmt.Sprintf(format, v...))
+}
+
+// Info logs a message with severity INFO.
+func (l *Logger) Info(format string, v ...interface{}) {
+	l.get().Info(fmt.Sprintf(format, v...))
+}
+
+// Warning logs a message with severity WARNING.
+func (l *Logger) Warning(format string, v ...interface{}) {
+	l.get().Warning(fmt.Sprintf(format, v...))
+}
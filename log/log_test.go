@@ -0,0 +1,55 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func capture(f func()) string {
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+	f()
+	return buf.String()
+}
+
+func TestWithField(t *testing.T) {
+	SetLevel("info")
+	defer SetFormat("text")
+
+	SetFormat("text")
+	out := capture(func() {
+		WithField("template", "nginx.toml").WithField("dest", "/etc/nginx.conf").Info("Target config %s out of sync", "/etc/nginx.conf")
+	})
+	if !strings.HasSuffix(out, ": INFO dest=/etc/nginx.conf template=nginx.toml Target config /etc/nginx.conf out of sync\n") {
+		t.Errorf("text output = %q, want the fields before the message", out)
+	}
+
+	SetFormat("json")
+	out = capture(func() {
+		WithField("template", "nginx.toml").Error("failed")
+	})
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(out), &entry); err != nil {
+		t.Fatalf("json output %q: %s", out, err)
+	}
+	if entry["template"] != "nginx.toml" || entry["level"] != "error" || entry["msg"] != "failed" || entry["time"] == "" {
+		t.Errorf("json output = %v", entry)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	SetLevel("info")
+	var l *Logger
+	out := capture(func() {
+		l.Info("untagged")
+	})
+	if !strings.HasSuffix(out, ": INFO untagged\n") {
+		t.Errorf("output = %q, want an untagged message", out)
+	}
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file which is rotated once it grows larger than
+// its maximum size: file is renamed file.1, file.1 file.2 and so on, and
+// the oldest one beyond the number of files to keep is removed. It is safe
+// for concurrent use.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens path for appending, rotating it once it grows
+// larger than maxSize bytes and keeping maxFiles old files. It is never
+// rotated if maxSize is 0.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would make it larger
+// than the maximum size. A single message is never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing messages
+			fmt.Fprintf(os.Stderr, "cannot rotate %s: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	var err error
+	if f.maxFiles > 0 {
+		err = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	}
+	if err == nil || os.IsNotExist(err) {
+		err = nil
+		for i := f.maxFiles - 1; i > 0; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				break
+			}
+			err = nil
+		}
+	}
+	if err == nil {
+		if f.maxFiles > 0 {
+			err = os.Rename(f.path, f.path+".1")
+		} else {
+			err = os.Remove(f.path)
+		}
+	}
+	// Reopen the file even if rotating failed
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Close closes the file, later writes fail.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confd-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "confd.log")
+
+	f, err := OpenRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	line := strings.Repeat("x", 29) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range []string{"confd.log", "confd.log.1", "confd.log.2"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || len(data) > 100 || len(data)%len(line) != 0 {
+			t.Errorf("%s holds %d bytes, want whole lines up to 100 bytes", name, len(data))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 old files to be kept, got %v", err)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confd-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "confd.log")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new\n"))
+	f.Write([]byte("newer\n"))
+	f.Close()
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Error("expected an error writing to a closed file")
+	}
+
+	for name, want := range map[string]string{"confd.log": "newer\n", "confd.log.1": "old\nnew\n"} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package template
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// cache remembers, per template resource, the fingerprint of its last
+// rendering which left dest in sync, so that a cycle reading the same
+// values does not render it again.
+type cache struct {
+	mu           sync.Mutex
+	fingerprints map[string]string
+}
+
+// renderCache outlives the template resources, which the interval processor
+// loads again every cycle.
+var renderCache = &cache{fingerprints: make(map[string]string)}
+
+// hit reports whether fingerprint is that of the last rendering of the
+// template resource at path.
+func (c *cache) hit(path, fingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fingerprint != "" && c.fingerprints[path] == fingerprint
+}
+
+func (c *cache) set(path, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fingerprint == "" {
+		delete(c.fingerprints, path)
+		return
+	}
+	c.fingerprints[path] = fingerprint
+}
+
+// invalidate makes the next processing of the template resource at path
+// render it.
+func (c *cache) invalidate(path string) {
+	c.set(path, "")
+}
+
+// impureFuncs are the template functions whose results do not only depend
+// on the values of the keys, e.g. on the environment, the time, DNS or the
+// keyrings.
+var impureFuncs = map[string]bool{
+	"getenv":     true,
+	"datetime":   true,
+	"lookupIP":   true,
+	"lookupIPV4": true,
+	"lookupIPV6": true,
+	"lookupSRV":  true,
+	"fileExists": true,
+	"getIP":      true,
+	"cget":       true,
+	"cgets":      true,
+	"cgetv":      true,
+	"cgetvs":     true,
+	"cryptgetv":  true,
+}
+
+// fingerprint returns a digest of what rendering t depends on, the values
+// read by setVars included, and of the state of dest. It returns "" if src
+// or dest cannot be stat'ed, or if the template calls one of impureFuncs,
+// never matching then.
+func (t *TemplateResource) fingerprint() string {
+	src, err := os.Stat(t.Src)
+	if err != nil {
+		return ""
+	}
+	if t.callsImpureFuncs() {
+		return ""
+	}
+	dest, err := os.Stat(t.Dest)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\x00%q\x00%s\x00", t.Prefix, t.Keys, t.values)
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00", t.Src, src.ModTime().UnixNano(), src.Size())
+	fmt.Fprintf(h, "%s\x00%v\x00%d\x00%d\x00", t.Dest, t.FileMode, t.Uid, t.Gid)
+	fmt.Fprintf(h, "%v\x00%d\x00%d", dest.Mode(), dest.ModTime().UnixNano(), dest.Size())
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// callsImpureFuncs reports whether the template of t calls one of
+// impureFuncs, or cannot be parsed.
+func (t *TemplateResource) callsImpureFuncs() bool {
+	tmpl, err := template.New(filepath.Base(t.Src)).Funcs(t.funcMap).ParseFiles(t.Src)
+	if err != nil {
+		return true
+	}
+	for _, tmpl := range tmpl.Templates() {
+		if tmpl.Tree != nil && callsAny(tmpl.Tree.Root, impureFuncs) {
+			return true
+		}
+	}
+	return false
+}
+
+// callsAny reports whether node calls one of the functions in names.
+func callsAny(node parse.Node, names map[string]bool) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, node := range n.Nodes {
+			if callsAny(node, names) {
+				return true
+			}
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if callsAny(cmd, names) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if callsAny(arg, names) {
+				return true
+			}
+		}
+	case *parse.IdentifierNode:
+		return names[n.Ident]
+	case *parse.ChainNode:
+		return callsAny(n.Node, names)
+	case *parse.ActionNode:
+		return callsAny(n.Pipe, names)
+	case *parse.TemplateNode:
+		return callsAny(n.Pipe, names)
+	case *parse.IfNode:
+		return callsAny(n.Pipe, names) || callsAny(n.List, names) || callsAny(n.ElseList, names)
+	case *parse.RangeNode:
+		return callsAny(n.Pipe, names) || callsAny(n.List, names) || callsAny(n.ElseList, names)
+	case *parse.WithNode:
+		return callsAny(n.Pipe, names) || callsAny(n.List, names) || callsAny(n.ElseList, names)
+	}
+	return false
+}
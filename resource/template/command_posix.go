@@ -0,0 +1,18 @@
+// +build !windows
+
+package template
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs c in a process group of its own, killed as a whole
+// when the context of c is done, so that the processes started by the
+// shell do not outlive it.
+func killProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,10 @@
+package template
+
+import (
+	"os/exec"
+)
+
+// killProcessGroup leaves c as it is, only the command itself is killed
+// when the context of c is done.
+func killProcessGroup(c *exec.Cmd) {
+}
@@ -0,0 +1,42 @@
+package template
+
+// A BackendError is the failure to read the keys of a template resource
+// from the backend.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// A CheckError is the failure of the check_cmd of a template resource, its
+// destination file was left as it was.
+type CheckError struct {
+	Err error
+}
+
+func (e *CheckError) Error() string {
+	return "Config check failed: " + e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// severity ranks the errors of template resources, Process returning the
+// most severe one.
+func severity(err error) int {
+	switch err.(type) {
+	case *BackendError:
+		return 2
+	case *CheckError:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,68 @@
+package template
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Health is the state of the template resources processed so far, served
+// over HTTP for liveness probes and as metrics for monitoring. A nil Health
+// records nothing.
+type Health struct {
+	mu        sync.Mutex
+	processed bool
+	failing   map[string]error
+}
+
+// NewHealth returns a Health with no template resource processed yet.
+func NewHealth() *Health {
+	return &Health{failing: make(map[string]error)}
+}
+
+// record records the outcome of processing the template resource loaded
+// from path.
+func (h *Health) record(path string, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.processed = true
+	templateRuns.Inc()
+	if err != nil {
+		templateFailures.Inc()
+		h.failing[path] = err
+	} else {
+		delete(h.failing, path)
+		lastSuccess.SetToCurrentTime()
+	}
+	templatesFailing.Set(float64(len(h.failing)))
+}
+
+// ServeHealthz answers 200 if the last processing of every template
+// resource succeeded, 503 listing the failing ones otherwise.
+func (h *Health) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !h.processed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "no template resource processed yet")
+		return
+	}
+	if len(h.failing) > 0 {
+		paths := make([]string, 0, len(h.failing))
+		for path := range h.failing {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, path := range paths {
+			fmt.Fprintf(w, "%s: %s\n", path, h.failing[path])
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,99 @@
+package template
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The metrics are always collected, they are only served if confd is
+// asked to. Those of the runs are recorded by the Health of the processor.
+var (
+	registry = prometheus.NewRegistry()
+
+	templateRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "template_runs_total",
+		Help:      "Template resources processed.",
+	})
+
+	templateFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "template_failures_total",
+		Help:      "Template resources which failed to process.",
+	})
+
+	templatesFailing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "confd",
+		Name:      "templates_failing",
+		Help:      "Template resources whose last processing failed.",
+	})
+
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "confd",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time a template resource was last processed successfully.",
+	})
+
+	templateChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "template_checks_total",
+		Help:      "Template resources checked against the backend.",
+	}, []string{"template"})
+
+	templateWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "template_writes_total",
+		Help:      "Destination files written because they were out of sync.",
+	}, []string{"template"})
+
+	commandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "command_failures_total",
+		Help:      "Failed runs of check_cmd and reload_cmd.",
+	}, []string{"template", "command"})
+
+	getValuesDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "confd",
+		Name:      "backend_get_values_duration_seconds",
+		Help:      "Time taken to retrieve the keys of a template resource from the backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"template"})
+
+	renderCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "render_cache_hits_total",
+		Help:      "Template resources not rendered as their values and destination file were unchanged.",
+	}, []string{"template"})
+
+	renderCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "confd",
+		Name:      "render_cache_misses_total",
+		Help:      "Template resources rendered as their values or destination file changed.",
+	}, []string{"template"})
+)
+
+func init() {
+	registry.MustRegister(
+		templateRuns,
+		templateFailures,
+		templatesFailing,
+		lastSuccess,
+		templateChecks,
+		templateWrites,
+		commandFailures,
+		getValuesDuration,
+		renderCacheHits,
+		renderCacheMisses,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler serves the metrics of template processing in the
+// Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
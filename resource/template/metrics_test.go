@@ -0,0 +1,86 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zyf0330/confd/backends/mock"
+	"github.com/zyf0330/confd/log"
+)
+
+func TestProcessMetrics(t *testing.T) {
+	log.SetLevel("fatal")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"metrics.tmpl": `{{getv "/metrics/key"}}`,
+		"conf.d/metrics.toml": `[template]
+src = "metrics.tmpl"
+dest = "` + filepath.Join(dir, "metrics.conf") + `"
+keys = ["/metrics"]
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := mock.New()
+	store.SetValue("/metrics/key", "foo")
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store, Health: NewHealth()}
+
+	// The metrics are shared with the other tests, only their changes
+	// are checked
+	const name = "metrics.toml"
+	type values struct {
+		runs, failures, failing, checks, writes, hits, misses float64
+		reads                                                 uint64
+	}
+	read := func() values {
+		return values{
+			runs:     testutil.ToFloat64(templateRuns),
+			failures: testutil.ToFloat64(templateFailures),
+			failing:  testutil.ToFloat64(templatesFailing),
+			checks:   testutil.ToFloat64(templateChecks.WithLabelValues(name)),
+			writes:   testutil.ToFloat64(templateWrites.WithLabelValues(name)),
+			hits:     testutil.ToFloat64(renderCacheHits.WithLabelValues(name)),
+			misses:   testutil.ToFloat64(renderCacheMisses.WithLabelValues(name)),
+			reads:    getValuesCount(name),
+		}
+	}
+	cycle := func(wantErr bool, want values) {
+		t.Helper()
+		before := read()
+		if err := Process(config); (err != nil) != wantErr {
+			t.Fatalf("Process() = %v, want an error: %v", err, wantErr)
+		}
+		after := read()
+		got := values{
+			runs:     after.runs - before.runs,
+			failures: after.failures - before.failures,
+			failing:  after.failing,
+			checks:   after.checks - before.checks,
+			writes:   after.writes - before.writes,
+			hits:     after.hits - before.hits,
+			misses:   after.misses - before.misses,
+			reads:    after.reads - before.reads,
+		}
+		if got != want {
+			t.Errorf("metrics changed by %+v, want %+v", got, want)
+		}
+	}
+
+	// Written
+	cycle(false, values{runs: 1, checks: 1, writes: 1, misses: 1, reads: 1})
+	// In sync, not rendered again
+	cycle(false, values{runs: 1, checks: 1, hits: 1, reads: 1})
+	// Failed
+	store.DeleteValue("/metrics/key")
+	cycle(true, values{runs: 1, failures: 1, failing: 1, checks: 1, misses: 1, reads: 1})
+}
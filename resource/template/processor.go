@@ -1,7 +1,10 @@
 package template
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,35 +16,218 @@ type Processor interface {
 	Process()
 }
 
+// Process processes every template resource once. If some of them failed
+// it returns the most telling error: a *BackendError if the keys of one of
+// them could not be read, otherwise a *CheckError if the check_cmd of one
+// of them failed, otherwise the error of the last one which failed.
+// The onchange command failing is returned only if they all succeeded.
 func Process(config Config) error {
 	ts, err := getTemplateResources(config)
 	if err != nil {
 		return err
 	}
-	return process(ts)
+	return process(context.Background(), config, ts)
 }
 
-func process(ts []*TemplateResource) error {
-	var lastErr error
-	for _, t := range ts {
-		if err := t.process(); err != nil {
-			log.Error(err.Error())
+// process processes ts in their order, reading the store within ctx. With
+// config.Workers above 1, the template resources of the same priority are
+// processed concurrently by that many workers.
+func process(ctx context.Context, config Config, ts []*TemplateResource) error {
+	var (
+		mu      sync.Mutex
+		lastErr error
+		dests   []string
+	)
+	run := func(t *TemplateResource) {
+		mu.Lock()
+		t.changed = append([]string(nil), dests...)
+		mu.Unlock()
+		templateChecks.WithLabelValues(t.name).Inc()
+		err := t.process(ctx)
+		t.health.record(t.path, err)
+		if err != nil {
+			t.logger.Error(err.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if t.written {
+			dests = append(dests, t.Dest)
+		}
+		if err != nil && (lastErr == nil || severity(err) >= severity(lastErr)) {
+			lastErr = err
+		}
+	}
+	prefetch(ctx, config, ts)
+	for start := 0; start < len(ts); {
+		end := start + 1
+		for end < len(ts) && ts[end].Priority == ts[start].Priority {
+			end++
+		}
+		forEach(ts[start:end], config.Workers, run)
+		start = end
+	}
+	if err := onchange(config, dests); err != nil {
+		log.Error(err.Error())
+		if lastErr == nil {
 			lastErr = err
 		}
 	}
 	return lastErr
 }
 
+// maxPrefetchKeys is the most prefixes prefetch reads at once. Beyond that
+// the template resources read their own keys: a request for so many
+// prefixes may cost more than those it saves.
+var maxPrefetchKeys = 64
+
+// prefetch reads the keys of every template resource of ts with a single
+// GetValues, which they then take their values from. It leaves them to
+// read their own keys if there is a single one, their prefixes are more
+// than maxPrefetchKeys, or the read fails, each reporting its error then.
+func prefetch(ctx context.Context, config Config, ts []*TemplateResource) {
+	if len(ts) < 2 || config.StoreClient == nil {
+		return
+	}
+	var all []string
+	for _, t := range ts {
+		all = append(all, util.AppendPrefix(t.Prefix, t.Keys)...)
+	}
+	// Leave out the prefixes below other ones
+	sort.Strings(all)
+	var keys []string
+	for _, key := range all {
+		if !hasPrefix(key, keys) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > maxPrefetchKeys {
+		log.Debug(fmt.Sprintf("Not prefetching %d prefixes, reading the keys of every template resource", len(keys)))
+		return
+	}
+
+	if config.BackendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.BackendTimeout)*time.Second)
+		defer cancel()
+	}
+	log.Debug(fmt.Sprintf("Prefetching the keys of %d template resources: %v", len(ts), keys))
+	start := time.Now()
+	values, err := config.StoreClient.GetValues(ctx, keys)
+	elapsed := time.Since(start).Seconds()
+	if err != nil {
+		log.Warning(fmt.Sprintf("Cannot prefetch the keys, reading those of every template resource: %s", err))
+		return
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+	for _, t := range ts {
+		t.prefetched = values
+		// The read counts for every template resource it served
+		getValuesDuration.WithLabelValues(t.name).Observe(elapsed)
+	}
+}
+
+// forEach calls fn with every template resource of ts, from up to workers
+// goroutines at once, and returns once all the calls returned. It calls fn
+// in the order of ts if workers is 1 or less.
+func forEach(ts []*TemplateResource, workers int, fn func(t *TemplateResource)) {
+	if workers <= 1 || len(ts) == 1 {
+		for _, t := range ts {
+			fn(t)
+		}
+		return
+	}
+	jobs := make(chan *TemplateResource)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(ts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				fn(t)
+			}
+		}()
+	}
+	for _, t := range ts {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// onchange runs the onchange command once for the given written
+// destinations, listed one per line in $CONFD_CHANGED_FILES. It does
+// nothing if none was written, and in sync-only mode.
+func onchange(config Config, dests []string) error {
+	if len(dests) == 0 || config.OnchangeCmd == "" || config.SyncOnly {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var changed []string
+	for _, dest := range dests {
+		if !seen[dest] {
+			seen[dest] = true
+			changed = append(changed, dest)
+		}
+	}
+	logger := log.WithField("command", "onchange")
+	logger.Info(fmt.Sprintf("Running the onchange command for %s", strings.Join(changed, ", ")))
+	env := []string{"CONFD_CHANGED_FILES=" + strings.Join(changed, "\n")}
+	if err := runCommand(logger, config.OnchangeCmd, 0, env); err != nil {
+		return fmt.Errorf("onchange command failed: %s", err)
+	}
+	return nil
+}
+
 type intervalProcessor struct {
+	ctx      context.Context
 	config   Config
-	stopChan chan bool
 	doneChan chan bool
 	errChan  chan error
+
+	mu       sync.Mutex
 	interval int
+	// Signals a new interval to the waiting processor
+	intervalChan chan struct{}
+}
+
+// An IntervalSetter is a Processor polling the backend whose interval can
+// be changed while it runs.
+type IntervalSetter interface {
+	SetInterval(interval int) error
 }
 
-func IntervalProcessor(config Config, stopChan, doneChan chan bool, errChan chan error, interval int) Processor {
-	return &intervalProcessor{config, stopChan, doneChan, errChan, interval}
+// IntervalProcessor returns a Processor processing the template resources
+// every interval seconds until ctx is done. A run reads the store within
+// the interval.
+func IntervalProcessor(ctx context.Context, config Config, doneChan chan bool, errChan chan error, interval int) Processor {
+	return &intervalProcessor{
+		ctx:          ctx,
+		config:       config,
+		doneChan:     doneChan,
+		errChan:      errChan,
+		interval:     interval,
+		intervalChan: make(chan struct{}, 1),
+	}
+}
+
+// SetInterval makes the processor wait interval seconds between two runs.
+// A run in progress finishes first, a wait in progress ends interval
+// seconds after it started instead. Intervals below one second are
+// rejected.
+func (p *intervalProcessor) SetInterval(interval int) error {
+	if interval < 1 {
+		return fmt.Errorf("invalid interval %d, it must be at least one second", interval)
+	}
+	p.mu.Lock()
+	p.interval = interval
+	p.mu.Unlock()
+	select {
+	case p.intervalChan <- struct{}{}:
+	default:
+	}
+	return nil
 }
 
 func (p *intervalProcessor) Process() {
@@ -52,27 +238,70 @@ func (p *intervalProcessor) Process() {
 			log.Fatal(err.Error())
 			break
 		}
-		process(ts)
+		p.mu.Lock()
+		interval := time.Duration(p.interval) * time.Second
+		p.mu.Unlock()
+		// The next run is due once the interval elapsed
+		ctx, cancel := context.WithTimeout(p.ctx, interval)
+		process(ctx, p.config, ts)
+		cancel()
+		if !p.wait() {
+			return
+		}
+	}
+}
+
+// wait returns true once the interval elapsed since the last run, or false
+// once the processor is stopped.
+func (p *intervalProcessor) wait() bool {
+	start := time.Now()
+	for {
+		p.mu.Lock()
+		interval := time.Duration(p.interval) * time.Second
+		p.mu.Unlock()
 		select {
-		case <-p.stopChan:
-			break
-		case <-time.After(time.Duration(p.interval) * time.Second):
-			continue
+		case <-p.ctx.Done():
+			return false
+		case <-p.intervalChan:
+			// Wait for the new interval instead, from the last run
+		case <-time.After(interval - time.Since(start)):
+			return true
 		}
 	}
 }
 
+// watchRetryInterval is how long the watch processor waits before watching
+// the keys of a template resource again after a first failure, doubled on
+// each following one.
+var watchRetryInterval = 2 * time.Second
+
+// onchangeDelay is how long the watch processor collects the destinations
+// written after a first one before running the onchange command, so that
+// the templates changed together run it once.
+var onchangeDelay = time.Second
+
 type watchProcessor struct {
+	ctx      context.Context
 	config   Config
-	stopChan chan bool
 	doneChan chan bool
 	errChan  chan error
 	wg       sync.WaitGroup
+	// Receives the written destinations, nil without an onchange command
+	written       chan string
+	onchangeDelay time.Duration
+	debounce      time.Duration
 }
 
-func WatchProcessor(config Config, stopChan, doneChan chan bool, errChan chan error) Processor {
-	var wg sync.WaitGroup
-	return &watchProcessor{config, stopChan, doneChan, errChan, wg}
+// WatchProcessor returns a Processor processing every template resource
+// once, then again whenever the backend tells its keys changed, until ctx
+// is done.
+func WatchProcessor(ctx context.Context, config Config, doneChan chan bool, errChan chan error) Processor {
+	p := &watchProcessor{ctx: ctx, config: config, doneChan: doneChan, errChan: errChan,
+		onchangeDelay: onchangeDelay, debounce: time.Duration(config.WatchDebounce) * time.Millisecond}
+	if config.OnchangeCmd != "" && !config.SyncOnly {
+		p.written = make(chan string, 64)
+	}
+	return p
 }
 
 func (p *watchProcessor) Process() {
@@ -82,6 +311,9 @@ func (p *watchProcessor) Process() {
 		log.Fatal(err.Error())
 		return
 	}
+	if p.written != nil {
+		go p.runOnchange()
+	}
 	for _, t := range ts {
 		t := t
 		p.wg.Add(1)
@@ -90,24 +322,100 @@ func (p *watchProcessor) Process() {
 	p.wg.Wait()
 }
 
+// runOnchange runs the onchange command once for the destinations written
+// within onchangeDelay of the first one, until the processor is stopped.
+func (p *watchProcessor) runOnchange() {
+	for {
+		var dests []string
+		select {
+		case <-p.ctx.Done():
+			return
+		case dest := <-p.written:
+			dests = append(dests, dest)
+		}
+		delay := time.After(p.onchangeDelay)
+	collect:
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case dest := <-p.written:
+				dests = append(dests, dest)
+			case <-delay:
+				break collect
+			}
+		}
+		if err := onchange(p.config, dests); err != nil {
+			p.errChan <- err
+		}
+	}
+}
+
 func (p *watchProcessor) monitorPrefix(t *TemplateResource) {
 	defer p.wg.Done()
 	keys := util.AppendPrefix(t.Prefix, t.Keys)
+	failures := 0
 	for {
-		index, err := t.storeClient.WatchPrefix(t.Prefix, keys, t.lastIndex, p.stopChan, p.doneChan)
+		index, err := t.storeClient.WatchPrefix(p.ctx, t.Prefix, keys, t.lastIndex)
+		if p.ctx.Err() != nil {
+			return
+		}
 		if err != nil {
+			t.health.record(t.path, err)
 			p.errChan <- err
-			// Prevent backend errors from consuming all resources.
-			time.Sleep(time.Second * 2)
+			// Prevent backend errors from consuming all resources, the
+			// watch resumes from the last index seen once it is back
+			wait := util.Backoff(watchRetryInterval, failures)
+			failures++
+			t.logger.Warning(fmt.Sprintf("Watching the keys failed %d times in a row, watching them again from index %d in %s", failures, t.lastIndex, wait))
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
 			continue
 		}
+		failures = 0
+		if p.debounce > 0 && t.lastIndex != 0 {
+			index = p.settle(t, keys, index)
+			if p.ctx.Err() != nil {
+				return
+			}
+		}
 		t.lastIndex = index
-		if err := t.process(); err != nil {
+		// The backend told of a change, even to values read before
+		renderCache.invalidate(t.path)
+		templateChecks.WithLabelValues(t.name).Inc()
+		err = t.process(p.ctx)
+		t.health.record(t.path, err)
+		if t.written && p.written != nil {
+			select {
+			case p.written <- t.Dest:
+			case <-p.ctx.Done():
+			}
+		}
+		if err != nil {
 			p.errChan <- err
 		}
 	}
 }
 
+// settle waits until the keys of t did not change for the debounce window
+// after index, and returns the index of the last change.
+func (p *watchProcessor) settle(t *TemplateResource, keys []string, index uint64) uint64 {
+	for {
+		ctx, cancel := context.WithTimeout(p.ctx, p.debounce)
+		next, err := t.storeClient.WatchPrefix(ctx, t.Prefix, keys, index)
+		cancel()
+		if err != nil || next == index || p.ctx.Err() != nil {
+			// A failed watch is told by the next one
+			return index
+		}
+		t.logger.Debug(fmt.Sprintf("Keys changed again within %s, waiting for more", p.debounce))
+		index = next
+	}
+}
+
 func getTemplateResources(config Config) ([]*TemplateResource, error) {
 	var lastError error
 	templates := make([]*TemplateResource, 0)
@@ -125,6 +433,8 @@ func getTemplateResources(config Config) ([]*TemplateResource, error) {
 		log.Warning("Found no templates")
 	}
 
+	// Process in a deterministic order: by priority, then by path
+	sort.Strings(paths)
 	for _, p := range paths {
 		log.Debug(fmt.Sprintf("Found template: %s", p))
 		t, err := NewTemplateResource(p, config)
@@ -134,5 +444,8 @@ func getTemplateResources(config Config) ([]*TemplateResource, error) {
 		}
 		templates = append(templates, t)
 	}
+	sort.SliceStable(templates, func(i, j int) bool {
+		return templates[i].Priority > templates[j].Priority
+	})
 	return templates, lastError
 }
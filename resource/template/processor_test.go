@@ -0,0 +1,836 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/memkv"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/zyf0330/confd/backends/mock"
+	"github.com/zyf0330/confd/log"
+)
+
+func TestWatchProcessor(t *testing.T) {
+	log.SetLevel("warn")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "myapp.conf")
+	files := map[string]string{
+		"myapp.conf.tmpl": `{{getv "/myapp/database/url"}}`,
+		"conf.d/myapp.toml": `[template]
+src = "myapp.conf.tmpl"
+dest = "` + dest + `"
+keys = ["/myapp/database"]
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := mock.New()
+	store.SetValue("/myapp/database/url", "db.example.com")
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := make(chan error, 10)
+	doneChan := make(chan bool)
+	go WatchProcessor(ctx, config, doneChan, errChan).Process()
+
+	// waitFor waits until the rendered file holds want
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			b, _ := ioutil.ReadFile(dest)
+			if string(b) == want {
+				return
+			}
+			select {
+			case err := <-errChan:
+				t.Fatal(err)
+			default:
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s = %q, want %q", dest, b, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("db.example.com")
+	store.SetValue("/myapp/database/url", "db2.example.com")
+	waitFor("db2.example.com")
+
+	cancel()
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch processor did not stop once its context was cancelled")
+	}
+}
+
+func TestWatchProcessorReloadError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the reload command is a shell command")
+	}
+	log.SetLevel("fatal")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"myapp.conf.tmpl": `{{getv "/myapp/database/url"}}`,
+		"conf.d/myapp.toml": `[template]
+src = "myapp.conf.tmpl"
+dest = "` + filepath.Join(dir, "myapp.conf") + `"
+keys = ["/myapp/database"]
+reload_cmd = "echo run >> ` + filepath.Join(dir, "reloads") + `; false"
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := mock.New()
+	store.SetValue("/myapp/database/url", "db.example.com")
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store,
+		ReloadRetries: 2, ReloadRetryInterval: 1}
+	errChan := make(chan error, 10)
+	go WatchProcessor(context.Background(), config, make(chan bool), errChan).Process()
+
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed reload command was not reported")
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "reloads"))
+	if runs := strings.Count(string(b), "run"); runs != 3 {
+		t.Errorf("reload command run %d times before the error was reported, want 3", runs)
+	}
+}
+
+// newOnchangeTest writes two template resources rendering /app/a and /app/b
+// in dir, and returns their config running an onchange command which
+// appends $CONFD_CHANGED_FILES to the returned file.
+func newOnchangeTest(t *testing.T, store *mock.Client) (Config, string) {
+	t.Helper()
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, name := range []string{"a", "b"} {
+		files[name+".tmpl"] = `{{getv "/app/` + name + `"}}`
+		files["conf.d/"+name+".toml"] = `[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(dir, name+".conf") + `"
+keys = ["/app/` + name + `"]
+`
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs := filepath.Join(dir, "runs")
+	return Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store,
+		OnchangeCmd: `echo "run $CONFD_CHANGED_FILES" >> ` + runs}, runs
+}
+
+func TestProcessOnchangeCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the onchange command is a shell command")
+	}
+	log.SetLevel("fatal")
+	store := mock.New()
+	store.SetValue("/app/a", "1")
+	store.SetValue("/app/b", "1")
+	config, runs := newOnchangeTest(t, store)
+
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(runs)
+	if n := strings.Count(string(b), "run"); n != 1 {
+		t.Fatalf("onchange command run %d times, want 1", n)
+	}
+	for _, name := range []string{"a.conf", "b.conf"} {
+		if !strings.Contains(string(b), filepath.Join(config.ConfDir, name)) {
+			t.Errorf("$CONFD_CHANGED_FILES = %q, want it to list %s", b, name)
+		}
+	}
+
+	// Nothing changed
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = ioutil.ReadFile(runs); strings.Count(string(b), "run") != 1 {
+		t.Errorf("onchange command run without changes: %q", b)
+	}
+
+	store.SetValue("/app/b", "2")
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(runs)
+	if want := "run " + filepath.Join(config.ConfDir, "b.conf") + "\n"; !strings.HasSuffix(string(b), want) {
+		t.Errorf("runs = %q, want a last one for b.conf only", b)
+	}
+
+	config.OnchangeCmd = "false"
+	store.SetValue("/app/a", "2")
+	if err := Process(config); err == nil {
+		t.Error("Process() with a failing onchange command succeeded")
+	}
+}
+
+func TestWatchProcessorOnchangeCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the onchange command is a shell command")
+	}
+	defer func(d time.Duration) { onchangeDelay = d }(onchangeDelay)
+	onchangeDelay = 200 * time.Millisecond
+	log.SetLevel("fatal")
+	store := mock.New()
+	store.SetValue("/app/a", "1")
+	store.SetValue("/app/b", "1")
+	config, runs := newOnchangeTest(t, store)
+	errChan := make(chan error, 10)
+	go WatchProcessor(context.Background(), config, make(chan bool), errChan).Process()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(runs)
+		if strings.Count(string(b), "run") > 0 {
+			break
+		}
+		select {
+		case err := <-errChan:
+			t.Fatal(err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the onchange command was not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(2 * onchangeDelay)
+	b, _ := ioutil.ReadFile(runs)
+	if n := strings.Count(string(b), "run"); n != 1 {
+		t.Errorf("onchange command run %d times for both files, want 1: %q", n, b)
+	}
+}
+
+func TestProcessCommandEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are shell commands")
+	}
+	log.SetLevel("fatal")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := filepath.Join(dir, "runs")
+	files := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name+".tmpl"] = `{{getv "/app/` + name + `"}}`
+		files["conf.d/"+name+".toml"] = `[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(dir, name+".conf") + `"
+keys = ["/app/` + name + `"]
+check_cmd = 'echo "check $CONFD_DEST|$CONFD_CHANGED" >> ` + runs + `'
+reload_cmd = 'echo "reload $CONFD_DEST|$CONFD_CHANGED" >> ` + runs + `'
+`
+	}
+	// b.conf is in sync already
+	files["b.conf"] = "1"
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := mock.New()
+	for _, name := range []string{"a", "b", "c"} {
+		store.SetValue("/app/"+name, "1")
+	}
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store}
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+
+	a, c := filepath.Join(dir, "a.conf"), filepath.Join(dir, "c.conf")
+	want := "check " + a + "|" + a + "\n" +
+		"reload " + a + "|" + a + "\n" +
+		"check " + c + "|" + a + " " + c + "\n" +
+		"reload " + c + "|" + a + " " + c + "\n"
+	if b, _ := ioutil.ReadFile(runs); string(b) != want {
+		t.Errorf("commands run with\n%s\nwant\n%s", b, want)
+	}
+}
+
+func TestProcessOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the reload command is a shell command")
+	}
+	log.SetLevel("fatal")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.MkdirAll(filepath.Join(confDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := filepath.Join(dir, "runs")
+	files := map[string]string{"app.tmpl": `{{getv "/app/key"}}`}
+	// The resources and their priorities, in the order they are processed
+	resources := []struct {
+		name     string
+		priority int
+	}{
+		{"zz", 10},
+		{"b", 5},
+		{"sub/a", 5},
+		{"a", 0},
+		{"c", 0},
+		{"sub/0", 0},
+		{"0", -1},
+	}
+	for _, r := range resources {
+		priority := ""
+		if r.priority != 0 {
+			priority = fmt.Sprintf("priority = %d\n", r.priority)
+		}
+		files["conf.d/"+r.name+".toml"] = `[template]
+src = "app.tmpl"
+dest = "` + filepath.Join(dir, strings.Replace(r.name, "/", "-", -1)+".conf") + `"
+keys = ["/app"]
+reload_cmd = "echo ` + r.name + ` >> ` + runs + `"
+` + priority
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := mock.New()
+	store.SetValue("/app/key", "1")
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store}
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, r := range resources {
+		want = append(want, r.name)
+	}
+	b, _ := ioutil.ReadFile(runs)
+	if got := strings.Fields(string(b)); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("resources processed in the order %v, want %v", got, want)
+	}
+}
+
+func TestProcessWorkers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the onchange command is a shell command")
+	}
+	log.SetLevel("fatal")
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := filepath.Join(dir, "runs")
+	store := mock.New()
+	const n = 60
+	files := map[string]string{"app.tmpl": `{{getv "/key"}}`}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("app%02d", i)
+		// Every tenth one reads a missing key and fails
+		if i%10 != 3 {
+			store.SetValue("/"+name+"/key", name)
+		}
+		files["conf.d/"+name+".toml"] = `[template]
+src = "app.tmpl"
+dest = "` + filepath.Join(dir, name+".conf") + `"
+prefix = "/` + name + `"
+keys = ["/key"]
+`
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store, Workers: 8,
+		OnchangeCmd: `echo "$CONFD_CHANGED_FILES" >> ` + runs}
+
+	if err := Process(config); err == nil {
+		t.Error("Process() with failing template resources succeeded")
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("app%02d", i)
+		b, err := ioutil.ReadFile(filepath.Join(dir, name+".conf"))
+		switch {
+		case i%10 == 3 && err == nil:
+			t.Errorf("%s.conf rendered without its key", name)
+		case i%10 != 3 && string(b) != name:
+			t.Errorf("%s.conf = %q, %v, want %q", name, b, err, name)
+		}
+	}
+	b, _ := ioutil.ReadFile(runs)
+	if changed := strings.Fields(string(b)); len(changed) != n-n/10 {
+		t.Errorf("onchange command run for %d files, want %d", len(changed), n-n/10)
+	}
+
+	// Nothing changed
+	os.Remove(runs)
+	for i := 3; i < n; i += 10 {
+		store.SetValue(fmt.Sprintf("/app%02d/key", i), "fixed")
+	}
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(runs); len(strings.Fields(string(b))) != n/10 {
+		t.Errorf("onchange command run for %q, want the %d fixed files", b, n/10)
+	}
+}
+
+// countingClient is a mock backend counting the GetValues calls, failing
+// those asking for more than one prefix if failBatch is set, and taking
+// latency to answer.
+type countingClient struct {
+	*mock.Client
+	failBatch bool
+	latency   time.Duration
+	calls     int32
+}
+
+func (c *countingClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	atomic.AddInt32(&c.calls, 1)
+	time.Sleep(c.latency)
+	if c.failBatch && len(keys) > 1 {
+		return nil, errors.New("too many prefixes")
+	}
+	return c.Client.GetValues(ctx, keys)
+}
+
+// newPrefetchTest writes n template resources, each reading
+// /app/<i>/key and /shared, and returns their config.
+func newPrefetchTest(tb testing.TB, n int) (Config, *countingClient) {
+	dir := tb.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	store := &countingClient{Client: mock.New()}
+	store.SetValue("/shared", "shared")
+	files := map[string]string{"app.tmpl": `{{range gets "/app/*/key"}}{{.Value}}{{end}} {{getv "/shared"}}`}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("app%d", i)
+		store.SetValue("/app/"+name+"/key", name)
+		files["conf.d/"+name+".toml"] = `[template]
+src = "app.tmpl"
+dest = "` + filepath.Join(dir, name+".conf") + `"
+keys = ["/app/` + name + `/key", "/shared"]
+`
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: store}, store
+}
+
+// getValuesCount returns how many reads of the keys of the template
+// resource name were timed.
+func getValuesCount(name string) uint64 {
+	families, err := registry.Gather()
+	if err != nil {
+		return 0
+	}
+	for _, family := range families {
+		if family.GetName() != "confd_backend_get_values_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "template" && label.GetValue() == name {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestProcessPrefetch(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(max int) { maxPrefetchKeys = max }(maxPrefetchKeys)
+	const n = 20
+	// The values of the other template resources are not seen
+	check := func(config Config) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("app%d", i)
+			b, err := ioutil.ReadFile(filepath.Join(config.ConfDir, name+".conf"))
+			if want := name + " shared"; string(b) != want {
+				t.Errorf("%s.conf = %q, %v, want %q", name, b, err, want)
+			}
+		}
+	}
+
+	config, store := newPrefetchTest(t, n)
+	// The counts of the other tests reading app1.toml are counted too
+	reads0 := getValuesCount("app1.toml")
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	if store.calls != 1 {
+		t.Errorf("GetValues called %d times for %d template resources, want once", store.calls, n)
+	}
+	if reads := getValuesCount("app1.toml") - reads0; reads != 1 {
+		t.Errorf("%d reads of app1.toml timed, want the prefetch", reads)
+	}
+	check(config)
+
+	// Too many prefixes
+	maxPrefetchKeys = n
+	config, store = newPrefetchTest(t, n)
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	if store.calls != n {
+		t.Errorf("GetValues called %d times beyond maxPrefetchKeys, want %d", store.calls, n)
+	}
+	check(config)
+
+	// The prefetch fails
+	maxPrefetchKeys = 64
+	config, store = newPrefetchTest(t, n)
+	store.failBatch = true
+	if err := Process(config); err == nil {
+		t.Error("Process() with failing reads succeeded")
+	}
+	if store.calls != n+1 {
+		t.Errorf("GetValues called %d times after a failed prefetch, want %d", store.calls, n+1)
+	}
+}
+
+func BenchmarkProcessPrefetch(b *testing.B) {
+	log.SetLevel("fatal")
+	defer func(max int) { maxPrefetchKeys = max }(maxPrefetchKeys)
+	for _, max := range []int{0, 64} {
+		name := "per-resource"
+		if max > 0 {
+			name = "prefetch"
+		}
+		b.Run(name, func(b *testing.B) {
+			maxPrefetchKeys = max
+			config, store := newPrefetchTest(b, 50)
+			// A backend over the network
+			store.latency = time.Millisecond
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Process(config); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// deadlineClient is a mock backend sending the deadline of the context of
+// every GetValues to deadlines.
+type deadlineClient struct {
+	*mock.Client
+	deadlines chan time.Time
+}
+
+func (c *deadlineClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	deadline, _ := ctx.Deadline()
+	select {
+	case c.deadlines <- deadline:
+	default:
+	}
+	return c.Client.GetValues(ctx, keys)
+}
+
+func TestIntervalProcessor(t *testing.T) {
+	log.SetLevel("fatal")
+	config, _ := newPrefetchTest(t, 1)
+	store := &deadlineClient{Client: mock.New(), deadlines: make(chan time.Time, 1)}
+	store.SetValue("/app/app0/key", "app0")
+	store.SetValue("/shared", "shared")
+	config.StoreClient = store
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	doneChan := make(chan bool)
+	start := time.Now()
+	go IntervalProcessor(ctx, config, doneChan, make(chan error, 10), 60).Process()
+
+	// A run reads the store within the interval
+	select {
+	case deadline := <-store.deadlines:
+		if deadline.Before(start.Add(59*time.Second)) || deadline.After(time.Now().Add(60*time.Second)) {
+			t.Errorf("the store was read with the deadline %s, want the end of the interval from %s", deadline, start)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the interval processor did not read the store")
+	}
+
+	cancel()
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the interval processor did not stop once its context was cancelled")
+	}
+}
+
+func TestProcessRenderCache(t *testing.T) {
+	log.SetLevel("fatal")
+	config, store := newPrefetchTest(t, 1)
+	dest := filepath.Join(config.ConfDir, "app0.conf")
+	// The counters of the other tests rendering app0.toml are counted too
+	hits := renderCacheHits.WithLabelValues("app0.toml")
+	misses := renderCacheMisses.WithLabelValues("app0.toml")
+	hits0, misses0 := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	steps := []struct {
+		name         string
+		change       func()
+		hits, misses float64
+		want         string
+	}{
+		{"first", func() {}, 0, 1, "app0 shared"},
+		{"unchanged", func() {}, 1, 1, "app0 shared"},
+		{"dest edited", func() { ioutil.WriteFile(dest, []byte("edited"), 0644) }, 1, 2, "app0 shared"},
+		{"value changed", func() { store.SetValue("/shared", "changed") }, 1, 3, "app0 changed"},
+		{"unchanged again", func() {}, 2, 3, "app0 changed"},
+	}
+	for _, step := range steps {
+		step.change()
+		if err := Process(config); err != nil {
+			t.Fatalf("Process() %s: %v", step.name, err)
+		}
+		if got := testutil.ToFloat64(hits) - hits0; got != step.hits {
+			t.Errorf("Process() %s: %v cache hits, want %v", step.name, got, step.hits)
+		}
+		if got := testutil.ToFloat64(misses) - misses0; got != step.misses {
+			t.Errorf("Process() %s: %v cache misses, want %v", step.name, got, step.misses)
+		}
+		if b, _ := ioutil.ReadFile(dest); string(b) != step.want {
+			t.Errorf("Process() %s: %s = %q, want %q", step.name, dest, b, step.want)
+		}
+	}
+}
+
+func TestProcessRenderCacheImpureFuncs(t *testing.T) {
+	log.SetLevel("fatal")
+	config, _ := newPrefetchTest(t, 1)
+	dest := filepath.Join(config.ConfDir, "app0.conf")
+	tmpl := `{{getv "/shared"}} {{getenv "CONFD_TEST_RENDER_CACHE"}}`
+	if err := ioutil.WriteFile(filepath.Join(config.TemplateDir, "app.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hits := renderCacheHits.WithLabelValues("app0.toml")
+	hits0 := testutil.ToFloat64(hits)
+
+	// The values stay the same, what getenv returns changes
+	for _, value := range []string{"foo", "bar"} {
+		t.Setenv("CONFD_TEST_RENDER_CACHE", value)
+		if err := Process(config); err != nil {
+			t.Fatalf("Process() with %s: %v", value, err)
+		}
+		if b, _ := ioutil.ReadFile(dest); string(b) != "shared "+value {
+			t.Errorf("Process() with %s: %s = %q, want %q", value, dest, b, "shared "+value)
+		}
+	}
+	if got := testutil.ToFloat64(hits) - hits0; got != 0 {
+		t.Errorf("%v cache hits for a template calling getenv, want 0", got)
+	}
+}
+
+func TestCallsImpureFuncs(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want bool
+	}{
+		{`{{getv "/key"}}`, false},
+		{`{{range gets "/app/*"}}{{.Value}}{{end}}`, false},
+		{`{{datetime}}`, true},
+		{`{{if getv "/key"}}{{else}}{{getenv "HOME"}}{{end}}`, true},
+		{`{{range lookupSRV "db" "tcp" "example.com"}}{{.Target}}{{end}}`, true},
+		{`{{define "ip"}}{{lookupIP "example.com"}}{{end}}{{template "ip"}}`, true},
+		{`{{with $v := getv "/key"}}{{$v | toUpper}}{{end}}`, false},
+		{`{{getv "/key" | printf "%s %s" (getenv "HOME")}}`, true},
+	}
+	src := filepath.Join(t.TempDir(), "app.tmpl")
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(src, []byte(tt.tmpl), 0644); err != nil {
+			t.Fatal(err)
+		}
+		funcMap := newFuncMap()
+		addFuncs(funcMap, memkv.New().FuncMap)
+		tr := &TemplateResource{Src: src, funcMap: funcMap}
+		if got := tr.callsImpureFuncs(); got != tt.want {
+			t.Errorf("callsImpureFuncs() of %s = %v, want %v", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestWatchProcessorRenderCache(t *testing.T) {
+	log.SetLevel("fatal")
+	config, store := newPrefetchTest(t, 1)
+	// The counters of the other tests rendering app0.toml are counted too
+	hits := renderCacheHits.WithLabelValues("app0.toml")
+	misses := renderCacheMisses.WithLabelValues("app0.toml")
+	hits0, misses0 := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchProcessor(ctx, config, make(chan bool), make(chan error, 10)).Process()
+	// waitFor waits until the template resource was rendered n times
+	waitFor := func(n float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(misses)-misses0 < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v renderings, want %v", testutil.ToFloat64(misses)-misses0, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// The values did not change since Process, but the watch signalled
+	// them
+	waitFor(2)
+	store.SetValue("/shared", "shared")
+	waitFor(3)
+	if got := testutil.ToFloat64(hits) - hits0; got != 0 {
+		t.Errorf("%v cache hits in watch mode, want 0", got)
+	}
+}
+
+func TestWatchProcessorDebounce(t *testing.T) {
+	log.SetLevel("fatal")
+	config, store := newPrefetchTest(t, 1)
+	config.StoreClient = store.Client
+	config.WatchDebounce = 200
+	dest := filepath.Join(config.ConfDir, "app0.conf")
+	// The counter of the other tests processing app0.toml is counted too
+	checks := templateChecks.WithLabelValues("app0.toml")
+	checks0 := testutil.ToFloat64(checks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchProcessor(ctx, config, make(chan bool), make(chan error, 10)).Process()
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if b, _ := ioutil.ReadFile(dest); string(b) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never held %q", dest, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("app0 shared")
+
+	// A burst of writes, each one within the window of the previous one
+	for i := 0; i < 5; i++ {
+		store.SetValue("/shared", fmt.Sprintf("burst%d", i))
+		time.Sleep(50 * time.Millisecond)
+	}
+	waitFor("app0 burst4")
+	time.Sleep(400 * time.Millisecond)
+	if got := testutil.ToFloat64(checks) - checks0; got != 2 {
+		t.Errorf("the template resource was processed %v times for a burst of writes, want 2: at start and once after", got)
+	}
+}
+
+// flakyClient is a mock backend whose first watch from a non-zero index
+// fails, as if the connection dropped, recording the indexes watched from.
+type flakyClient struct {
+	*mock.Client
+	mu      sync.Mutex
+	failed  bool
+	indexes []uint64
+}
+
+func (c *flakyClient) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex uint64) (uint64, error) {
+	c.mu.Lock()
+	c.indexes = append(c.indexes, waitIndex)
+	fail := waitIndex != 0 && !c.failed
+	c.failed = c.failed || fail
+	c.mu.Unlock()
+	if fail {
+		return waitIndex, errors.New("connection lost")
+	}
+	return c.Client.WatchPrefix(ctx, prefix, keys, waitIndex)
+}
+
+func TestWatchProcessorRecovers(t *testing.T) {
+	log.SetLevel("fatal")
+	defer func(interval time.Duration) { watchRetryInterval = interval }(watchRetryInterval)
+	watchRetryInterval = 10 * time.Millisecond
+	config, store := newPrefetchTest(t, 1)
+	flaky := &flakyClient{Client: store.Client}
+	config.StoreClient = flaky
+	dest := filepath.Join(config.ConfDir, "app0.conf")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := make(chan error, 10)
+	go WatchProcessor(ctx, config, make(chan bool), errChan).Process()
+
+	select {
+	case err := <-errChan:
+		if err.Error() != "connection lost" {
+			t.Fatalf("the watch processor reported %v, want the lost connection", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch processor did not report the lost connection")
+	}
+	store.SetValue("/shared", "recovered")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if b, _ := ioutil.ReadFile(dest); string(b) == "app0 recovered" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the watch processor did not render the change after the lost connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The watch failing at index i resumed from i
+	flaky.mu.Lock()
+	defer flaky.mu.Unlock()
+	if len(flaky.indexes) < 3 || flaky.indexes[1] == 0 || flaky.indexes[2] != flaky.indexes[1] {
+		t.Errorf("watched from the indexes %v, want the failed one watched again", flaky.indexes)
+	}
+}
@@ -2,34 +2,65 @@ package template
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/kelseyhightower/memkv"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/xordataexchange/crypt/encoding/secconf"
 	"github.com/zyf0330/confd/backends"
 	"github.com/zyf0330/confd/log"
 	"github.com/zyf0330/confd/util"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
 type Config struct {
-	ConfDir       string `toml:"confdir"`
-	ConfigDir     string
+	// Seconds a cycle may spend reading a template resource's keys from
+	// the backend, no limit if 0
+	BackendTimeout int `toml:"backend_timeout"`
+	// Seconds the check command may run before it is killed and the
+	// check fails, no limit if 0
+	CheckCmdTimeout int    `toml:"check_cmd_timeout"`
+	ConfDir         string `toml:"confdir"`
+	ConfigDir       string
+	// Print a unified diff of the pending changes to stdout, implies Noop
+	Diff          bool `toml:"diff"`
+	Health        *Health
 	KeepStageFile bool
-	Noop          bool   `toml:"noop"`
-	Prefix        string `toml:"prefix"`
-	StoreClient   backends.StoreClient
-	SyncOnly      bool `toml:"sync-only"`
-	TemplateDir   string
+	Noop          bool `toml:"noop"`
+	// Run once after the template resources processed together wrote
+	// their files
+	OnchangeCmd string `toml:"onchange_cmd"`
+	Prefix      string `toml:"prefix"`
+	// Times a failed reload command is run again, and the milliseconds to
+	// wait before the first retry, doubled on each retry
+	ReloadRetries       int `toml:"reload_retries"`
+	ReloadRetryInterval int `toml:"reload_retry_interval"`
+	StoreClient         backends.StoreClient
+	SyncOnly            bool `toml:"sync-only"`
+	TemplateDir         string
+	// Milliseconds the watch processor waits after a change for more
+	// before processing a template resource, each one restarting the wait
+	WatchDebounce int `toml:"watch_debounce"`
+	// Template resources of the same priority processed at once by
+	// Process and the interval processor, one after another if 1 or less
+	Workers       int `toml:"workers"`
 	PGPPrivateKey []byte
 }
 
@@ -40,25 +71,44 @@ type TemplateResourceConfig struct {
 
 // TemplateResource is the representation of a parsed template resource.
 type TemplateResource struct {
-	CheckCmd      string `toml:"check_cmd"`
-	Dest          string
-	FileMode      os.FileMode
-	Gid           int
-	Keys          []string
-	Mode          string
-	Prefix        string
-	ReloadCmd     string `toml:"reload_cmd"`
-	Src           string
-	StageFile     *os.File
-	Uid           int
-	funcMap       map[string]interface{}
-	lastIndex     uint64
-	keepStageFile bool
-	noop          bool
-	store         memkv.Store
-	storeClient   backends.StoreClient
-	syncOnly      bool
-	PGPPrivateKey []byte
+	CheckCmd  string `toml:"check_cmd"`
+	Dest      string
+	FileMode  os.FileMode
+	Gid       int
+	Group     string `toml:"group"`
+	Keys      []string
+	Mode      string
+	Owner     string `toml:"owner"`
+	Prefix    string `toml:"prefix"`
+	Priority  int    `toml:"priority"`
+	ReloadCmd string `toml:"reload_cmd"`
+	Src       string
+	StageFile *os.File
+	Uid       int
+	// The uid and gid of the config, -1 to keep those of dest
+	uid            int
+	gid            int
+	backendTimeout time.Duration
+	checkTimeout   time.Duration
+	reloadRetries  int
+	reloadInterval time.Duration
+	diff           bool
+	funcMap        map[string]interface{}
+	health         *Health
+	logger         *log.Logger
+	lastIndex      uint64
+	name           string
+	path           string
+	keepStageFile  bool
+	noop           bool
+	store          memkv.Store
+	storeClient    backends.StoreClient
+	syncOnly       bool
+	written        bool              // whether the last process wrote dest
+	changed        []string          // the dests written before in the same cycle
+	prefetched     map[string]string // the values of the cycle, nil to read them
+	values         string            // the digest of the values read by setVars
+	PGPPrivateKey  []byte
 }
 
 var ErrEmptySrc = errors.New("empty src template")
@@ -74,43 +124,73 @@ func NewTemplateResource(path string, config Config) (*TemplateResource, error)
 	tc := &TemplateResourceConfig{TemplateResource{Uid: -1, Gid: -1}}
 
 	log.Debug("Loading template resource from " + path)
-	_, err := toml.DecodeFile(path, &tc)
+	md, err := toml.DecodeFile(path, &tc)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
 	}
+	// A misspelled key would otherwise be ignored
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("Cannot process template resource %s - unknown keys: %s", path, strings.Join(keys, ", "))
+	}
 
-	tr := tc.TemplateResource
+	tr := &tc.TemplateResource
+	tr.name = filepath.Base(path)
+	tr.path = path
+	tr.health = config.Health
+	tr.logger = log.WithField("template", tr.name)
+	tr.backendTimeout = time.Duration(config.BackendTimeout) * time.Second
+	tr.checkTimeout = time.Duration(config.CheckCmdTimeout) * time.Second
+	tr.reloadRetries = config.ReloadRetries
+	tr.reloadInterval = time.Duration(config.ReloadRetryInterval) * time.Millisecond
 	tr.keepStageFile = config.KeepStageFile
-	tr.noop = config.Noop
+	tr.noop = config.Noop || config.Diff
+	tr.diff = config.Diff
 	tr.storeClient = config.StoreClient
 	tr.funcMap = newFuncMap()
 	tr.store = memkv.New()
 	tr.syncOnly = config.SyncOnly
 	addFuncs(tr.funcMap, tr.store.FuncMap)
+	tr.funcMap["getvs"] = getvs(&tr.store)
+	addJSONFuncs(tr)
 
-	if config.Prefix != "" {
+	// The prefix of the resource wins over the global one
+	if tr.Prefix == "" {
 		tr.Prefix = config.Prefix
 	}
 
 	if len(config.PGPPrivateKey) > 0 {
 		tr.PGPPrivateKey = config.PGPPrivateKey
-		addCryptFuncs(&tr)
+		addCryptFuncs(tr)
 	}
 
 	if tr.Src == "" {
 		return nil, ErrEmptySrc
 	}
 
-	if tr.Uid == -1 {
-		tr.Uid = os.Geteuid()
+	if tr.Owner != "" {
+		if tr.Uid != -1 {
+			return nil, fmt.Errorf("Cannot process template resource %s - both uid and owner are set", path)
+		}
+		if tr.Uid, err = lookupUser(tr.Owner); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err)
+		}
 	}
-
-	if tr.Gid == -1 {
-		tr.Gid = os.Getegid()
+	if tr.Group != "" {
+		if tr.Gid != -1 {
+			return nil, fmt.Errorf("Cannot process template resource %s - both gid and group are set", path)
+		}
+		if tr.Gid, err = lookupGroup(tr.Group); err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err)
+		}
 	}
+	tr.uid, tr.gid = tr.Uid, tr.Gid
 
 	tr.Src = filepath.Join(config.TemplateDir, tr.Src)
-	return &tr, nil
+	return tr, nil
 }
 
 func addCryptFuncs(tr *TemplateResource) {
@@ -150,6 +230,17 @@ func addCryptFuncs(tr *TemplateResource) {
 			}
 			return v, err
 		},
+		"cryptgetv": func(key string) (string, error) {
+			v, err := tr.funcMap["getv"].(func(string, ...string) (string, error))(key)
+			if err != nil {
+				return "", err
+			}
+			b, err := decryptArmored(v, tr.PGPPrivateKey)
+			if err != nil {
+				return "", fmt.Errorf("cannot decrypt the value of %s: %s", key, err)
+			}
+			return string(b), nil
+		},
 		"cgetvs": func(pattern string) ([]string, error) {
 			vs, err := tr.funcMap["getvs"].(func(string) ([]string, error))(pattern)
 			if err == nil {
@@ -166,18 +257,122 @@ func addCryptFuncs(tr *TemplateResource) {
 	})
 }
 
-// setVars sets the Vars for template resource.
-func (t *TemplateResource) setVars() error {
+// decryptArmored decrypts the ASCII-armored PGP message value, as written
+// by gpg --encrypt --armor, with the armored secret keyring.
+func decryptArmored(value string, keyring []byte) ([]byte, error) {
+	block, err := armor.Decode(strings.NewReader(value))
+	if err != nil {
+		return nil, fmt.Errorf("not an armored PGP message: %s", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return nil, fmt.Errorf("armored %s, want a PGP MESSAGE", block.Type)
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyring))
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, entities, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+// addJSONFuncs replaces json and jsonArray with functions naming the keys
+// holding the value in their errors, as the value is usually piped from
+// getv.
+func addJSONFuncs(tr *TemplateResource) {
+	addFuncs(tr.funcMap, map[string]interface{}{
+		"json": func(data string) (map[string]interface{}, error) {
+			ret, err := UnmarshalJsonObject(data)
+			if err != nil {
+				return nil, tr.jsonError(data, err)
+			}
+			return ret, nil
+		},
+		"jsonArray": func(data string) ([]interface{}, error) {
+			ret, err := UnmarshalJsonArray(data)
+			if err != nil {
+				return nil, tr.jsonError(data, err)
+			}
+			return ret, nil
+		},
+	})
+}
+
+// jsonError returns err naming the keys of the store holding data. The
+// keys of the resource are only walked once parsing failed.
+func (t *TemplateResource) jsonError(data string, err error) error {
+	found := make(map[string]bool)
+	check := func(key string) {
+		if kv, err := t.store.Get(key); err == nil && kv.Value == data {
+			found[key] = true
+		}
+	}
+	var walk func(dir string)
+	walk = func(dir string) {
+		check(dir)
+		for _, name := range t.store.List(dir) {
+			check(path.Join(dir, name))
+		}
+		for _, name := range t.store.ListDir(dir) {
+			walk(path.Join(dir, name))
+		}
+	}
+	for _, key := range t.Keys {
+		walk(path.Join("/", key))
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("cannot parse the value as JSON: %s", err)
+	}
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("cannot parse the value of %s as JSON: %s", strings.Join(keys, ", "), err)
+}
+
+// setVars sets the Vars for template resource, reading them within ctx.
+func (t *TemplateResource) setVars(ctx context.Context) error {
 	var err error
-	log.Debug("Retrieving keys from store")
-	log.Debug("Key prefix set to " + t.Prefix)
+	t.logger.Debug("Retrieving keys from store")
+	t.logger.Debug("Key prefix set to " + t.Prefix)
 
-	result, err := t.storeClient.GetValues(util.AppendPrefix(t.Prefix, t.Keys))
-	if err != nil {
-		return err
+	if t.backendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.backendTimeout)
+		defer cancel()
+	}
+	keys := util.AppendPrefix(t.Prefix, t.Keys)
+	var result map[string]string
+	if t.prefetched != nil {
+		result = make(map[string]string)
+		for k, v := range t.prefetched {
+			if hasPrefix(k, keys) {
+				result[k] = v
+			}
+		}
+	} else {
+		start := time.Now()
+		result, err = t.storeClient.GetValues(ctx, keys)
+		getValuesDuration.WithLabelValues(t.name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			return &BackendError{err}
+		}
+	}
+	if backends.IsSecret(t.storeClient) {
+		keys := make([]string, 0, len(result))
+		for k := range result {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.logger.Debug("Got the following keys from store: %v", keys)
+	} else {
+		t.logger.Debug("Got the following map from store: %v", result)
 	}
-	log.Debug("Got the following map from store: %v", result)
 
+	t.values = util.HashValues(result)
 	t.store.Purge()
 
 	for k, v := range result {
@@ -186,18 +381,28 @@ func (t *TemplateResource) setVars() error {
 	return nil
 }
 
+// hasPrefix reports whether key starts with one of prefixes.
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // createStageFile stages the src configuration file by processing the src
 // template and setting the desired owner, group, and mode. It also sets the
 // StageFile for the template resource.
 // It returns an error if any.
 func (t *TemplateResource) createStageFile() error {
-	log.Debug("Using source template " + t.Src)
+	t.logger.Debug("Using source template " + t.Src)
 
 	if !util.IsFileExist(t.Src) {
 		return errors.New("Missing template: " + t.Src)
 	}
 
-	log.Debug("Compiling source template " + t.Src)
+	t.logger.Debug("Compiling source template " + t.Src)
 
 	tmpl, err := template.New(filepath.Base(t.Src)).Funcs(t.funcMap).ParseFiles(t.Src)
 	if err != nil {
@@ -218,47 +423,76 @@ func (t *TemplateResource) createStageFile() error {
 	defer temp.Close()
 
 	// Set the owner, group, and mode on the stage file now to make it easier to
-	// compare against the destination configuration file later.
-	os.Chmod(temp.Name(), t.FileMode)
-	os.Chown(temp.Name(), t.Uid, t.Gid)
+	// compare against the destination configuration file later. The stage file
+	// replaces the destination as it is, readers never see it with other ones.
+	if err := os.Chmod(temp.Name(), t.FileMode); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := t.chown(temp.Name()); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
 	t.StageFile = temp
 	return nil
 }
 
+// chown gives the file to the uid and gid of the template resource. Files
+// have no owner on Windows.
+func (t *TemplateResource) chown(name string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	err := os.Chown(name, t.Uid, t.Gid)
+	if os.IsPermission(err) {
+		return fmt.Errorf("cannot give %s to uid %d and gid %d, confd is not allowed to change the owner of files, e.g. it does not run as root: %s", t.Dest, t.Uid, t.Gid, err)
+	}
+	return err
+}
+
 // sync compares the staged and dest config files and attempts to sync them
 // if they differ. sync will run a config check command if set before
 // overwriting the target config file. Finally, sync will run a reload command
-// if set to have the application or service pick up the changes.
+// if set to have the application or service pick up the changes, waiting
+// for its retries within ctx.
 // It returns an error if any.
-func (t *TemplateResource) sync() error {
+func (t *TemplateResource) sync(ctx context.Context) error {
 	staged := t.StageFile.Name()
 	if t.keepStageFile {
-		log.Info("Keeping staged file: " + staged)
+		t.logger.Info("Keeping staged file: " + staged)
 	} else {
 		defer os.Remove(staged)
 	}
 
-	log.Debug("Comparing candidate config to " + t.Dest)
+	t.logger.Debug("Comparing candidate config to " + t.Dest)
 	ok, err := util.IsConfigChanged(staged, t.Dest)
 	if err != nil {
-		log.Error(err.Error())
+		t.logger.Error(err.Error())
 	}
 	if t.noop {
-		log.Warning("Noop mode enabled. " + t.Dest + " will not be modified")
+		if ok && t.diff {
+			if err := t.printDiff(staged); err != nil {
+				t.logger.Error(err.Error())
+			}
+		}
+		t.logger.Warning("Noop mode enabled. " + t.Dest + " will not be modified")
 		return nil
 	}
 	if ok {
-		log.Info("Target config " + t.Dest + " out of sync")
+		t.logger.Info("Target config " + t.Dest + " out of sync")
 		if !t.syncOnly && t.CheckCmd != "" {
 			if err := t.check(); err != nil {
-				return errors.New("Config check failed: " + err.Error())
+				commandFailures.WithLabelValues(t.name, "check").Inc()
+				return &CheckError{err}
 			}
 		}
-		log.Debug("Overwriting target config " + t.Dest)
+		t.logger.Debug("Overwriting target config " + t.Dest)
 		err := os.Rename(staged, t.Dest)
 		if err != nil {
 			if strings.Contains(err.Error(), "device or resource busy") {
-				log.Debug("Rename failed - target is likely a mount. Trying to write instead")
+				t.logger.Debug("Rename failed - target is likely a mount. Trying to write instead")
 				// try to open the file and write to it
 				var contents []byte
 				var rerr error
@@ -266,34 +500,95 @@ func (t *TemplateResource) sync() error {
 				if rerr != nil {
 					return rerr
 				}
-				err := ioutil.WriteFile(t.Dest, contents, t.FileMode)
-				// make sure owner and group match the temp file, in case the file was created with WriteFile
-				os.Chown(t.Dest, t.Uid, t.Gid)
-				if err != nil {
+				if err := ioutil.WriteFile(t.Dest, contents, t.FileMode); err != nil {
+					return err
+				}
+				// make sure mode, owner and group match the temp file, WriteFile
+				// only sets the mode of a new file
+				if err := os.Chmod(t.Dest, t.FileMode); err != nil {
+					return err
+				}
+				if err := t.chown(t.Dest); err != nil {
 					return err
 				}
 			} else {
 				return err
 			}
 		}
+		templateWrites.WithLabelValues(t.name).Inc()
+		t.written = true
 		if !t.syncOnly && t.ReloadCmd != "" {
-			if err := t.reload(); err != nil {
+			if err := t.reload(ctx); err != nil {
+				commandFailures.WithLabelValues(t.name, "reload").Inc()
 				return err
 			}
 		}
-		log.Info("Target config " + t.Dest + " has been updated")
+		t.logger.Info("Target config " + t.Dest + " has been updated")
 	} else {
-		log.Debug("Target config " + t.Dest + " in sync")
+		t.logger.Debug("Target config " + t.Dest + " in sync")
 	}
 	return nil
 }
 
+// diffOutput is where printDiff prints the diffs.
+var diffOutput io.Writer = os.Stdout
+
+// printDiff prints a unified diff of the dest config file, empty if it does
+// not exist, and the staged one to stdout. Only the mode or owner may have
+// changed, it then prints nothing. The values of a secret store are not
+// shown, only that the content of dest changed.
+func (t *TemplateResource) printDiff(staged string) error {
+	current, err := ioutil.ReadFile(t.Dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rendered, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return err
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(string(current)),
+		B:        splitLines(string(rendered)),
+		FromFile: t.Dest,
+		FromDate: "current",
+		ToFile:   t.Dest,
+		ToDate:   "rendered",
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	if diff != "" && backends.IsSecret(t.storeClient) {
+		diff = "Content of " + t.Dest + " changed, not shown as it holds secrets\n"
+	}
+	// One write so that the diffs of templates processed at once do not
+	// interleave
+	_, err = io.WriteString(diffOutput, diff)
+	return err
+}
+
+// splitLines splits s after its newlines, ending the last line with one if
+// it has none.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n"
+	}
+	return lines
+}
+
 // check executes the check command to validate the staged config file. The
 // command is modified so that any references to src template are substituted
 // with a string representing the full path of the staged file. This allows the
 // check to be run on the staged file before overwriting the destination config
 // file.
-// It returns nil if the check command returns 0 and there are no other errors.
+// It returns nil if the check command returns 0 within checkTimeout and
+// there are no other errors.
 func (t *TemplateResource) check() error {
 	var cmdBuffer bytes.Buffer
 	data := make(map[string]string)
@@ -305,34 +600,78 @@ func (t *TemplateResource) check() error {
 	if err := tmpl.Execute(&cmdBuffer, data); err != nil {
 		return err
 	}
-	return runCommand(cmdBuffer.String())
+	return runCommand(t.logger, cmdBuffer.String(), t.checkTimeout, t.commandEnv())
 }
 
-// reload executes the reload command.
+// reload executes the reload command, and runs it again up to
+// reloadRetries times while it fails, e.g. as the service is not ready
+// yet, waiting according to util.Backoff in between. Once ctx is done it
+// stops retrying and returns the last failure.
 // It returns nil if the reload command returns 0.
-func (t *TemplateResource) reload() error {
-	return runCommand(t.ReloadCmd)
+func (t *TemplateResource) reload(ctx context.Context) error {
+	err := runCommand(t.logger, t.ReloadCmd, 0, t.commandEnv())
+	for i := 0; err != nil && i < t.reloadRetries; i++ {
+		wait := util.Backoff(t.reloadInterval, i)
+		t.logger.Warning(fmt.Sprintf("Reload command failed, retrying in %s: %s", wait, err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		err = runCommand(t.logger, t.ReloadCmd, 0, t.commandEnv())
+	}
+	return err
+}
+
+// commandEnv returns the environment variables telling the check and
+// reload commands the destination being changed, $CONFD_DEST, and the
+// destinations changed in the cycle so far, this one included,
+// space-separated in $CONFD_CHANGED.
+func (t *TemplateResource) commandEnv() []string {
+	changed := append(append([]string(nil), t.changed...), t.Dest)
+	return []string{
+		"CONFD_DEST=" + t.Dest,
+		"CONFD_CHANGED=" + strings.Join(changed, " "),
+	}
 }
 
 // runCommand is a shared function used by check and reload
 // to run the given command and log its output.
-// It returns nil if the given cmd returns 0.
+// It returns nil if the given cmd returns 0. A command running longer than
+// a timeout other than 0 is killed, with the processes it started, and
+// fails. env is added to the environment of the command.
 // The command can be run on unix and windows.
-func runCommand(cmd string) error {
-	log.Debug("Running " + cmd)
+func runCommand(logger *log.Logger, cmd string, timeout time.Duration, env []string) error {
+	logger.Debug("Running " + cmd)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	var c *exec.Cmd
 	if runtime.GOOS == "windows" {
-		c = exec.Command("cmd", "/C", cmd)
+		c = exec.CommandContext(ctx, "cmd", "/C", cmd)
 	} else {
-		c = exec.Command("/bin/sh", "-c", cmd)
+		c = exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	}
+	if env != nil {
+		c.Env = append(os.Environ(), env...)
 	}
+	killProcessGroup(c)
+	// Do not wait for the processes of a killed command holding its output
+	c.WaitDelay = time.Second
 
 	output, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Error(fmt.Sprintf("%q", string(output)))
+		return fmt.Errorf("%s did not exit within %s", cmd, timeout)
+	}
 	if err != nil {
-		log.Error(fmt.Sprintf("%q", string(output)))
+		logger.Error(fmt.Sprintf("%q", string(output)))
 		return err
 	}
-	log.Debug(fmt.Sprintf("%q", string(output)))
+	logger.Debug(fmt.Sprintf("%q", string(output)))
 	return nil
 }
 
@@ -340,25 +679,56 @@ func runCommand(cmd string) error {
 // required to keep local configuration files in sync. First we gather vars
 // from the store, then we stage a candidate configuration file, and finally sync
 // things up.
-// It returns an error if any.
-func (t *TemplateResource) process() error {
+// The store is read within ctx. It returns an error if any.
+func (t *TemplateResource) process(ctx context.Context) error {
+	t.written = false
 	if err := t.setFileMode(); err != nil {
 		return err
 	}
-	if err := t.setVars(); err != nil {
+	if err := t.setVars(ctx); err != nil {
 		return err
 	}
+	if !t.noop {
+		if renderCache.hit(t.path, t.fingerprint()) {
+			renderCacheHits.WithLabelValues(t.name).Inc()
+			t.logger.Debug("Values unchanged since the last rendering, " + t.Dest + " is in sync")
+			return nil
+		}
+		renderCacheMisses.WithLabelValues(t.name).Inc()
+		// Render again if this one fails
+		renderCache.invalidate(t.path)
+	}
 	if err := t.createStageFile(); err != nil {
 		return err
 	}
-	if err := t.sync(); err != nil {
+	if err := t.sync(ctx); err != nil {
 		return err
 	}
+	if !t.noop {
+		renderCache.set(t.path, t.fingerprint())
+	}
 	return nil
 }
 
-// setFileMode sets the FileMode.
+// setFileMode sets the FileMode, Uid and Gid: those of the config, else
+// those of the existing dest, else 0644 and the effective uid and gid.
 func (t *TemplateResource) setFileMode() error {
+	t.Uid, t.Gid = t.uid, t.gid
+	if t.Uid == -1 || t.Gid == -1 {
+		uid, gid, err := util.FileOwner(t.Dest)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || uid == -1 {
+			uid, gid = os.Geteuid(), os.Getegid()
+		}
+		if t.Uid == -1 {
+			t.Uid = uid
+		}
+		if t.Gid == -1 {
+			t.Gid = gid
+		}
+	}
 	if t.Mode == "" {
 		if !util.IsFileExist(t.Dest) {
 			t.FileMode = 0644
@@ -378,3 +748,27 @@ func (t *TemplateResource) setFileMode() error {
 	}
 	return nil
 }
+
+// lookupUser returns the uid of the user name, which may be a uid.
+func lookupUser(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of the group name, which may be a gid.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
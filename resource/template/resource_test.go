@@ -0,0 +1,435 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/backends"
+	"github.com/zyf0330/confd/backends/env"
+	"github.com/zyf0330/confd/log"
+	"github.com/zyf0330/confd/util"
+)
+
+func TestNewTemplateResourceUnknownKeys(t *testing.T) {
+	log.SetLevel("warn")
+	dir, err := ioutil.TempDir("", "confd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeClient, _ := env.NewEnvClient()
+	config := Config{StoreClient: storeClient, TemplateDir: dir}
+
+	tests := []struct {
+		reloadKey string
+		wantErr   string
+	}{
+		{"reload_cmd", ""},
+		{"reload-cmd", "unknown keys: template.reload-cmd"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "myapp.toml")
+		resource := `[template]
+src = "myapp.conf.tmpl"
+dest = "/tmp/myapp.conf"
+keys = ["/myapp"]
+` + tt.reloadKey + ` = "systemctl reload myapp"
+`
+		if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tr, err := NewTemplateResource(path, config)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("NewTemplateResource() with %s failed: %s", tt.reloadKey, err)
+			} else if tr.ReloadCmd != "systemctl reload myapp" {
+				t.Errorf("ReloadCmd = %q, want %q", tr.ReloadCmd, "systemctl reload myapp")
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), path) {
+			t.Errorf("NewTemplateResource() with %s = %v, want an error naming %s and %q", tt.reloadKey, err, path, tt.wantErr)
+		}
+	}
+}
+
+func TestProcessResourcePrefix(t *testing.T) {
+	log.SetLevel("warn")
+	dir, err := ioutil.TempDir("", "confd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"PRODUCTION_DATABASE_URL": "prod.example.com",
+		"STAGING_DATABASE_URL":    "staging.example.com",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	files := map[string]string{
+		"myapp.conf.tmpl": `{{getv "/database/url"}}`,
+		// Uses the global prefix
+		"conf.d/production.toml": `[template]
+src = "myapp.conf.tmpl"
+dest = "` + filepath.Join(dir, "production.conf") + `"
+keys = ["/database"]
+`,
+		"conf.d/staging.toml": `[template]
+src = "myapp.conf.tmpl"
+dest = "` + filepath.Join(dir, "staging.conf") + `"
+keys = ["/database"]
+prefix = "/staging"
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storeClient, _ := env.NewEnvClient()
+	config := Config{
+		ConfDir:     dir,
+		ConfigDir:   confDir,
+		TemplateDir: dir,
+		Prefix:      "/production",
+		StoreClient: storeClient,
+	}
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"production.conf": "prod.example.com",
+		"staging.conf":    "staging.example.com",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestProcessSeveralKeys(t *testing.T) {
+	log.SetLevel("warn")
+	dir, err := ioutil.TempDir("", "confd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"SHARED_DOMAIN":   "example.com",
+		"APP_FOO_PORT":    "8080",
+		"APP_BAR_PORT":    "9090",
+		"UNRELATED_VALUE": "secret",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	dest := filepath.Join(dir, "foo.conf")
+	files := map[string]string{
+		"foo.conf.tmpl": `{{getv "/shared/domain"}}:{{getv "/app/foo/port"}} {{len (ls "/app")}} {{exists "/unrelated/value"}}`,
+		// The overlapping /app/foo/port is read once
+		"conf.d/foo.toml": `[template]
+src = "foo.conf.tmpl"
+dest = "` + dest + `"
+keys = ["/shared", "/app/foo", "/app/foo/port"]
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storeClient, _ := env.NewEnvClient()
+	config := Config{ConfDir: dir, ConfigDir: confDir, TemplateDir: dir, StoreClient: storeClient}
+	if err := Process(config); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com:8080 1 false"; string(b) != want {
+		t.Errorf("foo.conf = %q, want %q", b, want)
+	}
+}
+
+// newOwnerTest writes a template resource rendering myapp.conf with the
+// given settings, and returns it and the path of the rendered file.
+func newOwnerTest(t *testing.T, settings string) (*TemplateResource, string) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "myapp.conf")
+	path := filepath.Join(dir, "myapp.toml")
+	resource := `[template]
+src = "myapp.conf.tmpl"
+dest = "` + dest + `"
+keys = ["/myapp"]
+` + settings
+	if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "myapp.conf.tmpl"), []byte("rendered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeClient, _ := env.NewEnvClient()
+	tr, err := NewTemplateResource(path, Config{StoreClient: storeClient, TemplateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, dest
+}
+
+func TestProcessMode(t *testing.T) {
+	log.SetLevel("warn")
+	tr, dest := newOwnerTest(t, `mode = "0640"`)
+	if err := tr.process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode of %s = %s, want -rw-r-----", dest, fi.Mode())
+	}
+	// The stage file was renamed to dest, not left behind
+	stages, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), ".myapp.conf*"))
+	if len(stages) > 0 {
+		t.Errorf("stage files %v left behind", stages)
+	}
+
+	// Without a mode, that of the existing file is kept
+	tr, dest = newOwnerTest(t, "")
+	if err := ioutil.WriteFile(dest, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode of the replaced %s = %v, %v, want the mode of the old file -rw-------", dest, fi.Mode(), err)
+	}
+}
+
+func TestProcessOwner(t *testing.T) {
+	log.SetLevel("warn")
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	tr, dest := newOwnerTest(t, `owner = "`+u.Username+`"
+group = "`+g.Name+`"
+`)
+	if err := tr.process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, err := util.FileOwner(dest)
+	if err != nil || strconv.Itoa(uid) != u.Uid || strconv.Itoa(gid) != u.Gid {
+		t.Errorf("owner of %s = %d:%d, %v, want %s:%s", dest, uid, gid, err, u.Uid, u.Gid)
+	}
+
+	if os.Geteuid() == 0 {
+		// root may give the file to anyone
+		return
+	}
+	tr, dest = newOwnerTest(t, `owner = "0"`)
+	err = tr.process(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not allowed to change the owner") {
+		t.Errorf("process() giving the file to root = %v, want a permission error", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("%s was written without its owner", dest)
+	}
+}
+
+func TestNewTemplateResourceOwnerErrors(t *testing.T) {
+	log.SetLevel("warn")
+	dir := t.TempDir()
+	storeClient, _ := env.NewEnvClient()
+	for _, settings := range []string{
+		"uid = 0\nowner = \"root\"",
+		"gid = 0\ngroup = \"root\"",
+		"owner = \"no-such-user-confd\"",
+	} {
+		path := filepath.Join(dir, "myapp.toml")
+		resource := "[template]\nsrc = \"myapp.conf.tmpl\"\ndest = \"/tmp/myapp.conf\"\nkeys = [\"/myapp\"]\n" + settings + "\n"
+		if err := ioutil.WriteFile(path, []byte(resource), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewTemplateResource(path, Config{StoreClient: storeClient, TemplateDir: dir}); err == nil {
+			t.Errorf("NewTemplateResource() with %q succeeded", settings)
+		}
+	}
+}
+
+func TestProcessCheckCmdTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the check command uses sleep")
+	}
+	log.SetLevel("fatal")
+	for _, keep := range []bool{false, true} {
+		tr, dest := newOwnerTest(t, `check_cmd = "sleep 10 & sleep 10"`)
+		tr.checkTimeout = 100 * time.Millisecond
+		tr.keepStageFile = keep
+
+		start := time.Now()
+		err := tr.process(context.Background())
+		if _, ok := err.(*CheckError); !ok || !strings.Contains(err.Error(), "did not exit within 100ms") {
+			t.Errorf("process() with a hung check = %v, want a failed check", err)
+		}
+		// The sleep in the background is killed too, it would otherwise
+		// hold the output until the WaitDelay
+		if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+			t.Errorf("process() with a hung check returned after %s", elapsed)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("%s was written despite the failed check", dest)
+		}
+		stages, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), ".myapp.conf*"))
+		if keep && len(stages) != 1 {
+			t.Errorf("stage files %v, want the one kept", stages)
+		} else if !keep && len(stages) > 0 {
+			t.Errorf("stage files %v left behind", stages)
+		}
+	}
+}
+
+func TestProcessReloadRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the reload command is a shell script")
+	}
+	log.SetLevel("fatal")
+	// The reload command fails twice, then succeeds
+	counter := filepath.Join(t.TempDir(), "reloads")
+	reload := `n=$(cat ` + counter + ` 2>/dev/null || echo 0); n=$((n+1)); echo $n > ` + counter + `; [ $n -ge 3 ]`
+	tr, _ := newOwnerTest(t, "reload_cmd = '"+reload+"'")
+	tr.reloadRetries = 2
+	tr.reloadInterval = time.Millisecond
+	if err := tr.process(context.Background()); err != nil {
+		t.Fatalf("process() with a reload command succeeding on the third run = %v", err)
+	}
+	if b, _ := ioutil.ReadFile(counter); strings.TrimSpace(string(b)) != "3" {
+		t.Errorf("reload command run %s times, want 3", b)
+	}
+
+	os.Remove(counter)
+	tr, _ = newOwnerTest(t, "reload_cmd = '"+reload+"'")
+	tr.reloadRetries = 1
+	tr.reloadInterval = time.Millisecond
+	if err := tr.process(context.Background()); err == nil {
+		t.Error("process() with a reload command failing past the retries succeeded")
+	}
+	if b, _ := ioutil.ReadFile(counter); strings.TrimSpace(string(b)) != "2" {
+		t.Errorf("reload command run %s times, want 2", b)
+	}
+	// Stopping confd does not wait for the retries
+	os.Remove(counter)
+	tr, _ = newOwnerTest(t, "reload_cmd = '"+reload+"'")
+	tr.reloadRetries = 5
+	tr.reloadInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := tr.process(ctx); err == nil {
+		t.Error("process() stopped while retrying the reload command succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("process() stopped while retrying returned after %s", elapsed)
+	}
+	if b, _ := ioutil.ReadFile(counter); strings.TrimSpace(string(b)) != "1" {
+		t.Errorf("reload command run %s times, want once", b)
+	}
+}
+
+// secretClient is a StoreClient whose values are secrets.
+type secretClient struct {
+	backends.StoreClient
+}
+
+func (secretClient) Secret() bool {
+	return true
+}
+
+func TestProcessDiff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the check and reload commands use touch")
+	}
+	log.SetLevel("fatal")
+	defer func(w io.Writer) { diffOutput = w }(diffOutput)
+
+	tests := []struct {
+		diff, secret bool
+	}{
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+	for _, tt := range tests {
+		marker := filepath.Join(t.TempDir(), "ran")
+		tr, dest := newOwnerTest(t, `check_cmd = "touch `+marker+`"
+reload_cmd = "touch `+marker+`"`)
+		tr.noop, tr.diff = true, tt.diff
+		if tt.secret {
+			tr.storeClient = secretClient{tr.storeClient}
+		}
+		if err := ioutil.WriteFile(dest, []byte("current\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		diffOutput = &out
+		if err := tr.process(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case !tt.diff:
+			if out.Len() > 0 {
+				t.Errorf("noop mode printed %q", out.String())
+			}
+		case tt.secret:
+			want := "Content of " + dest + " changed, not shown as it holds secrets\n"
+			if out.String() != want {
+				t.Errorf("diff of a secret store = %q, want %q", out.String(), want)
+			}
+		default:
+			for _, want := range []string{"--- " + dest + "\tcurrent\n", "+++ " + dest + "\trendered\n", "-current\n", "+rendered\n"} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("diff = %q, want it to contain %q", out.String(), want)
+				}
+			}
+		}
+		if b, _ := ioutil.ReadFile(dest); string(b) != "current\n" {
+			t.Errorf("%s = %q in noop mode, want it unchanged", dest, b)
+		}
+		if _, err := os.Stat(marker); !os.IsNotExist(err) {
+			t.Errorf("check_cmd or reload_cmd run in noop mode (diff: %v, secret: %v)", tt.diff, tt.secret)
+		}
+	}
+}
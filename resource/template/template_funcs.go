@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
@@ -39,7 +40,10 @@ func newFuncMap() map[string]interface{} {
 	m["lookupIP"] = LookupIP
 	m["lookupIPV4"] = LookupIPV4
 	m["lookupIPV6"] = LookupIPV6
-	m["lookupSRV"] = LookupSRV
+	m["lookupSRV"] = lookupSRV
+	m["parseIP"] = ParseIP
+	m["cidrContains"] = CIDRContains
+	m["cidrHost"] = CIDRHost
 	m["fileExists"] = util.IsFileExist
 	m["base64Encode"] = Base64Encode
 	m["base64Decode"] = Base64Decode
@@ -161,6 +165,23 @@ func Getenv(key string, v ...string) string {
 	return value
 }
 
+// getvs returns the getvs function of store, which unlike that of memkv
+// orders the values by key like gets does. Keys are unique, so a value
+// keeps its place when it changes, and the others do not move.
+func getvs(store *memkv.Store) func(pattern string) ([]string, error) {
+	return func(pattern string) ([]string, error) {
+		kvs, err := store.GetAll(pattern)
+		if err != nil {
+			return []string{}, err
+		}
+		vs := make([]string, len(kvs))
+		for i, kv := range kvs {
+			vs[i] = kv.Value
+		}
+		return vs, nil
+	}
+}
+
 // CreateMap creates a key-value map of string -> interface{}
 // The i'th is the key and the i+1 is the value
 func CreateMap(values ...interface{}) (map[string]interface{}, error) {
@@ -225,6 +246,58 @@ func LookupIPV4(data string) []string {
 	return addresses
 }
 
+// ParseIP parses s as an IPv4 or IPv6 address.
+func ParseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+	return ip, nil
+}
+
+// CIDRContains reports whether the network cidr contains ip, given as a
+// string or as returned by parseIP.
+func CIDRContains(cidr string, ip interface{}) (bool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	var addr net.IP
+	switch ip := ip.(type) {
+	case net.IP:
+		addr = ip
+	case string:
+		if addr, err = ParseIP(ip); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("cannot use %v as an IP address", ip)
+	}
+	return network.Contains(addr), nil
+}
+
+// CIDRHost returns the address of the host number n of the network cidr,
+// counting from its last address if n is negative.
+func CIDRHost(cidr string, n int) (net.IP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	host := big.NewInt(int64(n))
+	if n < 0 {
+		host.Add(host, size)
+	}
+	if host.Sign() < 0 || host.Cmp(size) >= 0 {
+		return nil, fmt.Errorf("%s has no host number %d", cidr, n)
+	}
+	host.Add(host, new(big.Int).SetBytes(network.IP))
+	ip := make(net.IP, len(network.IP))
+	host.FillBytes(ip)
+	return ip, nil
+}
+
 type sortSRV []*net.SRV
 
 func (s sortSRV) Len() int {
@@ -250,11 +323,81 @@ func LookupSRV(service, proto, name string) []*net.SRV {
 	return addrs
 }
 
+// resolveSRV resolves the SRV records of LookupSRVRecord, replaced in tests.
+var resolveSRV = net.LookupSRV
+
+// LookupSRVRecord returns the host:port addresses of the targets of the SRV
+// record, e.g. _http._tcp.example.com, by priority, the lowest first, then
+// by weight, the highest first. Unlike the random order of the resolver
+// within a priority, those of the same weight are sorted by address, so
+// that the rendered files do not change on every lookup.
+func LookupSRVRecord(record string) ([]string, error) {
+	_, addrs, err := resolveSRV("", "", record)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := addrs[i], addrs[j]
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority < b.Priority
+		case a.Weight != b.Weight:
+			return a.Weight > b.Weight
+		case a.Target != b.Target:
+			return a.Target < b.Target
+		}
+		return a.Port < b.Port
+	})
+	return util.SRVAddrs(addrs), nil
+}
+
+// lookupSRV is LookupSRVRecord given a whole record, and LookupSRV given a
+// service, protocol and name.
+func lookupSRV(args ...string) (interface{}, error) {
+	switch len(args) {
+	case 1:
+		return LookupSRVRecord(args[0])
+	case 3:
+		return LookupSRV(args[0], args[1], args[2]), nil
+	}
+	return nil, fmt.Errorf("lookupSRV takes a record, or a service, protocol and name, not %d arguments", len(args))
+}
+
 func Base64Encode(data string) string {
 	return base64.StdEncoding.EncodeToString([]byte(data))
 }
 
 func Base64Decode(data string) (string, error) {
 	s, err := base64.StdEncoding.DecodeString(data)
-	return string(s), err
+	if err != nil {
+		// Name a few bytes around the error rather than the whole value,
+		// which may be a secret
+		offset := 0
+		if corrupt, ok := err.(base64.CorruptInputError); ok {
+			offset = int(corrupt)
+		}
+		return "", fmt.Errorf("cannot decode %s as base64: %s", snippet(data, offset), err)
+	}
+	return string(s), nil
+}
+
+// snippet returns up to 16 bytes of data around offset, quoted.
+func snippet(data string, offset int) string {
+	const size = 16
+	start := offset - size/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + size
+	if end > len(data) {
+		end = len(data)
+	}
+	s := strconv.Quote(data[start:end])
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(data) {
+		s += "..."
+	}
+	return s
 }
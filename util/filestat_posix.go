@@ -30,3 +30,13 @@ func FileStat(name string) (fi FileInfo, err error) {
 	}
 	return fi, errors.New("File not found")
 }
+
+// FileOwner returns the uid and gid of the named file.
+func FileOwner(name string) (uid, gid int, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return -1, -1, err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return int(stat.Uid), int(stat.Gid), nil
+}
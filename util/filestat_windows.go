@@ -25,3 +25,12 @@ func FileStat(name string) (fi FileInfo, err error) {
 	}
 	return fi, errors.New("File not found")
 }
+
+// FileOwner returns -1 for the uid and gid of the named file, files have
+// no uid and gid on Windows.
+func FileOwner(name string) (uid, gid int, err error) {
+	if _, err := os.Stat(name); err != nil {
+		return -1, -1, err
+	}
+	return -1, -1, nil
+}
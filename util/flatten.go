@@ -0,0 +1,41 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// Flatten stores the values of a decoded YAML or JSON document into vars,
+// below key. Maps and arrays become directories, array elements are keyed
+// by their index.
+func Flatten(node interface{}, key string, vars map[string]string) {
+	switch node := node.(type) {
+	case []interface{}:
+		for i, j := range node {
+			Flatten(j, path.Join(key, strconv.Itoa(i)), vars)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range node {
+			Flatten(v, path.Join(key, fmt.Sprint(k)), vars)
+		}
+	case map[string]interface{}:
+		for k, v := range node {
+			Flatten(v, path.Join(key, k), vars)
+		}
+	case string:
+		vars[key] = node
+	case int:
+		vars[key] = strconv.Itoa(node)
+	case bool:
+		vars[key] = strconv.FormatBool(node)
+	case float64:
+		vars[key] = strconv.FormatFloat(node, 'f', -1, 64)
+	case json.Number:
+		vars[key] = node.String()
+	case nil:
+	default:
+		vars[key] = fmt.Sprint(node)
+	}
+}
@@ -0,0 +1,119 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Poller implements WatchPrefix for backends that cannot watch their
+// store. It periodically fetches the keys and compares a hash of the
+// values with the one seen on the previous call.
+type Poller struct {
+	Interval time.Duration
+	versions Versions
+}
+
+// NewPoller returns a Poller fetching the values every interval.
+func NewPoller(interval time.Duration) *Poller {
+	return &Poller{Interval: interval}
+}
+
+// Versions numbers the values seen for every set of keys, so that all the
+// watchers of a set learn of a change, not only the first one to see it.
+type Versions struct {
+	mu   sync.Mutex
+	sets map[string]*keysVersion
+}
+
+type keysVersion struct {
+	hash  string
+	index uint64
+}
+
+// Update records vars as the values of keys, and returns the index of
+// these values: 1 for the first ones, and one more on every change.
+func (v *Versions) Update(keys []string, vars map[string]string) uint64 {
+	id := strings.Join(keys, ",")
+	hash := HashValues(vars)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sets == nil {
+		v.sets = make(map[string]*keysVersion)
+	}
+	kv, ok := v.sets[id]
+	if !ok {
+		kv = &keysVersion{hash: hash, index: 1}
+		v.sets[id] = kv
+	} else if kv.hash != hash {
+		kv.hash = hash
+		kv.index++
+	}
+	return kv.index
+}
+
+// Index returns the index of the values last recorded for keys, 0 if none
+// were.
+func (v *Versions) Index(keys []string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if kv, ok := v.sets[strings.Join(keys, ",")]; ok {
+		return kv.index
+	}
+	return 0
+}
+
+// HashValues returns a digest of the given key/value pairs.
+func HashValues(vars map[string]string) string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00", k, vars[k])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// WatchPrefix blocks until the values returned by getValues for keys
+// change and returns their index, greater than waitIndex, or waitIndex once
+// ctx is done. A change seen by another caller watching the same keys is
+// returned at once. A zero waitIndex records the current values and
+// returns at once so the caller renders them.
+func (p *Poller) WatchPrefix(ctx context.Context, keys []string, waitIndex uint64, getValues func(context.Context, []string) (map[string]string, error)) (uint64, error) {
+	if waitIndex == 0 {
+		vars, err := getValues(ctx, keys)
+		if err != nil {
+			return 0, err
+		}
+		return p.versions.Update(keys, vars), nil
+	}
+
+	for {
+		if index := p.versions.Index(keys); index > waitIndex {
+			return index, nil
+		}
+		select {
+		case <-ctx.Done():
+			return waitIndex, nil
+		case <-time.After(p.Interval):
+		}
+
+		vars, err := getValues(ctx, keys)
+		if ctx.Err() != nil {
+			return waitIndex, nil
+		}
+		if err != nil {
+			return waitIndex, err
+		}
+		if index := p.versions.Update(keys, vars); index > waitIndex {
+			return index, nil
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPollerWatchersOfSameKeys(t *testing.T) {
+	var mu sync.Mutex
+	vars := map[string]string{"/app/key": "foo"}
+	getValues := func(ctx context.Context, keys []string) (map[string]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		values := make(map[string]string)
+		for k, v := range vars {
+			values[k] = v
+		}
+		return values, nil
+	}
+	p := NewPoller(10 * time.Millisecond)
+	keys := []string{"/app"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Two template resources watching the same keys
+	first, err := p.WatchPrefix(ctx, keys, 0, getValues)
+	if err != nil || first != 1 {
+		t.Fatalf("first WatchPrefix() = %d, %v, want 1", first, err)
+	}
+	second, err := p.WatchPrefix(ctx, keys, 0, getValues)
+	if err != nil || second != 1 {
+		t.Fatalf("second WatchPrefix() = %d, %v, want 1", second, err)
+	}
+
+	mu.Lock()
+	vars["/app/key"] = "bar"
+	mu.Unlock()
+
+	// The second learns of the change the first one polled
+	if index, err := p.WatchPrefix(ctx, keys, first, getValues); err != nil || index != 2 {
+		t.Fatalf("first WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+	if index, err := p.WatchPrefix(ctx, keys, second, getValues); err != nil || index != 2 {
+		t.Fatalf("second WatchPrefix() after change = %d, %v, want 2", index, err)
+	}
+
+	// A watcher done with the change does not see it again
+	watchCtx, watchCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer watchCancel()
+	if index, err := p.WatchPrefix(watchCtx, keys, 2, getValues); err != nil || index != 2 {
+		t.Errorf("WatchPrefix() without change = %d, %v, want 2", index, err)
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// MaxRetryInterval is the longest wait between two attempts of Retry.
+const MaxRetryInterval = 30 * time.Second
+
+// Backoff returns the wait before the given retry, counting from 0:
+// interval doubled on every retry, at most MaxRetryInterval, with a random
+// jitter of up to half of it so clients do not retry all at once.
+func Backoff(interval time.Duration, retry int) time.Duration {
+	return BackoffMax(interval, MaxRetryInterval, 0.5, retry)
+}
+
+// BackoffMax is Backoff waiting at most max, a random part of up to jitter
+// times the wait, between 0 and 1, being left out.
+func BackoffMax(interval, max time.Duration, jitter float64, retry int) time.Duration {
+	d := interval
+	for i := 0; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	random := time.Duration(jitter * float64(d))
+	return d - random + time.Duration(rand.Int63n(int64(random)+1))
+}
+
+// Retry calls f until it succeeds, at most retryMax more times after the
+// first failure, waiting according to Backoff in between. It gives up
+// early once ctx is done.
+func Retry(ctx context.Context, retryMax int, interval time.Duration, f func() error) error {
+	err := f()
+	for i := 0; err != nil && i < retryMax; i++ {
+		wait := Backoff(interval, i)
+		log.Warning("Request failed, retrying in %s: %s", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zyf0330/confd/log"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{20, MaxRetryInterval / 2, MaxRetryInterval},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := Backoff(100*time.Millisecond, tt.retry); d < tt.min || d > tt.max {
+				t.Fatalf("Backoff(100ms, %d) = %s, want between %s and %s", tt.retry, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestBackoffMax(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := BackoffMax(100*time.Millisecond, time.Second, 0, 20); d != time.Second {
+			t.Fatalf("BackoffMax(100ms, 1s, 0, 20) = %s, want 1s", d)
+		}
+		if d := BackoffMax(100*time.Millisecond, time.Second, 0.2, 1); d < 160*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("BackoffMax(100ms, 1s, 0.2, 1) = %s, want between 160ms and 200ms", d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	log.SetLevel("error")
+	calls := 0
+	err := Retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("etcdserver: leader changed")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), 2, time.Millisecond, func() error {
+		calls++
+		return errors.New("etcdserver: request timed out")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want an error after 3", err, calls)
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	log.SetLevel("error")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := Retry(ctx, 10, time.Hour, func() error {
+		return errors.New("etcdserver: request timed out")
+	})
+	if err == nil {
+		t.Error("expected the last error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry() took %s, want it to stop at the context deadline", elapsed)
+	}
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV resolves SRV records, replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// LookupSRV returns the host:port addresses of the targets of the SRV
+// record, in the order net.LookupSRV gives them: by priority, and at
+// random by weight within one, as RFC 2782 tells.
+func LookupSRV(record string) ([]string, error) {
+	// Ignore the CNAME as we don't need it.
+	_, addrs, err := lookupSRV("", "", record)
+	if err != nil {
+		return nil, err
+	}
+	return SRVAddrs(addrs), nil
+}
+
+// SRVAddrs returns the host:port addresses of the targets of addrs, in
+// their order.
+func SRVAddrs(addrs []*net.SRV) []string {
+	nodes := make([]string, 0, len(addrs))
+	for _, srv := range addrs {
+		host := strings.TrimRight(srv.Target, ".")
+		port := strconv.FormatUint(uint64(srv.Port), 10)
+		nodes = append(nodes, net.JoinHostPort(host, port))
+	}
+	return nodes
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLookupSRV(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_etcd-client._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return name, []*net.SRV{
+			{Target: "etcd2.example.com.", Port: 2379, Priority: 10},
+			{Target: "etcd1.example.com.", Port: 2379, Priority: 20},
+			{Target: "::1", Port: 2380, Priority: 30},
+		}, nil
+	}
+
+	nodes, err := LookupSRV("_etcd-client._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In the order of the resolver
+	want := []string{"etcd2.example.com:2379", "etcd1.example.com:2379", "[::1]:2380"}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("LookupSRV() = %v, want %v", nodes, want)
+	}
+	if _, err := LookupSRV("_other._tcp.example.com"); err == nil {
+		t.Error("LookupSRV() of a missing record succeeded")
+	}
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zyf0330/confd/log"
+)
+
+// TLSOptions are the settings of a client TLS configuration besides its
+// certificate files.
+type TLSOptions struct {
+	// Accept any certificate the server presents
+	InsecureSkipVerify bool
+	// The name the certificate of the server must hold, instead of the
+	// host dialed
+	ServerName string
+	// The oldest TLS version to speak, and the cipher suites to offer up to
+	// TLS 1.2, the defaults of crypto/tls if zero
+	MinVersion   uint16
+	CipherSuites []uint16
+	// Load the client certificate again for a new connection once its
+	// files changed, instead of once
+	ReloadClientCert bool
+}
+
+// tlsVersions are the TLS versions ParseTLSVersion knows.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version named name, e.g. "1.2", or 0 if
+// name is empty.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(name, "TLS")]
+	if !ok {
+		names := make([]string, 0, len(tlsVersions))
+		for n := range tlsVersions {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown TLS version %q, use one of %s", name, strings.Join(names, ", "))
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns the cipher suites of the comma-separated list
+// names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", or nil if it is
+// empty. Only the suites crypto/tls deems secure and lets choose, those of
+// TLS 1.2 and older, are known.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v < tls.VersionTLS13 {
+				known[s.Name] = s.ID
+			}
+		}
+	}
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			acceptable := make([]string, 0, len(known))
+			for n := range known {
+				acceptable = append(acceptable, n)
+			}
+			sort.Strings(acceptable)
+			return nil, fmt.Errorf("unknown cipher suite %q, use some of %s", name, strings.Join(acceptable, ", "))
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// NewTLSConfig builds a client TLS configuration from the given client
+// certificate, client key and CA certificate files.
+// It returns a nil config if none of them are set.
+func NewTLSConfig(cert, key, caCert string) (*tls.Config, error) {
+	return NewTLSConfigWithOptions(cert, key, caCert, TLSOptions{})
+}
+
+// NewTLSConfigWithOptions is NewTLSConfig with the settings of opts, which
+// enable TLS too, but for MinVersion which only applies once TLS is.
+func NewTLSConfigWithOptions(cert, key, caCert string, opts TLSOptions) (*tls.Config, error) {
+	tlsEnabled := opts.InsecureSkipVerify || opts.ServerName != "" || len(opts.CipherSuites) > 0
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		ServerName:         opts.ServerName,
+		MinVersion:         opts.MinVersion,
+		CipherSuites:       opts.CipherSuites,
+	}
+
+	if caCert != "" {
+		certBytes, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+
+		caCertPool := x509.NewCertPool()
+		ok := caCertPool.AppendCertsFromPEM(certBytes)
+
+		if ok {
+			tlsConfig.RootCAs = caCertPool
+		}
+		tlsEnabled = true
+	}
+
+	if cert != "" && key != "" && opts.ReloadClientCert {
+		r, err := newCertReloader(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = r.GetClientCertificate
+		tlsEnabled = true
+	} else if cert != "" && key != "" {
+		tlsCert, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{tlsCert}
+		tlsEnabled = true
+	}
+
+	if !tlsEnabled {
+		return nil, nil
+	}
+	return tlsConfig, nil
+}
+
+// certReloader holds a client certificate, loaded again from its files
+// when they changed, e.g. rotated by Vault while confd runs.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// The modification times and sizes of the files loaded
+	stamp string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetClientCertificate returns the certificate, loaded again if its files
+// changed. If they cannot be loaded, the previous certificate is kept and
+// the error logged, the next connection trying again.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		log.Error("Cannot load the client certificate %s, keeping the previous one: %s", r.certFile, err)
+	}
+	return r.cert, nil
+}
+
+// reload loads the certificate if its files changed since the last load.
+func (r *certReloader) reload() error {
+	var stamp string
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		stamp += fmt.Sprintf("%d:%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	if stamp == r.stamp {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		log.Info("Loaded the new client certificate %s", r.certFile)
+	}
+	r.cert, r.stamp = &cert, stamp
+	return nil
+}
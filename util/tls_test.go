@@ -0,0 +1,168 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for name and its key to
+// dir.
+func writeKeyPair(t *testing.T, dir, name string) (cert, key string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestNewTLSConfigWithOptions(t *testing.T) {
+	if c, err := NewTLSConfigWithOptions("", "", "", TLSOptions{}); c != nil || err != nil {
+		t.Errorf("NewTLSConfigWithOptions() without settings = %v, %v, want nil", c, err)
+	}
+
+	c, err := NewTLSConfigWithOptions("", "", "", TLSOptions{ServerName: "etcd.example.com"})
+	if err != nil || c == nil || c.ServerName != "etcd.example.com" || c.InsecureSkipVerify {
+		t.Errorf("NewTLSConfigWithOptions() with a server name = %+v, %v", c, err)
+	}
+
+	// The options go along with a client certificate
+	cert, key := writeKeyPair(t, t.TempDir(), "confd")
+	c, err = NewTLSConfigWithOptions(cert, key, "", TLSOptions{InsecureSkipVerify: true, ServerName: "etcd.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Certificates) != 1 || !c.InsecureSkipVerify || c.ServerName != "etcd.example.com" {
+		t.Errorf("NewTLSConfigWithOptions() with a client certificate = %+v", c)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for name, want := range map[string]uint16{"": 0, "1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13} {
+		if v, err := ParseTLSVersion(name); err != nil || v != want {
+			t.Errorf("ParseTLSVersion(%q) = %x, %v, want %x", name, v, err, want)
+		}
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil || !strings.Contains(err.Error(), "1.0, 1.1, 1.2, 1.3") {
+		t.Errorf("ParseTLSVersion(1.4) = %v, want an error listing the versions", err)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if err != nil || !reflect.DeepEqual(suites, want) {
+		t.Errorf("ParseCipherSuites() = %x, %v, want %x", suites, err, want)
+	}
+	if suites, err := ParseCipherSuites(""); suites != nil || err != nil {
+		t.Errorf("ParseCipherSuites(\"\") = %x, %v, want nil", suites, err)
+	}
+	// Insecure suites and those of TLS 1.3, which cannot be chosen, are
+	// refused
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256", "AES128"} {
+		_, err := ParseCipherSuites(name)
+		if err == nil || !strings.Contains(err.Error(), "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") {
+			t.Errorf("ParseCipherSuites(%s) = %v, want an error listing the suites", name, err)
+		}
+	}
+
+	c, err := NewTLSConfigWithOptions("", "", "", TLSOptions{MinVersion: tls.VersionTLS12, CipherSuites: want})
+	if err != nil || c == nil || c.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(c.CipherSuites, want) {
+		t.Errorf("NewTLSConfigWithOptions() with a version and suites = %+v, %v", c, err)
+	}
+}
+
+func TestReloadClientCert(t *testing.T) {
+	// A server answering with the name of the client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	cert, key := writeKeyPair(t, dir, "confd-1")
+	c, err := NewTLSConfigWithOptions(cert, key, "", TLSOptions{InsecureSkipVerify: true, ReloadClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new connection per request
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c, DisableKeepAlives: true}}
+	presented := func() string {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		name, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(name)
+	}
+	// touch makes the files look newer, whatever the resolution of the
+	// modification times
+	touch := func(d time.Duration) {
+		for _, name := range []string{cert, key} {
+			if err := os.Chtimes(name, time.Now().Add(d), time.Now().Add(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if name := presented(); name != "confd-1" {
+		t.Errorf("client presented %q, want confd-1", name)
+	}
+	writeKeyPair(t, dir, "confd-2")
+	touch(time.Minute)
+	if name := presented(); name != "confd-2" {
+		t.Errorf("client presented %q after the rotation, want confd-2", name)
+	}
+
+	// A broken key leaves the previous certificate in use
+	if err := ioutil.WriteFile(key, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Minute)
+	if name := presented(); name != "confd-2" {
+		t.Errorf("client presented %q with a broken key, want confd-2", name)
+	}
+}